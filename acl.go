@@ -0,0 +1,153 @@
+package archer
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dongzerun/archer/util"
+)
+
+// ACL restricts commands and keys per user, rules use the redis ACL syntax:
+// +get +set +@all for commands, ~user:* allkeys for key patterns and
+// >password nopass for the passwords AUTH accepts
+type ACL struct {
+	rw sync.RWMutex
+
+	users map[string]*aclUser
+}
+
+type aclUser struct {
+	allCommands bool
+	commands    map[string]bool // upper case
+
+	allKeys  bool
+	patterns [][]byte
+
+	nopass    bool
+	passwords []string
+}
+
+func NewACL() *ACL {
+	return &ACL{
+		users: make(map[string]*aclUser),
+	}
+}
+
+// newACL builds the ACL of the users in rules, nil without users
+func newACL(rules map[string]string) (*ACL, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	a := NewACL()
+	for user, r := range rules {
+		if err := a.SetUser(user, r); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// SetUser replaces the rules of user, e.g. SetUser("alice", "+get +set ~user:*")
+func (a *ACL) SetUser(user string, rules string) error {
+	u := &aclUser{
+		commands: make(map[string]bool),
+	}
+
+	for _, rule := range strings.Fields(rules) {
+		switch {
+		case rule == "+@all" || rule == "allcommands":
+			u.allCommands = true
+		case rule == "allkeys":
+			u.allKeys = true
+		case rule == "nopass":
+			u.nopass = true
+		case strings.HasPrefix(rule, ">") && len(rule) > 1:
+			u.passwords = append(u.passwords, rule[1:])
+		case strings.HasPrefix(rule, "+") && len(rule) > 1:
+			u.commands[strings.ToUpper(rule[1:])] = true
+		case strings.HasPrefix(rule, "~") && len(rule) > 1:
+			if rule == "~*" {
+				u.allKeys = true
+				continue
+			}
+			u.patterns = append(u.patterns, []byte(rule[1:]))
+		default:
+			return fmt.Errorf("ACL unknown rule %s for user %s", rule, user)
+		}
+	}
+
+	a.rw.Lock()
+	a.users[user] = u
+	a.rw.Unlock()
+	return nil
+}
+
+// Check returns a NOPERM error if user is not allowed to run ar,
+// the error message is ready to be sent as the error reply
+func (a *ACL) Check(user string, ar *ArrayResp) error {
+	a.rw.RLock()
+	u, ok := a.users[user]
+	a.rw.RUnlock()
+	if !ok {
+		return fmt.Errorf("NOPERM User %s has no permissions to run any command", user)
+	}
+
+	cmd := cmdName(ar)
+	if !u.allCommands && !u.commands[cmd] {
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", user, strings.ToLower(cmd))
+	}
+
+	if u.allKeys {
+		return nil
+	}
+	for _, key := range CommandKeys(ar) {
+		if !u.matchKey(key) {
+			return fmt.Errorf("NOPERM No permissions to access a key")
+		}
+	}
+	return nil
+}
+
+// Authenticate reports whether password is one of user's, any password
+// is accepted for a nopass user
+func (a *ACL) Authenticate(user string, password string) bool {
+	a.rw.RLock()
+	u, ok := a.users[user]
+	a.rw.RUnlock()
+	if !ok {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePass reports whether some user has a password, clients must AUTH
+// before anything else then
+func (a *ACL) RequirePass() bool {
+	a.rw.RLock()
+	defer a.rw.RUnlock()
+	for _, u := range a.users {
+		if len(u.passwords) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) matchKey(key []byte) bool {
+	for _, p := range u.patterns {
+		if util.GlobMatch(p, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package archer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestACLCheck(t *testing.T) {
+	acl := NewACL()
+	if err := acl.SetUser("alice", "+get ~user:*"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.SetUser("admin", "+@all allkeys"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.SetUser("bob", "-get"); err == nil {
+		t.Fatal("unknown rule must fail")
+	}
+
+	if err := acl.Check("alice", newCommand("GET", "user:1")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := acl.Check("alice", newCommand("GET", "order:1"))
+	if err == nil || err.Error() != "NOPERM No permissions to access a key" {
+		t.Fatal(err)
+	}
+	if got := encodeResp(t, NewErrorResp([]byte(err.Error()))); !strings.HasPrefix(got, "-NOPERM ") {
+		t.Fatal(got)
+	}
+
+	err = acl.Check("alice", newCommand("SET", "user:1", "v"))
+	if err == nil || !strings.Contains(err.Error(), "'set' command") {
+		t.Fatal(err)
+	}
+
+	if err := acl.Check("admin", newCommand("SET", "order:1", "v")); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.Check("nobody", newCommand("GET", "user:1")); err == nil {
+		t.Fatal("unknown user must be denied")
+	}
+}
+
+func TestACLAuthenticate(t *testing.T) {
+	acl := NewACL()
+	if err := acl.SetUser("alice", ">one >two +get"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.SetUser("bob", "nopass +get"); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.RequirePass() {
+		t.Fatal("alice has passwords")
+	}
+	if !acl.Authenticate("alice", "one") || !acl.Authenticate("alice", "two") || acl.Authenticate("alice", "three") {
+		t.Fatal("alice passwords")
+	}
+	if !acl.Authenticate("bob", "whatever") || acl.Authenticate("nobody", "") {
+		t.Fatal("nopass and unknown user")
+	}
+}
@@ -0,0 +1,84 @@
+package archer
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ProxyCommand handles the admin command PROXY, answered by the proxy
+// itself: PROXY SLOWLOG GET [count] | LEN | RESET, PROXY HOTKEYS [count]
+func (s *Session) ProxyCommand(ar *ArrayResp, seq int64) {
+	sub, _ := ar.Arg(1)
+	switch strings.ToUpper(string(sub)) {
+	case "SLOWLOG":
+		s.proxySlowLog(ar, seq)
+	case "HOTKEYS":
+		s.proxyHotKeys(ar, seq)
+	default:
+		s.reply(WrappedResp(NewErrorRespf("ERR unknown PROXY subcommand '%s'", sub), seq))
+	}
+}
+
+func (s *Session) proxySlowLog(ar *ArrayResp, seq int64) {
+	sl := s.p.slowlog
+	if sl == nil {
+		s.reply(WrappedErrorResp([]byte("ERR slowlog is disabled"), seq))
+		return
+	}
+
+	op, _ := ar.Arg(2)
+	switch strings.ToUpper(string(op)) {
+	case "GET":
+		n, ok := s.countArg(ar, 3, 10, seq)
+		if !ok {
+			return
+		}
+		resp := &ArrayResp{}
+		resp.Rtype = ArrayType
+		resp.Elems = []Resp{}
+		for _, e := range sl.Get(n) {
+			resp.append(e.Resp())
+		}
+		s.reply(WrappedResp(resp, seq))
+	case "LEN":
+		s.reply(WrappedResp(NewIntResp(int64(sl.Len())), seq))
+	case "RESET":
+		sl.Reset()
+		s.reply(WrappedOKResp(seq))
+	default:
+		s.reply(WrappedResp(NewErrorRespf("ERR unknown PROXY SLOWLOG subcommand '%s'", op), seq))
+	}
+}
+
+func (s *Session) proxyHotKeys(ar *ArrayResp, seq int64) {
+	if s.p.hotkeys == nil {
+		s.reply(WrappedErrorResp([]byte("ERR hotkeys is disabled"), seq))
+		return
+	}
+	n, ok := s.countArg(ar, 2, 10, seq)
+	if !ok {
+		return
+	}
+	resp := &ArrayResp{}
+	resp.Rtype = ArrayType
+	resp.Elems = []Resp{}
+	for _, k := range s.p.hotKeys(n) {
+		resp.append(k.Resp())
+	}
+	s.reply(WrappedResp(resp, seq))
+}
+
+// countArg parses the optional count at i, -1 means all. A bad count is
+// replied as an error and ok is false
+func (s *Session) countArg(ar *ArrayResp, i int, def int, seq int64) (int, bool) {
+	arg, ok := ar.Arg(i)
+	if !ok {
+		return def, true
+	}
+	n, err := strconv.Atoi(string(arg))
+	if err != nil || n < -1 {
+		s.reply(WrappedErrorResp([]byte("ERR count should be greater than or equal to -1"), seq))
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,272 @@
+package archer
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/dongzerun/archer/logging"
+)
+
+// The admin API on the admin http server, every request must carry the
+// admintoken as "Authorization: Bearer <token>" and every reply is json:
+//
+//	GET  /admin/clients              connected clients
+//	POST /admin/clients/kill?addr=   close the client at ip:port
+//	POST /admin/clients/audit?addr=&on=1|0
+//	                                 switch the audit log of the client
+//	GET  /admin/nodes                backend nodes with their pool usage and
+//	                                 circuit breaker
+//	GET  /admin/slots                slot map as runs of slots
+//	POST /admin/pause?ms=&mode=      hold the commands of every client for ms,
+//	                                 mode=write holds the writes only
+//	POST /admin/resume               release the commands held
+func (p *Proxy) registerAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/clients", p.adminAuth(p.clientsHandler))
+	mux.HandleFunc("/admin/clients/kill", p.adminAuth(p.killHandler))
+	mux.HandleFunc("/admin/clients/audit", p.adminAuth(p.auditHandler))
+	mux.HandleFunc("/admin/nodes", p.adminAuth(p.nodesHandler))
+	mux.HandleFunc("/admin/slots", p.adminAuth(p.slotsHandler))
+	mux.HandleFunc("/admin/pause", p.adminAuth(p.pauseHandler))
+	mux.HandleFunc("/admin/resume", p.adminAuth(p.resumeHandler))
+}
+
+// adminAuth passes to h the requests carrying the admintoken of the config,
+// read per request so a reload changes it. The digests are compared so the
+// time taken tells nothing of the token, its length included. Without an
+// admintoken every request is refused
+func (p *Proxy) adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := p.conf().adminToken
+		if token == "" {
+			http.Error(w, "admintoken not set", http.StatusForbidden)
+			return
+		}
+		got := sha256.Sum256([]byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")))
+		want := sha256.Sum256([]byte(token))
+		if subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "bad admin token", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ClientInfo is a connected client, like a line of CLIENT LIST
+type ClientInfo struct {
+	ID          int64         `json:"id"`
+	Addr        string        `json:"addr"`
+	Name        string        `json:"name,omitempty"`
+	Age         time.Duration `json:"age"`
+	Idle        time.Duration `json:"idle"` // since the last command read
+	LastCommand string        `json:"last_command,omitempty"`
+	Commands    int64         `json:"commands"`
+	Audit       bool          `json:"audit"`
+}
+
+// Info returns what the admin API shows of s
+func (s *Session) Info() ClientInfo {
+	now := time.Now()
+	s.tl.Lock()
+	defer s.tl.Unlock()
+	last := s.lastCmdAt
+	if last.IsZero() {
+		last = s.created
+	}
+	return ClientInfo{
+		ID:          s.id,
+		Addr:        s.remote,
+		Name:        s.name,
+		Age:         now.Sub(s.created),
+		Idle:        now.Sub(last),
+		LastCommand: s.lastCmd,
+		Commands:    s.cmdCount,
+		Audit:       s.auditing(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (p *Proxy) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	sessions := p.sm.Sessions()
+	clients := make([]ClientInfo, 0, len(sessions))
+	for _, s := range sessions {
+		clients = append(clients, s.Info())
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+	writeJSON(w, clients)
+}
+
+func (p *Proxy) killHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.URL.Query().Get("addr")
+	for _, s := range p.sm.Sessions() {
+		if s.remote == addr {
+			log.Warningf("client %s killed by the admin API", addr)
+			s.Close()
+			w.Write([]byte("OK\n"))
+			return
+		}
+	}
+	http.Error(w, "no such client "+addr, http.StatusNotFound)
+}
+
+func (p *Proxy) auditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	on, err := strconv.ParseBool(q.Get("on"))
+	if err != nil {
+		http.Error(w, "on must be 1 or 0", http.StatusBadRequest)
+		return
+	}
+	if p.audit == nil {
+		http.Error(w, "audit log not open", http.StatusServiceUnavailable)
+		return
+	}
+	addr := q.Get("addr")
+	for _, s := range p.sm.Sessions() {
+		if s.remote == addr {
+			log.Infof("audit of client %s switched to %v by the admin API", addr, on)
+			s.SetAudit(on)
+			w.Write([]byte("OK\n"))
+			return
+		}
+	}
+	http.Error(w, "no such client "+addr, http.StatusNotFound)
+}
+
+// BackendStatus is a backend node with the usage of its pool, a node
+// without a pool was never used
+type BackendStatus struct {
+	NodeStatus
+	Conns   int    `json:"conns"`
+	Idle    int    `json:"idle"`
+	Breaker string `json:"breaker"` // closed, open or half-open
+}
+
+func (p *Proxy) nodesHandler(w http.ResponseWriter, r *http.Request) {
+	pools := make(map[string]PoolStat)
+	for _, ps := range p.cluster.PoolStats() {
+		pools[ps.Node] = ps
+	}
+	breakers := p.cluster.BreakerStates()
+	nodes := p.cluster.topo.Nodes()
+	backends := make([]BackendStatus, 0, len(nodes))
+	for _, n := range nodes {
+		ps := pools[n.ID]
+		state, ok := breakers[n.ID]
+		if !ok {
+			state = BreakerClosed
+		}
+		backends = append(backends, BackendStatus{NodeStatus: n, Conns: ps.Conns, Idle: ps.Idle, Breaker: state})
+	}
+	writeJSON(w, backends)
+}
+
+func (p *Proxy) slotsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, p.cluster.topo.SlotSpans())
+}
+
+func (p *Proxy) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	ms, err := strconv.Atoi(q.Get("ms"))
+	if err != nil || ms <= 0 {
+		http.Error(w, "ms must be a positive number of milliseconds", http.StatusBadRequest)
+		return
+	}
+	writes := false
+	switch q.Get("mode") {
+	case "", "all":
+	case "write":
+		writes = true
+	default:
+		http.Error(w, "mode must be all or write", http.StatusBadRequest)
+		return
+	}
+	log.Warningf("traffic paused for %dms by the admin API, writes only %v", ms, writes)
+	p.pause.Pause(time.Duration(ms)*time.Millisecond, writes)
+	w.Write([]byte("OK\n"))
+}
+
+func (p *Proxy) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	p.pause.Resume()
+	w.Write([]byte("OK\n"))
+}
+
+// trafficPause holds the commands of every client, like CLIENT PAUSE.
+// The zero value is not paused
+type trafficPause struct {
+	mu      sync.Mutex
+	until   time.Time
+	writes  bool          // only writes are held
+	resumed chan struct{} // closed by Resume or by the next Pause
+}
+
+// Pause holds the commands, or the writes only, for d from now
+func (tp *trafficPause) Pause(d time.Duration, writes bool) {
+	tp.mu.Lock()
+	if tp.resumed != nil {
+		close(tp.resumed)
+	}
+	tp.until, tp.writes, tp.resumed = time.Now().Add(d), writes, make(chan struct{})
+	tp.mu.Unlock()
+}
+
+// Resume releases the commands held
+func (tp *trafficPause) Resume() {
+	tp.mu.Lock()
+	if tp.resumed != nil {
+		close(tp.resumed)
+		tp.resumed = nil
+	}
+	tp.until = time.Time{}
+	tp.mu.Unlock()
+}
+
+// Wait blocks while ar is held, false if quit is closed first
+func (tp *trafficPause) Wait(ar *ArrayResp, quit <-chan int) bool {
+	for {
+		tp.mu.Lock()
+		d := time.Until(tp.until)
+		if d <= 0 || (tp.writes && !IsWriteRequest(ar)) {
+			tp.mu.Unlock()
+			return true
+		}
+		resumed := tp.resumed
+		tp.mu.Unlock()
+
+		t := time.NewTimer(d)
+		select {
+		case <-resumed:
+		case <-t.C:
+		case <-quit:
+			t.Stop()
+			return false
+		}
+		t.Stop()
+	}
+}
@@ -0,0 +1,235 @@
+package archer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dongzerun/archer/logging"
+)
+
+func TestAdminAPI(t *testing.T) {
+	a := &Node{id: "127.0.0.1:7000", host: "127.0.0.1", port: 7000, role: "master"}
+	b := &Node{id: "127.0.0.1:7001", host: "127.0.0.1", port: 7001, role: "master"}
+	pc := &ProxyConfig{}
+	p := &Proxy{pc: pc, sm: &SessMana{pool: make(map[string]*Session)}, cluster: testCluster(pc, a, b)}
+
+	s := newTestSession(pc)
+	s.p, s.remote, s.created = p, "10.0.0.1:5000", time.Now()
+	s.quitChan = make(chan int, 1)
+	s.budget = newReplyBudget(0)
+	p.sm.Put(s.remote, s)
+	s.traceStart(0, newCommand("GET", "k"), time.Time{})
+
+	get := func(h http.HandlerFunc, method, url string, v interface{}) int {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, url, nil))
+		if v != nil && w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s %s: %s", url, err, w.Body.String())
+			}
+		}
+		return w.Code
+	}
+
+	var clients []ClientInfo
+	get(p.clientsHandler, "GET", "/admin/clients", &clients)
+	if len(clients) != 1 || clients[0].Addr != s.remote || clients[0].LastCommand != "GET" || clients[0].Commands != 1 {
+		t.Fatalf("clients %+v", clients)
+	}
+
+	var nodes []BackendStatus
+	get(p.nodesHandler, "GET", "/admin/nodes", &nodes)
+	if len(nodes) != 2 || nodes[0].ID != a.id || nodes[0].Slots != 8192 || nodes[1].Slots != 8192 {
+		t.Fatalf("nodes %+v", nodes)
+	}
+
+	var spans []SlotSpan
+	get(p.slotsHandler, "GET", "/admin/slots", &spans)
+	if len(spans) != 2 || spans[0].Stop != 8191 || spans[0].Master != a.id || spans[1].Start != 8192 || spans[1].Stop != 16383 {
+		t.Fatalf("slots %+v", spans)
+	}
+
+	if code := get(p.auditHandler, "POST", "/admin/clients/audit?addr="+s.remote+"&on=1", nil); code != http.StatusServiceUnavailable {
+		t.Fatalf("audit without a log %d", code)
+	}
+	p.audit = &AuditLog{log: logging.New(ioutil.Discard)}
+	if code := get(p.auditHandler, "POST", "/admin/clients/audit?addr="+s.remote+"&on=x", nil); code != http.StatusBadRequest {
+		t.Fatalf("audit bad on %d", code)
+	}
+	if code := get(p.auditHandler, "POST", "/admin/clients/audit?addr="+s.remote+"&on=1", nil); code != http.StatusOK || !s.auditing() {
+		t.Fatalf("audit %d", code)
+	}
+	get(p.clientsHandler, "GET", "/admin/clients", &clients)
+	if len(clients) != 1 || !clients[0].Audit {
+		t.Fatalf("audited clients %+v", clients)
+	}
+
+	if code := get(p.killHandler, "GET", "/admin/clients/kill?addr="+s.remote, nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET kill %d", code)
+	}
+	if code := get(p.killHandler, "POST", "/admin/clients/kill?addr=10.0.0.9:1", nil); code != http.StatusNotFound {
+		t.Fatalf("kill unknown client %d", code)
+	}
+	if code := get(p.killHandler, "POST", "/admin/clients/kill?addr="+s.remote, nil); code != http.StatusOK || atomic.LoadInt32(&s.closed) != 1 {
+		t.Fatalf("kill %d, closed %d", code, s.closed)
+	}
+	if len(p.sm.Sessions()) != 0 {
+		t.Fatal("killed client still listed")
+	}
+
+	if code := get(p.pauseHandler, "POST", "/admin/pause?ms=x", nil); code != http.StatusBadRequest {
+		t.Fatalf("pause bad ms %d", code)
+	}
+	if code := get(p.pauseHandler, "POST", "/admin/pause?ms=60000&mode=write", nil); code != http.StatusOK {
+		t.Fatalf("pause %d", code)
+	}
+	// reads go on, writes wait for resume
+	if !p.pause.Wait(newCommand("GET", "k"), nil) {
+		t.Fatal("read held by a write pause")
+	}
+	done := make(chan bool)
+	go func() { done <- p.pause.Wait(newCommand("SET", "k", "v"), nil) }()
+	select {
+	case <-done:
+		t.Fatal("write not held")
+	case <-time.After(20 * time.Millisecond):
+	}
+	get(p.resumeHandler, "POST", "/admin/resume", nil)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("Wait false after resume")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write still held after resume")
+	}
+}
+
+// TestAdminMux runs two proxies in one process, each routes its own admin
+// requests
+func TestAdminMux(t *testing.T) {
+	for _, port := range []int{7000, 7100} {
+		a := &Node{id: fmt.Sprintf("127.0.0.1:%d", port), host: "127.0.0.1", port: port, role: "master"}
+		pc := &ProxyConfig{adminToken: "secret"}
+		p := &Proxy{pc: pc, sm: &SessMana{pool: make(map[string]*Session)}, cluster: testCluster(pc, a, a)}
+		srv := httptest.NewServer(p.newMux())
+		defer srv.Close()
+
+		req, _ := http.NewRequest("GET", srv.URL+"/admin/slots", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spans []SlotSpan
+		err = json.NewDecoder(resp.Body).Decode(&spans)
+		resp.Body.Close()
+		if err != nil || len(spans) != 1 || spans[0].Master != a.id {
+			t.Fatalf("%d: slots %+v %v", port, spans, err)
+		}
+		if resp, err := http.Get(srv.URL + "/metrics"); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%d: metrics %v", port, err)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	pc := &ProxyConfig{}
+	p := &Proxy{pc: pc, sm: &SessMana{pool: make(map[string]*Session)}}
+	mux := p.newMux()
+	do := func(method, url, auth string) int {
+		t.Helper()
+		r := httptest.NewRequest(method, url, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// no admintoken, no admin API
+	if code := do("GET", "/admin/clients", "Bearer "); code != http.StatusForbidden {
+		t.Fatalf("without admintoken %d", code)
+	}
+	pc.adminToken = "secret"
+	for _, auth := range []string{"", "Bearer", "Bearer secre", "Bearer secret2", "Basic secret"} {
+		if code := do("POST", "/admin/resume", auth); code != http.StatusUnauthorized {
+			t.Fatalf("%q: %d", auth, code)
+		}
+	}
+	if code := do("GET", "/admin/clients", "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("clients %d", code)
+	}
+	for _, url := range []string{"/admin/clients/kill?addr=x", "/admin/clients/audit?addr=x&on=1", "/admin/pause?ms=1", "/admin/resume"} {
+		if code := do("GET", url, "Bearer secret"); code != http.StatusMethodNotAllowed {
+			t.Fatalf("GET %s %d", url, code)
+		}
+	}
+	if code := do("POST", "/admin/resume", "Bearer secret"); code != http.StatusOK {
+		t.Fatalf("resume %d", code)
+	}
+
+	// reload is behind the same token
+	if code := do("POST", "/reload", ""); code != http.StatusUnauthorized {
+		t.Fatalf("reload without token %d", code)
+	}
+	if code := do("GET", "/reload", "Bearer secret"); code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET reload %d", code)
+	}
+}
+
+// TestAdminKillReading kills a client in the middle of its commands, the
+// session closes once whichever of kill and its ReadLoop gets there first
+func TestAdminKillReading(t *testing.T) {
+	pc := &ProxyConfig{conCurrency: 5, pipeLength: 16}
+	p := &Proxy{pc: pc, sm: &SessMana{pool: make(map[string]*Session)}, filter: &StrFilter{}}
+	s, client, done := servingSession(t, p)
+	defer client.Close()
+
+	go io.Copy(ioutil.Discard, client)
+	go func() {
+		for {
+			if _, err := client.Write([]byte("PING\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+
+	w := httptest.NewRecorder()
+	p.killHandler(w, httptest.NewRequest("POST", "/admin/clients/kill?addr="+s.remote, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("kill %d", w.Code)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("killed session still served")
+	}
+	if len(p.sm.Sessions()) != 0 {
+		t.Fatal("killed session still listed")
+	}
+}
+
+func TestTrafficPauseTimeout(t *testing.T) {
+	var tp trafficPause
+	tp.Pause(20*time.Millisecond, false)
+	start := time.Now()
+	if !tp.Wait(newCommand("GET", "k"), nil) || time.Since(start) < 10*time.Millisecond {
+		t.Fatal("command not held until the pause ends")
+	}
+
+	tp.Pause(time.Minute, false)
+	quit := make(chan int)
+	close(quit)
+	if tp.Wait(newCommand("GET", "k"), quit) {
+		t.Fatal("Wait true after quit")
+	}
+}
@@ -0,0 +1,106 @@
+package archer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dongzerun/archer/logging"
+)
+
+// AuditLog logs every command of the audited clients, one entry per reply:
+// client, command, a sample of its keys, the number of arguments, the type
+// of the reply and the latency. Values are never logged, error replies only
+// by their code like ERR or WRONGTYPE, and with redactKeys keys are logged
+// as a hash
+type AuditLog struct {
+	log        *logging.Logger
+	keys       int // keys sampled per command
+	redactKeys bool
+}
+
+// NewAuditLog writes to pc's auditfile in the format of the log, or
+// through the writer of the standard logger if it's empty, so the entries
+// follow the log when it rotates
+func NewAuditLog(pc *ProxyConfig) (*AuditLog, error) {
+	out := logging.Std().Output()
+	if pc.auditFile != "" {
+		f, err := logging.OpenRotateFile(pc.auditFile)
+		if err != nil {
+			return nil, err
+		}
+		f.SetRotate(logging.RotateDaily)
+		out = f
+	}
+	l := logging.New(out)
+	l.SetJSON(pc.logFormat == "json")
+	return &AuditLog{log: l, keys: pc.auditKeys, redactKeys: pc.auditRedactKeys}, nil
+}
+
+// Log writes the entry of command t of s, replied resp after d
+func (a *AuditLog) Log(s *Session, seq int64, t *cmdTrace, resp Resp, d time.Duration) {
+	var keys []string
+	nargs := 0
+	if t.req != nil {
+		nargs = len(t.req.Args) - 1
+		for i, k := range CommandKeys(t.req) {
+			if i == a.keys {
+				break
+			}
+			keys = append(keys, a.key(k))
+		}
+	}
+	reply := "none"
+	if resp != nil {
+		reply = resp.Type()
+		if IsNull(resp) {
+			reply = NullType
+		}
+	}
+	kv := []interface{}{
+		"client", s.remote,
+		"seq", seq,
+		"cmd", t.name,
+		"keys", keys,
+		"args", nargs,
+		"reply", reply,
+		"latency_us", d.Microseconds(),
+	}
+	if er, ok := resp.(*ErrorResp); ok {
+		kv = append(kv, "error", errorCode(er))
+	}
+	a.log.Log(logging.LevelInfo, "audit", kv...)
+}
+
+func (a *AuditLog) key(k []byte) string {
+	if !a.redactKeys {
+		return string(k)
+	}
+	sum := sha256.Sum256(k)
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// errorCode is the first word of an error reply, the rest may quote the
+// arguments of the command
+func errorCode(er *ErrorResp) string {
+	msg := er.Error()
+	if i := strings.IndexByte(msg, ' '); i > 0 {
+		return msg[:i]
+	}
+	return msg
+}
+
+// SetAudit switches the audit of the commands of s
+func (s *Session) SetAudit(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&s.audit, v)
+}
+
+func (s *Session) auditing() bool {
+	return atomic.LoadInt32(&s.audit) == 1
+}
@@ -0,0 +1,73 @@
+package archer
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dongzerun/archer/logging"
+)
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := logging.New(&buf)
+	l.SetJSON(true)
+	s := newTestSession(&ProxyConfig{})
+	s.remote = "10.0.0.1:5000"
+	s.p.audit = &AuditLog{log: l, keys: 2, redactKeys: true}
+
+	// clients aren't audited until switched on
+	s.traceStart(0, newCommand("GET", "k"), time.Time{})
+	s.traceEnd(0, NewErrorResp([]byte("WRONGTYPE Operation against a key")), time.Now())
+	if buf.Len() != 0 {
+		t.Fatalf("not audited client logged %q", buf.String())
+	}
+
+	s.SetAudit(true)
+	s.traceStart(1, newCommand("MSET", "a", "secret", "b", "secret", "c", "secret"), time.Time{})
+	s.traceEnd(1, NewErrorResp([]byte("WRONGTYPE Operation against a key")), time.Now())
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("value logged %q", buf.String())
+	}
+	var e struct {
+		Client string   `json:"client"`
+		Seq    int64    `json:"seq"`
+		Cmd    string   `json:"cmd"`
+		Keys   []string `json:"keys"`
+		Args   int      `json:"args"`
+		Reply  string   `json:"reply"`
+		Error  string   `json:"error"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("%s: %q", err, buf.String())
+	}
+	if e.Client != s.remote || e.Seq != 1 || e.Cmd != "MSET" || e.Args != 6 || e.Reply != "error" || e.Error != "WRONGTYPE" {
+		t.Fatalf("entry %+v", e)
+	}
+	if len(e.Keys) != 2 || e.Keys[0] == "a" || !strings.HasPrefix(e.Keys[0], "sha256:") {
+		t.Fatalf("keys %v", e.Keys)
+	}
+}
+
+// TestAuditLogFollowsLog writes the entries through the writer of the
+// standard logger when there's no auditfile
+func TestAuditLogFollowsLog(t *testing.T) {
+	var buf bytes.Buffer
+	std := logging.Std()
+	old := std.Output()
+	std.SetOutput(&buf)
+	t.Cleanup(func() { std.SetOutput(old) })
+
+	a, err := NewAuditLog(&ProxyConfig{logFile: "/nonexistent/log", auditKeys: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestSession(&ProxyConfig{})
+	s.remote = "10.0.0.1:5000"
+	a.Log(s, 0, &cmdTrace{name: "GET", req: newCommand("GET", "k")}, NewNullBulkResp(), time.Millisecond)
+	if !strings.Contains(buf.String(), "10.0.0.1:5000") {
+		t.Fatalf("audit entry not in the log %q", buf.String())
+	}
+}
@@ -0,0 +1,98 @@
+package archer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+var (
+	NoAuthError      = errors.New("NOAUTH Authentication required.")
+	HelloNoAuthError = errors.New("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	WrongPassError   = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	NoPasswordError  = errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+)
+
+// 未认证的客户端只能发这些命令, ACL 也不限制它们
+var authFreeCommands = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+	"QUIT":  true,
+}
+
+// requirePass reports whether clients must AUTH before anything else
+func (p *Proxy) requirePass() bool {
+	acl := p.currentACL()
+	return p.conf().password != "" || (acl != nil && acl.RequirePass())
+}
+
+// authenticate checks the password of user. The proxy password is the
+// default user's, the other users have theirs in the ACL. Backends are
+// never asked, they have the proxy's own credentials
+func (p *Proxy) authenticate(user string, password string) error {
+	pass := p.conf().password
+	if user == "default" && pass != "" {
+		if subtle.ConstantTimeCompare([]byte(pass), []byte(password)) == 1 {
+			return nil
+		}
+		return WrongPassError
+	}
+	if acl := p.currentACL(); acl != nil {
+		if acl.Authenticate(user, password) {
+			return nil
+		}
+		return WrongPassError
+	}
+	// without passwords the default user is nopass
+	if user == "default" {
+		return nil
+	}
+	return WrongPassError
+}
+
+// Auth handles AUTH [username] password, a failure keeps the user
+// authenticated before
+func (s *Session) Auth(ar *ArrayResp, seq int64) {
+	user, password := "default", ""
+	if ar.Length() == 1 {
+		if !s.p.requirePass() {
+			s.replyError(NoPasswordError, seq)
+			return
+		}
+		p, _ := ar.Arg(1)
+		password = string(p)
+	} else {
+		u, _ := ar.Arg(1)
+		p, _ := ar.Arg(2)
+		user, password = string(u), string(p)
+	}
+
+	if err := s.p.authenticate(user, password); err != nil {
+		s.replyError(err, seq)
+		return
+	}
+	s.state.User, s.state.Authed = user, true
+	s.reply(WrappedOKResp(seq))
+}
+
+// Auth authenticates c to a password protected backend, user is empty
+// for the default user, which redis before 6 only has
+func (c *RedisConn) Auth(user string, password string) error {
+	cmd := txCommand("AUTH")
+	if user != "" {
+		cmd.append(NewBulkResp([]byte(user)))
+	}
+	cmd.append(NewBulkResp([]byte(password)))
+
+	if err := WriteProtocol(c.w, cmd); err != nil {
+		return err
+	}
+	r, err := ReadProtocol(c.r)
+	if err != nil {
+		return err
+	}
+	if !isStatus(r, OK) {
+		return fmt.Errorf("backend AUTH failed %s", r.String())
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package archer
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/dongzerun/archer/util"
+)
+
+func TestSessionAuth(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	s := newTestSession(&ProxyConfig{conCurrency: 5, password: "secret"})
+	s.p.filter = &StrFilter{}
+	s.p.acl = NewACL()
+	s.p.acl.SetUser("default", "+@all allkeys")
+	s.p.acl.SetUser("alice", ">alicepw +ping")
+	s.c = &util.Conn{Conn: server}
+	s.w = bufio.NewWriter(s.c)
+	s.cmds = make(chan *wrappedResp, 16)
+	s.quitChan = make(chan int, 1)
+	s.ooo = make(map[int64]*wrappedResp)
+	s.budget = newReplyBudget(0)
+	s.state = NewClientState()
+	s.state.Authed = !s.p.requirePass()
+	go s.WriteLoop()
+	go s.Dispatch()
+	defer close(s.quitChan)
+
+	steps := []struct {
+		cmd   []string
+		reply string
+	}{
+		{[]string{"PING"}, NoAuthError.Error()},
+		{[]string{"SHUTDOWN"}, NoAuthError.Error()},
+		{[]string{"HELLO", "3"}, HelloNoAuthError.Error()},
+		{[]string{"AUTH", "wrong"}, WrongPassError.Error()},
+		{[]string{"AUTH", "alice", "secret"}, WrongPassError.Error()},
+		{[]string{"PING"}, NoAuthError.Error()},
+		{[]string{"AUTH", "secret"}, "OK"},
+		{[]string{"PING"}, "PONG"},
+		{[]string{"AUTH", "alice", "alicepw"}, "OK"},
+		{[]string{"SELECT", "1"}, "NOPERM User alice has no permissions to run the 'select' command"},
+		{[]string{"HELLO", "2", "AUTH", "default", "nope"}, WrongPassError.Error()},
+		{[]string{"HELLO", "2", "AUTH", "default", "secret"}, "server archer version 6.0.0 proto 2 mode standalone role master modules "},
+		{[]string{"SELECT", "0"}, "OK"},
+		{[]string{"SELECT", "1"}, SelectClusterError.Error()},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"AUTH", "secret"}, TxForbiddenError.Error()},
+		{[]string{"DISCARD"}, "OK"},
+	}
+
+	r := bufio.NewReader(client)
+	for i, step := range steps {
+		s.cmds <- WrappedResp(newCommand(step.cmd...), int64(i))
+		resp, err := ReadProtocol(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.String(); got != step.reply {
+			t.Fatalf("step %d %v: got %q, want %q", i, step.cmd, got, step.reply)
+		}
+	}
+}
+
+func TestAuthNoPassword(t *testing.T) {
+	p := &Proxy{pc: &ProxyConfig{}}
+	if p.requirePass() {
+		t.Fatal("no password configured")
+	}
+	if err := p.authenticate("default", "anything"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.authenticate("alice", "anything"); err != WrongPassError {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisConnAuth(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	rc := &RedisConn{c: client, w: bufio.NewWriter(client), r: bufio.NewReader(client)}
+
+	go func() {
+		r := bufio.NewReader(server)
+		for _, reply := range []string{"+OK\r\n", "-WRONGPASS invalid username-password pair\r\n"} {
+			if _, err := ReadProtocol(r); err != nil {
+				return
+			}
+			server.Write([]byte(reply))
+		}
+	}()
+
+	if err := rc.Auth("proxy", "pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Auth("", "bad"); err == nil {
+		t.Fatal("AUTH error must fail")
+	}
+}
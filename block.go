@@ -0,0 +1,111 @@
+package archer
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/dongzerun/archer/logging"
+)
+
+// 阻塞命令最长等待时间的默认上限
+const defaultMaxBlockTimeout = 300 * time.Second
+
+// Block runs a blocking command like BLPOP on a backend connection of its
+// own, so it holds neither a pooled connection nor the concurrency of the
+// session while it waits: the commands pipelined after it go on, only
+// their replies wait for it. The timeout of the client is capped by
+// maxblocktimeout, blocking forever included. WAIT goes to the master of
+// the last key the session wrote, the writes went over pooled connections
+// so it reports the replicas of that master rather than waiting for them
+func (s *Session) Block(req *ArrayResp, seq int64) {
+	if max := s.p.conf().maxBlockTimeout; max > 0 {
+		if _, err := ClampBlockTimeout(req, max.Seconds()); err != nil {
+			s.replyError(err, seq)
+			return
+		}
+	}
+
+	key, _ := routeSlot(req)
+	if cmdName(req) == "WAIT" {
+		if s.lastWrite == nil {
+			// nothing written, nothing to wait for
+			s.reply(WrappedResp(NewIntResp(0), seq))
+			return
+		}
+		key = s.lastWrite
+	}
+	id := s.p.cluster.topo.GetNodeID(key, false)
+	db := s.state.DB
+	go func() {
+		s.reply(WrappedResp(s.execBlocking(id, db, req), seq))
+	}()
+}
+
+// execBlocking sends req on a new connection to node id and closes it
+// after the reply, or as soon as the session quits. MOVED and ASK are
+// followed up to maxredirects times like ExecWithRedirect. The new
+// connection is on DB 0, SELECT db goes first
+func (s *Session) execBlocking(id string, db int, req *ArrayResp) Resp {
+	timeout := BlockTimeout(req)
+	if timeout > 0 {
+		timeout += s.p.conf().readTimeout
+	}
+
+	asking := false
+	max := s.p.conf().maxRedirects
+	for i := 0; ; i++ {
+		rc, err := s.p.cluster.DialNode(id, timeout)
+		if err != nil {
+			log.Warning("Session execBlocking DialNode failed ", err)
+			return NewErrorRespf("proxy internal error %s", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-s.quitChan:
+				rc.Close()
+			case <-done:
+			}
+		}()
+
+		var resp Resp
+		if db != 0 {
+			resp, err = s.ExecOnce(rc, newSelect(db))
+		}
+		if _, failed := resp.(*ErrorResp); asking && err == nil && !failed {
+			resp, err = s.ExecOnce(rc, newASKING())
+		}
+		if _, failed := resp.(*ErrorResp); err == nil && !failed {
+			resp, err = s.ExecOnce(rc, req)
+		}
+		close(done)
+		rc.Close()
+		if err != nil {
+			return NewErrorRespf("proxy internal error %s", err)
+		}
+
+		er, ok := resp.(*ErrorResp)
+		if !ok {
+			return resp
+		}
+		rd, ok := er.Redirect()
+		if !ok {
+			return resp
+		}
+		if i == max {
+			return NewErrorRespf("%s, last %s", TooManyRedirectsError, er.Error())
+		}
+		Stats.Redirects.With(strings.ToLower(rd.Kind)).Add(1)
+		if rd.Kind == "MOVED" {
+			s.p.cluster.topo.Moved(rd.Slot, rd.Addr)
+		}
+		id, asking = rd.Addr, rd.Kind == "ASK"
+	}
+}
+
+func newASKING() *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Args = []*BulkResp{NewBulkResp([]byte("ASKING"))}
+	return ar
+}
@@ -0,0 +1,58 @@
+package archer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionBlock(t *testing.T) {
+	replies := map[string]string{
+		"BLPOP l 2":    "*2\r\n$1\r\nl\r\n$1\r\nv\r\n",
+		"BLPOP l 1.5":  "*-1\r\n",
+		"BLPOP hang 2": "",
+	}
+	n, l := fakeMaster(t, replies)
+	defer l.Close()
+
+	pc := &ProxyConfig{conCurrency: 5, dialTimeout: time.Second, readTimeout: time.Second, maxBlockTimeout: 2 * time.Second}
+	s := newTestSession(pc)
+	s.p.cluster = testCluster(pc, n, n)
+	s.quitChan = make(chan int)
+	s.state = NewClientState()
+	reply := func() string {
+		select {
+		case w := <-s.resps:
+			return encodeResp(t, w.resp)
+		case <-time.After(3 * time.Second):
+			t.Fatal("no reply")
+		}
+		return ""
+	}
+
+	// forever and over the cap are capped, shorter timeouts are kept
+	s.Block(newCommand("BLPOP", "l", "0"), 0)
+	if got := reply(); got != replies["BLPOP l 2"] {
+		t.Fatalf("BLPOP l 0 got %q", got)
+	}
+	s.Block(newCommand("BLPOP", "l", "1.5"), 1)
+	if got := reply(); got != "*-1\r\n" {
+		t.Fatalf("BLPOP l 1.5 got %q", got)
+	}
+	s.Block(newCommand("BLPOP", "l", "soon"), 2)
+	if got := reply(); got != "-"+TimeoutArgError.Error()+"\r\n" {
+		t.Fatalf("bad timeout got %q", got)
+	}
+	s.Block(newCommand("WAIT", "1", "100"), 3)
+	if got := reply(); got != ":0\r\n" {
+		t.Fatalf("WAIT without writes got %q", got)
+	}
+
+	// the connection of a blocked command is closed when the session quits
+	s.Block(newCommand("BLPOP", "hang", "5"), 4)
+	time.Sleep(50 * time.Millisecond)
+	close(s.quitChan)
+	start := time.Now()
+	if got := reply(); got[0] != '-' || time.Since(start) > time.Second {
+		t.Fatalf("blocked command got %q after %s", got, time.Since(start))
+	}
+}
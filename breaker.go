@@ -0,0 +1,242 @@
+package archer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/dongzerun/archer/logging"
+)
+
+// 熔断器的状态
+const (
+	BreakerClosed   = "closed"    // 正常路由
+	BreakerOpen     = "open"      // 节点被摘除, 请求直接失败, 后台探活
+	BreakerHalfOpen = "half-open" // 探活成功, 放请求进来试
+)
+
+var CircuitOpenError = errors.New("circuit open")
+
+// Breaker is the circuit breaker of a backend node. It counts the conns
+// put back broken and the failed dials over a window, and opens when the
+// share of failures reaches ratio with at least min requests. An open
+// breaker refuses every request until the prober reaches the node again,
+// then it's half-open: a failure opens it again at once, min successes
+// close it
+type Breaker struct {
+	mu       sync.Mutex
+	state    string
+	ratio    float64
+	min      int
+	window   time.Duration
+	start    time.Time // of the window, or of the half-open state
+	total    int
+	failures int
+
+	now func() time.Time
+}
+
+func NewBreaker(ratio float64, min int, window time.Duration) *Breaker {
+	return &Breaker{state: BreakerClosed, ratio: ratio, min: min, window: window, now: time.Now}
+}
+
+// Allow reports whether a request may go to the node
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != BreakerOpen
+}
+
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Report counts the result of a request, it returns true when the breaker
+// opens because of it
+func (b *Breaker) Report(failed bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	switch b.state {
+	case BreakerOpen:
+		// conns taken before the breaker opened
+		return false
+	case BreakerHalfOpen:
+		if failed {
+			b.set(BreakerOpen, now)
+			return true
+		}
+		if b.total++; b.total >= b.min {
+			b.set(BreakerClosed, now)
+		}
+		return false
+	}
+
+	if now.Sub(b.start) > b.window {
+		b.start, b.total, b.failures = now, 0, 0
+	}
+	b.total++
+	if failed {
+		b.failures++
+	}
+	if b.total >= b.min && float64(b.failures) >= b.ratio*float64(b.total) {
+		b.set(BreakerOpen, now)
+		return true
+	}
+	return false
+}
+
+// Probed is called by the prober once the node answers again
+func (b *Breaker) Probed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		b.set(BreakerHalfOpen, b.now())
+	}
+}
+
+// set switches to state, b.mu must be held
+func (b *Breaker) set(state string, now time.Time) {
+	b.state = state
+	b.start, b.total, b.failures = now, 0, 0
+}
+
+// breakerEnabled reports whether the nodes have circuit breakers
+func breakerEnabled(pc *ProxyConfig) bool {
+	return pc != nil && pc.breakerRatio > 0
+}
+
+// breaker returns the breaker of node id, created on first use, nil if
+// breakers are disabled
+func (c *Cluster) breaker(id string) *Breaker {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if !breakerEnabled(c.pc) {
+		return nil
+	}
+	b, ok := c.breakers[id]
+	if !ok {
+		if c.breakers == nil {
+			c.breakers = make(map[string]*Breaker)
+		}
+		b = NewBreaker(c.pc.breakerRatio, c.pc.breakerMin, c.pc.breakerWindow)
+		c.breakers[id] = b
+	}
+	return b
+}
+
+// allow fails fast the requests to a node whose breaker is open
+func (c *Cluster) allow(id string) error {
+	if b := c.breaker(id); b != nil && !b.Allow() {
+		return fmt.Errorf("backend %s unavailable, %s", id, CircuitOpenError)
+	}
+	return nil
+}
+
+// report counts a request to node id, a failed one is a failed dial or a
+// conn put back broken. A cluster node failing may be a master failing
+// over, the slot map is reloaded right away instead of waiting for the
+// next MOVED
+func (c *Cluster) report(id string, failed bool) {
+	b := c.breaker(id)
+	if b == nil {
+		return
+	}
+	if !b.Report(failed) {
+		return
+	}
+	Stats.BreakerTrips.With(id).Add(1)
+	log.Warningf("Cluster node %s circuit open, ejected until it answers again", id)
+	c.eject(id, true)
+	c.topo.Reload()
+	go c.probe(id, b)
+}
+
+// eject takes node id off the ketama ring with autoeject, or puts it back,
+// its keys go to the next servers of the ring meanwhile. Cluster masters
+// are never taken off, their slots have no other node, but the reads
+// going to slaves skip the slaves ejected
+func (c *Cluster) eject(id string, on bool) {
+	c.l.Lock()
+	pc := c.pc
+	c.l.Unlock()
+	if pc.ring != nil && pc.autoEject {
+		pc.ring.Eject(id, on)
+	}
+}
+
+// down reports whether the breaker of node id is open, for the routing
+// of the topology
+func (c *Cluster) down(id string) bool {
+	c.l.Lock()
+	b := c.breakers[id]
+	c.l.Unlock()
+	return b != nil && !b.Allow()
+}
+
+// probe PINGs node id every cooldown until it answers, then lets requests
+// in again. In a cluster every round reloads the slot map too, a slave
+// promoted in the meantime takes the slots over. It gives up on a node
+// gone from the topology
+func (c *Cluster) probe(id string, b *Breaker) {
+	for {
+		c.l.Lock()
+		pc := c.pc
+		c.l.Unlock()
+		time.Sleep(pc.breakerCooldown)
+
+		if !c.known(id) {
+			log.Warningf("Cluster node %s left the topology, stop probing it", id)
+			c.l.Lock()
+			delete(c.breakers, id)
+			c.l.Unlock()
+			return
+		}
+		if c.ping(id, pc) {
+			log.Warningf("Cluster node %s answers again, circuit half-open", id)
+			b.Probed()
+			c.eject(id, false)
+			return
+		}
+		c.topo.Reload()
+	}
+}
+
+// known reports whether node id is still in the slot map or the ring
+func (c *Cluster) known(id string) bool {
+	for _, n := range c.topo.allNodes() {
+		if n.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cluster) ping(id string, pc *ProxyConfig) bool {
+	n := nodeFromAddr(id)
+	if n == nil {
+		return false
+	}
+	cn, err := RedisConnDialer(n.host, n.port, n.id, pc)()
+	if err != nil {
+		return false
+	}
+	defer cn.Close()
+	return cn.Alive()
+}
+
+// BreakerStates returns the state of the breakers not closed
+func (c *Cluster) BreakerStates() map[string]string {
+	c.l.Lock()
+	defer c.l.Unlock()
+	states := make(map[string]string)
+	for id, b := range c.breakers {
+		if state := b.State(); state != BreakerClosed {
+			states[id] = state
+		}
+	}
+	return states
+}
@@ -0,0 +1,112 @@
+package archer
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := NewBreaker(0.5, 4, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	// under min requests nothing opens
+	for i := 0; i < 3; i++ {
+		if b.Report(true) {
+			t.Fatalf("opened after %d requests", i+1)
+		}
+	}
+	// a new window starts afresh
+	now = now.Add(11 * time.Second)
+	b.Report(false)
+	b.Report(false)
+	b.Report(true)
+	if !b.Report(true) || b.Allow() || b.State() != BreakerOpen {
+		t.Fatalf("not open at half failures, %s", b.State())
+	}
+
+	b.Probed()
+	if !b.Allow() || b.State() != BreakerHalfOpen {
+		t.Fatalf("probed breaker %s", b.State())
+	}
+	if !b.Report(true) || b.State() != BreakerOpen {
+		t.Fatal("half-open breaker not opened by a failure")
+	}
+	b.Probed()
+	for i := 0; i < 4; i++ {
+		b.Report(false)
+	}
+	if b.State() != BreakerClosed {
+		t.Fatalf("breaker %s after min successes", b.State())
+	}
+}
+
+func TestClusterBreaker(t *testing.T) {
+	a, la := fakeMaster(t, map[string]string{"PING": "+PONG\r\n"})
+	defer la.Close()
+	// b is down, nothing listens on its port
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	b := nodeFromAddr(l.Addr().String())
+	b.role = "slave"
+
+	pc := &ProxyConfig{dialTimeout: time.Second, readTimeout: time.Second, poolSize: 2,
+		breakerRatio: 0.5, breakerMin: 3, breakerWindow: time.Minute, breakerCooldown: 10 * time.Millisecond,
+		readPolicy: ReadPreferReplica}
+	c := testCluster(pc, a, a)
+	c.topo.down = c.down
+	for i := range c.topo.slots {
+		c.topo.slots[i].slaves = []*Node{b}
+	}
+
+	if id := c.topo.GetNodeID([]byte("k"), true); id != b.id {
+		t.Fatalf("read routed to %s, slave up", id)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetConnByID(b.id); err == nil || strings.Contains(err.Error(), CircuitOpenError.Error()) {
+			t.Fatalf("dial %d of a node down: %v", i, err)
+		}
+	}
+	// open: failing fast, the reads of its slots go to the master
+	if _, err := c.GetConnByID(b.id); err == nil || !strings.Contains(err.Error(), CircuitOpenError.Error()) {
+		t.Fatalf("open breaker got %v", err)
+	}
+	if id := c.topo.GetNodeID([]byte("k"), true); id != a.id {
+		t.Fatalf("read routed to %s, slave down", id)
+	}
+	if states := c.BreakerStates(); states[b.id] != BreakerOpen || len(states) != 1 {
+		t.Fatalf("states %v", states)
+	}
+
+	// the prober lets requests in once it answers
+	lb, err := net.Listen("tcp4", b.id)
+	if err != nil {
+		t.Skipf("port %d taken again: %s", port, err)
+	}
+	defer lb.Close()
+	go func() {
+		for {
+			cn, err := lb.Accept()
+			if err != nil {
+				return
+			}
+			cn.Write([]byte("+PONG\r\n"))
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.down(b.id) {
+		if time.Now().After(deadline) {
+			t.Fatal("node up never probed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if states := c.BreakerStates(); states[b.id] != BreakerHalfOpen {
+		t.Fatalf("states after the probe %v", states)
+	}
+}
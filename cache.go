@@ -0,0 +1,195 @@
+package archer
+
+import (
+	"bytes"
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplyCache keeps the replies of allowlisted single key read commands,
+// like GET or HGET, for ttl in an LRU of at most size entries. A write
+// passing through the proxy drops the entries of its keys, writes made
+// behind the proxy are only seen after ttl.
+//
+// A read racing with a write of its key must not cache the old value:
+// Get hands out a generation, Put is ignored if the key was invalidated
+// after it
+type ReplyCache struct {
+	mu       sync.Mutex
+	size     int
+	ttl      time.Duration
+	maxBytes int64           // replies bigger than it are not cached, 0 no limit
+	commands map[string]bool // upper case names allowed
+
+	lru   *list.List               // of *cacheEntry, front is the most recent
+	items map[string]*list.Element // cache key => entry
+	byKey map[string]map[*list.Element]struct{}
+
+	gen   uint64            // bumped by every invalidation
+	inval map[string]uint64 // key => gen of its last invalidation
+	floor uint64            // puts older than floor are ignored, inval was reset
+}
+
+type cacheEntry struct {
+	ck, key string
+	resp    Resp
+	expire  time.Time
+}
+
+// NewReplyCache returns nil, no cache, if size <= 0 or commands is empty
+func NewReplyCache(size int, ttl time.Duration, maxBytes int64, commands []string) *ReplyCache {
+	if size <= 0 || len(commands) == 0 {
+		return nil
+	}
+	c := &ReplyCache{
+		size:     size,
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		commands: make(map[string]bool),
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+		byKey:    make(map[string]map[*list.Element]struct{}),
+		inval:    make(map[string]uint64),
+	}
+	for _, name := range commands {
+		c.commands[strings.ToUpper(name)] = true
+	}
+	return c
+}
+
+// cacheKey returns the cache key of ar, the command and all its arguments,
+// and its only key. ok is false if ar is not cached
+func (c *ReplyCache) cacheKey(ar *ArrayResp) (ck, key string, ok bool) {
+	if !c.commands[cmdName(ar)] {
+		return "", "", false
+	}
+	keys := CommandKeys(ar)
+	if len(keys) != 1 {
+		return "", "", false
+	}
+	var b bytes.Buffer
+	b.WriteString(cmdName(ar))
+	for _, arg := range ar.Args[1:] {
+		if len(arg.Args) == 0 {
+			return "", "", false
+		}
+		b.WriteByte(0)
+		b.Write(arg.Args[0])
+	}
+	return b.String(), string(keys[0]), true
+}
+
+// Get returns the cached reply of ar. On a miss the generation is passed
+// to Put with the reply of the backend. A nil cache never hits
+func (c *ReplyCache) Get(ar *ArrayResp) (resp Resp, gen uint64, hit bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+	ck, _, ok := c.cacheKey(ar)
+	if !ok {
+		return nil, 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[ck]; ok {
+		ent := e.Value.(*cacheEntry)
+		if time.Now().Before(ent.expire) {
+			c.lru.MoveToFront(e)
+			Stats.CacheHits.Add(1)
+			return ent.resp, 0, true
+		}
+		c.remove(e)
+	}
+	Stats.CacheMisses.Add(1)
+	return nil, c.gen, false
+}
+
+// Put caches resp, the reply of ar read at generation gen. Errors, big
+// replies and replies racing with a write of their key are not cached
+func (c *ReplyCache) Put(ar *ArrayResp, resp Resp, gen uint64) {
+	if c == nil || resp == nil {
+		return
+	}
+	if _, ok := resp.(*ErrorResp); ok {
+		return
+	}
+	if c.maxBytes > 0 && respSize(resp) > c.maxBytes {
+		return
+	}
+	ck, key, ok := c.cacheKey(ar)
+	if !ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen < c.floor || c.inval[key] > gen {
+		return
+	}
+	if e, ok := c.items[ck]; ok {
+		c.remove(e)
+	}
+	e := c.lru.PushFront(&cacheEntry{ck: ck, key: key, resp: resp, expire: time.Now().Add(c.ttl)})
+	c.items[ck] = e
+	if c.byKey[key] == nil {
+		c.byKey[key] = make(map[*list.Element]struct{})
+	}
+	c.byKey[key][e] = struct{}{}
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Invalidate drops the entries of the keys of the write ar, a write
+// without keys like FLUSHALL drops everything
+func (c *ReplyCache) Invalidate(ar *ArrayResp) {
+	if c == nil {
+		return
+	}
+	keys := CommandKeys(ar)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if len(keys) == 0 {
+		c.lru.Init()
+		c.items = make(map[string]*list.Element)
+		c.byKey = make(map[string]map[*list.Element]struct{})
+		c.inval = make(map[string]uint64)
+		c.floor = c.gen
+		return
+	}
+	if len(c.inval) >= c.size {
+		// every read in flight is older than the reset, they'll refetch
+		c.inval = make(map[string]uint64)
+		c.floor = c.gen
+	}
+	for _, k := range keys {
+		key := string(k)
+		c.inval[key] = c.gen
+		for e := range c.byKey[key] {
+			c.remove(e)
+		}
+	}
+}
+
+// Len returns the number of entries, expired ones included
+func (c *ReplyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *ReplyCache) remove(e *list.Element) {
+	ent := c.lru.Remove(e).(*cacheEntry)
+	delete(c.items, ent.ck)
+	if m := c.byKey[ent.key]; m != nil {
+		delete(m, e)
+		if len(m) == 0 {
+			delete(c.byKey, ent.key)
+		}
+	}
+}
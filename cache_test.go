@@ -0,0 +1,93 @@
+package archer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplyCache(t *testing.T) {
+	if NewReplyCache(0, time.Second, 0, []string{"GET"}) != nil {
+		t.Fatal("cache of size 0")
+	}
+	var nilCache *ReplyCache
+	if _, _, hit := nilCache.Get(newCommand("GET", "k")); hit {
+		t.Fatal("nil cache hit")
+	}
+
+	c := NewReplyCache(2, time.Hour, 64, []string{"GET", "HGET"})
+	get := func(args ...string) (string, bool) {
+		resp, _, hit := c.Get(newCommand(args...))
+		if !hit {
+			return "", false
+		}
+		return encodeResp(t, resp), true
+	}
+	put := func(reply string, args ...string) {
+		ar := newCommand(args...)
+		_, gen, _ := c.Get(ar)
+		c.Put(ar, NewBulkResp([]byte(reply)), gen)
+	}
+
+	put("v", "GET", "k")
+	put("f", "HGET", "h", "f")
+	if got, hit := get("GET", "k"); !hit || got != "$1\r\nv\r\n" {
+		t.Fatalf("GET k got %q %v", got, hit)
+	}
+	if _, hit := get("HGET", "h", "g"); hit {
+		t.Fatal("HGET of another field hit")
+	}
+	if _, hit := get("STRLEN", "k"); hit {
+		t.Fatal("command not allowed hit")
+	}
+
+	// GET k is the most recent, HGET h f is evicted
+	put("w", "GET", "k2")
+	if _, hit := get("HGET", "h", "f"); hit {
+		t.Fatal("least recent entry not evicted")
+	}
+
+	// a write drops the entries of its key only
+	c.Invalidate(newCommand("SET", "k", "x"))
+	if _, hit := get("GET", "k"); hit {
+		t.Fatal("entry hit after a write of its key")
+	}
+	if _, hit := get("GET", "k2"); !hit {
+		t.Fatal("entry of another key dropped")
+	}
+
+	// a read racing with a write doesn't cache the old value
+	ar := newCommand("GET", "k")
+	_, gen, _ := c.Get(ar)
+	c.Invalidate(newCommand("SET", "k", "y"))
+	c.Put(ar, NewBulkResp([]byte("old")), gen)
+	if _, hit := get("GET", "k"); hit {
+		t.Fatal("value read before a write cached")
+	}
+
+	// errors and big replies are not cached
+	put(strings.Repeat("x", 64), "GET", "big")
+	if _, hit := get("GET", "big"); hit {
+		t.Fatal("big reply cached")
+	}
+	ar = newCommand("GET", "e")
+	_, gen, _ = c.Get(ar)
+	c.Put(ar, NewErrorResp([]byte("ERR x")), gen)
+	if _, hit := get("GET", "e"); hit {
+		t.Fatal("error cached")
+	}
+
+	// a write without keys drops everything
+	c.Invalidate(newCommand("FLUSHALL"))
+	if c.Len() != 0 {
+		t.Fatalf("%d entries after FLUSHALL", c.Len())
+	}
+
+	// entries expire
+	c = NewReplyCache(2, time.Millisecond, 0, []string{"GET"})
+	put("v", "GET", "k")
+	time.Sleep(5 * time.Millisecond)
+	if _, hit := get("GET", "k"); hit {
+		t.Fatal("expired entry hit")
+	}
+}
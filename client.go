@@ -0,0 +1,170 @@
+package archer
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientIDs is the last CLIENT ID given to a session
+var clientIDs int64
+
+// ClientCommand answers CLIENT from the proxy, a backend connection is
+// shared by many clients. Client libraries send SETNAME and SETINFO when
+// they connect, ID, GETNAME, INFO and LIST see the sessions of the proxy.
+// The other subcommands, like KILL and PAUSE, are the admin API's
+func (s *Session) ClientCommand(ar *ArrayResp, seq int64) {
+	sub, _ := ar.Arg(1)
+	op := strings.ToUpper(string(sub))
+	argc := map[string]int{"ID": 2, "GETNAME": 2, "INFO": 2, "SETNAME": 3, "SETINFO": 4}
+	if n, ok := argc[op]; ok && len(ar.Args) != n {
+		s.reply(WrappedResp(NewErrorRespf("ERR wrong number of arguments for 'client|%s' command", strings.ToLower(op)), seq))
+		return
+	}
+
+	switch op {
+	case "ID":
+		s.reply(WrappedResp(NewIntResp(s.id), seq))
+	case "GETNAME":
+		s.tl.Lock()
+		name := s.name
+		s.tl.Unlock()
+		if name == "" {
+			s.reply(WrappedResp(NewNullBulkResp(), seq))
+			return
+		}
+		s.reply(WrappedResp(NewBulkResp([]byte(name)), seq))
+	case "SETNAME":
+		name, _ := ar.Arg(2)
+		if !validClientName(name) {
+			s.reply(WrappedErrorResp([]byte("ERR Client names cannot contain spaces, newlines or special characters."), seq))
+			return
+		}
+		s.tl.Lock()
+		s.name = string(name)
+		s.tl.Unlock()
+		s.reply(WrappedOKResp(seq))
+	case "SETINFO":
+		attr, _ := ar.Arg(2)
+		val, _ := ar.Arg(3)
+		attrName := strings.ToLower(string(attr))
+		if attrName != "lib-name" && attrName != "lib-ver" {
+			s.reply(WrappedResp(NewErrorRespf("ERR Unrecognized option '%s'", attr), seq))
+			return
+		}
+		if !validClientName(val) {
+			s.reply(WrappedResp(NewErrorRespf("ERR %s cannot contain spaces, newlines or special characters.", attrName), seq))
+			return
+		}
+		s.tl.Lock()
+		if attrName == "lib-name" {
+			s.libName = string(val)
+		} else {
+			s.libVer = string(val)
+		}
+		s.tl.Unlock()
+		s.reply(WrappedOKResp(seq))
+	case "INFO":
+		s.reply(WrappedResp(NewBulkResp([]byte(s.clientLine(time.Now()))), seq))
+	case "LIST":
+		s.clientList(ar, seq)
+	default:
+		s.reply(WrappedResp(NewErrorRespf("ERR CLIENT %s is not supported by proxy", sub), seq))
+	}
+}
+
+// clientList replies CLIENT LIST [TYPE normal|pubsub] [ID id ...], one
+// line per session
+func (s *Session) clientList(ar *ArrayResp, seq int64) {
+	var kind string
+	var ids map[int64]bool
+	for i := 2; i < len(ar.Args); i++ {
+		opt, _ := ar.Arg(i)
+		switch strings.ToUpper(string(opt)) {
+		case "TYPE":
+			t, ok := ar.Arg(i + 1)
+			kind = strings.ToLower(string(t))
+			if !ok || (kind != "normal" && kind != "pubsub" && kind != "master" && kind != "replica") {
+				s.reply(WrappedResp(NewErrorRespf("ERR Unknown client type '%s'", t), seq))
+				return
+			}
+			i++
+		case "ID":
+			if i+1 >= len(ar.Args) {
+				s.reply(WrappedErrorResp([]byte("ERR syntax error"), seq))
+				return
+			}
+			ids = make(map[int64]bool)
+			for i++; i < len(ar.Args); i++ {
+				arg, _ := ar.Arg(i)
+				id, err := strconv.ParseInt(string(arg), 10, 64)
+				if err != nil || id <= 0 {
+					s.reply(WrappedErrorResp([]byte("ERR Invalid client ID"), seq))
+					return
+				}
+				ids[id] = true
+			}
+		default:
+			s.reply(WrappedErrorResp([]byte("ERR syntax error"), seq))
+			return
+		}
+	}
+
+	sessions := s.p.sm.Sessions()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	var buf bytes.Buffer
+	now := time.Now()
+	for _, c := range sessions {
+		pubsub := atomic.LoadInt32(&c.pubsub) == 1
+		if (kind == "normal" && pubsub) || (kind == "pubsub" && !pubsub) || kind == "master" || kind == "replica" {
+			continue
+		}
+		if ids != nil && !ids[c.id] {
+			continue
+		}
+		buf.WriteString(c.clientLine(now))
+	}
+	s.reply(WrappedResp(NewBulkResp(buf.Bytes()), seq))
+}
+
+// clientLine is the line of s in CLIENT LIST and CLIENT INFO, with the
+// fields the proxy knows of
+func (s *Session) clientLine(now time.Time) string {
+	laddr := ""
+	if s.c != nil && s.c.Conn != nil {
+		laddr = s.c.LocalAddr().String()
+	}
+	flags := "N"
+	if atomic.LoadInt32(&s.pubsub) == 1 {
+		flags = "P"
+	}
+
+	s.tl.Lock()
+	defer s.tl.Unlock()
+	last := s.lastCmdAt
+	if last.IsZero() {
+		last = s.created
+	}
+	cmd := "NULL"
+	if s.lastCmd != "" {
+		cmd = strings.ToLower(s.lastCmd)
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s cmd=%s lib-name=%s lib-ver=%s\n",
+		s.id, s.remote, laddr, s.name, int64(now.Sub(s.created)/time.Second), int64(now.Sub(last)/time.Second),
+		flags, cmd, s.libName, s.libVer)
+}
+
+// validClientName reports whether name has no spaces, newlines or other
+// characters outside of '!' to '~', like redis
+func validClientName(name []byte) bool {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package archer
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCommand(t *testing.T) {
+	p := &Proxy{pc: &ProxyConfig{}, sm: &SessMana{pool: make(map[string]*Session)}}
+	sessions := make([]*Session, 2)
+	for i := range sessions {
+		s := newTestSession(p.pc)
+		s.p, s.remote, s.created = p, fmt.Sprintf("10.0.0.1:500%d", i), time.Now()
+		s.id = atomic.AddInt64(&clientIDs, 1)
+		p.sm.Put(s.remote, s)
+		sessions[i] = s
+	}
+	s, other := sessions[0], sessions[1]
+	atomic.StoreInt32(&other.pubsub, 1)
+
+	steps := []struct {
+		cmd   []string
+		reply string
+	}{
+		{[]string{"CLIENT", "ID"}, fmt.Sprintf(":%d\r\n", s.id)},
+		{[]string{"CLIENT", "GETNAME"}, "$-1\r\n"},
+		{[]string{"CLIENT", "SETNAME", "worker-1"}, "+OK\r\n"},
+		{[]string{"CLIENT", "GETNAME"}, "$8\r\nworker-1\r\n"},
+		{[]string{"CLIENT", "SETNAME", "a b"}, "-ERR Client names cannot contain spaces, newlines or special characters.\r\n"},
+		{[]string{"CLIENT", "SETNAME"}, "-ERR wrong number of arguments for 'client|setname' command\r\n"},
+		{[]string{"client", "setinfo", "LIB-NAME", "go-redis"}, "+OK\r\n"},
+		{[]string{"CLIENT", "SETINFO", "lib-ver", "9.0.5"}, "+OK\r\n"},
+		{[]string{"CLIENT", "SETINFO", "color", "red"}, "-ERR Unrecognized option 'color'\r\n"},
+		{[]string{"CLIENT", "LIST", "TYPE", "slave"}, "-ERR Unknown client type 'slave'\r\n"},
+		{[]string{"CLIENT", "LIST", "ID", "x"}, "-ERR Invalid client ID\r\n"},
+		{[]string{"CLIENT", "KILL", "10.0.0.1:5001"}, "-ERR CLIENT KILL is not supported by proxy\r\n"},
+	}
+	for i, step := range steps {
+		s.ClientCommand(newCommand(step.cmd...), int64(i))
+		if got := encodeResp(t, (<-s.resps).resp); got != step.reply {
+			t.Fatalf("step %d %v: got %q, want %q", i, step.cmd, got, step.reply)
+		}
+	}
+
+	s.ClientCommand(newCommand("CLIENT", "INFO"), 0)
+	info := (<-s.resps).resp.String()
+	want := fmt.Sprintf("id=%d addr=10.0.0.1:5000 laddr= name=worker-1 ", s.id)
+	if !strings.HasPrefix(info, want) || !strings.Contains(info, " flags=N ") || !strings.HasSuffix(info, "lib-name=go-redis lib-ver=9.0.5\n") {
+		t.Fatalf("info %q", info)
+	}
+
+	list := func(args ...string) []string {
+		s.ClientCommand(newCommand(append([]string{"CLIENT", "LIST"}, args...)...), 0)
+		return strings.Split(strings.TrimSuffix((<-s.resps).resp.String(), "\n"), "\n")
+	}
+	if lines := list(); len(lines) != 2 || lines[0] != strings.TrimSuffix(info, "\n") || !strings.Contains(lines[1], " flags=P ") {
+		t.Fatalf("list %q", lines)
+	}
+	if lines := list("TYPE", "pubsub"); len(lines) != 1 || !strings.Contains(lines[0], other.remote) {
+		t.Fatalf("pubsub clients %q", lines)
+	}
+	if lines := list("ID", fmt.Sprint(other.id), "99999999"); len(lines) != 1 || !strings.Contains(lines[0], other.remote) {
+		t.Fatalf("clients by id %q", lines)
+	}
+	if info := s.Info(); info.ID != s.id || info.Name != "worker-1" {
+		t.Fatalf("admin info %+v", info)
+	}
+}
+
+func TestSessionIdle(t *testing.T) {
+	s := newTestSession(&ProxyConfig{})
+	now := time.Now()
+	s.lastUsed = now.Add(-time.Minute).UnixNano()
+	if d := s.idle(now); d != time.Minute {
+		t.Fatalf("idle %s", d)
+	}
+	// waiting for a reply, e.g. a BLPOP, is not idle
+	s.reqSequence = 1
+	if d := s.idle(now); d != 0 {
+		t.Fatalf("idle %s with a reply pending", d)
+	}
+	s.flushedSequence = 1
+	atomic.StoreInt32(&s.pubsub, 1)
+	if d := s.idle(now); d != 0 {
+		t.Fatalf("subscriber idle %s", d)
+	}
+}
@@ -1,26 +1,44 @@
 package archer
 
 import (
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
-	log "github.com/ngaut/logging"
+	log "github.com/dongzerun/archer/logging"
+	"github.com/dongzerun/archer/util"
 )
 
+// 默认最多跟随的 MOVED/ASK 次数, 和 redis-cli 一样
+const defaultMaxRedirects = 5
+
+var TooManyRedirectsError = errors.New("ERR too many cluster redirects")
+
 type Cluster struct {
 	pc    *ProxyConfig
+	l     sync.Mutex           // pools and opts are created lazily, pc is replaced by Reload
 	pools map[string]*ConnPool //key: node id host:port
 	opts  map[string]*Options
 
+	// pools replaced by Reload, kept until their conns in use are put back
+	retired map[string][]*ConnPool
+
+	// circuit breakers of the nodes used, nil when disabled
+	breakers map[string]*Breaker
+
 	topo *Topology
 }
 
 func NewCluster(pc *ProxyConfig) *Cluster {
 	c := &Cluster{
-		pc:    pc,
-		pools: make(map[string]*ConnPool, 1),
-		opts:  make(map[string]*Options, 1),
-		topo:  NewTopo(pc),
+		pc:      pc,
+		pools:   make(map[string]*ConnPool, 1),
+		opts:    make(map[string]*Options, 1),
+		retired: make(map[string][]*ConnPool),
+		topo:    NewTopo(pc),
 	}
+	c.topo.down = c.down
 	c.initializePool()
 	return c
 }
@@ -28,7 +46,16 @@ func NewCluster(pc *ProxyConfig) *Cluster {
 func (c *Cluster) GetConn(key []byte, slave bool) (Conn, error) {
 	id := c.topo.GetNodeID(key, slave)
 	log.Infof("GetConn %s for key: %s", id, string(key))
+	return c.GetConnByID(id)
+}
 
+// GetConnByID gets a conn to node id, host:port, the pool of a node new to
+// the proxy, e.g. the target of a redirect, is created on first use
+func (c *Cluster) GetConnByID(id string) (Conn, error) {
+	if err := c.allow(id); err != nil {
+		return nil, err
+	}
+	c.l.Lock()
 	pool, ok := c.pools[id]
 	if !ok {
 		// opt一定存在要做个判断
@@ -36,49 +63,226 @@ func (c *Cluster) GetConn(key []byte, slave bool) (Conn, error) {
 		if opt == nil {
 			n := c.topo.GetNode(id)
 			if n == nil {
+				n = nodeFromAddr(id)
+			}
+			if n == nil {
+				c.l.Unlock()
 				return nil, fmt.Errorf("Cluster GetConn ID %s not exists ", id)
 			}
 
-			opt := &Options{
-				Network:      "tcp",
-				Addr:         fmt.Sprintf("%s:%d", n.host, n.port),
-				Dialer:       RedisConnDialer(n.host, n.port, n.id, c.pc),
-				DialTimeout:  c.pc.dialTimeout,
-				ReadTimeout:  c.pc.readTimeout,
-				WriteTimeout: c.pc.writeTimeout,
-				PoolSize:     c.pc.poolSize,
-				IdleTimeout:  c.pc.idleTimeout,
-			}
+			opt = c.nodeOptions(n)
 			c.opts[id] = opt
 		}
 		pool = NewConnPool(opt)
 		c.pools[id] = pool
 	}
+	c.l.Unlock()
+
+	cn, err := pool.Get()
+	if err != nil && err != errPoolTimeout && err != errClosed {
+		c.report(id, true)
+	}
+	return cn, err
+}
+
+// DialConn dials a new connection to the master of key outside the pools,
+// for long lived uses like pub/sub which never give it back
+func (c *Cluster) DialConn(key []byte) (*RedisConn, error) {
+	return c.DialNode(c.topo.GetNodeID(key, false), 0)
+}
+
+// DialNode dials a new connection to node id outside the pools, its reads
+// time out after readTimeout, 0 waits as long as it takes
+func (c *Cluster) DialNode(id string, readTimeout time.Duration) (*RedisConn, error) {
+	if err := c.allow(id); err != nil {
+		return nil, err
+	}
+	n := c.topo.GetNode(id)
+	if n == nil {
+		n = nodeFromAddr(id)
+	}
+	if n == nil {
+		return nil, fmt.Errorf("Cluster DialConn ID %s not exists ", id)
+	}
 
-	return pool.Get()
+	c.l.Lock()
+	pc := c.pc
+	c.l.Unlock()
+	cn, err := RedisConnDialer(n.host, n.port, n.id, pc)()
+	if err != nil {
+		return nil, err
+	}
+	rc := cn.(*RedisConn)
+	if uc, ok := rc.c.(*util.Conn); ok {
+		uc.ReadTimeout = readTimeout
+	}
+	return rc, nil
 }
 
 func (c *Cluster) PutConn(cn Conn) {
+	c.report(cn.ID(), cn.Discard() != nil)
+	c.l.Lock()
 	pool, ok := c.pools[cn.ID()]
+	retired := false
+	if !ok || !pool.Owns(cn) {
+		pool, ok = c.retiredPool(cn)
+		retired = ok
+	}
+	c.l.Unlock()
 	if !ok {
 		log.Warningf("Cluster PutConn %s, belong no pool", cn.ID())
+		cn.Close()
 		return
 	}
 	pool.Put(cn)
+
+	if retired {
+		c.l.Lock()
+		c.forgetRetired(cn.ID())
+		c.l.Unlock()
+	}
 }
 
-// initialize conn Pool before Serve
-func (c *Cluster) initializePool() {
-	log.Info("Cluster start initializePool ", len(c.pc.nodes))
-	nodes := make(map[string]*Node, len(c.pc.nodes))
-	for _, s := range c.topo.slots {
-		if s.master != nil {
-			nodes[s.master.id] = s.master
+// retiredPool finds the retired pool of cn, c.l must be held
+func (c *Cluster) retiredPool(cn Conn) (*ConnPool, bool) {
+	for _, pool := range c.retired[cn.ID()] {
+		if pool.Owns(cn) {
+			return pool, true
 		}
-		for _, n := range s.slaves {
-			nodes[n.id] = n
+	}
+	return nil, false
+}
+
+// forgetRetired drops the retired pools of node id with no conns left,
+// c.l must be held
+func (c *Cluster) forgetRetired(id string) {
+	pools := c.retired[id][:0]
+	for _, pool := range c.retired[id] {
+		if pool.Len() > 0 {
+			pools = append(pools, pool)
 		}
 	}
+	if len(pools) == 0 {
+		delete(c.retired, id)
+	} else {
+		c.retired[id] = pools
+	}
+}
+
+// Reload switches to pc. If the pool settings changed every pool is
+// retired: new conns come from pools made with pc, the conns in use finish
+// their commands and are closed when put back
+func (c *Cluster) Reload(pc *ProxyConfig) {
+	c.l.Lock()
+	old := c.pc
+	c.pc = pc
+	if poolConfigChanged(old, pc) {
+		for id, pool := range c.pools {
+			if pool.Retire(); pool.Len() > 0 {
+				c.retired[id] = append(c.retired[id], pool)
+			}
+		}
+		c.pools = make(map[string]*ConnPool, len(c.pools))
+		c.opts = make(map[string]*Options, len(c.opts))
+	}
+	if !breakerEnabled(pc) {
+		c.breakers = nil
+	}
+	// the new ring starts with every server, the nodes still down leave it
+	var ejected []string
+	for id, b := range c.breakers {
+		if !b.Allow() {
+			ejected = append(ejected, id)
+		}
+	}
+	c.l.Unlock()
+	for _, id := range ejected {
+		c.eject(id, true)
+	}
+
+	c.topo.SetConf(pc)
+	c.topo.Reload()
+}
+
+// poolConfigChanged reports whether the pools made with old differ from
+// the ones made with pc
+func poolConfigChanged(old, pc *ProxyConfig) bool {
+	return old.poolSize != pc.poolSize || old.minIdle != pc.minIdle ||
+		old.maxLifetime != pc.maxLifetime || old.healthCheck != pc.healthCheck ||
+		old.idleTimeout != pc.idleTimeout || old.dialTimeout != pc.dialTimeout ||
+		old.readTimeout != pc.readTimeout || old.writeTimeout != pc.writeTimeout ||
+		old.backendUser != pc.backendUser || old.backendPassword != pc.backendPassword
+}
+
+// PoolStats returns the usage of every backend pool
+func (c *Cluster) PoolStats() []PoolStat {
+	c.l.Lock()
+	defer c.l.Unlock()
+	stats := make([]PoolStat, 0, len(c.pools))
+	for id, pool := range c.pools {
+		stats = append(stats, PoolStat{Node: id, Conns: pool.Len(), Idle: pool.FreeLen()})
+	}
+	return stats
+}
+
+// Close closes every backend pool, waiting for the conns in use first
+func (c *Cluster) Close() {
+	c.l.Lock()
+	defer c.l.Unlock()
+	for id, pool := range c.pools {
+		if err := pool.Close(); err != nil {
+			log.Warningf("Cluster Close pool %s failed %s", id, err)
+		}
+	}
+	for id, pools := range c.retired {
+		for _, pool := range pools {
+			pool.conns.Close()
+		}
+		delete(c.retired, id)
+	}
+}
+
+// nodeOptions are the pool options of node n
+func (c *Cluster) nodeOptions(n *Node) *Options {
+	dialer := RedisConnDialer(n.host, n.port, n.id, c.pc)
+	if n.role == "slave" {
+		dialer = readonlyDialer(dialer)
+	}
+	return &Options{
+		Network:             "tcp",
+		Addr:                fmt.Sprintf("%s:%d", n.host, n.port),
+		Dialer:              dialer,
+		DialTimeout:         c.pc.dialTimeout,
+		ReadTimeout:         c.pc.readTimeout,
+		WriteTimeout:        c.pc.writeTimeout,
+		PoolSize:            c.pc.poolSize,
+		IdleTimeout:         c.pc.idleTimeout,
+		MinIdleConns:        c.pc.minIdle,
+		MaxConnAge:          c.pc.maxLifetime,
+		HealthCheckInterval: c.pc.healthCheck,
+	}
+}
+
+// readonlyDialer sends READONLY on every conn dialer dials, for the pools
+// of slaves. It does no harm if the slave becomes a master
+func readonlyDialer(dialer func() (Conn, error)) func() (Conn, error) {
+	return func() (Conn, error) {
+		cn, err := dialer()
+		if err != nil {
+			return nil, err
+		}
+		if err := cn.(*RedisConn).Readonly(); err != nil {
+			cn.Close()
+			return nil, err
+		}
+		return cn, nil
+	}
+}
+
+// initialize conn Pool before Serve
+func (c *Cluster) initializePool() {
+	log.Info("Cluster start initializePool ", len(c.pc.nodes))
+	nodes := c.topo.allNodes()
 
 	log.Info("initializePool nodes len ", len(nodes))
 	for _, n := range nodes {
@@ -88,16 +292,7 @@ func (c *Cluster) initializePool() {
 			log.Fatalf("Cluster initializePool duplicate %s %s:%d", n.id, n.host, n.port)
 		}
 
-		opt := &Options{
-			Network:      "tcp",
-			Addr:         fmt.Sprintf("%s:%d", n.host, n.port),
-			Dialer:       RedisConnDialer(n.host, n.port, n.id, c.pc),
-			DialTimeout:  c.pc.dialTimeout,
-			ReadTimeout:  c.pc.readTimeout,
-			WriteTimeout: c.pc.writeTimeout,
-			PoolSize:     c.pc.poolSize,
-			IdleTimeout:  c.pc.idleTimeout,
-		}
+		opt := c.nodeOptions(n)
 
 		c.pools[n.id] = NewConnPool(opt)
 		c.opts[n.id] = opt
@@ -2,8 +2,12 @@ package main
 
 import (
 	"flag"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/dongzerun/archer"
+	log "github.com/dongzerun/archer/logging"
 )
 
 var (
@@ -14,5 +18,22 @@ func main() {
 	flag.Parse()
 	pc := archer.NewProxyConfig(*cfg)
 	p := archer.NewProxy(pc)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for s := range sig {
+			if s != syscall.SIGHUP {
+				p.Shutdown()
+				return
+			}
+			// SIGHUP reloads the config
+			if err := p.Reload(); err != nil {
+				log.Warning("reload config failed ", err)
+			}
+		}
+	}()
+
 	p.Start()
+	<-p.Done()
 }
@@ -0,0 +1,362 @@
+package archer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dongzerun/archer/util"
+)
+
+var TimeoutArgError = errors.New("timeout is not a float or out of range")
+
+// RoutePolicy decides which cluster node(s) a command is sent to
+type RoutePolicy int
+
+const (
+	RouteByKey        RoutePolicy = iota // 按 key 的 slot 路由
+	RouteAnyNode                         // 任意节点, 比如 PUBLISH 在集群内会广播, RANDOMKEY 从库也能回答
+	RouteRandomMaster                    // 随机挑选一个持有 slot 的 master
+	RouteAllMasters                      // 广播到所有 master, 比如 SCRIPT LOAD
+)
+
+func (rp RoutePolicy) String() string {
+	switch rp {
+	case RouteByKey:
+		return "key"
+	case RouteAnyNode:
+		return "any"
+	case RouteRandomMaster:
+		return "random-master"
+	case RouteAllMasters:
+		return "all-masters"
+	}
+	return "unknown"
+}
+
+// RoutePolicyOf returns the routing policy applied to command ar
+func RoutePolicyOf(ar *ArrayResp) RoutePolicy {
+	if rp, ok := routePolicies[cmdName(ar)]; ok {
+		return rp
+	}
+	return RouteByKey
+}
+
+// IsShutdown reports whether ar is a SHUTDOWN command
+func IsShutdown(ar *ArrayResp) bool {
+	return cmdName(ar) == "SHUTDOWN"
+}
+
+// IsReplicationStreamCommand reports whether name (upper case) turns the
+// connection into a replication stream, like SYNC and PSYNC
+func IsReplicationStreamCommand(name string) bool {
+	return replicationCommands[name]
+}
+
+// IsHelpSubcommand reports whether ar is a HELP subcommand like OBJECT HELP,
+// the reply is the same on every node so it can be routed to any node
+func IsHelpSubcommand(ar *ArrayResp) bool {
+	if cmdName(ar) == "" || ar.Length() != 1 {
+		return false
+	}
+	sub, ok := ar.Arg(1)
+	return ok && strings.EqualFold(string(sub), "HELP")
+}
+
+// cmdName returns the upper case command name without modifying ar
+func cmdName(ar *ArrayResp) string {
+	name, _ := ar.Command()
+	return name
+}
+
+// CommandFlags returns the CF_* flags of command name, name must be upper case
+func CommandFlags(name string) int {
+	return cmdFlags[name]
+}
+
+func IsReadCommand(name string) bool {
+	return cmdFlags[name]&CF_Read != 0
+}
+
+func IsWriteCommand(name string) bool {
+	return cmdFlags[name]&CF_Write != 0
+}
+
+// IsWriteRequest is IsWriteCommand looking at the options of ar as well,
+// GETEX only writes when EX/PX/EXAT/PXAT/PERSIST changes the TTL,
+// a bare GETEX key is a read and safe for replicas
+func IsWriteRequest(ar *ArrayResp) bool {
+	name := cmdName(ar)
+	switch name {
+	case "GETEX":
+		return len(ar.Args) > 2
+	case "GEORADIUS", "GEORADIUSBYMEMBER":
+		// STORE or STOREDIST
+		return len(CommandKeys(ar)) > 1
+	}
+	return IsWriteCommand(name)
+}
+
+func IsAdminCommand(name string) bool {
+	return cmdFlags[name]&CF_Admin != 0
+}
+
+// CommandKeys returns the keys of command ar, see keyPositions, nil for
+// keyless or unknown commands
+func CommandKeys(ar *ArrayResp) [][]byte {
+	var keys [][]byte
+	for _, i := range keyPositions(ar) {
+		if len(ar.Args[i].Args) == 0 {
+			continue
+		}
+		keys = append(keys, ar.Args[i].Args[0])
+	}
+	return keys
+}
+
+// specRange resolves a keySpecs style spec against a command of n arguments
+func specRange(spec []int, n int) (first, last, step int) {
+	first, last, step = spec[KI_First], spec[KI_Last], spec[KI_Step]
+	if last < 0 {
+		last = n + last
+	}
+	if last >= n {
+		last = n - 1
+	}
+	return
+}
+
+// keyPositions returns the positions of the keys of ar in its arguments,
+// in order: the range of keySpecs, the keys counted by the numkeys of
+// numKeysSpecs, the keys after STREAMS of streamsKeySpecs and the keys
+// after an option of keywordKeySpecs. It's nil for a keyless command, or
+// if a numkeys or STREAMS doesn't fit the arguments
+func keyPositions(ar *ArrayResp) []int {
+	name := cmdName(ar)
+	var pos []int
+	if spec, ok := keySpecs[name]; ok {
+		first, last, step := specRange(spec, len(ar.Args))
+		for i := first; i <= last; i += step {
+			pos = append(pos, i)
+		}
+	}
+
+	if i, ok := numKeysSpecs[name]; ok {
+		arg, _ := ar.Arg(i)
+		n, err := strconv.Atoi(string(arg))
+		if err != nil || n < 0 || i+n >= len(ar.Args) {
+			return nil
+		}
+		for k := i + 1; k <= i+n; k++ {
+			pos = append(pos, k)
+		}
+	}
+
+	if from, ok := streamsKeySpecs[name]; ok {
+		i := findKeyword(ar, from, "STREAMS")
+		rest := len(ar.Args) - i - 1
+		if i < 0 || rest == 0 || rest%2 != 0 {
+			return nil
+		}
+		for k := i + 1; k <= i+rest/2; k++ {
+			pos = append(pos, k)
+		}
+	}
+
+	if spec, ok := keywordKeySpecs[name]; ok {
+		for i := spec.From; i < len(ar.Args)-1; i++ {
+			arg, _ := ar.Arg(i)
+			for _, kw := range spec.Keywords {
+				if strings.EqualFold(string(arg), kw) {
+					pos = append(pos, i+1)
+					i++
+					break
+				}
+			}
+		}
+	}
+	return pos
+}
+
+// findKeyword returns the position of the first argument of ar from from on
+// equal to keyword ignoring case, -1 if there is none
+func findKeyword(ar *ArrayResp, from int, keyword string) int {
+	for i := from; i < len(ar.Args); i++ {
+		if arg, ok := ar.Arg(i); ok && strings.EqualFold(string(arg), keyword) {
+			return i
+		}
+	}
+	return -1
+}
+
+// IsKeyless reports whether command name (upper case) has no key argument,
+// like CONFIG, INFO or SCRIPT. Unknown commands are keyless too, so key
+// rewriters never touch arguments they don't understand
+func IsKeyless(name string) bool {
+	if _, ok := keySpecs[name]; ok {
+		return false
+	}
+	if _, ok := numKeysSpecs[name]; ok {
+		return false
+	}
+	if _, ok := streamsKeySpecs[name]; ok {
+		return false
+	}
+	_, ok := keywordKeySpecs[name]
+	return !ok
+}
+
+// RewriteKeys prefixes the key arguments of ar, see keyPositions, keyless
+// commands are left untouched. It reports whether ar is modified
+func RewriteKeys(ar *ArrayResp, prefix []byte) bool {
+	rewritten := false
+	for _, i := range keyPositions(ar) {
+		if len(ar.Args[i].Args) == 0 {
+			continue
+		}
+		key := make([]byte, 0, len(prefix)+len(ar.Args[i].Args[0]))
+		key = append(key, prefix...)
+		ar.Args[i].Args[0] = append(key, ar.Args[i].Args[0]...)
+		rewritten = true
+	}
+	return rewritten
+}
+
+// OnKeySlot is called with the slot and the upper case name of every
+// command routed by key, e.g. to build slot heat maps
+type OnKeySlot func(slot int, cmd string)
+
+// onKeySlot holds the OnKeySlot of SetOnKeySlot, loaded on every route
+var onKeySlot atomic.Value
+
+// SetOnKeySlot makes routing report to fn from now on, nil stops it. The
+// sessions routing at the same time see either the old or the new fn
+func SetOnKeySlot(fn OnKeySlot) {
+	onKeySlot.Store(fn)
+}
+
+// routeSlot returns the route key of ar and its cluster slot, and reports
+// them to the OnKeySlot set
+func routeSlot(ar *ArrayResp) ([]byte, int) {
+	key := routeKey(ar)
+	slot := int(util.Crc16sum(key) % 16384)
+	if fn, _ := onKeySlot.Load().(OnKeySlot); fn != nil {
+		fn(slot, cmdName(ar))
+	}
+	return key, slot
+}
+
+// keysSlot returns the slot of keys, see keySlot, CrossSlotError if they
+// don't hash to the same slot. keys must not be empty
+func keysSlot(pc *ProxyConfig, keys [][]byte) (int, error) {
+	slot := keySlot(pc, keys[0])
+	for _, key := range keys[1:] {
+		if keySlot(pc, key) != slot {
+			return 0, CrossSlotError
+		}
+	}
+	return slot, nil
+}
+
+// routeKey returns the key used to choose the cluster slot of ar, its first
+// key. Keyless commands are spread by their first argument, a command with
+// key specs but no key, like EVAL with numkeys 0, has no route key
+func routeKey(ar *ArrayResp) []byte {
+	if keys := CommandKeys(ar); len(keys) > 0 {
+		return keys[0]
+	}
+	if !IsKeyless(cmdName(ar)) {
+		return nil
+	}
+	if len(ar.Args) > 1 && len(ar.Args[1].Args) > 0 {
+		return ar.Args[1].Args[0]
+	}
+	return nil
+}
+
+// ClampBlockTimeout rewrites the timeout argument of a blocking command like
+// BLPOP or WAIT when it's over maxSeconds, block forever (0) included.
+// Non blocking commands are left untouched
+func ClampBlockTimeout(ar *ArrayResp, maxSeconds float64) (modified bool, err error) {
+	bt, ok := blockTimeouts[cmdName(ar)]
+	if !ok {
+		return false, nil
+	}
+
+	pos := bt[BT_Pos]
+	if pos < 0 {
+		pos = len(ar.Args) + pos
+	}
+	if pos <= 0 || pos >= len(ar.Args) || len(ar.Args[pos].Args) == 0 {
+		return false, WrongArgumentCount
+	}
+
+	arg := ar.Args[pos].Args[0]
+	timeout, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || timeout < 0 {
+		return false, TimeoutArgError
+	}
+
+	max := maxSeconds * float64(bt[BT_Unit])
+	if timeout != 0 && timeout <= max {
+		return false, nil
+	}
+	if bt[BT_Unit] == 1 {
+		ar.Args[pos].Args[0] = strconv.AppendFloat(nil, max, 'f', -1, 64)
+	} else {
+		// WAIT 只接受整数毫秒
+		ar.Args[pos].Args[0] = strconv.AppendInt(nil, int64(max), 10)
+	}
+	return true, nil
+}
+
+// IsBlockingCommand reports whether name (upper case) may block, like BLPOP
+func IsBlockingCommand(name string) bool {
+	_, ok := blockTimeouts[name]
+	return ok
+}
+
+// BlockTimeout returns the timeout argument of a blocking command, 0 if it
+// blocks forever. Call it after ClampBlockTimeout validated the argument
+func BlockTimeout(ar *ArrayResp) time.Duration {
+	bt, ok := blockTimeouts[cmdName(ar)]
+	if !ok {
+		return 0
+	}
+	pos := bt[BT_Pos]
+	if pos < 0 {
+		pos = len(ar.Args) + pos
+	}
+	arg, _ := ar.Arg(pos)
+	timeout, _ := strconv.ParseFloat(string(arg), 64)
+	return time.Duration(timeout / float64(bt[BT_Unit]) * float64(time.Second))
+}
+
+// RewriteChannels prefixes the channel and pattern arguments of pub/sub
+// commands, so tenants sharing the backend don't see each other's messages.
+// It reports whether ar is a pub/sub command with channels
+func RewriteChannels(ar *ArrayResp, prefix []byte) bool {
+	name := cmdName(ar)
+	if sub, ok := ar.Arg(1); ok && name == "PUBSUB" {
+		name += " " + strings.ToUpper(string(sub))
+	}
+	spec, ok := channelSpecs[name]
+	if !ok {
+		return false
+	}
+
+	first, last, step := specRange(spec, len(ar.Args))
+	rewritten := false
+	for i := first; i <= last; i += step {
+		if len(ar.Args[i].Args) == 0 {
+			continue
+		}
+		ch := make([]byte, 0, len(prefix)+len(ar.Args[i].Args[0]))
+		ch = append(ch, prefix...)
+		ar.Args[i].Args[0] = append(ch, ar.Args[i].Args[0]...)
+		rewritten = true
+	}
+	return rewritten
+}
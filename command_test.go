@@ -0,0 +1,468 @@
+package archer
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCommand(args ...string) *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	for _, a := range args {
+		br := &BulkResp{}
+		br.Rtype = BulkType
+		br.Args = [][]byte{[]byte(a)}
+		ar.Args = append(ar.Args, br)
+	}
+	return ar
+}
+
+func TestRoutePolicyOf(t *testing.T) {
+	tests := []struct {
+		cmd    *ArrayResp
+		policy RoutePolicy
+	}{
+		{newCommand("RANDOMKEY"), RouteAnyNode},
+		{newCommand("publish", "news", "hello"), RouteAnyNode},
+		{newCommand("SCRIPT", "LOAD", "return 1"), RouteAllMasters},
+		{newCommand("GET", "foo"), RouteByKey},
+	}
+
+	for _, tt := range tests {
+		if got := RoutePolicyOf(tt.cmd); got != tt.policy {
+			t.Fatalf("RoutePolicyOf(%s) = %s, want %s", tt.cmd.String(), got, tt.policy)
+		}
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		cmd  *ArrayResp
+		keys string
+	}{
+		{newCommand("TYPE", "foo"), "foo"},
+		{newCommand("type", "{user}:1"), "{user}:1"},
+		{newCommand("MSET", "a", "1", "b", "2"), "a b"},
+		{newCommand("BLPOP", "l1", "l2", "0"), "l1 l2"},
+		{newCommand("BITOP", "AND", "dest", "k1", "k2"), "dest k1 k2"},
+		{newCommand("PING"), ""},
+	}
+
+	for _, tt := range tests {
+		keys := CommandKeys(tt.cmd)
+		var got []string
+		for _, k := range keys {
+			got = append(got, string(k))
+		}
+		if strings.Join(got, " ") != tt.keys {
+			t.Fatalf("CommandKeys(%s) = %v, want %s", tt.cmd.String(), got, tt.keys)
+		}
+	}
+
+	if !IsReadCommand("TYPE") || IsWriteCommand("TYPE") {
+		t.Fatal("TYPE must be a read command")
+	}
+	if k := routeKey(newCommand("TYPE", "foo")); string(k) != "foo" {
+		t.Fatal(string(k))
+	}
+}
+
+func TestIsHelpSubcommand(t *testing.T) {
+	if !IsHelpSubcommand(newCommand("OBJECT", "help")) || !IsHelpSubcommand(newCommand("config", "HELP")) {
+		t.Fatal("HELP subcommand not detected")
+	}
+	if IsHelpSubcommand(newCommand("OBJECT", "ENCODING", "help")) || IsHelpSubcommand(newCommand("HELP")) {
+		t.Fatal("not a HELP subcommand")
+	}
+
+	// redis 6+ replies HELP with simple strings
+	r := readResp(t, "*2\r\n+OBJECT <subcommand> [<arg> ...]. Subcommands are:\r\n$4\r\nHELP\r\n")
+	if r.Length() != 1 || r.(*ArrayResp).Elems == nil {
+		t.Fatal(r.String())
+	}
+}
+
+func TestStringRangeCommands(t *testing.T) {
+	if !IsReadCommand("GETRANGE") || IsWriteCommand("GETRANGE") {
+		t.Fatal("GETRANGE must be a read command")
+	}
+	if !IsWriteCommand("SETRANGE") || IsReadCommand("SETRANGE") {
+		t.Fatal("SETRANGE must be a write command")
+	}
+
+	f := &StrFilter{}
+	for _, cmd := range []*ArrayResp{
+		newCommand("getrange", "foo", "0", "-1"),
+		newCommand("SETRANGE", "foo", "6", "redis"),
+	} {
+		if _, err := f.Inspect(cmd); err != nil {
+			t.Fatalf("Inspect(%s): %s", cmd.String(), err)
+		}
+		if RoutePolicyOf(cmd) != RouteByKey {
+			t.Fatalf("%s must be routed by key", cmd.String())
+		}
+		keys := CommandKeys(cmd)
+		if len(keys) != 1 || string(keys[0]) != "foo" || string(routeKey(cmd)) != "foo" {
+			t.Fatalf("CommandKeys(%s) = %q", cmd.String(), keys)
+		}
+	}
+
+	if _, err := f.Inspect(newCommand("GETRANGE", "foo", "0")); err != WrongArgumentCount {
+		t.Fatalf("expect WrongArgumentCount, got %v", err)
+	}
+}
+
+func TestIsReplicationStreamCommand(t *testing.T) {
+	for _, name := range []string{"SYNC", "PSYNC", "REPLCONF"} {
+		if !IsReplicationStreamCommand(name) {
+			t.Fatalf("%s not detected", name)
+		}
+		if !IsAdminCommand(name) {
+			t.Fatalf("%s must be an admin command", name)
+		}
+	}
+	for _, name := range []string{"GET", "SLAVEOF", "REPLICAOF", ""} {
+		if IsReplicationStreamCommand(name) {
+			t.Fatalf("%s is not a replication command", name)
+		}
+	}
+
+	if !IsReplicationStreamCommand(cmdName(newCommand("psync", "?", "-1"))) {
+		t.Fatal("lower case PSYNC not detected")
+	}
+	if _, err := (&StrFilter{}).Inspect(newCommand("REPLCONF", "listening-port", "6380")); err != CommandForbidden {
+		t.Fatalf("REPLCONF must be forbidden, got %v", err)
+	}
+}
+
+func TestOnKeySlot(t *testing.T) {
+	// nil hook is fine
+	if _, slot := routeSlot(newCommand("GET", "foo")); slot != 12182 {
+		t.Fatal(slot)
+	}
+
+	var got []string
+	SetOnKeySlot(func(slot int, cmd string) {
+		got = append(got, cmd+":"+strconv.Itoa(slot))
+	})
+	t.Cleanup(func() { SetOnKeySlot(nil) })
+
+	for _, cmd := range []*ArrayResp{
+		newCommand("GET", "foo"),
+		newCommand("set", "bar", "1"),
+		newCommand("HGET", "{user1000}.following", "f"),
+		newCommand("HGET", "{user1000}.followers", "f"),
+	} {
+		routeSlot(cmd)
+	}
+	if strings.Join(got, " ") != "GET:12182 SET:5061 HGET:3443 HGET:3443" {
+		t.Fatal(got)
+	}
+}
+
+func TestExpireOptions(t *testing.T) {
+	f := &StrFilter{}
+	for _, name := range []string{"EXPIRE", "PEXPIRE", "EXPIREAT", "PEXPIREAT"} {
+		cmd := newCommand(name, "foo", "100", "NX")
+		if _, err := f.Inspect(cmd); err != nil {
+			t.Fatalf("Inspect(%s): %s", cmd.String(), err)
+		}
+		keys := CommandKeys(cmd)
+		if len(keys) != 1 || string(keys[0]) != "foo" {
+			t.Fatalf("CommandKeys(%s) = %q", cmd.String(), keys)
+		}
+		if !IsWriteCommand(name) {
+			t.Fatalf("%s must be a write command", name)
+		}
+		if _, err := f.Inspect(newCommand(name, "foo", "100", "NX", "GT")); err != WrongArgumentCount {
+			t.Fatalf("expect WrongArgumentCount, got %v", err)
+		}
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	f := &StrFilter{}
+	for _, cmd := range []*ArrayResp{
+		newCommand("SET", "foo", "bar", "EX", "10"),
+		newCommand("SET", "foo", "bar", "GET"),
+		newCommand("SET", "foo", "bar", "NX", "GET", "PXAT", "1700000000000"),
+		newCommand("SET", "foo", "bar", "XX", "KEEPTTL"),
+		newCommand("SETEX", "foo", "10", "bar"),
+		newCommand("PSETEX", "foo", "10000", "bar"),
+	} {
+		if _, err := f.Inspect(cmd); err != nil {
+			t.Fatalf("Inspect(%s): %s", cmd.String(), err)
+		}
+		keys := CommandKeys(cmd)
+		if len(keys) != 1 || string(keys[0]) != "foo" {
+			t.Fatalf("CommandKeys(%s) = %q", cmd.String(), keys)
+		}
+		if name := cmdName(cmd); !IsWriteCommand(name) || IsReadCommand(name) {
+			t.Fatalf("%s must be a write command", name)
+		}
+	}
+}
+
+func TestClampBlockTimeout(t *testing.T) {
+	tests := []struct {
+		cmd      *ArrayResp
+		modified bool
+		result   string
+	}{
+		{newCommand("BLPOP", "l1", "l2", "100"), true, "BLPOP l1 l2 30"},
+		{newCommand("blpop", "l1", "0"), true, "blpop l1 30"},
+		{newCommand("BLPOP", "l1", "l2", "2.5"), false, "BLPOP l1 l2 2.5"},
+		{newCommand("BLPOP", "l1", "30"), false, "BLPOP l1 30"},
+		{newCommand("BLMPOP", "100", "1", "l1", "LEFT"), true, "BLMPOP 30 1 l1 LEFT"},
+		{newCommand("WAIT", "1", "60000"), true, "WAIT 1 30000"},
+		{newCommand("GET", "100"), false, "GET 100"},
+	}
+
+	for _, tt := range tests {
+		modified, err := ClampBlockTimeout(tt.cmd, 30)
+		if err != nil || modified != tt.modified || tt.cmd.String() != tt.result {
+			t.Fatalf("got %v %v %q, want %v %q", modified, err, tt.cmd.String(), tt.modified, tt.result)
+		}
+	}
+
+	if _, err := ClampBlockTimeout(newCommand("BLPOP", "l1", "soon"), 30); err != TimeoutArgError {
+		t.Fatal(err)
+	}
+	if _, err := ClampBlockTimeout(newCommand("BLPOP"), 30); err != WrongArgumentCount {
+		t.Fatal(err)
+	}
+}
+
+func TestBlockTimeout(t *testing.T) {
+	tests := []struct {
+		cmd     *ArrayResp
+		timeout time.Duration
+	}{
+		{newCommand("BLPOP", "l1", "l2", "2.5"), 2500 * time.Millisecond},
+		{newCommand("BLPOP", "l1", "0"), 0},
+		{newCommand("BLMPOP", "3", "1", "l1", "LEFT"), 3 * time.Second},
+		{newCommand("WAIT", "1", "1500"), 1500 * time.Millisecond},
+		{newCommand("GET", "100"), 0},
+	}
+	for _, tt := range tests {
+		if got := BlockTimeout(tt.cmd); got != tt.timeout {
+			t.Fatalf("%s timeout %s, want %s", tt.cmd, got, tt.timeout)
+		}
+	}
+	if !IsBlockingCommand("BLMOVE") || IsBlockingCommand("LPOP") {
+		t.Fatal("IsBlockingCommand")
+	}
+}
+
+func TestRewriteChannels(t *testing.T) {
+	tests := []struct {
+		cmd       *ArrayResp
+		rewritten bool
+		result    string
+	}{
+		{newCommand("PUBLISH", "news", "hello"), true, "PUBLISH t1:news hello"},
+		{newCommand("psubscribe", "news.*", "sport.*"), true, "psubscribe t1:news.* t1:sport.*"},
+		{newCommand("SUBSCRIBE", "a"), true, "SUBSCRIBE t1:a"},
+		{newCommand("PUBSUB", "numsub", "a", "b"), true, "PUBSUB numsub t1:a t1:b"},
+		{newCommand("PUBSUB", "CHANNELS", "n*"), true, "PUBSUB CHANNELS t1:n*"},
+		{newCommand("PUBSUB", "NUMPAT"), false, "PUBSUB NUMPAT"},
+		{newCommand("UNSUBSCRIBE"), false, "UNSUBSCRIBE"},
+		{newCommand("GET", "news"), false, "GET news"},
+	}
+
+	for _, tt := range tests {
+		rewritten := RewriteChannels(tt.cmd, []byte("t1:"))
+		if rewritten != tt.rewritten || tt.cmd.String() != tt.result {
+			t.Fatalf("got %v %q, want %v %q", rewritten, tt.cmd.String(), tt.rewritten, tt.result)
+		}
+	}
+}
+
+func TestIsKeyless(t *testing.T) {
+	for _, name := range []string{"CONFIG", "INFO", "SCRIPT", "CLUSTER", "PING", "NOSUCHCMD"} {
+		if !IsKeyless(name) {
+			t.Fatalf("%s must be keyless", name)
+		}
+	}
+	if IsKeyless("GET") || IsKeyless("MSET") {
+		t.Fatal("GET and MSET have keys")
+	}
+
+	cmd := newCommand("CONFIG", "GET", "maxmemory")
+	if RewriteKeys(cmd, []byte("t1:")) || cmd.String() != "CONFIG GET maxmemory" {
+		t.Fatalf("CONFIG GET must not be rewritten: %s", cmd.String())
+	}
+	cmd = newCommand("GET", "foo")
+	if !RewriteKeys(cmd, []byte("t1:")) || cmd.String() != "GET t1:foo" {
+		t.Fatalf("GET key must be rewritten: %s", cmd.String())
+	}
+	cmd = newCommand("MSET", "a", "1", "b", "2")
+	if !RewriteKeys(cmd, []byte("t1:")) || cmd.String() != "MSET t1:a 1 t1:b 2" {
+		t.Fatal(cmd.String())
+	}
+}
+
+func TestHashFieldExpire(t *testing.T) {
+	f := &StrFilter{}
+	for _, cmd := range []*ArrayResp{
+		newCommand("HEXPIRE", "h", "100", "FIELDS", "2", "f1", "f2"),
+		newCommand("HEXPIRE", "h", "100", "NX", "FIELDS", "1", "f1"),
+		newCommand("HTTL", "h", "FIELDS", "2", "f1", "f2"),
+		newCommand("HPERSIST", "h", "FIELDS", "1", "f1"),
+	} {
+		if _, err := f.Inspect(cmd); err != nil {
+			t.Fatalf("Inspect(%s): %s", cmd.String(), err)
+		}
+		keys := CommandKeys(cmd)
+		if len(keys) != 1 || string(keys[0]) != "h" {
+			t.Fatalf("CommandKeys(%s) = %q", cmd.String(), keys)
+		}
+	}
+
+	if !IsWriteCommand("HEXPIRE") || !IsWriteCommand("HPERSIST") || !IsReadCommand("HTTL") || IsWriteCommand("HTTL") {
+		t.Fatal("wrong classification")
+	}
+	if _, err := f.Inspect(newCommand("HEXPIRE", "h", "100", "FIELDS", "1")); err != WrongArgumentCount {
+		t.Fatal(err)
+	}
+}
+
+func TestDefaultDenyTable(t *testing.T) {
+	f := &StrFilter{Deny: DefaultDenyTable(false)}
+	for _, cmd := range []*ArrayResp{
+		newCommand("debug", "quicklist-packed-threshold", "100"),
+		newCommand("DEBUG", "SLEEP", "0"),
+		newCommand("CLUSTER", "reset", "hard"),
+		newCommand("FAILOVER"),
+	} {
+		if !f.Deny.Denied(cmd) {
+			t.Fatalf("%s should be denied", cmd.String())
+		}
+	}
+	if f.Deny.Denied(newCommand("CLUSTER", "NODES")) || f.Deny.Denied(newCommand("FLUSHDB")) {
+		t.Fatal("CLUSTER NODES and FLUSHDB are allowed by default")
+	}
+	if _, err := f.Inspect(newCommand("CLUSTER", "RESET")); err != CommandForbidden {
+		t.Fatal(err)
+	}
+	if _, err := f.Inspect(newCommand("GET", "foo")); err != nil {
+		t.Fatal(err)
+	}
+
+	if !DefaultDenyTable(true).Denied(newCommand("flushall", "async")) {
+		t.Fatal("strict denies FLUSHALL")
+	}
+
+	f.Deny.Allow("cluster reset")
+	f.Deny.Deny("cluster nodes")
+	if f.Deny.Denied(newCommand("CLUSTER", "RESET")) || !f.Deny.Denied(newCommand("cluster", "nodes")) {
+		t.Fatal("customized table")
+	}
+
+	var none DenyTable
+	if none.Denied(newCommand("DEBUG", "SLEEP", "0")) {
+		t.Fatal("nil table denies nothing")
+	}
+}
+
+func TestGetExClassification(t *testing.T) {
+	f := &StrFilter{}
+	tests := []struct {
+		cmd   *ArrayResp
+		write bool
+	}{
+		{newCommand("GETEX", "key"), false},
+		{newCommand("getex", "key", "EX", "10"), true},
+		{newCommand("GETEX", "key", "PXAT", "1700000000000"), true},
+		{newCommand("GETEX", "key", "PERSIST"), true},
+	}
+	for _, tt := range tests {
+		if _, err := f.Inspect(tt.cmd); err != nil {
+			t.Fatalf("Inspect(%s): %s", tt.cmd.String(), err)
+		}
+		if IsWriteRequest(tt.cmd) != tt.write {
+			t.Fatalf("IsWriteRequest(%s) != %v", tt.cmd.String(), tt.write)
+		}
+		if keys := CommandKeys(tt.cmd); len(keys) != 1 || string(keys[0]) != "key" {
+			t.Fatalf("keys of %s: %q", tt.cmd.String(), keys)
+		}
+	}
+	if _, err := f.Inspect(newCommand("GETEX", "key", "EX", "10", "PERSIST")); err != WrongArgumentCount {
+		t.Fatal(err)
+	}
+	if !IsWriteRequest(newCommand("SET", "a", "b")) || IsWriteRequest(newCommand("GET", "a")) {
+		t.Fatal("other commands follow IsWriteCommand")
+	}
+
+	// the reply is the value, or null for a missing key
+	if b, ok := readResp(t, "$1\r\nv\r\n").(*BulkResp).Bytes(); !ok || string(b) != "v" {
+		t.Fatal(string(b), ok)
+	}
+	if !IsNull(readResp(t, "$-1\r\n")) {
+		t.Fatal("missing key")
+	}
+}
+
+func TestKeyPositions(t *testing.T) {
+	tests := []struct {
+		cmd  *ArrayResp
+		keys string
+	}{
+		{newCommand("GEORADIUS", "g", "15", "37", "200", "km"), "g"},
+		{newCommand("GEORADIUS", "g", "15", "37", "200", "km", "WITHDIST", "store", "dst", "STOREDIST", "dd"), "g dst dd"},
+		{newCommand("GEORADIUSBYMEMBER", "g", "STORE", "100", "km"), "g"},
+		{newCommand("GEOSEARCHSTORE", "dst", "src", "FROMMEMBER", "m", "BYRADIUS", "1", "km"), "dst src"},
+		{newCommand("XADD", "s", "*", "f", "v"), "s"},
+		{newCommand("XREAD", "COUNT", "2", "STREAMS", "s1", "s2", "0", "0"), "s1 s2"},
+		{newCommand("XREADGROUP", "GROUP", "g", "c", "streams", "s1", ">"), "s1"},
+		{newCommand("XREAD", "STREAMS", "s1", "s2", "0"), ""},
+		{newCommand("ZADD", "z", "1", "m"), "z"},
+		{newCommand("ZUNIONSTORE", "dst", "2", "z1", "z2", "WEIGHTS", "1", "2"), "dst z1 z2"},
+		{newCommand("ZUNIONSTORE", "dst", "3", "z1"), ""},
+		{newCommand("BZMPOP", "1", "2", "z1", "z2", "MIN"), "z1 z2"},
+		{newCommand("OBJECT", "ENCODING", "k"), "k"},
+		{newCommand("OBJECT", "HELP"), ""},
+		{newCommand("EVAL", "return 1", "1", "k", "arg"), "k"},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, k := range CommandKeys(tt.cmd) {
+			got = append(got, string(k))
+		}
+		if strings.Join(got, " ") != tt.keys {
+			t.Fatalf("CommandKeys(%s) = %v, want %s", tt.cmd.String(), got, tt.keys)
+		}
+	}
+
+	// the route key is the first key, not argument 1
+	if k := routeKey(newCommand("XREAD", "COUNT", "1", "STREAMS", "s", "0")); string(k) != "s" {
+		t.Fatalf("XREAD routed by %q", k)
+	}
+	if k := routeKey(newCommand("EVAL", "return 1", "0")); k != nil {
+		t.Fatalf("EVAL without keys routed by %q", k)
+	}
+	if k := routeKey(newCommand("ZUNIONSTORE", "{z}dst", "1", "{z}1")); string(k) != "{z}dst" {
+		t.Fatalf("ZUNIONSTORE routed by %q", k)
+	}
+	_, a := routeSlot(newCommand("GEOADD", "{user}:geo", "15", "37", "m"))
+	_, b := routeSlot(newCommand("XADD", "{user}:events", "*", "f", "v"))
+	if a != b {
+		t.Fatal("keys of a hash tag in different slots")
+	}
+
+	if IsKeyless("XREAD") || IsKeyless("GEORADIUS") || IsKeyless("ZINTER") {
+		t.Fatal("commands with movable keys are not keyless")
+	}
+	if IsWriteRequest(newCommand("GEORADIUS", "g", "15", "37", "200", "km")) {
+		t.Fatal("GEORADIUS without STORE is a read")
+	}
+	if !IsWriteRequest(newCommand("GEORADIUS", "g", "15", "37", "200", "km", "STORE", "dst")) {
+		t.Fatal("GEORADIUS STORE is a write")
+	}
+	cmd := newCommand("GEORADIUS", "g", "15", "37", "200", "km", "STORE", "dst")
+	if !RewriteKeys(cmd, []byte("t:")) || cmd.String() != "GEORADIUS t:g 15 37 200 km STORE t:dst" {
+		t.Fatal(cmd.String())
+	}
+}
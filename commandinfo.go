@@ -0,0 +1,151 @@
+package archer
+
+import (
+	"errors"
+	"strings"
+)
+
+var NoKeyArgumentsError = errors.New("the command has no key arguments")
+
+// CommandSpec is one entry of COMMAND INFO:
+// name, arity, flags, first key, last key, key step
+type CommandSpec struct {
+	Name     string // lower case like redis
+	Arity    int    // negative means at least -Arity arguments
+	Flags    []string
+	FirstKey int
+	LastKey  int
+	Step     int
+}
+
+// CommandTable maps upper case command names to their spec
+type CommandTable map[string]*CommandSpec
+
+// DefaultCommandTable builds the table from the proxy rules, blacklisted
+// commands are left out since the proxy never runs them
+func DefaultCommandTable() CommandTable {
+	table := make(CommandTable, len(reqrules))
+	for name, rule := range reqrules {
+		if blackList[name] {
+			continue
+		}
+
+		spec := &CommandSpec{Name: strings.ToLower(name)}
+		min, max := rule[RI_MinCount].(int), rule[RI_MaxCount].(int)
+		spec.Arity = min
+		if min != max {
+			spec.Arity = -min
+		}
+
+		flags := cmdFlags[name]
+		if flags&CF_Write != 0 {
+			spec.Flags = append(spec.Flags, "write")
+		}
+		if flags&CF_Read != 0 {
+			spec.Flags = append(spec.Flags, "readonly")
+		}
+		if flags&CF_Admin != 0 {
+			spec.Flags = append(spec.Flags, "admin")
+		}
+
+		if ks, ok := keySpecs[name]; ok {
+			spec.FirstKey, spec.LastKey, spec.Step = ks[KI_First], ks[KI_Last], ks[KI_Step]
+		}
+		if hasMovableKeys(name) {
+			spec.Flags = append(spec.Flags, "movablekeys")
+		}
+		table[name] = spec
+	}
+	return table
+}
+
+// hasMovableKeys reports whether the keys of command name are found by
+// parsing its arguments, like the numkeys of EVAL
+func hasMovableKeys(name string) bool {
+	_, numkeys := numKeysSpecs[name]
+	_, streams := streamsKeySpecs[name]
+	_, keyword := keywordKeySpecs[name]
+	return numkeys || streams || keyword
+}
+
+// Resp encodes spec the way redis replies COMMAND INFO
+func (spec *CommandSpec) Resp() *ArrayResp {
+	flags := &ArrayResp{}
+	flags.Rtype = ArrayType
+	flags.Elems = []Resp{}
+	for _, f := range spec.Flags {
+		flags.Elems = append(flags.Elems, NewSimpleResp([]byte(f)))
+	}
+
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Elems = []Resp{
+		NewBulkResp([]byte(spec.Name)),
+		NewIntResp(int64(spec.Arity)),
+		flags,
+		NewIntResp(int64(spec.FirstKey)),
+		NewIntResp(int64(spec.LastKey)),
+		NewIntResp(int64(spec.Step)),
+	}
+	return ar
+}
+
+// BuildCommandInfoReply builds the reply of COMMAND INFO names...,
+// unknown commands get a null element like redis does
+func BuildCommandInfoReply(names []string, table CommandTable) *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Elems = make([]Resp, 0, len(names))
+	for _, name := range names {
+		spec, ok := table[strings.ToUpper(name)]
+		if !ok {
+			ar.Elems = append(ar.Elems, NewNullBulkResp())
+			continue
+		}
+		ar.Elems = append(ar.Elems, spec.Resp())
+	}
+	return ar
+}
+
+// KeyFlags returns the access flags of the keys of command name (upper case)
+// as COMMAND GETKEYSANDFLAGS replies them, like RO access or RW access update
+func KeyFlags(name string) []string {
+	if flags, ok := keyFlags[name]; ok {
+		return flags
+	}
+	if IsWriteCommand(name) {
+		return []string{"RW", "access", "update"}
+	}
+	return []string{"RO", "access"}
+}
+
+// BuildGetKeysAndFlags builds the reply of COMMAND GETKEYSANDFLAGS for ar:
+// one [key, [flag ...]] pair per key
+func BuildGetKeysAndFlags(ar *ArrayResp) (*ArrayResp, error) {
+	name := cmdName(ar)
+	if _, ok := cmdFlags[name]; !ok {
+		return nil, BadCommandError
+	}
+	if IsKeyless(name) {
+		return nil, NoKeyArgumentsError
+	}
+
+	flags := KeyFlags(name)
+	reply := &ArrayResp{}
+	reply.Rtype = ArrayType
+	reply.Elems = []Resp{}
+	for _, key := range CommandKeys(ar) {
+		fr := &ArrayResp{}
+		fr.Rtype = ArrayType
+		fr.Elems = make([]Resp, 0, len(flags))
+		for _, f := range flags {
+			fr.Elems = append(fr.Elems, NewSimpleResp([]byte(f)))
+		}
+
+		pair := &ArrayResp{}
+		pair.Rtype = ArrayType
+		pair.Elems = []Resp{NewBulkResp(key), fr}
+		reply.Elems = append(reply.Elems, pair)
+	}
+	return reply, nil
+}
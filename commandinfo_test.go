@@ -0,0 +1,59 @@
+package archer
+
+import (
+	"testing"
+)
+
+func TestBuildCommandInfoReply(t *testing.T) {
+	table := DefaultCommandTable()
+	if _, ok := table["SYNC"]; ok {
+		t.Fatal("blacklisted commands must not be listed")
+	}
+
+	ar := BuildCommandInfoReply([]string{"get", "NOSUCHCMD", "MSET"}, table)
+	want := "*3\r\n" +
+		"*6\r\n$3\r\nget\r\n:2\r\n*1\r\n+readonly\r\n:1\r\n:1\r\n:1\r\n" +
+		"$-1\r\n" +
+		"*6\r\n$4\r\nmset\r\n:-3\r\n*1\r\n+write\r\n:1\r\n:-1\r\n:2\r\n"
+	if got := encodeResp(t, ar); got != want {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+
+	if flags := table["EVAL"].Flags; len(flags) != 2 || flags[1] != "movablekeys" {
+		t.Fatalf("EVAL flags %v", flags)
+	}
+
+	// a custom table
+	table = CommandTable{"FOO": {Name: "foo", Arity: 1, Flags: []string{}}}
+	ar = BuildCommandInfoReply([]string{"foo", "get"}, table)
+	if got := encodeResp(t, ar); got != "*2\r\n*6\r\n$3\r\nfoo\r\n:1\r\n*0\r\n:0\r\n:0\r\n:0\r\n$-1\r\n" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestBuildGetKeysAndFlags(t *testing.T) {
+	tests := []struct {
+		cmd   *ArrayResp
+		reply string
+	}{
+		{newCommand("SET", "k", "v"), "*1\r\n*2\r\n$1\r\nk\r\n*3\r\n+RW\r\n+access\r\n+update\r\n"},
+		{newCommand("get", "k"), "*1\r\n*2\r\n$1\r\nk\r\n*2\r\n+RO\r\n+access\r\n"},
+		{newCommand("MSET", "a", "1", "b", "2"), "*2\r\n*2\r\n$1\r\na\r\n*2\r\n+OW\r\n+update\r\n*2\r\n$1\r\nb\r\n*2\r\n+OW\r\n+update\r\n"},
+	}
+	for _, tt := range tests {
+		ar, err := BuildGetKeysAndFlags(tt.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := encodeResp(t, ar); got != tt.reply {
+			t.Fatalf("%s: got %q want %q", tt.cmd.String(), got, tt.reply)
+		}
+	}
+
+	if _, err := BuildGetKeysAndFlags(newCommand("PING")); err != NoKeyArgumentsError {
+		t.Fatal(err)
+	}
+	if _, err := BuildGetKeysAndFlags(newCommand("NOSUCHCMD", "k")); err != BadCommandError {
+		t.Fatal(err)
+	}
+}
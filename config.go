@@ -1,8 +1,9 @@
 package archer
 
 import (
-	"net/http"
-	_ "net/http/pprof"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"os"
 	"runtime"
 	"runtime/pprof"
@@ -10,24 +11,98 @@ import (
 	"time"
 
 	"github.com/astaxie/beego/config"
-	log "github.com/ngaut/logging"
+	log "github.com/dongzerun/archer/logging"
+)
+
+const (
+	ShutdownReject = "reject" // SHUTDOWN 返回错误
+	ShutdownProxy  = "proxy"  // SHUTDOWN 关闭代理自身, 只用于可信环境
+)
+
+// 读命令的路由策略, 写命令永远发给 master
+const (
+	ReadPrimaryOnly   = "primary-only"   // 读写都走 master
+	ReadPreferReplica = "prefer-replica" // 读走第一个 slave, 没有或连不上走 master
+	ReadRoundRobin    = "round-robin"    // 读在 slave 之间轮询, 没有或连不上走 master
 )
 
 type ProxyConfig struct {
+	file string // 配置文件, Reload 重新读取
+
 	//proxy
 	name        string
 	port        int
+	unixSocket  string // also listen on this unix socket, empty for none
+	unixPerm    os.FileMode
 	cpu         int
 	slaveOk     bool
+	readPolicy  string // primary-only, prefer-replica or round-robin
 	maxConn     int
 	conCurrency int
 	pipeLength  int
+	// memcached text protocol clients on this port, 0 for none
+	memcachePort int
+	// clients silent for clientTimeout are closed, 0 never. Subscribers
+	// and clients waiting for a reply are not silent
+	clientTimeout time.Duration
+	// TCP keepalive period of the clients, 0 disables it
+	tcpKeepAlive time.Duration
+
+	shutdownPolicy  string         // reject or proxy
+	shutdownTimeout time.Duration  // in-flight commands finish within it on shutdown
+	shutdownReply   bool           // reply ShuttingDownError to new commands on shutdown
+	strict          bool           // deny FLUSHALL and FLUSHDB as well
+	deny            []string       // more commands to deny, "NAME" or "NAME SUBCOMMAND"
+	policy          *CommandPolicy // blocked and renamed commands, nil for none
+	maxPendingBytes int64          // max bytes of replies waiting for a slow client, 0 no limit
+	maxBlockTimeout time.Duration  // cap of the timeout of blocking commands, 0 no cap
+	maxReplyBytes   int64          // max bytes of one frame, 0 no limit
+	maxBulkLen      int            // parser limits, 0 keeps the default
+	maxArrayLen     int
+	maxDepth        int
+	maxLineLen      int
+	strictInline    bool   // inline commands must end in \r\n too
+	password        string // AUTH password of the default user, empty no password
+
+	slowlogSlowerThan time.Duration // negative logs nothing, 0 logs every command
+	slowlogMaxLen     int           // entries kept, 0 disables the slowlog
+
+	hotKeys        int           // top keys reported per interval, 0 disables it
+	hotKeyInterval time.Duration // keys are counted afresh every interval
+	hotKeySample   int           // count 1 of hotkeysample accesses
 
 	//redis
-	nodes      []string
-	kickOff    []string //TODO: handle kickOff nodes
+	nodes      []string // seeds of the slot map, never changed once loaded
 	poolSize   int
 	reloadSlot time.Duration
+	// node host:port => unix socket it is dialed over instead of tcp
+	unixSockets map[string]string
+	// cluster or ketama, with ketama keys go to the standalone servers of
+	// ring and nodes is not used
+	distribution string
+	ring         *Ketama
+	// MOVED/ASK followed for one command before giving up, 0 follows none
+	maxRedirects int
+	// backend pool: idle conns kept open, max age of a conn (0 no limit),
+	// period of the PING health check of idle conns
+	minIdle     int
+	maxLifetime time.Duration
+	healthCheck time.Duration
+	// circuit breaker of every node: open when failures/requests over
+	// breakerWindow reach breakerRatio with breakerMin requests, 0 ratio
+	// disables it. An open node is probed every breakerCooldown
+	breakerRatio    float64
+	breakerMin      int
+	breakerWindow   time.Duration
+	breakerCooldown time.Duration
+	// with ketama the keys of a node open go to the next servers
+	autoEject bool
+	// credentials of the backends, user is empty for the default user
+	backendUser     string
+	backendPassword string
+
+	// TLS of the backends, nil means plaintext
+	backendTLS *tls.Config
 
 	//common
 	idleTimeout  time.Duration
@@ -35,72 +110,245 @@ type ProxyConfig struct {
 	writeTimeout time.Duration
 	dialTimeout  time.Duration
 
+	//tls of the client listener, nil means plaintext
+	tls *tls.Config
+
+	//ratelimit, per second, 0 no limit. bytes count requests and replies
+	limitQPS         float64
+	limitBytes       float64
+	limitClientQPS   float64
+	limitClientBytes float64
+	limitPer         string // ip or conn
+	limitMode        string // reject or delay
+	limitReply       string // error replied in reject mode
+
+	//cache of read replies, 0 entries disables it
+	cacheSize     int
+	cacheTTL      time.Duration
+	cacheMaxBytes int64    // bigger replies are not cached, 0 no limit
+	cacheCommands []string // upper case names of the cached commands
+
+	//trace, OTLP/HTTP endpoint of the collector, empty disables tracing
+	traceEndpoint string
+	traceService  string
+	traceRatio    float64 // share of commands sampled, 0 to 1
+
+	//acl, user => rules
+	aclRules map[string]string
+
 	//log
-	logLevel string
-	logFile  string
+	logLevel  string
+	logFile   string
+	logFormat string // text or json
+	// audit log of every command, of every client with auditAll, of the
+	// clients switched on by the admin API otherwise
+	auditAll        bool
+	auditFile       string // empty writes next to the log
+	auditKeys       int    // keys sampled per command
+	auditRedactKeys bool   // keys are logged as a hash
 
 	//debug
 	cpuFile string
 	memFile string
+	// http server of metrics, pprof, the admin API and reload, empty for none
+	adminAddr string
+	// bearer token of the admin API and reload, empty refuses them
+	adminToken string
 }
 
 func NewProxyConfig(file string) *ProxyConfig {
+	pc, err := LoadProxyConfig(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pc.apply()
+	log.Info("NewProxyConfig ", pc)
+	return pc
+}
+
+// LoadProxyConfig reads and checks file without applying it, NewProxyConfig
+// and Proxy.Reload share it
+func LoadProxyConfig(file string) (*ProxyConfig, error) {
 	c, err := config.NewConfig("ini", file)
 	if err != nil {
-		log.Fatal("read config file failed ", err)
+		return nil, fmt.Errorf("read config file failed %s", err)
 	}
 
-	pc := &ProxyConfig{}
+	pc := &ProxyConfig{file: file}
 	// proxy
 	pc.name = c.DefaultString("proxy::name", "")
 	pc.port = c.DefaultInt("proxy::port", 0)
+	pc.unixSocket = c.DefaultString("proxy::unixsocket", "")
+	pc.memcachePort = c.DefaultInt("proxy::memcacheport", 0)
+	pc.adminAddr = c.DefaultString("proxy::adminaddr", "127.0.0.1:6061")
+	pc.adminToken = c.DefaultString("proxy::admintoken", "")
+	if pc.unixPerm, err = ParseUnixSocketPerm(c.DefaultString("proxy::unixsocketperm", "700")); err != nil {
+		return nil, fmt.Errorf("ProxyConfig %s", err)
+	}
 	pc.cpu = c.DefaultInt("proxy::cpu", 0)
 	pc.slaveOk = c.DefaultBool("proxy::slaveok", false)
+	pc.readPolicy = ReadPrimaryOnly
+	if pc.slaveOk {
+		pc.readPolicy = ReadPreferReplica
+	}
+	pc.readPolicy = c.DefaultString("proxy::readpolicy", pc.readPolicy)
 	pc.maxConn = c.DefaultInt("proxy::maxconn", 4000)
 	pc.conCurrency = c.DefaultInt("proxy::concurrency", 5)
 	pc.pipeLength = c.DefaultInt("proxy::pipelength", 4096)
+	pc.shutdownPolicy = c.DefaultString("proxy::shutdown", ShutdownReject)
+	pc.shutdownTimeout = time.Duration(c.DefaultInt("proxy::shutdowntimeout", 30)) * time.Second
+	pc.shutdownReply = c.DefaultBool("proxy::shutdownreply", true)
+	pc.strict = c.DefaultBool("proxy::strict", false)
+	for _, name := range strings.Split(c.DefaultString("proxy::deny", ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			pc.deny = append(pc.deny, name)
+		}
+	}
+	block := strings.Fields(strings.Replace(c.DefaultString("proxy::block", ""), ",", " ", -1))
+	rename := make(map[string]string)
+	for _, r := range strings.Fields(strings.Replace(c.DefaultString("proxy::rename", ""), ",", " ", -1)) {
+		kv := strings.SplitN(r, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("ProxyConfig rename %s, want COMMAND:NEWNAME", r)
+		}
+		rename[kv[0]] = kv[1]
+	}
+	if len(block) > 0 || len(rename) > 0 {
+		if pc.policy, err = NewCommandPolicy(block, rename); err != nil {
+			return nil, fmt.Errorf("ProxyConfig %s", err)
+		}
+	}
+	pc.maxPendingBytes = c.DefaultInt64("proxy::maxpendingbytes", 0)
+	pc.maxBlockTimeout = time.Duration(c.DefaultInt("proxy::maxblocktimeout", int(defaultMaxBlockTimeout/time.Second))) * time.Second
+	pc.maxReplyBytes = c.DefaultInt64("proxy::maxreplybytes", 0)
+	pc.maxBulkLen = c.DefaultInt("proxy::maxbulklen", 0)
+	pc.maxArrayLen = c.DefaultInt("proxy::maxarraylen", 0)
+	pc.maxDepth = c.DefaultInt("proxy::maxdepth", 0)
+	pc.maxLineLen = c.DefaultInt("proxy::maxlinelen", 0)
+	pc.strictInline = c.DefaultBool("proxy::strictinline", false)
+	pc.password = c.DefaultString("proxy::password", "")
+	pc.slowlogSlowerThan = time.Duration(c.DefaultInt("proxy::slowlogslowerthan", 10000)) * time.Microsecond
+	pc.slowlogMaxLen = c.DefaultInt("proxy::slowlogmaxlen", 128)
+	pc.hotKeys = c.DefaultInt("proxy::hotkeys", 0)
+	pc.hotKeyInterval = time.Duration(c.DefaultInt("proxy::hotkeyinterval", 60)) * time.Second
+	pc.hotKeySample = c.DefaultInt("proxy::hotkeysample", 1)
 
 	// redis
 	pc.poolSize = c.DefaultInt("redis::poolsize", 10)
 	pc.nodes = strings.Fields(c.DefaultString("redis::nodes", ""))
+	if pc.unixSockets, err = ParseUnixSockets(c.DefaultString("redis::unixsockets", "")); err != nil {
+		return nil, fmt.Errorf("ProxyConfig %s", err)
+	}
 	pc.reloadSlot = time.Duration(c.DefaultInt("redis::reloadslot", 600)) * time.Second
+	pc.distribution = c.DefaultString("redis::distribution", DistCluster)
+	if pc.distribution == DistKetama {
+		servers, err := ParseKetamaServers(c.DefaultString("redis::servers", ""))
+		if err != nil {
+			return nil, fmt.Errorf("ProxyConfig %s", err)
+		}
+		pc.ring, err = NewKetama(servers, c.DefaultString("redis::hash", HashFnv1a64), c.DefaultString("redis::hashtag", ""))
+		if err != nil {
+			return nil, fmt.Errorf("ProxyConfig %s", err)
+		}
+	}
+	pc.maxRedirects = c.DefaultInt("redis::maxredirects", defaultMaxRedirects)
+	pc.minIdle = c.DefaultInt("redis::minidle", 0)
+	pc.maxLifetime = time.Duration(c.DefaultInt("redis::maxlifetime", 0)) * time.Second
+	pc.healthCheck = time.Duration(c.DefaultInt("redis::healthcheck", 30)) * time.Second
+	pc.breakerRatio = c.DefaultFloat("redis::breakerratio", 0.5)
+	pc.breakerMin = c.DefaultInt("redis::breakerminrequests", 20)
+	pc.breakerWindow = time.Duration(c.DefaultInt("redis::breakerwindow", 10)) * time.Second
+	pc.breakerCooldown = time.Duration(c.DefaultInt("redis::breakercooldown", 1)) * time.Second
+	pc.autoEject = c.DefaultBool("redis::autoeject", false)
+	pc.backendUser = c.DefaultString("redis::user", "")
+	pc.backendPassword = c.DefaultString("redis::password", "")
 
 	//common
 	pc.idleTimeout = time.Duration(c.DefaultInt("common::idletimeout", 30)) * time.Second
+	pc.clientTimeout = time.Duration(c.DefaultInt("proxy::timeout", int(pc.idleTimeout/time.Second))) * time.Second
+	pc.tcpKeepAlive = time.Duration(c.DefaultInt("proxy::tcpkeepalive", 300)) * time.Second
 	pc.writeTimeout = time.Duration(c.DefaultInt("common::writetimeout", 5)) * time.Second
 	pc.readTimeout = time.Duration(c.DefaultInt("common::readtimeout", 5)) * time.Second
 	pc.dialTimeout = time.Duration(c.DefaultInt("common::dialtimeout", 3)) * time.Second
 
+	// ratelimit
+	pc.limitQPS = c.DefaultFloat("ratelimit::qps", 0)
+	pc.limitBytes = c.DefaultFloat("ratelimit::bandwidth", 0)
+	pc.limitClientQPS = c.DefaultFloat("ratelimit::clientqps", 0)
+	pc.limitClientBytes = c.DefaultFloat("ratelimit::clientbandwidth", 0)
+	pc.limitPer = c.DefaultString("ratelimit::per", LimitPerIP)
+	pc.limitMode = c.DefaultString("ratelimit::mode", LimitReject)
+	pc.limitReply = c.DefaultString("ratelimit::reply", RateLimitError.Error())
+
+	// cache
+	pc.cacheSize = c.DefaultInt("cache::size", 0)
+	pc.cacheTTL = time.Duration(c.DefaultInt("cache::ttl", 1000)) * time.Millisecond
+	pc.cacheMaxBytes = c.DefaultInt64("cache::maxbytes", 64<<10)
+	for _, name := range strings.Split(c.DefaultString("cache::commands", "GET,HGET"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			pc.cacheCommands = append(pc.cacheCommands, strings.ToUpper(name))
+		}
+	}
+
+	// trace
+	pc.traceEndpoint = c.DefaultString("trace::endpoint", "")
+	pc.traceService = c.DefaultString("trace::service", pc.name)
+	pc.traceRatio = c.DefaultFloat("trace::samplerate", 0.01)
+
+	//tls
+	if certFile := c.DefaultString("tls::certfile", ""); certFile != "" {
+		pc.tls, err = ServerTLSConfig(certFile, c.DefaultString("tls::keyfile", ""),
+			c.DefaultString("tls::cafile", ""), c.DefaultBool("tls::clientauth", false))
+		if err != nil {
+			return nil, fmt.Errorf("ProxyConfig tls %s", err)
+		}
+	}
+	if c.DefaultBool("redis::tls", false) {
+		pc.backendTLS, err = BackendTLSConfig(c.DefaultString("redis::tlscafile", ""),
+			c.DefaultString("redis::tlscertfile", ""), c.DefaultString("redis::tlskeyfile", ""),
+			c.DefaultString("redis::tlsservername", ""), c.DefaultBool("redis::tlsskipverify", false))
+		if err != nil {
+			return nil, fmt.Errorf("ProxyConfig redis tls %s", err)
+		}
+	}
+
+	//acl
+	pc.aclRules = make(map[string]string)
+	for _, user := range strings.Fields(c.DefaultString("acl::users", "")) {
+		pc.aclRules[user] = c.DefaultString("acl::"+user, "")
+	}
+
 	//log
 	pc.logFile = c.DefaultString("log::logfile", "")
 	pc.logLevel = c.DefaultString("log::loglevel", "info")
+	pc.logFormat = c.DefaultString("log::format", "text")
+	pc.auditAll = c.DefaultBool("log::audit", false)
+	pc.auditFile = c.DefaultString("log::auditfile", "")
+	pc.auditKeys = c.DefaultInt("log::auditkeys", 3)
+	pc.auditRedactKeys = c.DefaultBool("log::auditredactkeys", false)
 
 	//debug
 	pc.cpuFile = c.DefaultString("debug::cpufile", "")
 	pc.memFile = c.DefaultString("debug::memfile", "")
 
-	pc.apply()
-	log.Info("NewProxyConfig ", pc)
-	return pc
+	if err := pc.check(); err != nil {
+		return nil, err
+	}
+	return pc, nil
 }
 
-func (pc *ProxyConfig) apply() {
-	log.SetLevelByString(pc.logLevel)
-
-	if pc.logFile != "" {
-		err := log.SetOutputByName(pc.logFile)
-		if err != nil {
-			log.Fatalf("ProxyConfig SetOutputByName %s failed %s ", pc.logFile, err.Error())
-		}
-		log.SetRotateByDay()
+// check rejects invalid settings and adjusts the out of range ones
+func (pc *ProxyConfig) check() error {
+	if pc.name == "" {
+		return errors.New("ProxyConfig name must not empty")
 	}
 
-	if pc.name == "" {
-		log.Fatal("ProxyConfig name must not empty")
+	if pc.port == 0 && pc.unixSocket == "" && pc.memcachePort == 0 {
+		return errors.New("ProxyConfig port  must not 0")
 	}
 
-	if pc.port == 0 {
-		log.Fatal("ProxyConfig port  must not 0")
+	if pc.distribution != DistCluster && pc.distribution != DistKetama {
+		return fmt.Errorf("ProxyConfig distribution %s unknown, cluster or ketama", pc.distribution)
 	}
 
 	if pc.cpu > runtime.NumCPU() {
@@ -113,13 +361,129 @@ func (pc *ProxyConfig) apply() {
 		pc.maxConn = 10000
 	}
 
-	runtime.GOMAXPROCS(pc.cpu)
+	if pc.tcpKeepAlive < 0 {
+		log.Warningf("ProxyConfig tcpkeepalive %s negative, adjust to 0", pc.tcpKeepAlive)
+		pc.tcpKeepAlive = 0
+	}
+
+	if pc.shutdownPolicy != ShutdownReject && pc.shutdownPolicy != ShutdownProxy {
+		log.Warningf("ProxyConfig shutdown %s unknown, adjust to %s", pc.shutdownPolicy, ShutdownReject)
+		pc.shutdownPolicy = ShutdownReject
+	}
+
+	switch pc.readPolicy {
+	case ReadPrimaryOnly, ReadPreferReplica, ReadRoundRobin:
+	default:
+		log.Warningf("ProxyConfig readpolicy %s unknown, adjust to %s", pc.readPolicy, ReadPrimaryOnly)
+		pc.readPolicy = ReadPrimaryOnly
+	}
 
 	if pc.poolSize <= 0 || pc.poolSize > 30 {
-		log.Warning("ProxyConfig poolSize %d , adjust to 10 ", pc.poolSize)
+		log.Warningf("ProxyConfig poolSize %d , adjust to 10 ", pc.poolSize)
 		pc.poolSize = 10
 	}
 
+	if pc.limitPer != LimitPerIP && pc.limitPer != LimitPerConn {
+		log.Warningf("ProxyConfig ratelimit per %s unknown, adjust to %s", pc.limitPer, LimitPerIP)
+		pc.limitPer = LimitPerIP
+	}
+
+	if pc.limitMode != LimitReject && pc.limitMode != LimitDelay {
+		log.Warningf("ProxyConfig ratelimit mode %s unknown, adjust to %s", pc.limitMode, LimitReject)
+		pc.limitMode = LimitReject
+	}
+
+	for _, name := range pc.cacheCommands {
+		spec, ok := keySpecs[name]
+		if !IsReadCommand(name) || !ok || spec[KI_First] != spec[KI_Last] {
+			return fmt.Errorf("ProxyConfig cache command %s is not a read command of one key", name)
+		}
+	}
+
+	if _, err := log.ParseLevel(pc.logLevel); err != nil {
+		return fmt.Errorf("ProxyConfig %s", err)
+	}
+
+	if pc.logFormat != "text" && pc.logFormat != "json" {
+		return fmt.Errorf("ProxyConfig log format %s unknown, text or json", pc.logFormat)
+	}
+
+	if pc.auditKeys < 0 {
+		log.Warningf("ProxyConfig auditkeys %d negative, adjust to 0", pc.auditKeys)
+		pc.auditKeys = 0
+	}
+
+	if pc.traceRatio < 0 || pc.traceRatio > 1 {
+		log.Warningf("ProxyConfig trace samplerate %g out of [0, 1], adjust to 1", pc.traceRatio)
+		pc.traceRatio = 1
+	}
+
+	if pc.maxRedirects < 0 {
+		log.Warningf("ProxyConfig maxredirects %d negative, adjust to %d", pc.maxRedirects, defaultMaxRedirects)
+		pc.maxRedirects = defaultMaxRedirects
+	}
+
+	if pc.breakerRatio < 0 || pc.breakerRatio > 1 {
+		log.Warningf("ProxyConfig breakerratio %g out of [0, 1], adjust to 0.5", pc.breakerRatio)
+		pc.breakerRatio = 0.5
+	}
+
+	if pc.breakerMin <= 0 {
+		log.Warningf("ProxyConfig breakerminrequests %d, adjust to 20", pc.breakerMin)
+		pc.breakerMin = 20
+	}
+
+	if pc.breakerCooldown <= 0 {
+		log.Warningf("ProxyConfig breakercooldown %s, adjust to 1s", pc.breakerCooldown)
+		pc.breakerCooldown = time.Second
+	}
+
+	if pc.minIdle < 0 || pc.minIdle > pc.poolSize {
+		log.Warningf("ProxyConfig minidle %d out of [0, poolsize], adjust to %d", pc.minIdle, pc.poolSize)
+		pc.minIdle = pc.poolSize
+	}
+	return nil
+}
+
+// parserLimits are DefaultParserLimits with the ones set in proxy:: instead,
+// each session reads its commands and the backend replies with them
+func (pc *ProxyConfig) parserLimits() ParserLimits {
+	l := DefaultParserLimits
+	if pc.maxReplyBytes > 0 {
+		l.MaxReplyBytes = pc.maxReplyBytes
+	}
+	if pc.maxBulkLen > 0 {
+		l.MaxBulkLen = pc.maxBulkLen
+	}
+	if pc.maxArrayLen > 0 {
+		l.MaxArrayLen = pc.maxArrayLen
+	}
+	if pc.maxDepth > 0 {
+		l.MaxDepth = pc.maxDepth
+	}
+	if pc.maxLineLen > 0 {
+		l.MaxLineLen = pc.maxLineLen
+	}
+	l.StrictInline = pc.strictInline
+	return l
+}
+
+// apply sets up the process from pc once at startup: log, cpu and profiles.
+// The admin http server belongs to the Proxy, see Proxy.newMux
+func (pc *ProxyConfig) apply() {
+	log.SetLevelByString(pc.logLevel)
+	log.SetFormat(pc.logFormat)
+
+	if pc.logFile != "" {
+		err := log.SetOutputByName(pc.logFile)
+		if err != nil {
+			log.Fatalf("ProxyConfig SetOutputByName %s failed %s ", pc.logFile, err.Error())
+		}
+		log.SetRotateByDay()
+	}
+
+	runtime.GOMAXPROCS(pc.cpu)
+
 	if pc.cpuFile != "" {
 		f, err := os.Create(pc.cpuFile)
 		if err != nil {
@@ -137,8 +501,4 @@ func (pc *ProxyConfig) apply() {
 			pprof.WriteHeapProfile(f)
 		}
 	}
-
-	go func() {
-		log.Warning(http.ListenAndServe(":6061", nil))
-	}()
 }
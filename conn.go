@@ -6,16 +6,19 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"strconv"
 	"strings"
 	"time"
 
-	log "github.com/ngaut/logging"
+	log "github.com/dongzerun/archer/logging"
+	"github.com/dongzerun/archer/util"
 )
 
 var (
 	ClusterNodes = []byte("*2\r\n$7\r\nCLUSTER\r\n$5\r\nNODES\r\n") // cluster nodes
 	Ping         = []byte("*1\r\n$4\r\nPING\r\n")
+	Readonly     = []byte("*1\r\n$8\r\nREADONLY\r\n")
+
+	BrokenConnError = errors.New("redis conn broken")
 )
 
 type RedisConn struct {
@@ -24,21 +27,26 @@ type RedisConn struct {
 	w  *bufio.Writer
 	r  *bufio.Reader
 
-	lastUsed time.Time
+	lastUsed  time.Time
+	createdAt time.Time
 
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 
 	closed bool
+	broken bool // a read failed in the middle of a reply, the stream is out of sync
+	db     int  // selected by the last SELECT, 0 for a new conn
 }
 
-func NewRedisConn(host string, port int) (*RedisConn, error) {
+func NewRedisConn(host string, port int, pc *ProxyConfig) (*RedisConn, error) {
 	conn := &RedisConn{}
-	c, err := net.Dial("tcp4", fmt.Sprintf("%s:%d", host, port))
+	c, err := dialBackend(host, port, pc)
 	if err != nil {
-		log.Fatalf("Backend Dial  %s:%d failed %s", host, port, err)
+		log.Warningf("Backend Dial  %s:%d failed %s", host, port, err)
+		return nil, err
 	}
 
+	conn.c = c
 	conn.w = bufio.NewWriter(c)
 	conn.r = bufio.NewReader(c)
 	return conn, nil
@@ -46,19 +54,14 @@ func NewRedisConn(host string, port int) (*RedisConn, error) {
 
 func RedisConnDialer(host string, port int, id string, pc *ProxyConfig) func() (Conn, error) {
 	return func() (Conn, error) {
-		var c net.Conn
-		var err error
-
-		if pc.dialTimeout > 0 {
-			c, err = net.DialTimeout("tcp4", fmt.Sprintf("%s:%d", host, port), pc.dialTimeout*time.Second)
-		} else {
-			c, err = net.Dial("tcp4", fmt.Sprintf("%s:%d", host, port))
-		}
+		c, err := dialBackend(host, port, pc)
 		if err != nil {
 			log.Warning("RedisConnDialer failed ", err)
 			return nil, err
 		}
 
+		// every read and write of a backend has a deadline
+		c = &util.Conn{Conn: c, ReadTimeout: pc.readTimeout, WriteTimeout: pc.writeTimeout}
 		conn := &RedisConn{
 			id:           id,
 			c:            c,
@@ -67,6 +70,14 @@ func RedisConnDialer(host string, port int, id string, pc *ProxyConfig) func() (
 			readTimeout:  pc.readTimeout,
 			writeTimeout: pc.writeTimeout,
 			lastUsed:     time.Now(),
+			createdAt:    time.Now(),
+		}
+		if pc.backendPassword != "" {
+			if err := conn.Auth(pc.backendUser, pc.backendPassword); err != nil {
+				log.Warning("RedisConnDialer auth failed ", err)
+				c.Close()
+				return nil, err
+			}
 		}
 		return conn, nil
 	}
@@ -83,7 +94,11 @@ func (c *RedisConn) Close() error {
 	return nil
 }
 
+// Discard makes the pool replace the conn instead of reusing it
 func (c *RedisConn) Discard() error {
+	if c.broken {
+		return BrokenConnError
+	}
 	return nil
 }
 
@@ -95,6 +110,10 @@ func (c *RedisConn) SetLastUsed(t time.Time) {
 	c.lastUsed = t
 }
 
+func (c *RedisConn) CreatedAt() time.Time {
+	return c.createdAt
+}
+
 func (c *RedisConn) ID() string {
 	return c.id
 }
@@ -106,19 +125,42 @@ func (c *RedisConn) Alive() bool {
 	return false
 }
 
+// Readonly sends READONLY, a slave serves reads of its master's slots
+// on c instead of replying MOVED
+func (c *RedisConn) Readonly() error {
+	if _, err := c.w.Write(Readonly); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	r, err := ReadProtocol(c.r)
+	if err != nil {
+		return err
+	}
+	if !isStatus(r, OK) {
+		return fmt.Errorf("READONLY replied %s", r.String())
+	}
+	return nil
+}
+
+// Ping sends PING, a failure marks c broken so the pool closes it
 func (c *RedisConn) Ping() bool {
-	_, err := c.w.Write(ClusterNodes)
+	_, err := c.w.Write(Ping)
 	if err != nil {
+		c.broken = true
 		return false
 	}
 
 	err = c.w.Flush()
 	if err != nil {
+		c.broken = true
 		return false
 	}
 	r, e := ReadProtocol(c.r)
 
 	if e != nil {
+		c.broken = true
 		return false
 	}
 
@@ -133,11 +175,18 @@ func (c *RedisConn) Ping() bool {
 	return false
 }
 
-func GetClusterNodes(host string, port int) ([]*Node, error) {
-	c, err := NewRedisConn(host, port)
+func GetClusterNodes(host string, port int, pc *ProxyConfig) ([]*Node, error) {
+	c, err := NewRedisConn(host, port, pc)
 	if err != nil {
 		return nil, err
 	}
+	defer c.Close()
+
+	if pc.backendPassword != "" {
+		if err := c.Auth(pc.backendUser, pc.backendPassword); err != nil {
+			return nil, err
+		}
+	}
 
 	_, err = c.w.Write(ClusterNodes)
 	if err != nil {
@@ -163,54 +212,33 @@ func GetClusterNodes(host string, port int) ([]*Node, error) {
 		return nil, errors.New("Cluster nodes Command failed")
 	}
 
-	lines := strings.Split(string(br.Args[0]), "\n")
-	// 96ea3677b33334fb27382a08e475571a48342db0 10.10.10.86:6592 slave 4382646a92a3949bb9fdcfdc5a383e5e4b20a849 0 1447149668244 57 connected
-	// 219dfcf127e995244a43a5d57d95ea5f55b69c07 10.10.10.96:6595 master - 0 1447149668743 44 connected 3736-3939
-	ns := make([]*Node, 0)
-	for _, l := range lines[:len(lines)-1] {
-		n := &Node{
-			serveSlot: new(SlotRange),
-		}
-		fields := strings.Fields(l)
-		log.Info("GetClusterNodes fields: ", len(fields), fields)
-		if len(fields) < 8 || len(fields) > 9 {
-			return nil, errors.New("Cluster nodes fileds wrong")
-		}
-
-		n.id = fields[1]
-
-		url := strings.Split(fields[1], ":")
+	cns, err := ParseClusterNodes(br)
+	if err != nil {
+		return nil, err
+	}
+	return topoNodes(cns)
+}
 
-		if len(url) != 2 {
+// topoNodes converts the parsed CLUSTER NODES to the nodes of the topology
+func topoNodes(cns []ClusterNode) ([]*Node, error) {
+	ns := make([]*Node, 0, len(cns))
+	for _, cn := range cns {
+		n := nodeFromAddr(cn.Addr)
+		if n == nil {
 			return nil, errors.New("cluster nodes url wrong")
 		}
+		n.name = cn.ID
 
-		n.host = url[0]
-		var err error
-		n.port, err = strconv.Atoi(url[1])
-		if err != nil {
-			return nil, errors.New("cluster nodes port wrong")
-		}
-
-		if strings.Contains(fields[2], "slave") {
+		if strings.Contains(strings.Join(cn.Flags, ","), "slave") {
 			n.role = "slave"
-			n.slaveOf = fields[3]
-		} else {
-			n.role = "master"
-			slot := strings.Split(fields[8], "-")
-
-			var err error
-			n.serveSlot.start, err = strconv.Atoi(slot[0])
-			if err != nil {
-				return nil, errors.New("cluster nodes serve slots wrong")
-			}
-
-			n.serveSlot.stop, err = strconv.Atoi(slot[1])
-			if err != nil {
+			n.slaveOf = cn.MasterID
+		}
+		for _, rg := range cn.Slots {
+			if rg[0] < 0 || rg[1] >= 16384 || rg[0] > rg[1] {
 				return nil, errors.New("cluster nodes serve slots wrong")
 			}
+			n.serveSlots = append(n.serveSlots, SlotRange{rg[0], rg[1]})
 		}
-
 		ns = append(ns, n)
 	}
 	return ns, nil
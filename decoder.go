@@ -0,0 +1,175 @@
+package archer
+
+import (
+	"bufio"
+
+	"github.com/dongzerun/archer/util"
+)
+
+// Decoder reads Resp one by one from a bufio.Reader.
+//
+// With reuse enabled, arrays made up of bulk strings (every client command)
+// are decoded into a single ArrayResp owned by the Decoder: the ArrayResp,
+// its Args and the bytes of every argument are overwritten by the next call
+// to Decode. The caller must be completely done with the returned command,
+// and must not keep any reference to its Args, before calling Decode again.
+// Copy whatever needs to outlive the call. Other types, and arrays with
+// elements of other types like nested arrays, are never reused.
+type Decoder struct {
+	r     *bufio.Reader
+	reuse bool
+
+	ar    *ArrayResp
+	bulks []BulkResp // backing array for ar.Args
+}
+
+func NewDecoder(r *bufio.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+// SetReuse turns on/off reusing ArrayResp between Decode calls
+func (d *Decoder) SetReuse(reuse bool) {
+	d.reuse = reuse
+}
+
+func (d *Decoder) Decode() (Resp, error) {
+	if !d.reuse {
+		return ReadProtocol(d.r)
+	}
+
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != ArrSep {
+		return ReadProtocol(d.r)
+	}
+
+	res, err := d.r.ReadSlice(byte('\n'))
+	if err != nil {
+		return nil, err
+	}
+	lim := &readLimits{ParserLimits: DefaultParserLimits}
+	if err := lim.checkLine(res); err != nil {
+		return nil, err
+	}
+	if err := lim.add(len(res)); err != nil {
+		return nil, err
+	}
+	n, err := util.ParseLen(res[1 : len(res)-2])
+	if err != nil {
+		return nil, err
+	}
+	if n == -1 {
+		ar := &ArrayResp{}
+		ar.Rtype = ArrayType
+		ar.Empty = true
+		return ar, nil
+	}
+	if err := lim.enter(n); err != nil {
+		return nil, err
+	}
+	defer lim.leave()
+
+	if d.ar == nil {
+		d.ar = &ArrayResp{}
+		d.ar.Rtype = ArrayType
+	}
+	// don't trust a huge n before the elements really arrive
+	if want := minInt(n, maxPreallocArgs); cap(d.bulks) < want {
+		bulks := make([]BulkResp, want)
+		copy(bulks, d.bulks[:cap(d.bulks)])
+		d.bulks = bulks
+	}
+	d.bulks = d.bulks[:cap(d.bulks)]
+
+	ar := d.ar
+	ar.Args = ar.Args[:0]
+	for i := 0; i < n; i++ {
+		b, err := d.r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != BulkSep {
+			return d.decodeMixed(i, n, lim)
+		}
+
+		if i == len(d.bulks) {
+			d.bulks = append(d.bulks, BulkResp{})
+		}
+		br := &d.bulks[i]
+		if err := d.readBulk(br, lim); err != nil {
+			return nil, err
+		}
+		ar.Args = append(ar.Args, br)
+	}
+	return ar, nil
+}
+
+// decodeMixed finishes an array whose element i is not a bulk string.
+// Such an array is not reused: the i bulks read so far are moved to a new
+// ArrayResp, and the rest elements are read by readProtocol
+func (d *Decoder) decodeMixed(i, n int, lim *readLimits) (Resp, error) {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	for j := 0; j < i; j++ {
+		br := d.bulks[j]
+		ar.append(&br)
+		// the payload belongs to ar now, never overwrite it
+		d.bulks[j].Args = nil
+	}
+	for ; i < n; i++ {
+		rsp, err := readProtocol(d.r, lim)
+		if err != nil {
+			return nil, err
+		}
+		ar.append(rsp)
+	}
+	return ar, nil
+}
+
+// readBulk reads a bulk string into br, reusing its old payload buffer.
+// header lines are read by ReadSlice and parsed in place, no copy needed
+func (d *Decoder) readBulk(br *BulkResp, lim *readLimits) error {
+	res, err := d.r.ReadSlice(byte('\n'))
+	if err != nil {
+		return err
+	}
+	if res[0] != BulkSep {
+		return ArrSepReadError
+	}
+	if err := lim.checkLine(res); err != nil {
+		return err
+	}
+	l, err := util.ParseLen(res[1 : len(res)-2])
+	if err != nil {
+		return err
+	}
+
+	br.Rtype = BulkType
+	br.Empty = l == -1
+	if br.Empty {
+		br.Args = br.Args[:0]
+		return nil
+	}
+	if err := lim.add(len(res) + l + 2); err != nil {
+		return err
+	}
+	if err := lim.bulk(l); err != nil {
+		return err
+	}
+
+	var old []byte
+	if len(br.Args) > 0 {
+		old = br.Args[0]
+	}
+	buf, err := readPayload(d.r, old, l+2)
+	if err != nil {
+		return err
+	}
+	if err := checkBulkEnd(buf, l); err != nil {
+		return err
+	}
+	br.Args = append(br.Args[:0], buf[:l])
+	return nil
+}
@@ -0,0 +1,106 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecoderReuse(t *testing.T) {
+	data := "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n*3\r\n$3\r\nSET\r\n$1\r\na\r\n$-1\r\n+OK\r\n"
+	d := NewDecoder(bufio.NewReader(strings.NewReader(data)))
+	d.SetReuse(true)
+
+	first, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != "GET foo" {
+		t.Fatal(first.String())
+	}
+
+	second, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Fatal("ArrayResp should be reused")
+	}
+	ar := second.(*ArrayResp)
+	if len(ar.Args) != 3 || ar.Args[0].String() != "SET" || ar.Args[1].String() != "a" || !ar.Args[2].Empty {
+		t.Fatal(ar.String())
+	}
+
+	third, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := third.(*SimpleResp); !ok {
+		t.Fatal(third.Type())
+	}
+}
+
+func benchmarkDecode(b *testing.B, reuse bool) {
+	cmd := "*3\r\n$3\r\nSET\r\n$8\r\nkey:1234\r\n$16\r\nvalue:0123456789\r\n"
+	data := []byte(strings.Repeat(cmd, 1000))
+	r := bytes.NewReader(data)
+	br := bufio.NewReader(r)
+	d := NewDecoder(br)
+	d.SetReuse(reuse)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			r.Reset(data)
+			br.Reset(r)
+		}
+		if _, err := d.Decode(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func Benchmark_Decode(b *testing.B) {
+	benchmarkDecode(b, false)
+}
+
+func Benchmark_DecodeReuse(b *testing.B) {
+	benchmarkDecode(b, true)
+}
+
+func TestDecoderReuseNested(t *testing.T) {
+	// CLUSTER SLOTS, XRANGE and a command, all through one reusing Decoder
+	frames := []string{
+		"*1\r\n*3\r\n:0\r\n:5460\r\n*2\r\n$9\r\n127.0.0.1\r\n:6379\r\n",
+		"*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n",
+		"*2\r\n$5\r\nentry\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n",
+		"*3\r\n$1\r\na\r\n:1\r\n*-1\r\n",
+		"*2\r\n$3\r\nGET\r\n$3\r\nbar\r\n",
+	}
+	d := NewDecoder(bufio.NewReader(strings.NewReader(strings.Join(frames, ""))))
+	d.SetReuse(true)
+
+	var got []Resp
+	for _, f := range frames {
+		r, err := d.Decode()
+		if err != nil {
+			t.Fatalf("%q: %s", f, err)
+		}
+		if s := encodeResp(t, r); s != f {
+			t.Fatalf("got %q want %q", s, f)
+		}
+		got = append(got, r)
+	}
+
+	// mixed arrays are not reused, the later commands don't touch them
+	for _, i := range []int{0, 2, 3} {
+		if s := encodeResp(t, got[i]); s != frames[i] {
+			t.Fatalf("frame %d overwritten: %q", i, s)
+		}
+	}
+	if got[2].Length() != 1 || got[3].Length() != 2 {
+		t.Fatal(got[2].Length(), got[3].Length())
+	}
+}
@@ -2,6 +2,8 @@ package archer
 
 import (
 	"errors"
+	"strings"
+
 	"github.com/dongzerun/archer/hack"
 	"github.com/dongzerun/archer/util"
 )
@@ -16,6 +18,12 @@ var (
 	CommandNotSupported  = errors.New("command not supported")
 	UnknowProxyOpType    = errors.New("Unknow args type for proxy command")
 	BlackTimeUnavaliable = errors.New("black time unavaliable")
+	ShutdownForbidden    = errors.New("ERR shutdown forbidden by proxy")
+	ReplicationForbidden = errors.New("replication commands not supported by proxy")
+	IdleTimeoutError     = errors.New("client idle timeout")
+	DrainingError        = errors.New("proxy is draining")
+	DrainTimeoutError    = errors.New("drain deadline exceeded")
+	ShuttingDownError    = errors.New("ERR server shutting down")
 )
 
 type Filter interface {
@@ -23,6 +31,7 @@ type Filter interface {
 }
 
 type StrFilter struct {
+	Deny DenyTable // nil denies nothing more than blackList
 }
 
 func (s *StrFilter) Inspect(r Resp) (string, error) {
@@ -31,6 +40,11 @@ func (s *StrFilter) Inspect(r Resp) (string, error) {
 		return "", InspectArgWrong
 	}
 
+	// 命令必须是非空的 BulkResp 数组
+	if name, ok := ar.Arg(0); ar.Elems != nil || !ok || len(name) == 0 {
+		return "", BadCommandError
+	}
+
 	cmd := hack.String(util.UpperSlice(ar.Args[0].Args[0]))
 
 	l := ar.Length() + 1
@@ -39,6 +53,9 @@ func (s *StrFilter) Inspect(r Resp) (string, error) {
 	if _, ok := blackList[cmd]; ok {
 		return "", CommandForbidden
 	}
+	if s.Deny.Denied(ar) {
+		return "", CommandForbidden
+	}
 
 	// 规则检查，参数数量
 	rule, exists := reqrules[cmd]
@@ -62,6 +79,59 @@ func (s *StrFilter) Inspect(r Resp) (string, error) {
 	return cmd, nil
 }
 
+// DenyTable lists dangerous commands to refuse, keyed by the upper case
+// command name, or "NAME SUBCOMMAND" to deny only one subcommand
+type DenyTable map[string]bool
+
+// DefaultDenyTable denies DEBUG, FAILOVER and the CLUSTER subcommands
+// changing the topology, strict adds FLUSHALL and FLUSHDB
+func DefaultDenyTable(strict bool) DenyTable {
+	t := DenyTable{
+		"DEBUG":              true,
+		"FAILOVER":           true,
+		"CLUSTER RESET":      true,
+		"CLUSTER FAILOVER":   true,
+		"CLUSTER FORGET":     true,
+		"CLUSTER MEET":       true,
+		"CLUSTER SETSLOT":    true,
+		"CLUSTER ADDSLOTS":   true,
+		"CLUSTER DELSLOTS":   true,
+		"CLUSTER FLUSHSLOTS": true,
+		"CLUSTER REPLICATE":  true,
+	}
+	if strict {
+		t["FLUSHALL"] = true
+		t["FLUSHDB"] = true
+	}
+	return t
+}
+
+// Deny adds name, a command or "NAME SUBCOMMAND"
+func (t DenyTable) Deny(name string) {
+	t[strings.ToUpper(name)] = true
+}
+
+// Allow removes name added by Deny or DefaultDenyTable
+func (t DenyTable) Allow(name string) {
+	delete(t, strings.ToUpper(name))
+}
+
+// Denied reports whether the command ar or its subcommand is denied
+func (t DenyTable) Denied(ar *ArrayResp) bool {
+	if len(t) == 0 {
+		return false
+	}
+	name := cmdName(ar)
+	if t[name] {
+		return true
+	}
+	sub, ok := ar.Arg(1)
+	if !ok {
+		return false
+	}
+	return t[name+" "+strings.ToUpper(string(sub))]
+}
+
 type TrieFilter struct {
 }
 
@@ -69,3 +139,12 @@ func (t *TrieFilter) Inspect(r Resp) error {
 	panic("currently Trie Not Implemented")
 	return nil
 }
+
+// newFilter checks commands against the deny settings of pc
+func newFilter(pc *ProxyConfig) Filter {
+	deny := DefaultDenyTable(pc.strict)
+	for _, name := range pc.deny {
+		deny.Deny(name)
+	}
+	return &StrFilter{Deny: deny}
+}
@@ -0,0 +1,200 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// framer is implemented by every Resp of this package, writeFrame is the
+// one place a type is encoded: Encode, EncodeTo and WriteTo all call it
+type framer interface {
+	writeFrame(fw frameWriter) (int64, error)
+}
+
+// frameWriter writes the pieces of a frame straight into a *bytes.Buffer
+// or a *bufio.Writer, no intermediate buffer. It's passed by value so it
+// stays on the stack even through interface calls. The zero frameWriter
+// writes nothing, it only walks the frame to validate it
+type frameWriter struct {
+	b  *bytes.Buffer
+	bw *bufio.Writer
+}
+
+func (fw frameWriter) write(p []byte) (int64, error) {
+	var n int
+	var err error
+	if fw.b != nil {
+		n, err = fw.b.Write(p)
+	} else if fw.bw != nil {
+		n, err = fw.bw.Write(p)
+	} else {
+		n = len(p)
+	}
+	return int64(n), err
+}
+
+func (fw frameWriter) writeString(s string) (int64, error) {
+	var n int
+	var err error
+	if fw.b != nil {
+		n, err = fw.b.WriteString(s)
+	} else if fw.bw != nil {
+		n, err = fw.bw.WriteString(s)
+	} else {
+		n = len(s)
+	}
+	return int64(n), err
+}
+
+func (fw frameWriter) writeByte(c byte) (int64, error) {
+	var err error
+	if fw.b != nil {
+		err = fw.b.WriteByte(c)
+	} else if fw.bw != nil {
+		err = fw.bw.WriteByte(c)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// line writes sep, p and \r\n, the frame of simple strings, errors,
+// integers and the other one line types
+func (fw frameWriter) line(sep byte, p []byte) (int64, error) {
+	n, err := fw.writeByte(sep)
+	if err != nil {
+		return n, err
+	}
+	m, err := fw.write(p)
+	n += m
+	if err != nil {
+		return n, err
+	}
+	m, err = fw.write(CRLF)
+	return n + m, err
+}
+
+// header writes sep, the length l and \r\n. The digits are written one by
+// one, a scratch slice handed to bufio.Writer.Write would escape
+func (fw frameWriter) header(sep byte, l int) (int64, error) {
+	n, err := fw.writeByte(sep)
+	if err != nil {
+		return n, err
+	}
+	d := 1
+	for l/d >= 10 {
+		d *= 10
+	}
+	for ; d > 0; d /= 10 {
+		m, err := fw.writeByte(byte('0' + l/d%10))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	m, err := fw.write(CRLF)
+	return n + m, err
+}
+
+// elem writes r as an element of an aggregate
+func (fw frameWriter) elem(r Resp) (int64, error) {
+	if r == nil {
+		return 0, RespTypeError
+	}
+	if f, ok := r.(framer); ok {
+		return f.writeFrame(fw)
+	}
+
+	// a Resp implemented outside this package, can't be validated
+	if fw.b == nil && fw.bw == nil {
+		return 0, nil
+	}
+	if fw.b != nil {
+		l := fw.b.Len()
+		err := r.EncodeTo(fw.b)
+		return int64(fw.b.Len() - l), err
+	}
+	var b bytes.Buffer
+	if err := r.EncodeTo(&b); err != nil {
+		return 0, err
+	}
+	return fw.write(b.Bytes())
+}
+
+// checkFrame walks f without writing, RespTypeError or RespArgsError if
+// some part of it can't be encoded. A half written frame would corrupt the
+// connection, so nothing goes to a bufio.Writer before this passes
+func checkFrame(f framer) error {
+	_, err := f.writeFrame(frameWriter{})
+	return err
+}
+
+// encodeTo appends the frame of f to b, b is left untouched on error
+func encodeTo(b *bytes.Buffer, f framer) error {
+	_, err := bufferFrame(b, f)
+	return err
+}
+
+func bufferFrame(b *bytes.Buffer, f framer) (int64, error) {
+	l := b.Len()
+	n, err := f.writeFrame(frameWriter{b: b})
+	if err != nil {
+		b.Truncate(l)
+		return 0, err
+	}
+	return n, nil
+}
+
+// encodeFrame writes the frame of f straight into w and flushes it
+func encodeFrame(w *bufio.Writer, f framer) error {
+	if err := checkFrame(f); err != nil {
+		return err
+	}
+	if _, err := f.writeFrame(frameWriter{bw: w}); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// writeTo implements io.WriterTo for every Resp: the frame goes straight
+// into a *bytes.Buffer, or a *bufio.Writer which is flushed at the end,
+// other writers get a pooled bufio.Writer in front of them
+func writeTo(w io.Writer, f framer) (int64, error) {
+	if v, ok := w.(*bytes.Buffer); ok {
+		return bufferFrame(v, f)
+	}
+	if err := checkFrame(f); err != nil {
+		return 0, err
+	}
+
+	switch v := w.(type) {
+	case *bufio.Writer:
+		n, err := f.writeFrame(frameWriter{bw: v})
+		if err != nil {
+			return n, err
+		}
+		return n, v.Flush()
+	}
+
+	bw := writerPool.Get().(*bufio.Writer)
+	bw.Reset(w)
+	defer func() {
+		// don't keep w alive in the pool
+		bw.Reset(nil)
+		writerPool.Put(bw)
+	}()
+	n, err := f.writeFrame(frameWriter{bw: bw})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// writerPool keeps the bufio.Writer put in front of plain writers by
+// WriteTo, so writing to a net.Conn doesn't allocate 4KB every time
+var writerPool = sync.Pool{
+	New: func() interface{} { return bufio.NewWriter(nil) },
+}
@@ -0,0 +1,282 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/dongzerun/archer/util"
+)
+
+// fuzzLimits keep the fuzzer from asking for huge allocations, the limits
+// are what is tested, not the memory of the machine
+var fuzzLimits = ParserLimits{MaxBulkLen: 1 << 20, MaxArrayLen: 1 << 16, MaxDepth: 32, MaxLineLen: 1 << 16}
+
+// FuzzReadProtocol feeds ReadProtocol arbitrary bytes. It must never panic,
+// whatever it accepts must encode and parse back to the same reply, and
+// the StreamParser must agree with it on every complete frame
+//
+//	go test -run XXX -fuzz FuzzReadProtocol
+func FuzzReadProtocol(f *testing.F) {
+	for _, seed := range []string{
+		"+OK\r\n", "-ERR wrong\r\n", ":-42\r\n", "$3\r\nfoo\r\n", "$0\r\n\r\n", "$-1\r\n",
+		"*0\r\n", "*-1\r\n", "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "*2\r\n*1\r\n:1\r\n$-1\r\n",
+		"$2\r\n\r\n\r\n", "$2147483647\r\n", "*2147483647\r\n", "$99999999999999999999\r\n",
+		"_\r\n", "#t\r\n", ",1.5\r\n", "(123\r\n", "=7\r\ntxt:abc\r\n",
+		"%1\r\n+a\r\n:1\r\n", "~1\r\n+a\r\n", ">2\r\n+message\r\n+hi\r\n",
+		"SET k \"a b\\x41\"\r\n", "GET 'unbalanced\r\n", "\r\n", "$3\r\nfoo\n", "*1\r\n$3\r\nfoo",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r, err := ReadProtocolWithLimits(bufio.NewReader(bytes.NewReader(data)), fuzzLimits)
+		if err != nil && r != nil {
+			t.Fatalf("%q: reply %v with error %v", data, r, err)
+		}
+
+		frame := len(data) > 0 && isFrameByte(data[0])
+		if frame {
+			p := NewStreamParserWithLimits(fuzzLimits)
+			p.Feed(data)
+			sr, ok := p.Next()
+			if (err == nil) != ok {
+				t.Fatalf("%q: ReadProtocol %v, StreamParser %v %v", data, err, ok, p.Err())
+			}
+			if ok && !Equal(r, sr) {
+				t.Fatalf("%q: ReadProtocol %q, StreamParser %q", data, encodeBytes(r), encodeBytes(sr))
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		enc := encodeBytes(r)
+		if enc == nil {
+			t.Fatalf("%q: reply read can't be encoded", data)
+		}
+		back, n, err := Decode(enc)
+		if err != nil || n != len(enc) {
+			t.Fatalf("%q: Decode of %q: %d %v", data, enc, n, err)
+		}
+		if !Equal(r, back) {
+			t.Fatalf("%q: encoded %q, decoded %q", data, enc, encodeBytes(back))
+		}
+		if frame && bytes.HasPrefix(data, enc) {
+			// the canonical encoding of a frame is the frame itself
+			return
+		}
+		if again := encodeBytes(back); !bytes.Equal(again, enc) {
+			t.Fatalf("%q: encoding not stable, %q then %q", data, enc, again)
+		}
+	})
+}
+
+// checkRoundTrip encodes r and reads it back with every parser of the
+// package, each must give back r
+func checkRoundTrip(t *testing.T, r Resp) {
+	t.Helper()
+	enc := encodeBytes(r)
+	if enc == nil {
+		t.Fatalf("can't encode %s", r.String())
+	}
+
+	got, err := ReadProtocol(bufio.NewReader(bytes.NewReader(enc)))
+	if err != nil || !Equal(r, got) {
+		t.Fatalf("ReadProtocol %q: %v %v", enc, got, err)
+	}
+	got, n, err := Decode(enc)
+	if err != nil || n != len(enc) || !Equal(r, got) {
+		t.Fatalf("Decode %q: %d %v", enc, n, err)
+	}
+
+	// byte by byte, every prefix is incomplete
+	p := NewStreamParser()
+	for i, c := range enc {
+		p.Feed([]byte{c})
+		got, ok := p.Next()
+		if ok != (i == len(enc)-1) || p.Err() != nil {
+			t.Fatalf("StreamParser %q at %d: %v %v", enc, i, ok, p.Err())
+		}
+		if ok && !Equal(r, got) {
+			t.Fatalf("StreamParser %q: %q", enc, encodeBytes(got))
+		}
+	}
+
+	// twice, the second Decode overwrites what the first reused
+	d := NewDecoder(bufio.NewReader(bytes.NewReader(append(append([]byte{}, enc...), enc...))))
+	d.SetReuse(true)
+	for i := 0; i < 2; i++ {
+		if got, err := d.Decode(); err != nil || !Equal(r, got) {
+			t.Fatalf("Decoder %q, %d: %v", enc, i, err)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	bulks := func(args ...string) *ArrayResp {
+		ar := &ArrayResp{}
+		ar.Rtype = ArrayType
+		for _, a := range args {
+			ar.Args = append(ar.Args, NewBulkResp([]byte(a)))
+		}
+		return ar
+	}
+	nullArray := bulks()
+	nullArray.Empty = true
+	mixed := &ArrayResp{}
+	mixed.Rtype = ArrayType
+	mixed.Elems = []Resp{NewIntResp(1), bulks(), nullArray, NewNullBulkResp(), bulks("a\r\nb")}
+	m := &MapResp{}
+	m.Rtype = MapType
+	m.Elems = []Resp{NewSimpleResp([]byte("k")), mixed, NewBulkResp(nil), NewNullResp()}
+
+	for _, r := range []Resp{
+		NewSimpleResp([]byte("OK")),
+		NewErrorResp([]byte("ERR wrong")),
+		NewIntResp(0), NewIntResp(-1 << 63),
+		NewBulkResp(nil), NewBulkResp([]byte("\r\n")), NewBulkResp([]byte("$3\r\nfoo\r\n")), NewNullBulkResp(),
+		bulks(), nullArray, bulks("SET", "k", "v\r\n"), mixed,
+		NewNullResp(), NewBooleanResp(true), NewBooleanResp(false),
+		NewDoubleResp(-0.5), NewBigNumberResp([]byte("-123456789012345678901234567890")),
+		NewVerbatimResp("txt", []byte("two\r\nlines")), NewVerbatimResp("mkd", nil),
+		m, NewSetResp(), NewSetResp(NewIntResp(1), NewBulkResp([]byte("1"))),
+		NewPushResp(NewBulkResp([]byte("message")), mixed), NewPushResp(),
+	} {
+		checkRoundTrip(t, r)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		checkRoundTrip(t, randResp(rnd, 3))
+	}
+}
+
+// randResp builds a random reply of any type, aggregates nest up to depth
+// levels and bulks hold any byte, CRLF included
+func randResp(rnd *rand.Rand, depth int) Resp {
+	kinds := 10
+	if depth > 0 {
+		kinds = 15
+	}
+	n := rnd.Intn(4)
+	elems := func(n int) []Resp {
+		var elems []Resp
+		for i := 0; i < n; i++ {
+			elems = append(elems, randResp(rnd, depth-1))
+		}
+		return elems
+	}
+
+	switch rnd.Intn(kinds) {
+	case 0:
+		return NewSimpleResp(randText(rnd))
+	case 1:
+		return NewErrorResp(append([]byte("ERR "), randText(rnd)...))
+	case 2:
+		return NewIntResp(rnd.Int63() - rnd.Int63())
+	case 3:
+		return NewNullBulkResp()
+	case 4:
+		return NewNullResp()
+	case 5:
+		return NewBooleanResp(n%2 == 0)
+	case 6:
+		return NewDoubleResp(rnd.NormFloat64() * 1e6)
+	case 7:
+		digits := []byte("-")
+		for i := 0; i <= n*10; i++ {
+			digits = append(digits, byte('0'+rnd.Intn(10)))
+		}
+		return NewBigNumberResp(digits[n%2:])
+	case 8:
+		return NewVerbatimResp("txt", randBytes(rnd))
+	case 9, 10:
+		return NewBulkResp(randBytes(rnd))
+	case 11:
+		ar := &ArrayResp{}
+		ar.Rtype = ArrayType
+		if n == 0 && rnd.Intn(2) == 0 {
+			ar.Empty = true
+		} else {
+			ar.Elems = elems(n)
+		}
+		return ar
+	case 12:
+		mr := &MapResp{}
+		mr.Rtype = MapType
+		mr.Elems = elems(2 * n)
+		return mr
+	case 13:
+		return NewSetResp(elems(n)...)
+	}
+	return NewPushResp(elems(n)...)
+}
+
+func randBytes(rnd *rand.Rand) []byte {
+	b := make([]byte, rnd.Intn(16))
+	for i := range b {
+		// CR and LF often
+		b[i] = []byte{'\r', '\n', 'a', byte(rnd.Intn(256))}[rnd.Intn(4)]
+	}
+	return b
+}
+
+// randText is the text of a simple string or an error, no CR or LF
+func randText(rnd *rand.Rand) []byte {
+	b := make([]byte, 1+rnd.Intn(16))
+	for i := range b {
+		b[i] = byte(' ' + rnd.Intn(95))
+	}
+	return b
+}
+
+// TestReadProtocolHugeLengths sends headers declaring huge lengths and not
+// the data, the parser must fail without allocating what was declared
+func TestReadProtocolHugeLengths(t *testing.T) {
+	cases := []struct {
+		in  string
+		err error
+	}{
+		{"$2147483647\r\n", BulkTooLargeError},
+		{"*2000000000\r\n", ArrayTooLongError},
+		{"*1048577\r\n", ArrayTooLongError},
+		{"%2147483647\r\n", ArrayTooLongError},
+		{"$99999999999999999999\r\n", nil},
+		{"$-2\r\n", util.NegativeLengthError},
+		{"*-1\r\n", nil},
+		{"%-1\r\n", NullAggregateError},
+		{"~-1\r\n", NullAggregateError},
+		{">-1\r\n", NullAggregateError},
+		// under the limits, the data never comes
+		{"$536870912\r\nabc", io.ErrUnexpectedEOF},
+		{"*1048576\r\n:1\r\n", io.EOF},
+	}
+	for _, c := range cases {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		r, err := ReadProtocol(bufio.NewReader(strings.NewReader(c.in)))
+		runtime.ReadMemStats(&after)
+
+		if c.in == "*-1\r\n" {
+			if ar, ok := r.(*ArrayResp); err != nil || !ok || !ar.Empty {
+				t.Fatalf("%q: %v %v", c.in, r, err)
+			}
+			continue
+		}
+		if err == nil || (c.err != nil && err != c.err) {
+			t.Fatalf("%q: got %v %v, want %v", c.in, r, err, c.err)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8<<20 {
+			t.Fatalf("%q: %d bytes allocated", c.in, allocated)
+		}
+
+		if _, _, err := Decode([]byte(c.in)); err == nil {
+			t.Fatalf("Decode %q: no error", c.in)
+		}
+	}
+}
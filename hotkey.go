@@ -0,0 +1,160 @@
+package archer
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+// HotKey is a key and its estimated accesses in an interval
+type HotKey struct {
+	Key   string `json:"key"`
+	Count uint32 `json:"count"`
+	Node  string `json:"node,omitempty"`
+}
+
+// HotKeys finds the most accessed keys per interval. A count-min sketch
+// estimates the accesses of every key in constant memory, the n keys with
+// the highest estimates are the candidates. Top reports the last finished
+// interval, the one running is only half counted
+type HotKeys struct {
+	l        sync.Mutex
+	sketch   [sketchDepth][sketchWidth]uint32
+	top      map[string]uint32 // at most n keys
+	n        int
+	interval time.Duration
+	start    time.Time // of the running interval
+	last     []HotKey  // top of the last finished interval, sorted
+
+	sample int   // record 1 of sample accesses, 1 records all
+	seen   int64 // atomic
+}
+
+func NewHotKeys(n int, interval time.Duration, sample int) *HotKeys {
+	if sample < 1 {
+		sample = 1
+	}
+	return &HotKeys{
+		top:      make(map[string]uint32, n),
+		n:        n,
+		interval: interval,
+		start:    time.Now(),
+		sample:   sample,
+	}
+}
+
+// Record counts an access of key
+func (h *HotKeys) Record(key []byte) {
+	if h.sample > 1 && atomic.AddInt64(&h.seen, 1)%int64(h.sample) != 0 {
+		return
+	}
+
+	f := fnv.New64a()
+	f.Write(key)
+	sum := f.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.rotate(time.Now())
+
+	est := ^uint32(0)
+	for i := 0; i < sketchDepth; i++ {
+		idx := (h1 + uint32(i)*h2) % sketchWidth
+		h.sketch[i][idx]++
+		if c := h.sketch[i][idx]; c < est {
+			est = c
+		}
+	}
+
+	k := string(key)
+	if _, ok := h.top[k]; ok || len(h.top) < h.n {
+		h.top[k] = est
+		return
+	}
+	// replace the coldest candidate if key is hotter
+	var minKey string
+	minCount := ^uint32(0)
+	for tk, c := range h.top {
+		if c < minCount {
+			minKey, minCount = tk, c
+		}
+	}
+	if est > minCount {
+		delete(h.top, minKey)
+		h.top[k] = est
+	}
+}
+
+// rotate finishes the running interval if it's over
+func (h *HotKeys) rotate(now time.Time) {
+	if now.Sub(h.start) < h.interval {
+		return
+	}
+	h.last = make([]HotKey, 0, len(h.top))
+	for k, c := range h.top {
+		h.last = append(h.last, HotKey{Key: k, Count: c * uint32(h.sample)})
+	}
+	sort.Slice(h.last, func(i, j int) bool {
+		if h.last[i].Count != h.last[j].Count {
+			return h.last[i].Count > h.last[j].Count
+		}
+		return h.last[i].Key < h.last[j].Key
+	})
+
+	h.sketch = [sketchDepth][sketchWidth]uint32{}
+	h.top = make(map[string]uint32, h.n)
+	h.start = now
+}
+
+// Top returns at most count keys of the last finished interval, hottest
+// first, count <= 0 returns them all
+func (h *HotKeys) Top(count int) []HotKey {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.rotate(time.Now())
+	if count <= 0 || count > len(h.last) {
+		count = len(h.last)
+	}
+	top := make([]HotKey, count)
+	copy(top, h.last)
+	return top
+}
+
+// hotKeys returns the top keys with the node each one routes to
+func (p *Proxy) hotKeys(count int) []HotKey {
+	top := p.hotkeys.Top(count)
+	if p.cluster != nil && p.cluster.topo != nil {
+		for i := range top {
+			top[i].Node = p.cluster.topo.GetNodeID([]byte(top[i].Key), false)
+		}
+	}
+	return top
+}
+
+// hotKeysHandler serves the top keys as json, ?n= limits them
+func (p *Proxy) hotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.hotKeys(n))
+}
+
+// Resp is the entry in the reply of PROXY HOTKEYS: key, count and node
+func (k HotKey) Resp() Resp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.append(NewBulkResp([]byte(k.Key)))
+	ar.append(NewIntResp(int64(k.Count)))
+	ar.append(NewBulkResp([]byte(k.Node)))
+	return ar
+}
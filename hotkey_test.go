@@ -0,0 +1,53 @@
+package archer
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHotKeysTop(t *testing.T) {
+	h := NewHotKeys(3, time.Hour, 1)
+	for i := 0; i < 1000; i++ {
+		h.Record([]byte("cold:" + strconv.Itoa(i)))
+		if i%2 == 0 {
+			h.Record([]byte("hot:a"))
+		}
+		if i%4 == 0 {
+			h.Record([]byte("hot:b"))
+		}
+	}
+	if top := h.Top(-1); len(top) != 0 {
+		t.Fatalf("interval not finished %v", top)
+	}
+
+	h.l.Lock()
+	h.rotate(time.Now().Add(2 * time.Hour))
+	h.l.Unlock()
+	top := h.Top(2)
+	if len(top) != 2 || top[0].Key != "hot:a" || top[1].Key != "hot:b" {
+		t.Fatalf("%+v", top)
+	}
+	// count-min never underestimates
+	if top[0].Count < 500 || top[1].Count < 250 {
+		t.Fatalf("%+v", top)
+	}
+}
+
+func TestProxyHotKeysCommand(t *testing.T) {
+	s := newTestSession(&ProxyConfig{})
+	s.ProxyCommand(newCommand("PROXY", "HOTKEYS"), 0)
+	if got := (<-s.resps).resp.String(); got != "ERR hotkeys is disabled" {
+		t.Fatal(got)
+	}
+
+	s.p.hotkeys = NewHotKeys(2, time.Hour, 1)
+	s.p.hotkeys.Record([]byte("k"))
+	s.p.hotkeys.l.Lock()
+	s.p.hotkeys.rotate(time.Now().Add(2 * time.Hour))
+	s.p.hotkeys.l.Unlock()
+	s.ProxyCommand(newCommand("PROXY", "HOTKEYS", "10"), 1)
+	if got := (<-s.resps).resp.String(); got != "k 1 " {
+		t.Fatalf("%q", got)
+	}
+}
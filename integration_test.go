@@ -0,0 +1,90 @@
+//go:build integration
+// +build integration
+
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// go test -tags integration -run Conformance with ARCHER_REDIS_ADDR=127.0.0.1:6379
+// runs commands against a real redis-server, skipped when the env is not set.
+// keys are prefixed by archer:conformance: and deleted before and after
+func TestConformance(t *testing.T) {
+	addr := os.Getenv("ARCHER_REDIS_ADDR")
+	if addr == "" {
+		t.Skip("ARCHER_REDIS_ADDR not set")
+	}
+
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// keep a copy of what the server sent to compare with Encode
+	var raw bytes.Buffer
+	r := bufio.NewReader(io.TeeReader(c, &raw))
+	w := bufio.NewWriter(c)
+
+	const p = "archer:conformance:"
+	cleanup := []string{"DEL", p + "s", p + "n", p + "l", p + "h", p + "z", p + "x", p + "set"}
+	cmds := [][]string{
+		cleanup,
+		{"PING"},
+		{"SET", p + "s", "hello\r\nworld"},
+		{"GET", p + "s"},
+		{"GET", p + "missing"},
+		{"SET", p + "s", "v", "NX"},
+		{"INCR", p + "n"},
+		{"INCR", p + "s"},
+		{"MGET", p + "s", p + "missing", p + "n"},
+		{"RPUSH", p + "l", "a", "", "c"},
+		{"LRANGE", p + "l", "0", "-1"},
+		{"LRANGE", p + "missing", "0", "-1"},
+		{"HSET", p + "h", "f1", "1", "f2", "2"},
+		{"HGETALL", p + "h"},
+		{"ZADD", p + "z", "1.5", "a", "2", "b"},
+		{"ZRANGE", p + "z", "0", "-1", "WITHSCORES"},
+		{"SADD", p + "set", "m"},
+		{"SMEMBERS", p + "set"},
+		{"XADD", p + "x", "1-1", "f", "v"},
+		{"XRANGE", p + "x", "-", "+"},
+		{"TYPE", p + "h"},
+		{"EXISTS", p + "s", p + "missing"},
+		{"BITFIELD", p + "bf", "INCRBY", "u2", "0", "1", "GET", "u2", "0"},
+		{"COMMAND", "INFO", "get", "nosuchcmd"},
+		{"NOSUCHCMD"},
+		cleanup,
+		{"DEL", p + "bf"},
+	}
+
+	for _, cmd := range cmds {
+		if err := WriteCommand(w, cmd...); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := ReadProtocol(r)
+		if err != nil {
+			t.Fatalf("%q: %s", cmd, err)
+		}
+		if r.Buffered() != 0 {
+			t.Fatalf("%q: %d bytes left after the reply", cmd, r.Buffered())
+		}
+
+		var b bytes.Buffer
+		if err := resp.EncodeTo(&b); err != nil {
+			t.Fatalf("%q: %s", cmd, err)
+		}
+		if !bytes.Equal(b.Bytes(), raw.Bytes()) {
+			t.Fatalf("%q: round trip %q, server sent %q", cmd, b.String(), raw.String())
+		}
+		raw.Reset()
+	}
+}
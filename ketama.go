@@ -0,0 +1,260 @@
+package archer
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dongzerun/archer/util"
+)
+
+// 后端的分布方式
+const (
+	DistCluster = "cluster" // redis cluster, 按 slot 路由
+	DistKetama  = "ketama"  // 独立的 redis, 按 key 的一致性哈希路由, 和 twemproxy 一样
+)
+
+// the key hashes of twemproxy
+const (
+	HashFnv1a64 = "fnv1a_64"
+	HashFnv1a32 = "fnv1a_32"
+	HashMD5     = "md5"
+)
+
+// same as nc_ketama.c, a server of weight w among n servers of total
+// weight t gets floor(w/t*160/4*n)*4 points
+const ketamaPointsPerServer = 160
+
+// KetamaServer is a standalone backend: host:port:weight [name]. The name,
+// host:port by default, is what the ring hashes, renaming a server moves
+// its keys. Like twemproxy the default name of port 11211 is the host only
+type KetamaServer struct {
+	Addr   string
+	Name   string
+	Weight int
+}
+
+type ketamaPoint struct {
+	value uint32
+	index int // in servers
+}
+
+// Ketama routes keys to standalone servers by consistent hashing, the way
+// twemproxy does with distribution ketama, so archer finds the keys
+// twemproxy stored given the same servers, names, weights, hash and
+// hash_tag. A server added or removed only moves its share of the keys
+type Ketama struct {
+	servers []*Node
+	points  []ketamaPoint // sorted by value
+	hash    func([]byte) uint32
+	tag     []byte  // two bytes like {}, nil hashes the whole key
+	ejected []int32 // per server, 1 while its keys go to the next servers
+}
+
+// ParseKetamaServers parses comma separated host:port:weight [name]
+func ParseKetamaServers(s string) ([]KetamaServer, error) {
+	var servers []KetamaServer
+	for _, e := range strings.Split(s, ",") {
+		f := strings.Fields(e)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) > 2 {
+			return nil, fmt.Errorf("ketama server %q is not host:port:weight [name]", e)
+		}
+		i := strings.LastIndex(f[0], ":")
+		if i < 0 {
+			return nil, fmt.Errorf("ketama server %s has no weight", f[0])
+		}
+		weight, err := strconv.Atoi(f[0][i+1:])
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("ketama server %s weight must be a positive number", f[0])
+		}
+		addr := f[0][:i]
+		if nodeFromAddr(addr) == nil {
+			return nil, fmt.Errorf("ketama server %s is not host:port:weight", f[0])
+		}
+		ks := KetamaServer{Addr: addr, Name: addr, Weight: weight}
+		if len(f) == 2 {
+			ks.Name = f[1]
+		} else if host, port, _ := net.SplitHostPort(addr); port == "11211" {
+			ks.Name = host
+		}
+		servers = append(servers, ks)
+	}
+	return servers, nil
+}
+
+// NewKetama builds the ring of servers, hash is one of HashFnv1a64,
+// HashFnv1a32 and HashMD5, tag is empty or two bytes
+func NewKetama(servers []KetamaServer, hash, tag string) (*Ketama, error) {
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("ketama without servers")
+	}
+	if tag != "" && len(tag) != 2 {
+		return nil, fmt.Errorf("ketama hashtag %q must be two bytes", tag)
+	}
+	k := &Ketama{}
+	switch hash {
+	case HashFnv1a64:
+		k.hash = hashFnv1a64
+	case HashFnv1a32:
+		k.hash = hashFnv1a32
+	case HashMD5:
+		k.hash = hashMD5
+	default:
+		return nil, fmt.Errorf("ketama hash %s unknown", hash)
+	}
+	if tag != "" {
+		k.tag = []byte(tag)
+	}
+
+	total := 0
+	for _, ks := range servers {
+		total += ks.Weight
+	}
+	seen := make(map[string]bool)
+	for i, ks := range servers {
+		if seen[ks.Addr] {
+			return nil, fmt.Errorf("ketama server %s listed twice", ks.Addr)
+		}
+		seen[ks.Addr] = true
+		n := nodeFromAddr(ks.Addr)
+		if n == nil {
+			return nil, fmt.Errorf("ketama server %s is not host:port", ks.Addr)
+		}
+		n.name = ks.Name
+		k.servers = append(k.servers, n)
+		k.ejected = append(k.ejected, 0)
+
+		// float32 like the C code, or the points of odd weights differ
+		pct := float32(ks.Weight) / float32(total)
+		share := float64(pct*ketamaPointsPerServer/4*float32(len(servers))) + 0.0000000001
+		points := int(math.Floor(float64(float32(share)))) * 4
+		for p := 0; p < points/4; p++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", ks.Name, p)))
+			for x := 0; x < 4; x++ {
+				k.points = append(k.points, ketamaPoint{value: md5Word(digest, x), index: i})
+			}
+		}
+	}
+	sort.Slice(k.points, func(i, j int) bool { return k.points[i].value < k.points[j].value })
+	return k, nil
+}
+
+// Index returns the index of the server of key in Servers. The keys of an
+// ejected server go to the next server of the ring, like twemproxy's
+// auto_eject_hosts, unless every server is ejected
+func (k *Ketama) Index(key []byte) int {
+	if len(k.servers) == 1 {
+		return 0
+	}
+	h := k.hash(k.hashKey(key))
+	i := sort.Search(len(k.points), func(i int) bool { return k.points[i].value >= h })
+	for n := 0; n < len(k.points); n++ {
+		p := k.points[(i+n)%len(k.points)]
+		if atomic.LoadInt32(&k.ejected[p.index]) == 0 {
+			return p.index
+		}
+	}
+	return k.points[i%len(k.points)].index
+}
+
+// Eject takes the server id off the ring, or puts it back with on false
+func (k *Ketama) Eject(id string, on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	for i, n := range k.servers {
+		if n.id == id {
+			atomic.StoreInt32(&k.ejected[i], v)
+		}
+	}
+}
+
+// Get returns the server of key
+func (k *Ketama) Get(key []byte) *Node {
+	return k.servers[k.Index(key)]
+}
+
+// Servers returns the servers in the order configured
+func (k *Ketama) Servers() []*Node {
+	return k.servers
+}
+
+// Node returns the server of id host:port, nil if it's not in the ring
+func (k *Ketama) Node(id string) *Node {
+	for _, n := range k.servers {
+		if n.id == id {
+			return n
+		}
+	}
+	return nil
+}
+
+// hashKey returns the part of key between the hash tag, if there is one
+// and it's not empty, like twemproxy's hash_tag
+func (k *Ketama) hashKey(key []byte) []byte {
+	if k.tag == nil {
+		return key
+	}
+	start := bytes.IndexByte(key, k.tag[0])
+	if start < 0 {
+		return key
+	}
+	end := bytes.IndexByte(key[start+1:], k.tag[1])
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+func md5Word(digest [md5.Size]byte, x int) uint32 {
+	return uint32(digest[3+x*4])<<24 | uint32(digest[2+x*4])<<16 | uint32(digest[1+x*4])<<8 | uint32(digest[x*4])
+}
+
+func hashMD5(key []byte) uint32 {
+	return md5Word(md5.Sum(key), 0)
+}
+
+// hashFnv1a64 is fnv1a_64 of twemproxy, computed in 32 bits with the
+// 64 bit offset and prime truncated
+func hashFnv1a64(key []byte) uint32 {
+	h := uint32(0xcbf29ce484222325 & 0xffffffff)
+	for _, b := range key {
+		h ^= signedByte(b)
+		h *= uint32(0x100000001b3 & 0xffffffff)
+	}
+	return h
+}
+
+func hashFnv1a32(key []byte) uint32 {
+	h := uint32(0x811c9dc5)
+	for _, b := range key {
+		h ^= signedByte(b)
+		h *= 0x01000193
+	}
+	return h
+}
+
+// signedByte is b widened like a C char, twemproxy's fnv hashes sign
+// extend the bytes over 0x7f
+func signedByte(b byte) uint32 {
+	return uint32(int32(int8(b)))
+}
+
+// keySlot groups the keys going to the same backend: their cluster slot,
+// or their server in the ketama ring. pc nil is a cluster
+func keySlot(pc *ProxyConfig, key []byte) int {
+	if pc != nil && pc.ring != nil {
+		return pc.ring.Index(key)
+	}
+	return int(util.Crc16sum(key) % 16384)
+}
@@ -0,0 +1,155 @@
+package archer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"testing"
+)
+
+func TestParseKetamaServers(t *testing.T) {
+	servers, err := ParseKetamaServers("10.0.0.1:6379:1, 10.0.0.2:6379:2 shard2,10.0.0.3:11211:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []KetamaServer{
+		{Addr: "10.0.0.1:6379", Name: "10.0.0.1:6379", Weight: 1},
+		{Addr: "10.0.0.2:6379", Name: "shard2", Weight: 2},
+		{Addr: "10.0.0.3:11211", Name: "10.0.0.3", Weight: 1},
+	}
+	if len(servers) != len(want) {
+		t.Fatalf("servers %+v", servers)
+	}
+	for i := range want {
+		if servers[i] != want[i] {
+			t.Fatalf("server %d %+v, want %+v", i, servers[i], want[i])
+		}
+	}
+
+	for _, s := range []string{"10.0.0.1:6379", "10.0.0.1:6379:0", "10.0.0.1:6379:1 a b", "10.0.0.1:1"} {
+		if _, err := ParseKetamaServers(s); err == nil {
+			t.Fatalf("%q accepted", s)
+		}
+	}
+}
+
+// the points and servers of twemproxy for the same servers, built from
+// nc_ketama.c with the default hash fnv1a_64
+func TestKetamaTwemproxy(t *testing.T) {
+	servers, _ := ParseKetamaServers("10.0.0.1:6379:1, 10.0.0.2:6379:2, 10.0.0.3:6379:3 shard3")
+	k, err := NewKetama(servers, HashFnv1a64, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	points := make([]int, 3)
+	for _, p := range k.points {
+		points[p.index]++
+	}
+	if points[0] != 80 || points[1] != 160 || points[2] != 240 {
+		t.Fatalf("points %v", points)
+	}
+
+	for key, want := range map[string]int{
+		"foo": 1, "bar": 2, "user:1000": 0, "a": 1, "你好": 2, "k1": 2,
+	} {
+		if i := k.Index([]byte(key)); i != want {
+			t.Fatalf("%s on server %d, twemproxy %d", key, i, want)
+		}
+	}
+	if h := hashFnv1a64([]byte("你好")); h != 931594915 {
+		t.Fatalf("fnv1a_64 of a key over 0x7f %d", h)
+	}
+	h := fnv.New32a()
+	h.Write([]byte("user:1000"))
+	if hashFnv1a32([]byte("user:1000")) != h.Sum32() {
+		t.Fatal("fnv1a_32 differs from hash/fnv")
+	}
+}
+
+func TestKetamaRing(t *testing.T) {
+	if _, err := NewKetama(nil, HashFnv1a64, ""); err == nil {
+		t.Fatal("ring without servers")
+	}
+	servers, _ := ParseKetamaServers("10.0.0.1:6379:1, 10.0.0.2:6379:1, 10.0.0.3:6379:1")
+	for _, bad := range [][2]string{{"crc16", ""}, {HashMD5, "{"}} {
+		if _, err := NewKetama(servers, bad[0], bad[1]); err == nil {
+			t.Fatalf("hash %s hashtag %s accepted", bad[0], bad[1])
+		}
+	}
+
+	k, _ := NewKetama(servers, HashMD5, "{}")
+	if k.Index([]byte("{user1}.name")) != k.Index([]byte("{user1}.age")) {
+		t.Fatal("keys of a hash tag on different servers")
+	}
+	if string(k.hashKey([]byte("a{}b"))) != "a{}b" {
+		t.Fatal("empty hash tag not hashing the whole key")
+	}
+
+	// a server removed only moves its keys
+	small, _ := NewKetama(servers[:2], HashMD5, "{}")
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key:%d", i))
+		n := k.Get(key)
+		if n.id == "10.0.0.3:6379" {
+			continue
+		}
+		if small.Get(key).id != n.id {
+			moved++
+		}
+	}
+	if moved != 0 {
+		t.Fatalf("%d keys of the servers left moved", moved)
+	}
+
+	// the keys of an ejected server go to the others, the rest stay
+	home := make([]string, 3000)
+	for i := range home {
+		home[i] = k.Get([]byte(fmt.Sprintf("key:%d", i))).id
+	}
+	k.Eject("10.0.0.3:6379", true)
+	for i := range home {
+		id := k.Get([]byte(fmt.Sprintf("key:%d", i))).id
+		if id == "10.0.0.3:6379" || (home[i] != "10.0.0.3:6379" && id != home[i]) {
+			t.Fatalf("key:%d on %s ejected, %s before", i, id, home[i])
+		}
+	}
+	k.Eject("10.0.0.3:6379", false)
+	for i := range home {
+		if k.Get([]byte(fmt.Sprintf("key:%d", i))).id != home[i] {
+			t.Fatalf("key:%d not back on %s", i, home[i])
+		}
+	}
+}
+
+func TestKetamaRouting(t *testing.T) {
+	servers, _ := ParseKetamaServers("10.0.0.1:6379:1, 10.0.0.2:6379:1")
+	ring, _ := NewKetama(servers, HashFnv1a64, "")
+	pc := &ProxyConfig{distribution: DistKetama, ring: ring}
+	topo := &Topology{conf: pc, slots: &SlotMap{}, reloadChan: make(chan int, 1)}
+
+	if ids := topo.Masters(); len(ids) != 2 || ids[0] != "10.0.0.1:6379" {
+		t.Fatalf("masters %v", ids)
+	}
+	if id := topo.GetNodeID([]byte("foo"), true); id != ring.Get([]byte("foo")).id {
+		t.Fatalf("foo on %s", id)
+	}
+	if n := topo.GetNode("10.0.0.2:6379"); n == nil || n.role != "master" {
+		t.Fatalf("node %+v", n)
+	}
+	if nodes := topo.Nodes(); len(nodes) != 2 || nodes[1].ID != "10.0.0.2:6379" {
+		t.Fatalf("nodes %+v", nodes)
+	}
+
+	// multi key commands are split by server
+	parts := splitMGet(pc, newCommand("MGET", "foo", "bar", "user:1000", "a"))
+	for slot, part := range parts {
+		for _, arg := range part.cmd.Args[1:] {
+			if keySlot(pc, arg.Args[0]) != slot {
+				t.Fatalf("%s in the part of server %d", arg.Args[0], slot)
+			}
+		}
+	}
+	if _, err := keysSlot(pc, [][]byte{[]byte("foo"), []byte("foo")}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,269 @@
+package archer
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var RateLimitError = errors.New("ERR rate limit exceeded")
+
+// 超过限速时的处理方式
+const (
+	LimitReject = "reject" // 回复错误
+	LimitDelay  = "delay"  // 推迟读取客户端的下一条命令
+)
+
+// 客户端限速的粒度
+const (
+	LimitPerIP   = "ip"   // 同一个 IP 的连接共用额度
+	LimitPerConn = "conn" // 每个连接单独计算
+)
+
+// TokenBucket allows rate tokens per second with bursts of burst tokens.
+// It may run into debt: Take always succeeds and tells how long until the
+// debt is paid back, so a command bigger than burst still goes through
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket, nil if rate <= 0 which means no
+// limit. A burst <= 0 is one second of rate
+func NewTokenBucket(rate, burst float64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	return &TokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if d := now.Sub(b.last); d > 0 {
+		b.tokens += d.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// Allow takes n tokens if the bucket is not in debt and holds n tokens,
+// or is full for n over burst. A nil bucket allows everything
+func (b *TokenBucket) Allow(n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	need := n
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens < need {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Take takes n tokens even if it runs the bucket into debt, and returns
+// how long until the bucket is out of debt, 0 if it isn't
+func (b *TokenBucket) Take(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund gives back n tokens taken by Allow
+func (b *TokenBucket) refund(n float64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if b.tokens += n; b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.mu.Unlock()
+}
+
+// ClientLimit is the quota of a client, shared by the connections of one
+// IP when the limit is per IP
+type ClientLimit struct {
+	key   string
+	qps   *TokenBucket
+	bytes *TokenBucket
+	refs  int // connections sharing it, guarded by RateLimiter.mu
+}
+
+// RateLimiter caps the commands and bytes per second of the whole proxy
+// and of every client. Request bytes are counted when the command is read,
+// reply bytes when the reply is written, a big reply delays or rejects
+// the next commands of the client. Its methods are no-ops on nil
+type RateLimiter struct {
+	mode  string // reject or delay
+	reply error  // replied in reject mode
+
+	qps   *TokenBucket // global, nil no limit
+	bytes *TokenBucket
+
+	per         string // ip or conn
+	clientQPS   float64
+	clientBytes float64
+
+	mu      sync.Mutex
+	clients map[string]*ClientLimit
+}
+
+// NewRateLimiter returns the limiter configured by pc, nil if there is no
+// limit at all
+func NewRateLimiter(pc *ProxyConfig) *RateLimiter {
+	if pc.limitQPS <= 0 && pc.limitBytes <= 0 && pc.limitClientQPS <= 0 && pc.limitClientBytes <= 0 {
+		return nil
+	}
+	rl := &RateLimiter{
+		mode:        pc.limitMode,
+		reply:       RateLimitError,
+		qps:         NewTokenBucket(pc.limitQPS, 0),
+		bytes:       NewTokenBucket(pc.limitBytes, 0),
+		per:         pc.limitPer,
+		clientQPS:   pc.limitClientQPS,
+		clientBytes: pc.limitClientBytes,
+		clients:     make(map[string]*ClientLimit),
+	}
+	if pc.limitReply != "" {
+		rl.reply = errors.New(pc.limitReply)
+	}
+	return rl
+}
+
+// Client returns the quota of the client at remote, the caller releases
+// it with Release when the connection is closed
+func (rl *RateLimiter) Client(remote string) *ClientLimit {
+	if rl == nil || (rl.clientQPS <= 0 && rl.clientBytes <= 0) {
+		return nil
+	}
+	key := remote
+	if rl.per == LimitPerIP {
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			key = host
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	cl, ok := rl.clients[key]
+	if !ok {
+		cl = &ClientLimit{
+			key:   key,
+			qps:   NewTokenBucket(rl.clientQPS, 0),
+			bytes: NewTokenBucket(rl.clientBytes, 0),
+		}
+		rl.clients[key] = cl
+	}
+	cl.refs++
+	return cl
+}
+
+// Release forgets cl once the last connection using it is closed
+func (rl *RateLimiter) Release(cl *ClientLimit) {
+	if rl == nil || cl == nil {
+		return
+	}
+	rl.mu.Lock()
+	if cl.refs--; cl.refs <= 0 {
+		delete(rl.clients, cl.key)
+	}
+	rl.mu.Unlock()
+}
+
+// Reject takes the quota of a command of size bytes in reject mode, and
+// returns the error to reply if a limit is hit. It's nil in delay mode
+func (rl *RateLimiter) Reject(cl *ClientLimit, size int64) error {
+	if rl == nil || rl.mode != LimitReject {
+		return nil
+	}
+	var cqps, cbytes *TokenBucket
+	if cl != nil {
+		cqps, cbytes = cl.qps, cl.bytes
+	}
+
+	n := float64(size)
+	if !cqps.Allow(1) {
+		Stats.RateLimited.With("client").Add(1)
+		return rl.reply
+	}
+	if !cbytes.Allow(n) {
+		cqps.refund(1)
+		Stats.RateLimited.With("client").Add(1)
+		return rl.reply
+	}
+	if !rl.qps.Allow(1) {
+		cqps.refund(1)
+		cbytes.refund(n)
+		Stats.RateLimited.With("global").Add(1)
+		return rl.reply
+	}
+	if !rl.bytes.Allow(n) {
+		cqps.refund(1)
+		cbytes.refund(n)
+		rl.qps.refund(1)
+		Stats.RateLimited.With("global").Add(1)
+		return rl.reply
+	}
+	return nil
+}
+
+// Delay takes the quota of a command of size bytes in delay mode, and
+// returns how long to wait before reading the next command. It's 0 in
+// reject mode
+func (rl *RateLimiter) Delay(cl *ClientLimit, size int64) time.Duration {
+	if rl == nil || rl.mode != LimitDelay {
+		return 0
+	}
+	n := float64(size)
+	d := maxDuration(rl.qps.Take(1), rl.bytes.Take(n))
+	scope := "global"
+	if cl != nil {
+		if cd := maxDuration(cl.qps.Take(1), cl.bytes.Take(n)); cd > d {
+			d, scope = cd, "client"
+		}
+	}
+	if d > 0 {
+		Stats.RateLimited.With(scope).Add(1)
+	}
+	return d
+}
+
+// Written counts a reply of size bytes, it only affects the next commands
+func (rl *RateLimiter) Written(cl *ClientLimit, size int64) {
+	if rl == nil {
+		return
+	}
+	rl.bytes.Take(float64(size))
+	if cl != nil {
+		cl.bytes.Take(float64(size))
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
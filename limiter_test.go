@@ -0,0 +1,93 @@
+package archer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var nilBucket *TokenBucket
+	if !nilBucket.Allow(1) || nilBucket.Take(1) != 0 {
+		t.Fatal("nil bucket limits")
+	}
+	if NewTokenBucket(0, 10) != nil {
+		t.Fatal("rate 0 is not unlimited")
+	}
+
+	b := NewTokenBucket(10, 0)
+	for i := 0; i < 10; i++ {
+		if !b.Allow(1) {
+			t.Fatalf("token %d of the burst denied", i)
+		}
+	}
+	if b.Allow(1) {
+		t.Fatal("empty bucket allowed a token")
+	}
+
+	// a command over burst goes through a full bucket, into debt
+	b = NewTokenBucket(10, 0)
+	if !b.Allow(25) {
+		t.Fatal("full bucket denied a command over burst")
+	}
+	if b.Allow(1) {
+		t.Fatal("bucket in debt allowed a token")
+	}
+	if d := b.Take(5); d < 1900*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("debt of 20 tokens at 10/s paid back in %s", d)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	if NewRateLimiter(&ProxyConfig{}) != nil {
+		t.Fatal("limiter without limits")
+	}
+
+	pc := &ProxyConfig{limitClientQPS: 2, limitPer: LimitPerIP, limitMode: LimitReject, limitReply: "ERR slow down"}
+	rl := NewRateLimiter(pc)
+	a := rl.Client("10.0.0.1:5000")
+	b := rl.Client("10.0.0.1:5001")
+	c := rl.Client("10.0.0.2:5000")
+	if a != b || a == c {
+		t.Fatal("clients of an IP don't share their limit")
+	}
+	if rl.Reject(a, 10) != nil || rl.Reject(b, 10) != nil {
+		t.Fatal("commands within the limit rejected")
+	}
+	if err := rl.Reject(a, 10); err == nil || err.Error() != "ERR slow down" {
+		t.Fatalf("command over the limit got %v", err)
+	}
+	if rl.Reject(c, 10) != nil {
+		t.Fatal("other IP limited")
+	}
+	if rl.Delay(a, 10) != 0 {
+		t.Fatal("reject mode delayed a command")
+	}
+
+	rl.Release(a)
+	rl.Release(b)
+	rl.Release(c)
+	if len(rl.clients) != 0 {
+		t.Fatalf("%d clients left after release", len(rl.clients))
+	}
+
+	// per connection, delay mode and a global bandwidth
+	pc = &ProxyConfig{limitBytes: 100, limitClientQPS: 1, limitPer: LimitPerConn, limitMode: LimitDelay}
+	rl = NewRateLimiter(pc)
+	a, b = rl.Client("10.0.0.1:5000"), rl.Client("10.0.0.1:5001")
+	if a == b {
+		t.Fatal("connections share their limit")
+	}
+	if d := rl.Delay(a, 10); d != 0 {
+		t.Fatalf("first command delayed %s", d)
+	}
+	if d := rl.Delay(a, 10); d < 900*time.Millisecond {
+		t.Fatalf("second command of 1 qps delayed %s", d)
+	}
+	rl.Written(b, 290)
+	if d := rl.Delay(b, 0); d < 1900*time.Millisecond {
+		t.Fatalf("reply over the bandwidth delayed the next command %s", d)
+	}
+	if rl.Reject(b, 10) != nil {
+		t.Fatal("delay mode rejected a command")
+	}
+}
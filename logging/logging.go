@@ -0,0 +1,361 @@
+// Package logging is the leveled, structured logger of archer. Entries have
+// a time, a level, the caller, a message and optional key value fields,
+// written as text or as one JSON object per line:
+//
+//	2026-10-15T08:00:00.000Z warning session.go:222 close the client client=10.0.0.1:5000
+//	{"time":"2026-10-15T08:00:00.000Z","level":"warning","caller":"session.go:222","msg":"close the client","client":"10.0.0.1:5000"}
+//
+// The package functions log to the standard logger, their names are those
+// of github.com/ngaut/logging it replaces
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelFatal
+)
+
+var levelNames = []string{"debug", "info", "warning", "error", "fatal"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelFatal {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name, warn is warning
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(s)
+	if s == "warn" {
+		return LevelWarning, nil
+	}
+	for i, name := range levelNames {
+		if name == s {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %s", s)
+}
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Logger writes the entries of at least its level to its output, it's safe
+// for concurrent use
+type Logger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level Level
+	json  bool
+	buf   bytes.Buffer
+}
+
+// New returns a text logger of level info writing to out
+func New(out io.Writer) *Logger {
+	return &Logger{out: out, level: LevelInfo}
+}
+
+func (l *Logger) SetOutput(out io.Writer) {
+	l.mu.Lock()
+	l.out = out
+	l.mu.Unlock()
+}
+
+// Output returns the writer of l, loggers sharing it write to the same
+// file and follow its rotation
+func (l *Logger) Output() io.Writer {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.out
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.mu.Lock()
+	l.level = level
+	l.mu.Unlock()
+}
+
+// SetJSON switches between one JSON object per line and text
+func (l *Logger) SetJSON(on bool) {
+	l.mu.Lock()
+	l.json = on
+	l.mu.Unlock()
+}
+
+// Enabled reports whether entries of level are written
+func (l *Logger) Enabled(level Level) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return level >= l.level
+}
+
+// Log writes msg with the fields kv, pairs of a string key and a value
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	l.output(1, level, msg, kv)
+}
+
+// output writes an entry, calldepth is the number of frames between output
+// and the caller reported
+func (l *Logger) output(calldepth int, level Level, msg string, kv []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	caller := "???:0"
+	if _, file, line, ok := runtime.Caller(calldepth + 1); ok {
+		caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+	}
+	now := time.Now().UTC().Format(timeFormat)
+
+	b := &l.buf
+	b.Reset()
+	if l.json {
+		b.WriteString(`{"time":"`)
+		b.WriteString(now)
+		b.WriteString(`","level":"`)
+		b.WriteString(level.String())
+		b.WriteString(`","caller":`)
+		writeJSON(b, caller)
+		b.WriteString(`,"msg":`)
+		writeJSON(b, msg)
+		for i := 0; i < len(kv); i += 2 {
+			b.WriteByte(',')
+			writeJSON(b, fieldKey(kv, i))
+			b.WriteByte(':')
+			writeJSON(b, fieldValue(kv, i))
+		}
+		b.WriteString("}\n")
+	} else {
+		b.WriteString(now)
+		b.WriteByte(' ')
+		b.WriteString(level.String())
+		b.WriteByte(' ')
+		b.WriteString(caller)
+		b.WriteByte(' ')
+		b.WriteString(strings.TrimRight(msg, "\n "))
+		for i := 0; i < len(kv); i += 2 {
+			b.WriteByte(' ')
+			b.WriteString(fieldKey(kv, i))
+			b.WriteByte('=')
+			b.WriteString(textValue(fieldValue(kv, i)))
+		}
+		b.WriteByte('\n')
+	}
+	l.out.Write(b.Bytes())
+}
+
+func fieldKey(kv []interface{}, i int) string {
+	if k, ok := kv[i].(string); ok {
+		return k
+	}
+	return fmt.Sprint(kv[i])
+}
+
+func fieldValue(kv []interface{}, i int) interface{} {
+	if i+1 >= len(kv) {
+		return "!MISSING"
+	}
+	switch v := kv[i+1].(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	case []byte:
+		return string(v)
+	}
+	return kv[i+1]
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// textValue quotes strings with spaces, quotes or control characters
+func textValue(v interface{}) string {
+	s, ok := v.(string)
+	if !ok {
+		if data, err := json.Marshal(v); err == nil {
+			return string(data)
+		}
+		return fmt.Sprint(v)
+	}
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r <= ' ' || r == '"' || r == '=' }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// std is the logger of the package functions, stderr until
+// SetOutputByName
+var std = New(os.Stderr)
+
+// Std returns the standard logger
+func Std() *Logger {
+	return std
+}
+
+func Debug(v ...interface{})              { std.output(1, LevelDebug, fmt.Sprint(v...), nil) }
+func Debugf(f string, v ...interface{})   { std.output(1, LevelDebug, fmt.Sprintf(f, v...), nil) }
+func Info(v ...interface{})               { std.output(1, LevelInfo, fmt.Sprint(v...), nil) }
+func Infof(f string, v ...interface{})    { std.output(1, LevelInfo, fmt.Sprintf(f, v...), nil) }
+func Warning(v ...interface{})            { std.output(1, LevelWarning, fmt.Sprint(v...), nil) }
+func Warningf(f string, v ...interface{}) { std.output(1, LevelWarning, fmt.Sprintf(f, v...), nil) }
+func Warn(v ...interface{})               { std.output(1, LevelWarning, fmt.Sprint(v...), nil) }
+func Warnf(f string, v ...interface{})    { std.output(1, LevelWarning, fmt.Sprintf(f, v...), nil) }
+func Error(v ...interface{})              { std.output(1, LevelError, fmt.Sprint(v...), nil) }
+func Errorf(f string, v ...interface{})   { std.output(1, LevelError, fmt.Sprintf(f, v...), nil) }
+
+// Fatal logs and exits the process
+func Fatal(v ...interface{}) {
+	std.output(1, LevelFatal, fmt.Sprint(v...), nil)
+	os.Exit(1)
+}
+
+func Fatalf(f string, v ...interface{}) {
+	std.output(1, LevelFatal, fmt.Sprintf(f, v...), nil)
+	os.Exit(1)
+}
+
+// Log writes a structured entry to the standard logger
+func Log(level Level, msg string, kv ...interface{}) {
+	std.output(1, level, msg, kv)
+}
+
+// SetLevelByString sets the level of the standard logger, unknown names
+// keep it
+func SetLevelByString(s string) {
+	if level, err := ParseLevel(s); err == nil {
+		std.SetLevel(level)
+	}
+}
+
+// SetFormat sets the format of the standard logger, text or json
+func SetFormat(format string) error {
+	switch format {
+	case "text":
+		std.SetJSON(false)
+	case "json":
+		std.SetJSON(true)
+	default:
+		return fmt.Errorf("unknown log format %s", format)
+	}
+	return nil
+}
+
+var stdFile *RotateFile
+
+// SetOutputByName sends the standard logger to the file path
+func SetOutputByName(path string) error {
+	f, err := OpenRotateFile(path)
+	if err != nil {
+		return err
+	}
+	stdFile = f
+	std.SetOutput(f)
+	return nil
+}
+
+// SetRotateByDay rotates the file of SetOutputByName every day
+func SetRotateByDay() {
+	if stdFile != nil {
+		stdFile.SetRotate(RotateDaily)
+	}
+}
+
+// SetRotateByHour rotates the file of SetOutputByName every hour
+func SetRotateByHour() {
+	if stdFile != nil {
+		stdFile.SetRotate(RotateHourly)
+	}
+}
+
+// 轮转后的文件名后缀
+const (
+	RotateNone   = ""
+	RotateDaily  = "20060102"
+	RotateHourly = "2006010215"
+)
+
+// RotateFile is a log file renamed to path.suffix when the period of its
+// rotation, a time layout, is over, and opened afresh
+type RotateFile struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	layout string
+	period string // of the entries in f
+}
+
+// OpenRotateFile opens path for appending, it doesn't rotate until
+// SetRotate
+func OpenRotateFile(path string) (*RotateFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &RotateFile{path: path, f: f}, nil
+}
+
+// SetRotate sets the rotation, RotateNone, RotateDaily or RotateHourly
+func (rf *RotateFile) SetRotate(layout string) {
+	rf.mu.Lock()
+	rf.layout = layout
+	rf.period = time.Now().Format(layout)
+	rf.mu.Unlock()
+}
+
+func (rf *RotateFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.layout != RotateNone {
+		if period := time.Now().Format(rf.layout); period != rf.period {
+			rf.rotate()
+			rf.period = period
+		}
+	}
+	return rf.f.Write(b)
+}
+
+// rotate keeps writing to the old file if the new one can't be opened
+func (rf *RotateFile) rotate() {
+	if err := os.Rename(rf.path, rf.path+"."+rf.period); err != nil {
+		return
+	}
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	rf.f.Close()
+	rf.f = f
+}
+
+func (rf *RotateFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
@@ -0,0 +1,90 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoggerText(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.SetLevel(LevelWarning)
+	l.Log(LevelInfo, "dropped")
+	l.Log(LevelWarning, "close the client", "client", "10.0.0.1:5000", "reason", "read timeout", "n", 3)
+
+	line := buf.String()
+	if strings.Contains(line, "dropped") || strings.Count(line, "\n") != 1 {
+		t.Fatalf("level filter %q", line)
+	}
+	f := strings.Fields(line)
+	if f[1] != "warning" || !strings.HasPrefix(f[2], "logging_test.go:") {
+		t.Fatalf("level or caller %q", line)
+	}
+	if !strings.HasSuffix(line, `close the client client=10.0.0.1:5000 reason="read timeout" n=3`+"\n") {
+		t.Fatalf("fields %q", line)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.SetJSON(true)
+	l.Log(LevelError, "bad \"reply\"", "keys", []string{"a", "b"}, "odd")
+
+	var e map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("%s: %q", err, buf.String())
+	}
+	if e["level"] != "error" || e["msg"] != `bad "reply"` || e["odd"] != "!MISSING" {
+		t.Fatalf("entry %v", e)
+	}
+	if keys, ok := e["keys"].([]interface{}); !ok || len(keys) != 2 {
+		t.Fatalf("keys %v", e["keys"])
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LevelDebug, "WARN": LevelWarning, "error": LevelError} {
+		if l, err := ParseLevel(s); err != nil || l != want {
+			t.Fatalf("%s parsed %v %v", s, l, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("unknown level parsed")
+	}
+	if err := SetFormat("xml"); err == nil {
+		t.Fatal("unknown format set")
+	}
+}
+
+func TestRotateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archer-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archer.log")
+
+	rf, err := OpenRotateFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+	rf.SetRotate(RotateDaily)
+	rf.Write([]byte("old\n"))
+	// the period is over, the next write goes to a new file
+	rf.period = "20000101"
+	rf.Write([]byte("new\n"))
+
+	if b, _ := ioutil.ReadFile(path + ".20000101"); string(b) != "old\n" {
+		t.Fatalf("rotated file %q", b)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "new\n" {
+		t.Fatalf("log file %q", b)
+	}
+}
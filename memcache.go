@@ -0,0 +1,472 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/dongzerun/archer/logging"
+)
+
+// memcached 文本协议前端, 命令翻译成 redis 命令后按 key 路由, 和 redis 客户端共用
+// 集群, 连接池和 MOVED/ASK 处理.
+//
+// 一个 memcached item 存成一个 redis string, 值为 "flags:data", 比如 flags 为 0 的
+// abc 存成 "0:abc". exptime 和 memcached 一样: 0 不过期, 30 天以内是相对秒数,
+// 更大是 unix 时间戳, 负数立即过期. get/set/add/replace/delete/touch 对应一条 redis
+// 命令, incr/decr/append/prepend 读出来改完用 memcacheCAS 脚本写回, 值被别人改过就重试
+
+// memcacheMaxKeyLen is the longest key memcached accepts
+const memcacheMaxKeyLen = 250
+
+// memcacheRelativeExptime is the largest exptime in seconds from now, a
+// larger one is a unix timestamp
+const memcacheRelativeExptime = 60 * 60 * 24 * 30
+
+// memcacheCASRetries is how many times incr, decr, append and prepend read
+// the item again when it changed before it was written back
+const memcacheCASRetries = 16
+
+// memcacheCAS sets KEYS[1] to ARGV[2] keeping its ttl if it still holds
+// ARGV[1], it returns 1 if so and 0 if the key changed or is gone
+const memcacheCAS = "if redis.call('GET', KEYS[1]) == ARGV[1] then " +
+	"redis.call('SET', KEYS[1], ARGV[2], 'KEEPTTL') return 1 end return 0"
+
+// memcached commands known but not translated
+var memcacheUnsupported = map[string]bool{
+	"gets": true, "gat": true, "gats": true, "cas": true, "flush_all": true,
+	"stats": true, "slabs": true, "lru_crawler": true, "watch": true, "shutdown": true,
+	"mg": true, "ms": true, "md": true, "ma": true, "mn": true, "me": true,
+}
+
+var (
+	memcacheFormatError = errors.New("CLIENT_ERROR bad command line format")
+	memcacheChunkError  = errors.New("CLIENT_ERROR bad data chunk")
+	memcacheNumberError = errors.New("CLIENT_ERROR cannot increment or decrement non-numeric value")
+	memcacheDeltaError  = errors.New("CLIENT_ERROR invalid numeric delta argument")
+	memcacheRetryError  = errors.New("SERVER_ERROR item changed too often, try again")
+)
+
+// memcacheConn is a client of the memcached listener. It has no pipeline
+// or session of its own: commands are served one by one, the Session is
+// only there to route them to the backends
+type memcacheConn struct {
+	p *Proxy
+	s *Session
+	c net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+
+	lim *readLimits
+}
+
+// HandleMemcacheConn serves a client of the memcached listener until it
+// quits or fails. The memcached text protocol has no authentication, the
+// listener must only be reachable by trusted clients
+func HandleMemcacheConn(p *Proxy, c net.Conn) {
+	Stats.Clients.Add(1)
+	defer Stats.Clients.Add(-1)
+	mc := &memcacheConn{
+		p:   p,
+		s:   &Session{p: p, remote: clientAddr(c), created: time.Now()},
+		c:   c,
+		r:   bufio.NewReader(countingReader{c, &Stats.BytesIn}),
+		w:   bufio.NewWriter(countingWriter{c, &Stats.BytesOut}),
+		lim: &readLimits{ParserLimits: p.conf().parserLimits()},
+	}
+	if err := mc.serve(); err != nil && err != io.EOF {
+		log.Warningf("memcache client %s %s", mc.s.remote, err)
+	}
+	c.Close()
+}
+
+func (mc *memcacheConn) serve() error {
+	for {
+		if t := mc.p.conf().clientTimeout; t > 0 {
+			mc.c.SetReadDeadline(time.Now().Add(t))
+		}
+		line, err := mc.lim.readLine(mc.r)
+		if err == LineTooLongError {
+			mc.w.WriteString("CLIENT_ERROR line too long\r\n")
+			return mc.w.Flush()
+		}
+		if err != nil {
+			return err
+		}
+
+		quit, err := mc.exec(strings.Fields(string(line)))
+		if err == memcacheFormatError || err == memcacheChunkError {
+			// the data block was not where the command line said, what
+			// follows can't be trusted
+			mc.w.WriteString(err.Error() + "\r\n")
+			mc.w.Flush()
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if quit {
+			return mc.w.Flush()
+		}
+		if mc.r.Buffered() == 0 {
+			if err := mc.w.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exec runs one command line, the replies are written to mc.w. It returns
+// true on quit, an error only if the rest of the stream can't be trusted
+func (mc *memcacheConn) exec(f []string) (bool, error) {
+	if len(f) == 0 {
+		mc.w.WriteString("ERROR\r\n")
+		return false, nil
+	}
+
+	cmd := strings.ToLower(f[0])
+	noreply := len(f) > 1 && f[len(f)-1] == "noreply"
+	if noreply {
+		f = f[:len(f)-1]
+	}
+	var reply string
+	switch cmd {
+	case "get":
+		if len(f) < 2 {
+			mc.w.WriteString("ERROR\r\n")
+			return false, nil
+		}
+		mc.get(f[1:])
+		return false, nil
+	case "set", "add", "replace", "append", "prepend":
+		r, err := mc.store(cmd, f)
+		if err != nil {
+			return false, err
+		}
+		reply = r
+	case "delete":
+		// delete <key> 0 of the old clients
+		if (len(f) != 2 && (len(f) != 3 || f[2] != "0")) || !validMemcacheKey(f[1]) {
+			reply = memcacheFormatError.Error()
+			break
+		}
+		reply = mc.delete(f[1])
+	case "incr", "decr":
+		if len(f) != 3 || !validMemcacheKey(f[1]) {
+			reply = memcacheFormatError.Error()
+			break
+		}
+		reply = mc.incr(cmd == "incr", f[1], f[2])
+	case "touch":
+		if len(f) != 3 || !validMemcacheKey(f[1]) {
+			reply = memcacheFormatError.Error()
+			break
+		}
+		exptime, err := strconv.ParseInt(f[2], 10, 64)
+		if err != nil {
+			reply = memcacheFormatError.Error()
+			break
+		}
+		reply = mc.touch(f[1], exptime)
+	case "version":
+		reply = "VERSION 1.6.0-archer"
+	case "verbosity":
+		reply = "OK"
+	case "quit":
+		return true, nil
+	default:
+		if memcacheUnsupported[cmd] {
+			reply = fmt.Sprintf("SERVER_ERROR %s is not supported by proxy", cmd)
+		} else {
+			reply = "ERROR"
+		}
+	}
+
+	if !noreply {
+		mc.w.WriteString(reply + "\r\n")
+	}
+	return false, nil
+}
+
+// get replies a VALUE for every key found, then END
+func (mc *memcacheConn) get(keys []string) {
+	for _, key := range keys {
+		if !validMemcacheKey(key) {
+			mc.w.WriteString(memcacheFormatError.Error() + "\r\n")
+			return
+		}
+		item, found, err := mc.read(key)
+		if err != nil {
+			mc.w.WriteString(err.Error() + "\r\n")
+			return
+		}
+		if !found {
+			continue
+		}
+		flags, data := splitMemcacheItem(item)
+		fmt.Fprintf(mc.w, "VALUE %s %d %d\r\n", key, flags, len(data))
+		mc.w.Write(data)
+		mc.w.WriteString("\r\n")
+	}
+	mc.w.WriteString("END\r\n")
+}
+
+// store reads the data block of set, add, replace, append or prepend
+// <key> <flags> <exptime> <bytes>, and stores it
+func (mc *memcacheConn) store(cmd string, f []string) (string, error) {
+	if len(f) != 5 {
+		// the data block can't be skipped without <bytes>
+		return "", memcacheFormatError
+	}
+	flags, ferr := strconv.ParseUint(f[2], 10, 32)
+	exptime, eerr := strconv.ParseInt(f[3], 10, 64)
+	n, nerr := strconv.Atoi(f[4])
+	if nerr != nil || n < 0 {
+		return "", memcacheFormatError
+	}
+	if mc.lim.bulk(n) != nil {
+		if _, err := io.CopyN(io.Discard, mc.r, int64(n)+2); err != nil {
+			return "", err
+		}
+		return "SERVER_ERROR object too large for cache", nil
+	}
+	data, err := readPayload(mc.r, nil, n+2)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return "", memcacheChunkError
+	}
+	data = data[:n]
+	if ferr != nil || eerr != nil || !validMemcacheKey(f[1]) {
+		return memcacheFormatError.Error(), nil
+	}
+
+	key := f[1]
+	if cmd == "append" || cmd == "prepend" {
+		// flags and exptime are ignored, the item keeps its own
+		reply := mc.update(key, "NOT_STORED", func(old []byte) ([]byte, error) {
+			flags, payload := splitMemcacheItem(old)
+			if cmd == "append" {
+				return memcacheItem(flags, append(append([]byte{}, payload...), data...)), nil
+			}
+			return memcacheItem(flags, append(append([]byte{}, data...), payload...)), nil
+		})
+		if reply == "" {
+			reply = "STORED"
+		}
+		return reply, nil
+	}
+
+	args := [][]byte{[]byte("SET"), []byte(key), memcacheItem(uint32(flags), data)}
+	switch cmd {
+	case "add":
+		args = append(args, []byte("NX"))
+	case "replace":
+		args = append(args, []byte("XX"))
+	}
+	args = append(args, mc.expire(exptime)...)
+	r, err := mc.do(args...)
+	if err != nil {
+		return err.Error(), nil
+	}
+	if br, ok := r.(*BulkResp); ok && br.Empty {
+		return "NOT_STORED", nil
+	}
+	if _, ok := r.(*SimpleResp); !ok {
+		return memcacheServerError(r), nil
+	}
+	return "STORED", nil
+}
+
+func (mc *memcacheConn) delete(key string) string {
+	r, err := mc.do([]byte("DEL"), []byte(key))
+	if err != nil {
+		return err.Error()
+	}
+	ir, ok := r.(*IntResp)
+	if !ok {
+		return memcacheServerError(r)
+	}
+	if n, _ := ir.Int(); n == 0 {
+		return "NOT_FOUND"
+	}
+	return "DELETED"
+}
+
+// incr adds delta to the decimal number of key, or takes it away. Like
+// memcached the number is a 64 bits unsigned integer, incr wraps around
+// and decr stops at 0
+func (mc *memcacheConn) incr(incr bool, key, arg string) string {
+	delta, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return memcacheDeltaError.Error()
+	}
+	var value uint64
+	reply := mc.update(key, "NOT_FOUND", func(old []byte) ([]byte, error) {
+		flags, data := splitMemcacheItem(old)
+		n, err := strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return nil, memcacheNumberError
+		}
+		switch {
+		case incr:
+			n += delta
+		case n < delta:
+			n = 0
+		default:
+			n -= delta
+		}
+		value = n
+		return memcacheItem(flags, strconv.AppendUint(nil, n, 10)), nil
+	})
+	if reply != "" {
+		return reply
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+func (mc *memcacheConn) touch(key string, exptime int64) string {
+	args := [][]byte{[]byte("GETEX"), []byte(key)}
+	if exp := mc.expire(exptime); exp != nil {
+		args = append(args, exp...)
+	} else {
+		args = append(args, []byte("PERSIST"))
+	}
+	r, err := mc.do(args...)
+	if err != nil {
+		return err.Error()
+	}
+	br, ok := r.(*BulkResp)
+	if !ok {
+		return memcacheServerError(r)
+	}
+	if br.Empty {
+		return "NOT_FOUND"
+	}
+	return "TOUCHED"
+}
+
+// update reads the item of key, changes it by fn and writes it back if
+// nobody wrote it in the meantime, retrying otherwise. It returns missing
+// if there is no item, "" once stored, or the error reply
+func (mc *memcacheConn) update(key, missing string, fn func(old []byte) ([]byte, error)) string {
+	for i := 0; i < memcacheCASRetries; i++ {
+		old, found, err := mc.read(key)
+		if err != nil {
+			return err.Error()
+		}
+		if !found {
+			return missing
+		}
+		item, err := fn(old)
+		if err != nil {
+			return err.Error()
+		}
+		r, err := mc.do([]byte("EVAL"), []byte(memcacheCAS), []byte("1"), []byte(key), old, item)
+		if err != nil {
+			return err.Error()
+		}
+		ir, ok := r.(*IntResp)
+		if !ok {
+			return memcacheServerError(r)
+		}
+		if n, _ := ir.Int(); n == 1 {
+			return ""
+		}
+	}
+	return memcacheRetryError.Error()
+}
+
+// read returns the item stored at key, false if there's none
+func (mc *memcacheConn) read(key string) ([]byte, bool, error) {
+	r, err := mc.do([]byte("GET"), []byte(key))
+	if err != nil {
+		return nil, false, err
+	}
+	br, ok := r.(*BulkResp)
+	if !ok {
+		return nil, false, errors.New(memcacheServerError(r))
+	}
+	data, ok := br.Bytes()
+	return data, ok, nil
+}
+
+// do sends a redis command to the node of its key, following redirects.
+// A failure is returned as the SERVER_ERROR to reply
+func (mc *memcacheConn) do(args ...[]byte) (Resp, error) {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	for _, a := range args {
+		ar.Args = append(ar.Args, NewBulkResp(a))
+	}
+	r, err := mc.s.ExecWithRedirect(ar, true, nil)
+	if err != nil {
+		return nil, fmt.Errorf("SERVER_ERROR %s", err)
+	}
+	return r, nil
+}
+
+// expire returns the SET options of a memcached exptime, nil for 0. One
+// in the past, negative ones included, expires the item at once
+func (mc *memcacheConn) expire(exptime int64) [][]byte {
+	switch {
+	case exptime == 0:
+		return nil
+	case exptime < 0:
+		return [][]byte{[]byte("EXAT"), []byte("1")}
+	case exptime <= memcacheRelativeExptime:
+		return [][]byte{[]byte("EX"), strconv.AppendInt(nil, exptime, 10)}
+	}
+	return [][]byte{[]byte("EXAT"), strconv.AppendInt(nil, exptime, 10)}
+}
+
+// memcacheItem is the redis value of an item
+func memcacheItem(flags uint32, data []byte) []byte {
+	item := strconv.AppendUint(nil, uint64(flags), 10)
+	item = append(item, ':')
+	return append(item, data...)
+}
+
+// splitMemcacheItem splits the redis value of an item. A value without
+// the flags, written by a redis client, is the data of flags 0
+func splitMemcacheItem(item []byte) (uint32, []byte) {
+	i := bytes.IndexByte(item, ':')
+	if i <= 0 {
+		return 0, item
+	}
+	flags, err := strconv.ParseUint(string(item[:i]), 10, 32)
+	if err != nil {
+		return 0, item
+	}
+	return uint32(flags), item[i+1:]
+}
+
+// validMemcacheKey reports whether key is up to 250 bytes without control
+// characters, spaces are never in a field
+func validMemcacheKey(key string) bool {
+	if len(key) == 0 || len(key) > memcacheMaxKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < '!' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// memcacheServerError is the reply to an unexpected redis reply r, like
+// a WRONGTYPE error
+func memcacheServerError(r Resp) string {
+	if er, ok := r.(*ErrorResp); ok {
+		return "SERVER_ERROR " + er.Error()
+	}
+	return "SERVER_ERROR unexpected reply " + r.Type()
+}
@@ -0,0 +1,134 @@
+package archer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemcacheConn(t *testing.T) {
+	cas := func(key, old, item string) string {
+		return fmt.Sprintf("EVAL %s 1 %s %s %s", memcacheCAS, key, old, item)
+	}
+	a, la := fakeMaster(t, map[string]string{
+		"SET k 5:abc":                 "+OK\r\n",
+		"SET k 0:x NX EX 100":         "$-1\r\n",
+		"SET k 1:x XX EXAT 2592001":   "+OK\r\n",
+		"SET k 0:gone EXAT 1":         "+OK\r\n",
+		"SET k 0:z":                   "+OK\r\n",
+		"GET k":                       "$5\r\n5:abc\r\n",
+		"GET missing":                 "$-1\r\n",
+		"GET raw":                     "$3\r\nabc\r\n",
+		"GET list":                    "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n",
+		"DEL k":                       ":1\r\n",
+		"DEL missing":                 ":0\r\n",
+		"GET n":                       "$4\r\n7:10\r\n",
+		cas("n", "7:10", "7:15"):      ":1\r\n",
+		cas("n", "7:10", "7:0"):       ":1\r\n",
+		cas("k", "5:abc", "5:abcdef"): ":1\r\n",
+		"GET busy":                    "$3\r\n0:1\r\n",
+		cas("busy", "0:1", "0:2"):     ":0\r\n",
+		"GETEX k EX 10":               "$5\r\n5:abc\r\n",
+		"GETEX missing PERSIST":       "$-1\r\n",
+	})
+	defer la.Close()
+	pc := &ProxyConfig{dialTimeout: time.Second, readTimeout: time.Second, poolSize: 2}
+	p := &Proxy{pc: pc, cluster: testCluster(pc, a, a)}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleMemcacheConn(p, server)
+	r := bufio.NewReader(client)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	steps := []struct {
+		req, reply string
+	}{
+		{"set k 5 0 3\r\nabc\r\n", "STORED\r\n"},
+		{"add k 0 100 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"replace k 1 2592001 1\r\nx\r\n", "STORED\r\n"},
+		{"set k 0 -1 4\r\ngone\r\n", "STORED\r\n"},
+		{"set k 0 0 1 noreply\r\nz\r\nget k missing raw\r\n", "VALUE k 5 3\r\nabc\r\nVALUE raw 0 3\r\nabc\r\nEND\r\n"},
+		{"get list\r\n", "SERVER_ERROR WRONGTYPE Operation against a key holding the wrong kind of value\r\n"},
+		{"delete k\r\n", "DELETED\r\n"},
+		{"delete missing 0\r\n", "NOT_FOUND\r\n"},
+		{"incr n 5\r\n", "15\r\n"},
+		{"decr n 20\r\n", "0\r\n"},
+		{"incr missing 1\r\n", "NOT_FOUND\r\n"},
+		{"incr k 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{"incr n -1\r\n", "CLIENT_ERROR invalid numeric delta argument\r\n"},
+		{"incr busy 1\r\n", "SERVER_ERROR item changed too often, try again\r\n"},
+		{"append k 9 9 3\r\ndef\r\n", "STORED\r\n"},
+		{"prepend missing 0 0 1\r\nx\r\n", "NOT_STORED\r\n"},
+		{"touch k 10\r\n", "TOUCHED\r\n"},
+		{"touch missing 0\r\n", "NOT_FOUND\r\n"},
+		{"set k 0 0 abc\r\n", "CLIENT_ERROR bad command line format\r\n"},
+	}
+	// the last step closes the connection
+	for i, step := range steps {
+		if _, err := io.WriteString(client, step.req); err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+		got := make([]byte, len(step.reply))
+		if _, err := io.ReadFull(r, got); err != nil || string(got) != step.reply {
+			t.Fatalf("step %d %q: got %q %v, want %q", i, step.req, got, err, step.reply)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("connection open after a bad command line: %v", err)
+	}
+}
+
+func TestMemcacheCommands(t *testing.T) {
+	p := &Proxy{pc: &ProxyConfig{}}
+	steps := []struct {
+		req, reply string
+	}{
+		{"version\r\n", "VERSION 1.6.0-archer\r\n"},
+		{"gets k\r\n", "SERVER_ERROR gets is not supported by proxy\r\n"},
+		{"bogus\r\n", "ERROR\r\n"},
+		{"get\r\n", "ERROR\r\n"},
+		{"get a\x01b\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"delete k 10\r\n", "CLIENT_ERROR bad command line format\r\n"},
+		{"set k 0 0 2\r\nabc\r\n", "CLIENT_ERROR bad data chunk\r\n"},
+	}
+	for i, step := range steps {
+		client, server := net.Pipe()
+		go HandleMemcacheConn(p, server)
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		go io.WriteString(client, step.req+"quit\r\n")
+		got, _ := io.ReadAll(client)
+		if string(got) != step.reply {
+			t.Fatalf("step %d %q: got %q, want %q", i, step.req, got, step.reply)
+		}
+		client.Close()
+	}
+}
+
+func TestSplitMemcacheItem(t *testing.T) {
+	cases := []struct {
+		item  string
+		flags uint32
+		data  string
+		raw   bool // not written by the listener, read as the data of flags 0
+	}{
+		{"0:abc", 0, "abc", false},
+		{"4294967295:", 4294967295, "", false},
+		{"12:30:00", 12, "30:00", false},
+		{"4294967296:x", 0, "4294967296:x", true},
+		{":x", 0, ":x", true},
+		{"plain", 0, "plain", true},
+	}
+	for _, c := range cases {
+		flags, data := splitMemcacheItem([]byte(c.item))
+		if flags != c.flags || string(data) != c.data {
+			t.Fatalf("%q: %d %q", c.item, flags, data)
+		}
+		if item := memcacheItem(flags, data); !c.raw && string(item) != c.item {
+			t.Fatalf("%d %q: item %q, want %q", flags, data, item, c.item)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package archer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the proxy metrics, served in the prometheus text format at
+// /metrics of the admin http server. Latency percentiles come from the
+// histogram buckets, e.g. histogram_quantile(0.99, ...)
+var Stats = NewMetrics()
+
+// 命令耗时的 histogram 桶, 单位秒
+var latencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Counter struct {
+	v int64
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// CounterVec is a counter per value of one label
+type CounterVec struct {
+	rw sync.RWMutex
+	m  map[string]*Counter
+}
+
+func (v *CounterVec) With(label string) *Counter {
+	v.rw.RLock()
+	c, ok := v.m[label]
+	v.rw.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.rw.Lock()
+	defer v.rw.Unlock()
+	if c, ok = v.m[label]; !ok {
+		c = &Counter{}
+		v.m[label] = c
+	}
+	return c
+}
+
+func (v *CounterVec) labels() []string {
+	v.rw.RLock()
+	defer v.rw.RUnlock()
+	ls := make([]string, 0, len(v.m))
+	for l := range v.m {
+		ls = append(ls, l)
+	}
+	sort.Strings(ls)
+	return ls
+}
+
+type Histogram struct {
+	l      sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.l.Lock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+	h.l.Unlock()
+}
+
+// HistogramVec is a histogram per value of one label
+type HistogramVec struct {
+	rw sync.RWMutex
+	m  map[string]*Histogram
+}
+
+func (v *HistogramVec) With(label string) *Histogram {
+	v.rw.RLock()
+	h, ok := v.m[label]
+	v.rw.RUnlock()
+	if ok {
+		return h
+	}
+
+	v.rw.Lock()
+	defer v.rw.Unlock()
+	if h, ok = v.m[label]; !ok {
+		h = &Histogram{}
+		v.m[label] = h
+	}
+	return h
+}
+
+// PoolStat is the usage of the backend pool of a node
+type PoolStat struct {
+	Node  string
+	Conns int
+	Idle  int
+}
+
+type Metrics struct {
+	Commands     *CounterVec   // replies written per command
+	Latency      *HistogramVec // read to reply written per command
+	BytesIn      Counter       // bytes read from clients
+	BytesOut     Counter       // bytes written to clients
+	Clients      Counter       // client connections open
+	Redirects    *CounterVec   // MOVED and ASK
+	ParseErrors  Counter       // client commands failed to parse
+	SpansDropped Counter       // trace spans not exported
+	RateLimited  *CounterVec   // commands rejected or delayed, global or client limit
+	CacheHits    Counter       // reads served by the reply cache
+	CacheMisses  Counter       // cacheable reads sent to the backend
+	BreakerTrips *CounterVec   // circuit breakers opened per node
+
+	// pools returns the backend pools at scrape time, nil without a cluster
+	pools func() []PoolStat
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Commands:     &CounterVec{m: make(map[string]*Counter)},
+		Latency:      &HistogramVec{m: make(map[string]*Histogram)},
+		Redirects:    &CounterVec{m: make(map[string]*Counter)},
+		RateLimited:  &CounterVec{m: make(map[string]*Counter)},
+		BreakerTrips: &CounterVec{m: make(map[string]*Counter)},
+	}
+}
+
+// Command records a command replied after d, unknown commands share the
+// label other so clients can't blow up the number of series
+func (m *Metrics) Command(name string, d time.Duration) {
+	if _, ok := reqrules[name]; ok {
+		name = strings.ToLower(name)
+	} else {
+		name = "other"
+	}
+	m.Commands.With(name).Add(1)
+	m.Latency.With(name).Observe(d.Seconds())
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.Expose(w)
+}
+
+// Expose writes the metrics in the prometheus text format
+func (m *Metrics) Expose(out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	counterVec := func(name, help, label string, v *CounterVec) {
+		header(name, "counter", help)
+		for _, l := range v.labels() {
+			fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, l, v.With(l).Value())
+		}
+	}
+
+	counterVec("archer_commands_total", "Commands replied.", "cmd", m.Commands)
+
+	header("archer_command_duration_seconds", "histogram", "Time from reading a command to writing its reply.")
+	m.Latency.rw.RLock()
+	names := make([]string, 0, len(m.Latency.m))
+	for name := range m.Latency.m {
+		names = append(names, name)
+	}
+	m.Latency.rw.RUnlock()
+	sort.Strings(names)
+	for _, name := range names {
+		h := m.Latency.With(name)
+		h.l.Lock()
+		var cum uint64
+		for i, b := range latencyBuckets {
+			if h.counts != nil {
+				cum += h.counts[i]
+			}
+			fmt.Fprintf(w, "archer_command_duration_seconds_bucket{cmd=%q,le=%q} %d\n", name, formatFloat(b), cum)
+		}
+		fmt.Fprintf(w, "archer_command_duration_seconds_bucket{cmd=%q,le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(w, "archer_command_duration_seconds_sum{cmd=%q} %s\n", name, formatFloat(h.sum))
+		fmt.Fprintf(w, "archer_command_duration_seconds_count{cmd=%q} %d\n", name, h.count)
+		h.l.Unlock()
+	}
+
+	header("archer_client_bytes_in_total", "counter", "Bytes read from clients.")
+	fmt.Fprintf(w, "archer_client_bytes_in_total %d\n", m.BytesIn.Value())
+	header("archer_client_bytes_out_total", "counter", "Bytes written to clients.")
+	fmt.Fprintf(w, "archer_client_bytes_out_total %d\n", m.BytesOut.Value())
+	header("archer_client_connections", "gauge", "Client connections open.")
+	fmt.Fprintf(w, "archer_client_connections %d\n", m.Clients.Value())
+	counterVec("archer_redirects_total", "MOVED and ASK redirects followed.", "type", m.Redirects)
+	header("archer_parse_errors_total", "counter", "Client commands failed to parse.")
+	fmt.Fprintf(w, "archer_parse_errors_total %d\n", m.ParseErrors.Value())
+	counterVec("archer_rate_limited_total", "Commands rejected or delayed by a rate limit.", "scope", m.RateLimited)
+	header("archer_cache_hits_total", "counter", "Reads served by the reply cache.")
+	fmt.Fprintf(w, "archer_cache_hits_total %d\n", m.CacheHits.Value())
+	header("archer_cache_misses_total", "counter", "Cacheable reads sent to the backend.")
+	fmt.Fprintf(w, "archer_cache_misses_total %d\n", m.CacheMisses.Value())
+	counterVec("archer_breaker_trips_total", "Circuit breakers opened, the node ejected.", "node", m.BreakerTrips)
+	header("archer_trace_spans_dropped_total", "counter", "Trace spans dropped, queue full or export failed.")
+	fmt.Fprintf(w, "archer_trace_spans_dropped_total %d\n", m.SpansDropped.Value())
+
+	if m.pools != nil {
+		stats := m.pools()
+		sort.Slice(stats, func(i, j int) bool { return stats[i].Node < stats[j].Node })
+		header("archer_backend_pool_connections", "gauge", "Backend connections open per node.")
+		for _, s := range stats {
+			fmt.Fprintf(w, "archer_backend_pool_connections{node=%q} %d\n", s.Node, s.Conns)
+		}
+		header("archer_backend_pool_idle_connections", "gauge", "Idle backend connections per node.")
+		for _, s := range stats {
+			fmt.Fprintf(w, "archer_backend_pool_idle_connections{node=%q} %d\n", s.Node, s.Idle)
+		}
+	}
+
+	return w.Flush()
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countingReader and countingWriter count the client bytes
+type countingReader struct {
+	r io.Reader
+	c *Counter
+}
+
+func (cr countingReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.c.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	c *Counter
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.c.Add(int64(n))
+	return n, err
+}
+
+// cmdTrace is a command in flight, from read to its reply written
+type cmdTrace struct {
+	name  string
+	req   *ArrayResp // for the slowlog
+	start time.Time
+	span  *Span // nil if not sampled
+}
+
+// traceStart is called by ReadLoop for every command read, readStart is
+// when its first byte arrived, zero if unknown
+func (s *Session) traceStart(seq int64, r Resp, readStart time.Time) {
+	t := &cmdTrace{start: time.Now()}
+	if ar, ok := r.(*ArrayResp); ok {
+		t.name, t.req = cmdName(ar), ar
+	}
+	if readStart.IsZero() {
+		readStart = t.start
+	}
+	if t.span = s.p.tracer.Start(t.name, readStart); t.span != nil {
+		t.span.SetAttr("db.system", "redis")
+		t.span.SetAttr("db.operation", t.name)
+		t.span.SetAttr("client.address", s.remote)
+		t.span.SetAttr("archer.seq", seq)
+		rs := t.span.ChildAt("read", SpanInternal, readStart)
+		rs.EndAt(t.start)
+	}
+	s.tl.Lock()
+	if s.traces == nil {
+		s.traces = make(map[int64]*cmdTrace)
+	}
+	s.traces[seq] = t
+	s.lastCmd, s.lastCmdAt = t.name, t.start
+	s.cmdCount++
+	s.tl.Unlock()
+}
+
+// span returns the root span of command seq, nil if it's not sampled
+func (s *Session) span(seq int64) *Span {
+	s.tl.Lock()
+	defer s.tl.Unlock()
+	if t, ok := s.traces[seq]; ok {
+		return t.span
+	}
+	return nil
+}
+
+// traceEnd is called by WriteLoop for the reply resp of seq, written is
+// when WriteLoop started writing it. The write span doesn't include the
+// flush, which is shared by a pipeline of replies
+func (s *Session) traceEnd(seq int64, resp Resp, written time.Time) {
+	s.tl.Lock()
+	t, ok := s.traces[seq]
+	delete(s.traces, seq)
+	s.tl.Unlock()
+	if !ok {
+		return
+	}
+	if t.span != nil {
+		end := time.Now()
+		ws := t.span.ChildAt("write", SpanInternal, written)
+		ws.EndAt(end)
+		t.span.EndAt(end)
+	}
+	d := time.Since(t.start)
+	Stats.Command(t.name, d)
+	if sl := s.p.slowlog; sl != nil && sl.Slow(d) {
+		sl.Add(s.slowEntry(t, d))
+	}
+	if s.p.audit != nil && s.auditing() {
+		s.p.audit.Log(s, seq, t, resp, d)
+	}
+}
@@ -0,0 +1,58 @@
+package archer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExpose(t *testing.T) {
+	m := NewMetrics()
+	m.Command("GET", 2*time.Millisecond)
+	m.Command("GET", 20*time.Second)
+	m.Command("NOSUCHCMD", time.Millisecond)
+	m.Redirects.With("moved").Add(3)
+	m.BytesIn.Add(10)
+	m.pools = func() []PoolStat {
+		return []PoolStat{{Node: "127.0.0.1:7001", Conns: 4, Idle: 1}}
+	}
+
+	var buf bytes.Buffer
+	if err := m.Expose(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		`archer_commands_total{cmd="get"} 2`,
+		`archer_commands_total{cmd="other"} 1`,
+		`archer_command_duration_seconds_bucket{cmd="get",le="0.001"} 0`,
+		`archer_command_duration_seconds_bucket{cmd="get",le="0.0025"} 1`,
+		`archer_command_duration_seconds_bucket{cmd="get",le="10"} 1`,
+		`archer_command_duration_seconds_bucket{cmd="get",le="+Inf"} 2`,
+		`archer_command_duration_seconds_count{cmd="get"} 2`,
+		`archer_redirects_total{type="moved"} 3`,
+		`archer_client_bytes_in_total 10`,
+		`archer_backend_pool_connections{node="127.0.0.1:7001"} 4`,
+		`archer_backend_pool_idle_connections{node="127.0.0.1:7001"} 1`,
+		"# TYPE archer_command_duration_seconds histogram",
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Fatalf("missing %q in\n%s", want, out)
+		}
+	}
+}
+
+func TestSessionTrace(t *testing.T) {
+	s := newTestSession(&ProxyConfig{})
+	before := Stats.Commands.With("hello").Value()
+	s.traceStart(0, newCommand("hello", "3"), time.Time{})
+	s.traceEnd(0, nil, time.Now())
+	s.traceEnd(0, nil, time.Now())
+	if got := Stats.Commands.With("hello").Value() - before; got != 1 {
+		t.Fatalf("%d recorded, want 1", got)
+	}
+	if len(s.traces) != 0 {
+		t.Fatal("trace leaked")
+	}
+}
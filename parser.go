@@ -3,10 +3,17 @@ package archer
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dongzerun/archer/util"
 	// "github.com/oxtoacart/bpool"
@@ -41,16 +48,26 @@ var (
 	PONG      = []byte("PONG")
 	SELECT    = []byte("SELECT")
 	OK        = []byte("OK")
+	QUEUED    = []byte("QUEUED")
 	QUIT      = []byte("QUIT")
 	MOVED     = []byte("MOVED")
 	ASK       = []byte("ASK")
 	ASKING    = []byte("ASKING")
 	EmptyBulk = []byte("$-1\r\n")
+	EmptyArr  = []byte("*-1\r\n")
 
 	ArrSepReadError         = errors.New("In  ReadResp ArrSep, must read BulkResp")
-	RawCmdError             = errors.New("raw command must be quit or ping")
+	RawCmdError             = errors.New("inline command is empty")
+	InlineQuotesError       = errors.New("ERR Protocol error: unbalanced quotes in request")
 	ReadRespUnexpectedError = errors.New("ReadResp error, unexpected")
 	RespTypeError           = errors.New("Encode Type error")
+	RespArgsError           = errors.New("Encode Resp without payload")
+	ResyncLimitError        = errors.New("resync discarded too many bytes")
+	ReplyTooLargeError      = errors.New("reply exceeds max reply bytes")
+	BulkTooLargeError       = errors.New("bulk length exceeds the parser limit")
+	ArrayTooLongError       = errors.New("array length exceeds the parser limit")
+	NestingTooDeepError     = errors.New("nesting depth exceeds the parser limit")
+	LineTooLongError        = errors.New("too big inline request")
 )
 
 // Response Interface based on: redis client protocol
@@ -61,8 +78,12 @@ var (
 // For Integers the first byte of the reply is ":"
 // For Bulk Strings the first byte of the reply is "$"
 // For Arrays the first byte of the reply is "*"
+// A malformed Resp, wrong Rtype or no payload, is never encoded half way:
+// Encode, EncodeTo and WriteTo write nothing and return RespTypeError or
+// RespArgsError instead of panicking
 type Resp interface {
-	Encode(w *bufio.Writer) error
+	Encode(w *bufio.Writer) error   // 直接写到 w 再 Flush, 没有中间缓冲, 不分配内存
+	EncodeTo(b *bytes.Buffer) error // 追加到 b, 调用方自己管理缓冲时用, 省掉一次分配
 	String() string
 	Type() string
 	Length() int //只给ArrayResp使用，检测命令参数的个数，其它均为0
@@ -92,64 +113,181 @@ type SimpleResp struct {
 	BaseResp
 }
 
-func (sr *SimpleResp) Encode(w *bufio.Writer) error {
-	if sr.Rtype != SimpleType {
-		panic(RespTypeError)
+func NewSimpleResp(s []byte) *SimpleResp {
+	sr := &SimpleResp{}
+	sr.Rtype = SimpleType
+	sr.Args = append(sr.Args, s)
+	return sr
+}
+
+// Status returns the status like OK, "" if sr is empty
+func (sr *SimpleResp) Status() string {
+	if len(sr.Args) == 0 {
+		return ""
 	}
+	return string(sr.Args[0])
+}
 
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
-	b.WriteByte(SimpSep)
-	b.Write(sr.Args[0])
-	b.Write(CRLF)
-	// bufpool.Put(b)
-	// return b.Bytes()
-	err := WriteRawByte(w, b.Bytes())
-	return err
+func (sr *SimpleResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, sr)
+}
+
+func (sr *SimpleResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, sr)
+}
+
+// WriteTo implements io.WriterTo
+func (sr *SimpleResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, sr)
+}
+
+func (sr *SimpleResp) writeFrame(fw frameWriter) (int64, error) {
+	if sr == nil || sr.Rtype != SimpleType {
+		return 0, RespTypeError
+	}
+	if len(sr.Args) == 0 {
+		return 0, RespArgsError
+	}
+	return fw.line(SimpSep, sr.Args[0])
 }
 
 type ErrorResp struct {
 	BaseResp
+	ProxyGenerated bool // made by archer itself, not replied by redis, never encoded
 }
 
-func (er *ErrorResp) Encode(w *bufio.Writer) error {
-	if er.Rtype != ErrorType {
-		panic(RespTypeError)
+// 错误信息里不能出现 \r \n, 否则会破坏协议, 统一替换成空格
+// errors made by NewErrorResp are ProxyGenerated
+func NewErrorResp(reason []byte) *ErrorResp {
+	er := &ErrorResp{ProxyGenerated: true}
+	er.Rtype = ErrorType
+	er.Args = append(er.Args, sanitizeLine(reason))
+	return er
+}
+
+// NewErrorRespf formats according to a format specifier, e.g.
+// NewErrorRespf("ERR unknown command '%s'", name)
+func NewErrorRespf(format string, args ...interface{}) *ErrorResp {
+	return NewErrorResp([]byte(fmt.Sprintf(format, args...)))
+}
+
+// Redirect is a cluster redirect replied as -MOVED or -ASK
+type Redirect struct {
+	Kind string // MOVED or ASK
+	Slot int
+	Addr string // host:port of the node serving the slot
+}
+
+// Redirect parses -MOVED 3999 127.0.0.1:6381 or -ASK 3999 127.0.0.1:6381,
+// false for any other error or a malformed slot or address
+func (er *ErrorResp) Redirect() (*Redirect, bool) {
+	if len(er.Args) == 0 {
+		return nil, false
+	}
+	e := strings.Fields(string(er.Args[0]))
+	if len(e) != 3 {
+		return nil, false
+	}
+	if e[0] != string(MOVED) && e[0] != string(ASK) {
+		return nil, false
+	}
+	slot, err := strconv.Atoi(e[1])
+	if err != nil || slot < 0 || slot >= 16384 {
+		return nil, false
+	}
+	host, port, err := net.SplitHostPort(e[2])
+	if err != nil || host == "" || port == "" {
+		return nil, false
 	}
+	return &Redirect{Kind: e[0], Slot: slot, Addr: e[2]}, true
+}
 
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
-	b.WriteByte(ErrSep)
-	b.Write(er.Args[0])
-	b.Write(CRLF)
-	// return b.Bytes()
-	err := WriteRawByte(w, b.Bytes())
-	return err
+func sanitizeLine(b []byte) []byte {
+	if bytes.IndexAny(b, "\r\n") == -1 {
+		return b
+	}
+	s := make([]byte, len(b))
+	for i, c := range b {
+		if c == '\r' || c == '\n' {
+			c = Space
+		}
+		s[i] = c
+	}
+	return s
+}
+
+// Error returns the error message like ERR unknown command, so an
+// ErrorResp can be returned as an error
+func (er *ErrorResp) Error() string {
+	if len(er.Args) == 0 {
+		return ""
+	}
+	return string(er.Args[0])
+}
+
+func (er *ErrorResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, er)
+}
+
+func (er *ErrorResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, er)
+}
+
+// WriteTo implements io.WriterTo
+func (er *ErrorResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, er)
+}
+
+func (er *ErrorResp) writeFrame(fw frameWriter) (int64, error) {
+	if er == nil || er.Rtype != ErrorType {
+		return 0, RespTypeError
+	}
+	if len(er.Args) == 0 {
+		return 0, RespArgsError
+	}
+	return fw.line(ErrSep, er.Args[0])
 }
 
 type IntResp struct {
 	BaseResp
 }
 
-func (ir *IntResp) Encode(w *bufio.Writer) error {
-	if ir.Rtype != IntType {
-		panic(RespTypeError)
+func NewIntResp(i int64) *IntResp {
+	ir := &IntResp{}
+	ir.Rtype = IntType
+	ir.Args = append(ir.Args, strconv.AppendInt(nil, i, 10))
+	return ir
+}
+
+// Int parses the integer, ReplyFormError if ir is empty
+func (ir *IntResp) Int() (int64, error) {
+	if len(ir.Args) == 0 {
+		return 0, ReplyFormError
 	}
+	return strconv.ParseInt(string(ir.Args[0]), 10, 64)
+}
 
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
-	b.WriteByte(IntSep)
-	b.Write(ir.Args[0])
-	b.Write(CRLF)
-	// return b.Bytes()
-	err := WriteRawByte(w, b.Bytes())
-	return err
+func (ir *IntResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, ir)
+}
+
+func (ir *IntResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, ir)
+}
+
+// WriteTo implements io.WriterTo
+func (ir *IntResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, ir)
+}
+
+func (ir *IntResp) writeFrame(fw frameWriter) (int64, error) {
+	if ir == nil || ir.Rtype != IntType {
+		return 0, RespTypeError
+	}
+	if len(ir.Args) == 0 {
+		return 0, RespArgsError
+	}
+	return fw.line(IntSep, ir.Args[0])
 }
 
 type BulkResp struct {
@@ -157,87 +295,341 @@ type BulkResp struct {
 	Empty bool
 }
 
-func (br *BulkResp) Bytes() []byte {
-	if br.Rtype != BulkType {
-		panic(RespTypeError)
+func NewBulkResp(b []byte) *BulkResp {
+	br := &BulkResp{}
+	br.Rtype = BulkType
+	br.Args = append(br.Args, b)
+	return br
+}
+
+// Bytes returns the payload, false for the null bulk
+func (br *BulkResp) Bytes() ([]byte, bool) {
+	if br.Empty || len(br.Args) == 0 {
+		return nil, false
 	}
+	return br.Args[0], true
+}
 
-	if br.Empty {
+// Frame returns the encoded bulk, $-1\r\n for the null bulk, nil if br
+// can't be encoded
+func (br *BulkResp) Frame() []byte {
+	if br != nil && br.Rtype == BulkType && br.Empty {
 		return EmptyBulk
 	}
 
 	b := new(bytes.Buffer)
-	b.WriteByte(BulkSep)
-	// b.Write(util.Iu32tob2(len(br.Args[0])))
-	util.WriteLength(b, len(br.Args[0]))
-	b.Write(CRLF)
-	b.Write(br.Args[0])
-	b.Write(CRLF)
+	if err := br.EncodeTo(b); err != nil {
+		return nil
+	}
 	return b.Bytes()
 }
 
 func (br *BulkResp) Encode(w *bufio.Writer) error {
-	if br.Rtype != BulkType {
-		panic(RespTypeError)
+	return encodeFrame(w, br)
+}
+
+func (br *BulkResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, br)
+}
+
+// WriteTo implements io.WriterTo
+func (br *BulkResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, br)
+}
+
+func (br *BulkResp) writeFrame(fw frameWriter) (int64, error) {
+	if br == nil || br.Rtype != BulkType {
+		return 0, RespTypeError
 	}
 
 	if br.Empty {
-		return WriteRawByte(w, EmptyBulk)
+		return fw.write(EmptyBulk)
+	}
+	if len(br.Args) == 0 {
+		return 0, RespArgsError
 	}
 
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
-	b.WriteByte(BulkSep)
-	// b.Write(util.Iu32tob2(len(br.Args[0])))
-	util.WriteLength(b, len(br.Args[0]))
-	b.Write(CRLF)
-	b.Write(br.Args[0])
-	b.Write(CRLF)
-	err := WriteRawByte(w, b.Bytes())
-	return err
+	n, err := fw.header(BulkSep, len(br.Args[0]))
+	if err != nil {
+		return n, err
+	}
+	m, err := fw.write(br.Args[0])
+	n += m
+	if err != nil {
+		return n, err
+	}
+	m, err = fw.write(CRLF)
+	return n + m, err
 }
 
+// 命令一定是由 BulkResp 组成的数组, 放在 Args 里
+// 回复里的数组可以嵌套任意类型, 比如 CLUSTER SLOTS, 这时全部元素放在 Elems 里, Args 为空
 type ArrayResp struct {
 	BaseResp
-	Args []*BulkResp
+	Args  []*BulkResp
+	Elems []Resp // non nil only when some element is not a BulkResp
+	Empty bool   // *-1 null array
 }
 
 func (ar *ArrayResp) String() string {
 	var str []string
-	for _, i := range ar.Args {
+	for _, i := range ar.Items() {
 		str = append(str, i.String())
 	}
 	return strings.Join(str, " ")
 }
 
+// Items returns all elements whatever they are stored in Args or Elems
+func (ar *ArrayResp) Items() []Resp {
+	if ar.Elems != nil {
+		return ar.Elems
+	}
+	items := make([]Resp, len(ar.Args))
+	for i, br := range ar.Args {
+		items[i] = br
+	}
+	return items
+}
+
+// Command returns the upper case command name without modifying ar, false
+// if ar has none
+func (ar *ArrayResp) Command() (string, bool) {
+	name, ok := ar.Arg(0)
+	if !ok || len(name) == 0 {
+		return "", false
+	}
+	return strings.ToUpper(string(name)), true
+}
+
+// Arg returns the payload of the i-th element counting the command name,
+// Arg(0) is the name and Arg(1) the first argument. false if i is out of
+// range or the element isn't a non null bulk
+func (ar *ArrayResp) Arg(i int) ([]byte, bool) {
+	if ar == nil || i < 0 {
+		return nil, false
+	}
+
+	var br *BulkResp
+	if ar.Elems != nil {
+		if i >= len(ar.Elems) {
+			return nil, false
+		}
+		br, _ = ar.Elems[i].(*BulkResp)
+	} else if i < len(ar.Args) {
+		br = ar.Args[i]
+	}
+	if br == nil || br.Empty || len(br.Args) == 0 {
+		return nil, false
+	}
+	return br.Args[0], true
+}
+
 func (ar *ArrayResp) Encode(w *bufio.Writer) error {
-	if ar.Rtype != ArrayType {
-		panic(RespTypeError)
+	return encodeFrame(w, ar)
+}
+
+func (ar *ArrayResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, ar)
+}
+
+// flush the client *bufio.Writer every writeToFlushEvery elements in WriteTo
+const writeToFlushEvery = 1024
+
+// WriteTo writes ar to w element by element, without building the whole
+// reply in memory, so it's ok for arrays with millions of elements.
+// If w is a *bufio.Writer it's flushed periodically and at the end.
+func (ar *ArrayResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, ar)
+}
+
+func (ar *ArrayResp) writeFrame(fw frameWriter) (int64, error) {
+	if ar == nil || ar.Rtype != ArrayType {
+		return 0, RespTypeError
 	}
 
-	// var b bytes.Buffer
-	b := bPool.Get().(*bytes.Buffer)
-	b.Reset()
-	defer bPool.Put(b)
-	b.WriteByte(ArrSep)
-	// b.Write(util.Iu32tob2(len(ar.Args)))
-	util.WriteLength(b, len(ar.Args))
-	b.Write(CRLF)
+	if ar.Empty {
+		return fw.write(EmptyArr)
+	}
 
-	for _, arg := range ar.Args {
-		b.Write(arg.Bytes())
+	l := len(ar.Args)
+	if ar.Elems != nil {
+		l = len(ar.Elems)
 	}
-	// return b.Bytes()
-	err := WriteRawByte(w, b.Bytes())
-	return err
+	n, err := fw.header(ArrSep, l)
+	if err != nil {
+		return n, err
+	}
+	for i := 0; i < l; i++ {
+		var m int64
+		if ar.Elems != nil {
+			m, err = fw.elem(ar.Elems[i])
+		} else {
+			m, err = ar.Args[i].writeFrame(fw)
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if fw.bw != nil && i%writeToFlushEvery == writeToFlushEvery-1 {
+			if err := fw.bw.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
 }
 
 func (ar *ArrayResp) Length() int {
+	if ar.Elems != nil {
+		return len(ar.Elems) - 1
+	}
 	return len(ar.Args) - 1
 }
 
+// append keeps the all BulkResp case in Args, and moves everything
+// to Elems as soon as an element of other type shows up
+func (ar *ArrayResp) append(r Resp) {
+	if br, ok := r.(*BulkResp); ok && ar.Elems == nil {
+		ar.Args = append(ar.Args, br)
+		return
+	}
+	if ar.Elems == nil {
+		ar.Elems = make([]Resp, 0, len(ar.Args)+1)
+		for _, br := range ar.Args {
+			ar.Elems = append(ar.Elems, br)
+		}
+		ar.Args = nil
+	}
+	ar.Elems = append(ar.Elems, r)
+}
+
+// pooled buffers larger than this are dropped instead of put back,
+// so one huge reply doesn't pin its memory in the pool
+const maxPooledBuffer = 64 << 10
+
+// EncodeEquals reports whether r encodes to exactly expected. Go has no
+// methods on interfaces, so it's a function working for every Resp type
+func EncodeEquals(r Resp, expected []byte) bool {
+	b := bPool.Get().(*bytes.Buffer)
+	b.Reset()
+	defer func() {
+		if b.Cap() <= maxPooledBuffer {
+			bPool.Put(b)
+		}
+	}()
+
+	if err := r.EncodeTo(b); err != nil {
+		return false
+	}
+	return bytes.Equal(b.Bytes(), expected)
+}
+
+// Equal reports whether a and b are the same reply, recursively for
+// aggregates. Unlike reflect.DeepEqual it compares what goes on the wire:
+// an ArrayResp in Args or in Elems form compares by its items, and a null
+// bulk equals any other null bulk whatever its Args. The null forms $-1,
+// *-1 and _ stay different. Two nils are equal, typed nil pointers included
+func Equal(a, b Resp) bool {
+	if an, bn := isNilResp(a), isNilResp(b); an || bn {
+		return an && bn
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+
+	switch x := a.(type) {
+	case *BulkResp:
+		y, ok := b.(*BulkResp)
+		if !ok {
+			return false
+		}
+		xb, xok := x.Bytes()
+		yb, yok := y.Bytes()
+		return xok == yok && bytes.Equal(xb, yb)
+	case *ArrayResp:
+		y, ok := b.(*ArrayResp)
+		if !ok || x.Empty != y.Empty {
+			return false
+		}
+		return equalElems(x.Items(), y.Items())
+	case *MapResp:
+		y, ok := b.(*MapResp)
+		return ok && equalElems(x.Elems, y.Elems)
+	case *SetResp:
+		y, ok := b.(*SetResp)
+		return ok && equalElems(x.Elems, y.Elems)
+	case *PushResp:
+		y, ok := b.(*PushResp)
+		return ok && equalElems(x.Elems, y.Elems)
+	case *BooleanResp:
+		y, ok := b.(*BooleanResp)
+		return ok && x.Value == y.Value
+	case *VerbatimResp:
+		y, ok := b.(*VerbatimResp)
+		return ok && x.Format == y.Format && equalArgs(x.Args, y.Args)
+	case *NullResp:
+		_, ok := b.(*NullResp)
+		return ok
+	case *SimpleResp:
+		y, ok := b.(*SimpleResp)
+		return ok && equalArgs(x.Args, y.Args)
+	case *ErrorResp:
+		y, ok := b.(*ErrorResp)
+		return ok && equalArgs(x.Args, y.Args)
+	case *IntResp:
+		y, ok := b.(*IntResp)
+		return ok && equalArgs(x.Args, y.Args)
+	case *DoubleResp:
+		y, ok := b.(*DoubleResp)
+		return ok && equalArgs(x.Args, y.Args)
+	case *BigNumberResp:
+		y, ok := b.(*BigNumberResp)
+		return ok && equalArgs(x.Args, y.Args)
+	}
+	return EncodeEquals(b, encodeBytes(a))
+}
+
+func isNilResp(r Resp) bool {
+	if r == nil {
+		return true
+	}
+	v := reflect.ValueOf(r)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
+
+func equalElems(x, y []Resp) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !Equal(x[i], y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalArgs(x, y [][]byte) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for i := range x {
+		if !bytes.Equal(x[i], y[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeBytes returns the encoding of r, nil if it can't be encoded
+func encodeBytes(r Resp) []byte {
+	var b bytes.Buffer
+	if err := r.EncodeTo(&b); err != nil {
+		return nil
+	}
+	return b.Bytes()
+}
+
 func WriteRawByte(w *bufio.Writer, data []byte) error {
 	_, err := w.Write(data)
 	if err != nil {
@@ -251,16 +643,396 @@ func WriteRawByte(w *bufio.Writer, data []byte) error {
 }
 
 func WriteProtocol(w *bufio.Writer, r Resp) error {
+	if wt, ok := r.(io.WriterTo); ok {
+		_, err := wt.WriteTo(w)
+		return err
+	}
 	return r.Encode(w)
 }
 
+// bufferProtocol is WriteProtocol without the Flush, so the replies of a
+// pipeline go out in one write. Types of other packages are flushed anyway
+func bufferProtocol(w *bufio.Writer, r Resp) error {
+	f, ok := r.(framer)
+	if !ok {
+		return WriteProtocol(w, r)
+	}
+	if err := checkFrame(f); err != nil {
+		return err
+	}
+	_, err := f.writeFrame(frameWriter{bw: w})
+	return err
+}
+
+// WriteCommand encodes args as a command, an array of bulk strings, to w
+func WriteCommand(w *bufio.Writer, args ...string) error {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Args = make([]*BulkResp, 0, len(args))
+	for _, a := range args {
+		ar.Args = append(ar.Args, NewBulkResp([]byte(a)))
+	}
+	return ar.Encode(w)
+}
+
+// PeekIsError reports whether the next frame in r is an error reply,
+// nothing is consumed so the frame can still be read by ReadProtocol
+func PeekIsError(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	return b[0] == ErrSep, nil
+}
+
+// Resync tries to recover r after a protocol desync: it discards bytes
+// until a CRLF followed by a plausible first byte of a frame, so the next
+// ReadProtocol starts there. At most max bytes are discarded, after that
+// ResyncLimitError is returned. It returns the number of discarded bytes.
+//
+// a boundary found this way is only a guess, e.g. a bulk payload may contain
+// "\r\n+", so closing the connection is usually the safer recovery
+func Resync(r *bufio.Reader, max int) (int, error) {
+	n := 0
+	crlf := false
+	var last byte
+	for {
+		if crlf {
+			b, err := r.Peek(1)
+			if err != nil {
+				return n, err
+			}
+			switch b[0] {
+			case SimpSep, ErrSep, IntSep, BulkSep, ArrSep, NullSep, MapSep, SetSep, BoolSep, PushSep:
+				return n, nil
+			}
+		}
+
+		if n >= max {
+			return n, ResyncLimitError
+		}
+		c, err := r.ReadByte()
+		if err != nil {
+			return n, err
+		}
+		n++
+		crlf = last == '\r' && c == '\n'
+		last = c
+	}
+}
+
+// ValidateStream reads and discards n frames from r, returning the first
+// parse error. No Resp is built, bulk payloads are skipped with Discard,
+// so it's cheap enough to verify the replies of a load generator
+func ValidateStream(r *bufio.Reader, n int) error {
+	for i := 0; i < n; i++ {
+		if err := skipFrame(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipFrame discards one frame, nested elements are counted instead of
+// recursed into
+func skipFrame(r *bufio.Reader) error {
+	for remain := 1; remain > 0; remain-- {
+		res, err := r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if len(res) < 3 || res[len(res)-2] != '\r' {
+			return ReadRespUnexpectedError
+		}
+
+		switch res[0] {
+		case SimpSep, ErrSep, IntSep, NullSep, BoolSep:
+		case BulkSep:
+			l, err := util.ParseLen(res[1 : len(res)-2])
+			if err != nil {
+				return err
+			}
+			if l == -1 {
+				continue
+			}
+			if _, err := r.Discard(l); err != nil {
+				return err
+			}
+			if b, err := r.ReadByte(); err != nil || b != '\r' {
+				return ReadRespUnexpectedError
+			}
+			if b, err := r.ReadByte(); err != nil || b != '\n' {
+				return ReadRespUnexpectedError
+			}
+		case ArrSep, MapSep, SetSep, PushSep:
+			l, err := util.ParseLen(res[1 : len(res)-2])
+			if err != nil {
+				return err
+			}
+			if l == -1 {
+				continue
+			}
+			if res[0] == MapSep {
+				l *= 2
+			}
+			remain += l
+		default:
+			return ReadRespUnexpectedError
+		}
+	}
+	return nil
+}
+
+// ParseTracer is called by ReadProtocol after each frame is parsed with its
+// type and the time spent, including waiting for the data
+type ParseTracer func(typ string, dur time.Duration)
+
+// parseTracer holds the ParseTracer of SetParseTracer, every session reads
+// it for each frame so it's swapped atomically
+var parseTracer atomic.Value
+
+// SetParseTracer makes ReadProtocol call fn from now on, nil stops tracing.
+// It may be called while the sessions are reading
+func SetParseTracer(fn ParseTracer) {
+	parseTracer.Store(fn)
+}
+
+// ProtocolError is a line or bulk body not terminated by \r\n,
+// Bytes holds the offending bytes, at most maxProtocolErrorBytes of them
+type ProtocolError struct {
+	Bytes []byte
+}
+
+const maxProtocolErrorBytes = 64
+
+func newProtocolError(p []byte) *ProtocolError {
+	if len(p) > maxProtocolErrorBytes {
+		p = p[len(p)-maxProtocolErrorBytes:]
+	}
+	// p may be in the bufio.Reader buffer, keep a copy
+	return &ProtocolError{Bytes: append([]byte(nil), p...)}
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error: expected CRLF terminator, got %q", e.Bytes)
+}
+
+// isFrameByte reports whether c is the first byte of a RESP2 or RESP3
+// frame, a line starting with anything else is an inline command
+func isFrameByte(c byte) bool {
+	switch c {
+	case SimpSep, ErrSep, IntSep, BulkSep, ArrSep,
+		NullSep, MapSep, SetSep, BoolSep, DoubleSep, BigNumSep, VerbatimSep, PushSep:
+		return true
+	}
+	return false
+}
+
+// checkLine checks the line read up to \n ends in \r\n, an inline command
+// may end in a bare \n unless StrictInline
+func (pl *ParserLimits) checkLine(line []byte) error {
+	if len(line) >= 2 && line[len(line)-2] == '\r' {
+		return nil
+	}
+	if !pl.StrictInline && !isFrameByte(line[0]) {
+		return nil
+	}
+	return newProtocolError(line)
+}
+
+// checkBulkEnd checks the l bytes payload in buf is followed by exactly \r\n
+func checkBulkEnd(buf []byte, l int) error {
+	if buf[l] != '\r' || buf[l+1] != '\n' {
+		return newProtocolError(buf[l:])
+	}
+	return nil
+}
+
+// ParserLimits caps the lengths a frame header may announce, they are
+// checked on the header before anything is allocated. 0 means no limit
+type ParserLimits struct {
+	MaxBulkLen  int // bytes of one bulk string
+	MaxArrayLen int // elements of one array or set, pairs of one map
+	MaxDepth    int // nesting of arrays, maps and sets
+	MaxLineLen  int // bytes of one line, an inline command or a frame header
+
+	// MaxReplyBytes is the max bytes of one frame, nested elements included.
+	// A frame over it gets ReplyTooLargeError and the connection should be
+	// dropped
+	MaxReplyBytes int64
+
+	// StrictInline rejects inline commands ending in a bare \n like telnet
+	// sends, RESP framed lines must always end in \r\n
+	StrictInline bool
+}
+
+// DefaultParserLimits are the limits of ReadProtocol and of the decoders,
+// the bulk limit is the proto-max-bulk-len default of redis, arrays have
+// at most the 1024*1024 elements redis accepts in a multibulk and frames
+// have no size limit. The sessions of a proxy start from them and apply
+// the proxy:: limits of its config, see ProxyConfig.parserLimits
+var DefaultParserLimits = ParserLimits{
+	MaxBulkLen:  512 << 20,
+	MaxArrayLen: 1 << 20,
+	MaxDepth:    128,
+	MaxLineLen:  64 << 10,
+}
+
+// readLimits accounts the bytes and depth of one frame across nested elements
+type readLimits struct {
+	ParserLimits
+	read   int64
+	depth  int
+	pooled bool // bulks and arrays from the pools, see ReadProtocolPooled
+}
+
+func (l *readLimits) add(n int) error {
+	l.read += int64(n)
+	if l.MaxReplyBytes > 0 && l.read > l.MaxReplyBytes {
+		return ReplyTooLargeError
+	}
+	return nil
+}
+
+func (l *readLimits) bulk(n int) error {
+	if l.MaxBulkLen > 0 && n > l.MaxBulkLen {
+		return BulkTooLargeError
+	}
+	return nil
+}
+
+// enter checks an aggregate of n elements one level deeper,
+// the caller calls leave when the aggregate is read
+func (l *readLimits) enter(n int) error {
+	if l.MaxArrayLen > 0 && n > l.MaxArrayLen {
+		return ArrayTooLongError
+	}
+	l.depth++
+	if l.MaxDepth > 0 && l.depth > l.MaxDepth {
+		return NestingTooDeepError
+	}
+	return nil
+}
+
+func (l *readLimits) leave() {
+	l.depth--
+}
+
+// readLine is ReadBytes('\n') giving up once the line is over MaxLineLen,
+// a client sending no \n never makes it buffer the line forever
+func (l *readLimits) readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := r.ReadSlice('\n')
+		if l.MaxLineLen > 0 && len(line)+len(frag) > l.MaxLineLen {
+			return nil, LineTooLongError
+		}
+		line = append(line, frag...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
 // binary data  may contain \r\n
 // so ,we must read fixed-length data by io.ReadFull
 func ReadProtocol(r *bufio.Reader) (Resp, error) {
-	res, err := r.ReadBytes(byte('\n'))
+	return ReadProtocolWithLimits(r, DefaultParserLimits)
+}
+
+// ReadProtocolWithLimits is ReadProtocol with the header lengths capped by limits
+func ReadProtocolWithLimits(r *bufio.Reader, limits ParserLimits) (Resp, error) {
+	lim := &readLimits{ParserLimits: limits}
+	trace, _ := parseTracer.Load().(ParseTracer)
+	if trace == nil {
+		return readProtocol(r, lim)
+	}
+
+	start := time.Now()
+	resp, err := readProtocol(r, lim)
+	if err == nil {
+		trace(resp.Type(), time.Since(start))
+	}
+	return resp, err
+}
+
+// ReadProtocolContext is ReadProtocol bounded by ctx, r must read from conn.
+// The deadline of ctx becomes the read deadline of conn, and cancelling ctx
+// expires it at once, so a read blocked in the middle of an array or a bulk
+// body is aborted too and ctx.Err() is returned. The frame was cut then,
+// conn is out of sync and must be closed. The read deadline is cleared
+// before returning
+func ReadProtocolContext(ctx context.Context, r *bufio.Reader, conn net.Conn) (Resp, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		if err := conn.SetReadDeadline(d); err != nil {
+			return nil, err
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	resp, err := ReadProtocol(r)
+	close(stop)
+	<-done
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		// the conn deadline may fire just before the timer of ctx
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && hasDeadline && !time.Now().Before(d) {
+			return nil, context.DeadlineExceeded
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReadPipeline reads exactly n replies of n pipelined commands in order.
+// If one fails, the replies read before it are returned with the error,
+// the connection is out of sync then and must not be reused
+func ReadPipeline(r *bufio.Reader, n int) ([]Resp, error) {
+	return AppendPipeline(make([]Resp, 0, minInt(n, maxPreallocArgs)), r, n)
+}
+
+// AppendPipeline is ReadPipeline appending the replies to dst, so the
+// caller can reuse one slice between batches with dst[:0]
+func AppendPipeline(dst []Resp, r *bufio.Reader, n int) ([]Resp, error) {
+	for i := 0; i < n; i++ {
+		resp, err := ReadProtocol(r)
+		if err != nil {
+			return dst, err
+		}
+		dst = append(dst, resp)
+	}
+	return dst, nil
+}
+
+func readProtocol(r *bufio.Reader, lim *readLimits) (Resp, error) {
+	res, err := lim.readLine(r)
 	if err != nil {
 		return nil, err
 	}
+	if err := lim.add(len(res)); err != nil {
+		return nil, err
+	}
+	if err := lim.checkLine(res); err != nil {
+		return nil, err
+	}
 
 	switch res[0] {
 	case SimpSep:
@@ -279,73 +1051,376 @@ func ReadProtocol(r *bufio.Reader) (Resp, error) {
 		ir.Args = append(ir.Args, res[1:len(res)-2])
 		return ir, nil
 	case BulkSep:
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		l, err := util.ParseLen(res[1 : len(res)-2])
+		return readBulkBody(r, res, lim)
+	case ArrSep:
+		ar := lim.newArray()
+		n, err := util.ParseLen(res[1 : len(res)-2])
 		if err != nil {
 			return nil, err
 		}
-		if l == -1 {
-			br.Empty = true
-			return br, nil
+		if n == -1 {
+			ar.Empty = true
+			return ar, nil
 		}
+		if err := lim.enter(n); err != nil {
+			return nil, err
+		}
+		defer lim.leave()
+
+		// commands are followed by n BulkResp, read them in a loop,
+		// only other types (nested replies) recurse
+		if n > 0 && cap(ar.Args) < n {
+			ar.Args = make([]*BulkResp, 0, minInt(n, maxPreallocArgs))
+		}
+		for i := 0; i < n; i++ {
+			b, err := r.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if b[0] != BulkSep {
+				rsp, err := readProtocol(r, lim)
+				if err != nil {
+					return nil, err
+				}
+				ar.append(rsp)
+				continue
+			}
 
-		// 把\r\n也读出来，扔掉
-		buf := make([]byte, l+2)
-		n, e := io.ReadFull(r, buf)
-		if e != nil || n != l+2 {
+			line, err := lim.readLine(r)
+			if err != nil {
+				return nil, err
+			}
+			if err := lim.add(len(line)); err != nil {
+				return nil, err
+			}
+			br, err := readBulkBody(r, line, lim)
+			if err != nil {
+				return nil, err
+			}
+			ar.append(br)
+		}
+		return ar, nil
+	case NullSep:
+		nr := &NullResp{}
+		nr.Rtype = NullType
+		return nr, nil
+	case BoolSep:
+		return parseBool(res)
+	case DoubleSep:
+		dr := &DoubleResp{}
+		dr.Rtype = DoubleType
+		dr.Args = append(dr.Args, res[1:len(res)-2])
+		return dr, nil
+	case BigNumSep:
+		return NewBigNumberResp(res[1 : len(res)-2]), nil
+	case VerbatimSep:
+		rsp, err := readBulkBody(r, res, lim)
+		if err != nil {
 			return nil, err
 		}
-		br.Args = append(br.Args, buf[:len(buf)-2])
-		return br, nil
-	case ArrSep:
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		n, err := util.ParseLen(res[1 : len(res)-2])
+		br := rsp.(*BulkResp)
+		if br.Empty {
+			return nil, VerbatimFormError
+		}
+		vr, err := parseVerbatim(br.Args[0])
+		if err != nil {
+			// not a nil *VerbatimResp in a non nil Resp
+			return nil, err
+		}
+		return vr, nil
+	case MapSep:
+		mr := &MapResp{}
+		mr.Rtype = MapType
+		n, err := parseAggregateLen(res[1 : len(res)-2])
+		if err != nil {
+			return nil, err
+		}
+		if err := lim.enter(n); err != nil {
+			return nil, err
+		}
+		defer lim.leave()
+
+		// n pairs, 2*n elements
+		for i := 0; i < 2*n; i++ {
+			rsp, err := readProtocol(r, lim)
+			if err != nil {
+				return nil, err
+			}
+			mr.Elems = append(mr.Elems, rsp)
+		}
+		return mr, nil
+	case SetSep:
+		n, err := parseAggregateLen(res[1 : len(res)-2])
 		if err != nil {
 			return nil, err
 		}
+		if err := lim.enter(n); err != nil {
+			return nil, err
+		}
+		defer lim.leave()
 
-		// must followed by n BulkResp
+		sr := NewSetResp()
 		for i := 0; i < n; i++ {
-			rsp, err := ReadProtocol(r)
+			rsp, err := readProtocol(r, lim)
 			if err != nil {
 				return nil, err
 			}
-			br, ok := rsp.(*BulkResp)
-			if !ok {
-				return nil, ArrSepReadError
+			sr.Add(rsp)
+		}
+		return sr, nil
+	case PushSep:
+		n, err := parseAggregateLen(res[1 : len(res)-2])
+		if err != nil {
+			return nil, err
+		}
+		if err := lim.enter(n); err != nil {
+			return nil, err
+		}
+		defer lim.leave()
+
+		pr := NewPushResp()
+		for i := 0; i < n; i++ {
+			rsp, err := readProtocol(r, lim)
+			if err != nil {
+				return nil, err
 			}
-			ar.Args = append(ar.Args, br)
+			pr.Elems = append(pr.Elems, rsp)
 		}
-		return ar, nil
-	case byte('Q'):
-		fallthrough
-	case byte('q'):
-		if len(res) != 6 {
-			return nil, RawCmdError
-		}
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{QUIT}
-		ar.Args = append(ar.Args, br)
-		return ar, nil
-	case byte('p'):
-		fallthrough
-	case byte('P'):
-		if len(res) != 6 {
-			return nil, RawCmdError
-		}
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
+		return pr, nil
+	}
+
+	return parseInline(res)
+}
+
+// parseBool parses the line #t\r\n or #f\r\n
+func parseBool(res []byte) (Resp, error) {
+	if len(res) != 4 {
+		return nil, BoolFormError
+	}
+	switch res[1] {
+	case 't':
+		return NewBooleanResp(true), nil
+	case 'f':
+		return NewBooleanResp(false), nil
+	}
+	return nil, BoolFormError
+}
+
+// don't trust a huge array length before the elements really arrive
+const maxPreallocArgs = 1024
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readBulkBody reads the payload of the bulk whose header line is res
+func readBulkBody(r *bufio.Reader, res []byte, lim *readLimits) (Resp, error) {
+	if err := lim.checkLine(res); err != nil {
+		return nil, err
+	}
+	br := lim.newBulk()
+	l, err := util.ParseLen(res[1 : len(res)-2])
+	if err != nil {
+		return nil, err
+	}
+	if l == -1 {
+		br.Empty = true
+		return br, nil
+	}
+	if err := lim.add(l + 2); err != nil {
+		return nil, err
+	}
+	if err := lim.bulk(l); err != nil {
+		return nil, err
+	}
+
+	// 把\r\n也读出来，扔掉
+	buf, e := readPayload(r, lim.payload(br), l+2)
+	if e != nil || len(buf) != l+2 {
+		// the header was read, EOF before the body is a truncated frame
+		if e == nil || e == io.EOF {
+			e = io.ErrUnexpectedEOF
+		}
+		return nil, e
+	}
+	if err := checkBulkEnd(buf, l); err != nil {
+		return nil, err
+	}
+	br.Args = append(br.Args, buf[:l])
+	return br, nil
+}
+
+// bulkPrealloc is the most of a bulk payload allocated before its bytes
+// arrive. A larger one grows as it's read, a header declaring 512MB with
+// nothing after it costs what was sent, not 512MB
+const bulkPrealloc = 1 << 20
+
+// readPayload reads n bytes into buf if it's large enough, or into a new
+// buffer, grown chunk by chunk over bulkPrealloc. On error the bytes read
+// so far are returned, like io.ReadFull
+func readPayload(r io.Reader, buf []byte, n int) ([]byte, error) {
+	if cap(buf) < n && n <= bulkPrealloc {
+		buf = make([]byte, n)
+	}
+	if cap(buf) >= n {
+		m, err := io.ReadFull(r, buf[:n])
+		return buf[:m], err
+	}
+
+	buf = make([]byte, 0, bulkPrealloc)
+	for len(buf) < n {
+		if len(buf) == cap(buf) {
+			size := 2 * cap(buf)
+			if size > n {
+				size = n
+			}
+			grown := make([]byte, len(buf), size)
+			copy(grown, buf)
+			buf = grown
+		}
+		m, err := io.ReadFull(r, buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+m]
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// parseInline parses the raw command without RESP framing sent by telnet
+// or redis-cli, the line is split into the arguments of a command array
+func parseInline(res []byte) (Resp, error) {
+	args, err := splitInlineArgs(bytes.TrimRight(res, "\r\n"))
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, RawCmdError
+	}
+
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Args = make([]*BulkResp, 0, len(args))
+	for _, arg := range args {
 		br := &BulkResp{}
 		br.Rtype = BulkType
-		br.Args = [][]byte{PING}
+		br.Args = [][]byte{arg}
 		ar.Args = append(ar.Args, br)
-		return ar, nil
 	}
+	return ar, nil
+}
+
+// splitInlineArgs splits an inline command the way redis does: arguments
+// are separated by white space, "..." may contain spaces and the escapes
+// \n \r \t \b \a \xHH, '...' may contain spaces and \'. A closing quote
+// must be followed by white space or the end of the line
+func splitInlineArgs(line []byte) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		switch line[i] {
+		case '"':
+			i++
+			for ; ; i++ {
+				if i == len(line) {
+					return nil, InlineQuotesError
+				}
+				c := line[i]
+				if c == '"' {
+					break
+				}
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					arg = append(arg, hexDigit(line[i+2])<<4|hexDigit(line[i+3]))
+					i += 3
+					continue
+				}
+				if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = line[i]
+					}
+				}
+				arg = append(arg, c)
+			}
+			i++
+		case '\'':
+			i++
+			for ; ; i++ {
+				if i == len(line) {
+					return nil, InlineQuotesError
+				}
+				c := line[i]
+				if c == '\'' {
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+				}
+				arg = append(arg, line[i])
+			}
+			i++
+		default:
+			start := i
+			for i < len(line) && !isInlineSpace(line[i]) {
+				i++
+			}
+			arg = line[start:i]
+		}
+
+		if i < len(line) && !isInlineSpace(line[i]) {
+			// "foo"bar
+			return nil, InlineQuotesError
+		}
+		if arg == nil {
+			arg = []byte{}
+		}
+		args = append(args, arg)
+	}
+}
 
-	return nil, ReadRespUnexpectedError
+func isInlineSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\r', '\v', '\f':
+		return true
+	}
+	return false
+}
+
+func isHexDigit(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func hexDigit(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
 }
@@ -3,7 +3,17 @@ package archer
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/dongzerun/archer/util"
 )
 
 func Benchmark_ReadProtocol(b *testing.B) {
@@ -13,3 +23,974 @@ func Benchmark_ReadProtocol(b *testing.B) {
 		ReadProtocol(bufio.NewReader(r))
 	}
 }
+
+func readResp(t *testing.T, data string) Resp {
+	r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString(data)))
+	if err != nil {
+		t.Fatalf("ReadProtocol %q: %s", data, err)
+	}
+	return r
+}
+
+func encodeResp(t *testing.T, r Resp) string {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := r.Encode(w); err != nil {
+		t.Fatalf("Encode %s: %s", r.String(), err)
+	}
+	return b.String()
+}
+
+func TestNewErrorRespf(t *testing.T) {
+	name := "foo\r\n+OK"
+	er := NewErrorRespf("ERR unknown command '%s'", name)
+	if got := encodeResp(t, er); got != "-ERR unknown command 'foo  +OK'\r\n" {
+		t.Fatalf("unexpected frame %q", got)
+	}
+	if name != "foo\r\n+OK" {
+		t.Fatal("argument must not be modified")
+	}
+}
+
+func TestErrorRespProxyGenerated(t *testing.T) {
+	for _, er := range []*ErrorResp{
+		NewErrorResp([]byte("CROSSSLOT Keys in request don't hash to the same slot")),
+		NewErrorRespf("ERR unknown command '%s'", "foo"),
+		SubscribeModeErrorResp(newCommand("GET", "a")),
+	} {
+		if !er.ProxyGenerated {
+			t.Fatalf("%q should be proxy generated", er.String())
+		}
+	}
+
+	data := "-ERR unknown command 'foo'\r\n"
+	parsed := readResp(t, data).(*ErrorResp)
+	if parsed.ProxyGenerated {
+		t.Fatal("parsed error is from the backend")
+	}
+	r, _, err := Decode([]byte(data))
+	if err != nil || r.(*ErrorResp).ProxyGenerated {
+		t.Fatal("decoded error is from the backend", err)
+	}
+
+	// the flag is not on the wire
+	if got := encodeResp(t, NewErrorRespf("ERR unknown command '%s'", "foo")); got != data {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestArrayRespWriteTo(t *testing.T) {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	for i := 0; i < 100000; i++ {
+		br := &BulkResp{}
+		br.Rtype = BulkType
+		if i%10 == 0 {
+			br.Empty = true
+		} else {
+			br.Args = [][]byte{[]byte("member:" + strconv.Itoa(i))}
+		}
+		ar.Args = append(ar.Args, br)
+	}
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	n, err := ar.WriteTo(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(b.Len()) {
+		t.Fatalf("WriteTo returned %d, wrote %d", n, b.Len())
+	}
+	if encoded := encodeResp(t, ar); encoded != b.String() {
+		t.Fatal("WriteTo differs from Encode")
+	}
+
+	r, err := ReadProtocol(bufio.NewReader(&b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Length() != 100000-1 {
+		t.Fatal(r.Length())
+	}
+}
+
+func TestParseTracer(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		types []string
+	)
+	SetParseTracer(func(typ string, dur time.Duration) {
+		if dur < 0 {
+			t.Error(dur)
+		}
+		mu.Lock()
+		types = append(types, typ)
+		mu.Unlock()
+	})
+	t.Cleanup(func() { SetParseTracer(nil) })
+
+	r := bufio.NewReader(bytes.NewBufferString("*2\r\n$3\r\nGET\r\n$1\r\na\r\n+OK\r\n:1\r\n"))
+	for i := 0; i < 3; i++ {
+		if _, err := ReadProtocol(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Join(types, " ") != "array simple int" {
+		t.Fatal(types)
+	}
+}
+
+func TestPeekIsError(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("-ERR wrong\r\n$3\r\n-no\r\n"))
+
+	isErr, err := PeekIsError(r)
+	if err != nil || !isErr {
+		t.Fatal(isErr, err)
+	}
+	resp, err := ReadProtocol(r)
+	if err != nil || resp.Type() != ErrorType || resp.String() != "ERR wrong" {
+		t.Fatal(resp, err)
+	}
+
+	// a bulk starting with - is not an error
+	isErr, err = PeekIsError(r)
+	if err != nil || isErr {
+		t.Fatal(isErr, err)
+	}
+	if _, err := ReadProtocol(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := PeekIsError(r); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestReadProtocolCRLFBulk(t *testing.T) {
+	data := "$2\r\n\r\n\r\n*2\r\n$2\r\n\r\n\r\n$1\r\n\n\r\n"
+	r := bufio.NewReader(bytes.NewBufferString(data))
+
+	resp, err := ReadProtocol(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := resp.(*BulkResp)
+	if !bytes.Equal(br.Args[0], []byte("\r\n")) {
+		t.Fatalf("%q", br.Args[0])
+	}
+
+	resp, err = ReadProtocol(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ar := resp.(*ArrayResp)
+	if len(ar.Args) != 2 || !bytes.Equal(ar.Args[0].Args[0], []byte("\r\n")) || !bytes.Equal(ar.Args[1].Args[0], []byte("\n")) {
+		t.Fatalf("%q", ar.String())
+	}
+	if got := encodeResp(t, br) + encodeResp(t, ar); got != data {
+		t.Fatalf("round trip %q", got)
+	}
+}
+
+func TestReadProtocolPaddedLength(t *testing.T) {
+	for _, data := range []string{"$007\r\nabcdefg\r\n", "$ 7\r\nabcdefg\r\n", "*02\r\n$01\r\na\r\n$ 1\r\nb\r\n"} {
+		r := readResp(t, data)
+		if s := r.String(); s != "abcdefg" && s != "a b" {
+			t.Fatalf("%q: %q", data, s)
+		}
+	}
+	for _, data := range []string{"$+7\r\nabcdefg\r\n", "$7a\r\nabcdefg\r\n", "*+1\r\n$1\r\na\r\n"} {
+		if _, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString(data))); err == nil {
+			t.Fatalf("%q should be rejected", data)
+		}
+	}
+}
+
+func TestReadProtocolTruncatedBulk(t *testing.T) {
+	for _, data := range []string{"$10\r\n", "$10\r\nabc", "*2\r\n$3\r\nfoo\r\n$10\r\nabc"} {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte(data))
+			pw.Close()
+		}()
+		r, err := ReadProtocol(bufio.NewReader(pr))
+		if err != io.ErrUnexpectedEOF || r != nil {
+			t.Fatalf("%q: %v %v", data, r, err)
+		}
+	}
+}
+
+func TestEncodeEquals(t *testing.T) {
+	br := NewBulkResp([]byte("foo"))
+	if !EncodeEquals(br, []byte("$3\r\nfoo\r\n")) {
+		t.Fatal("bulk should equal")
+	}
+	if EncodeEquals(br, []byte("$3\r\nbar\r\n")) {
+		t.Fatal("bulk should differ")
+	}
+
+	ar := newCommand("GET", "foo")
+	if !EncodeEquals(ar, []byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n")) {
+		t.Fatal("array should equal")
+	}
+	if EncodeEquals(ar, []byte("*2\r\n$3\r\nGET\r\n$3\r\nfoo")) {
+		t.Fatal("truncated array should differ")
+	}
+}
+
+func TestReadProtocolInline(t *testing.T) {
+	cases := map[string]string{
+		"PING\r\n":                   "*1\r\n$4\r\nPING\r\n",
+		"quit\r\n":                   "*1\r\n$4\r\nquit\r\n",
+		"GET foo\r\n":                "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n",
+		"  SET  a b \r\n":            "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"set a b\n":                  "*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"SET k \"a b\"\r\n":          "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$3\r\na b\r\n",
+		"SET k \"\"\r\n":             "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n",
+		"SET k \"\\x41\\n\\\"\"\r\n": "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$3\r\nA\n\"\r\n",
+		"SET k 'it\\'s \\n'\r\n":     "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$7\r\nit's \\n\r\n",
+		"HSET h\tf\tv\r\n":           "*4\r\n$4\r\nHSET\r\n$1\r\nh\r\n$1\r\nf\r\n$1\r\nv\r\n",
+	}
+	for in, want := range cases {
+		if got := encodeResp(t, readResp(t, in)); got != want {
+			t.Fatalf("%q: got %q want %q", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"\r\n", "\n", "   \r\n", "\t \r\n"} {
+		_, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString(in)))
+		if err != RawCmdError {
+			t.Fatalf("%q: %v", in, err)
+		}
+	}
+
+	for _, in := range []string{"SET k \"a\r\n", "SET k 'a\r\n", "SET k \"a\"b\r\n", "SET k 'a'b\r\n"} {
+		_, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString(in)))
+		if err != InlineQuotesError {
+			t.Fatalf("%q: %v", in, err)
+		}
+	}
+}
+
+func TestEncodeToMatchesEncode(t *testing.T) {
+	frames := []string{
+		"+OK\r\n",
+		"-ERR wrong\r\n",
+		":42\r\n",
+		"$5\r\nhello\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*3\r\n$3\r\nset\r\n$-1\r\n$0\r\n\r\n",
+		"*2\r\n*2\r\n:1\r\n+a\r\n$1\r\nx\r\n",
+		"_\r\n",
+		"%1\r\n+a\r\n*1\r\n:1\r\n",
+	}
+
+	// EncodeTo appends, so share one buffer between frames
+	var all bytes.Buffer
+	for _, f := range frames {
+		r := readResp(t, f)
+		var b bytes.Buffer
+		if err := r.EncodeTo(&b); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != encodeResp(t, r) || b.String() != f {
+			t.Fatalf("EncodeTo %q got %q", f, b.String())
+		}
+		r.EncodeTo(&all)
+	}
+	if all.String() != strings.Join(frames, "") {
+		t.Fatalf("EncodeTo must append, got %q", all.String())
+	}
+}
+
+// plainWriter hides the *bytes.Buffer so WriteTo takes its generic path
+type plainWriter struct{ b bytes.Buffer }
+
+func (w *plainWriter) Write(p []byte) (int, error) { return w.b.Write(p) }
+
+func TestWriteToMatchesEncode(t *testing.T) {
+	frames := []string{
+		"+OK\r\n",
+		"-ERR wrong\r\n",
+		":-42\r\n",
+		"$5\r\nhello\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		"*0\r\n",
+		"*3\r\n$3\r\nset\r\n$-1\r\n$0\r\n\r\n",
+		"*2\r\n*2\r\n:1\r\n+a\r\n$1\r\nx\r\n",
+		"_\r\n",
+		"#t\r\n",
+		",1.5\r\n",
+		"(12345678901234567890\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"%1\r\n+a\r\n*1\r\n:1\r\n",
+		"~2\r\n:1\r\n$1\r\nb\r\n",
+	}
+
+	for _, f := range frames {
+		r := readResp(t, f)
+		wt, ok := r.(io.WriterTo)
+		if !ok {
+			t.Fatalf("%T is not an io.WriterTo", r)
+		}
+
+		var pw plainWriter
+		n, err := wt.WriteTo(&pw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pw.b.String() != f || n != int64(len(f)) {
+			t.Fatalf("WriteTo %q got %q, n %d", f, pw.b.String(), n)
+		}
+
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		if err := WriteProtocol(w, r); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != encodeResp(t, r) || b.String() != f {
+			t.Fatalf("WriteProtocol %q got %q", f, b.String())
+		}
+	}
+}
+
+func TestEncodeMalformed(t *testing.T) {
+	wrongType := &SimpleResp{}
+	wrongType.Rtype = IntType
+	wrongType.Args = [][]byte{[]byte("OK")}
+	noArgs := &SimpleResp{}
+	noArgs.Rtype = SimpleType
+	badElem := &ArrayResp{}
+	badElem.Rtype = ArrayType
+	badElem.Elems = []Resp{NewIntResp(1), noArgs}
+	nilElem := &ArrayResp{}
+	nilElem.Rtype = ArrayType
+	nilElem.Args = []*BulkResp{NewBulkResp([]byte("a")), nil}
+	nilMap := &MapResp{}
+	nilMap.Rtype = MapType
+	nilMap.Elems = []Resp{NewIntResp(1), nil}
+
+	cases := []struct {
+		r   Resp
+		err error
+	}{
+		{wrongType, RespTypeError},
+		{noArgs, RespArgsError},
+		{&BulkResp{BaseResp: BaseResp{Rtype: BulkType}}, RespArgsError},
+		{&DoubleResp{BaseResp{Rtype: DoubleType}}, RespArgsError},
+		{badElem, RespArgsError},
+		{nilElem, RespTypeError},
+		{nilMap, RespTypeError},
+	}
+	for _, c := range cases {
+		// nothing may be written, not even the array header
+		var out bytes.Buffer
+		w := bufio.NewWriter(&out)
+		if err := c.r.Encode(w); err != c.err {
+			t.Fatalf("%T Encode got %v", c.r, err)
+		}
+		w.Flush()
+		if out.Len() != 0 {
+			t.Fatalf("%T Encode wrote %q", c.r, out.String())
+		}
+
+		b := bytes.NewBufferString("+OK\r\n")
+		if err := c.r.EncodeTo(b); err != c.err || b.String() != "+OK\r\n" {
+			t.Fatalf("%T EncodeTo got %v %q", c.r, err, b.String())
+		}
+
+		var pw plainWriter
+		if n, err := c.r.(io.WriterTo).WriteTo(&pw); err != c.err || n != 0 || pw.b.Len() != 0 {
+			t.Fatalf("%T WriteTo got %v %d %q", c.r, err, n, pw.b.String())
+		}
+	}
+
+	if f := (&BulkResp{BaseResp: BaseResp{Rtype: BulkType}}).Frame(); f != nil {
+		t.Fatalf("%q", f)
+	}
+}
+
+func TestEncodeZeroAlloc(t *testing.T) {
+	frames := []string{
+		"+OK\r\n",
+		"-ERR wrong\r\n",
+		":42\r\n",
+		"$5\r\nhello\r\n",
+		"$-1\r\n",
+		"*3\r\n$3\r\nset\r\n$-1\r\n$0\r\n\r\n",
+		"*2\r\n*2\r\n:1\r\n+a\r\n$1\r\nx\r\n",
+		"_\r\n",
+		"#t\r\n",
+		",1.5\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"%1\r\n+a\r\n*1\r\n:1\r\n",
+		"~2\r\n:1\r\n$1\r\nb\r\n",
+		">2\r\n$7\r\nmessage\r\n:1\r\n",
+	}
+	w := bufio.NewWriter(ioutil.Discard)
+	var b bytes.Buffer
+	b.Grow(1024)
+	var pw io.Writer = struct{ io.Writer }{ioutil.Discard}
+	for _, f := range frames {
+		r := readResp(t, f)
+		// warm up the writer pool
+		r.(io.WriterTo).WriteTo(pw)
+		if n := testing.AllocsPerRun(100, func() {
+			r.Encode(w)
+			b.Reset()
+			r.EncodeTo(&b)
+			r.(io.WriterTo).WriteTo(pw)
+		}); n != 0 {
+			t.Fatalf("%q: %v allocs", f, n)
+		}
+	}
+}
+
+func Benchmark_EncodeReply(b *testing.B) {
+	r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString("*4\r\n$5\r\nhello\r\n$5\r\nworld\r\n$12\r\nwocao\r\nzhaha\r\n$-1\r\n")))
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Encode(w)
+	}
+}
+
+func Benchmark_EncodeToReply(b *testing.B) {
+	r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString("*4\r\n$5\r\nhello\r\n$5\r\nworld\r\n$12\r\nwocao\r\nzhaha\r\n$-1\r\n")))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		r.EncodeTo(&buf)
+	}
+}
+
+func Benchmark_WriteToReply(b *testing.B) {
+	r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString("*4\r\n$5\r\nhello\r\n$5\r\nworld\r\n$12\r\nwocao\r\nzhaha\r\n$-1\r\n")))
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(ioutil.Discard)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		WriteProtocol(w, r)
+	}
+}
+
+func TestResync(t *testing.T) {
+	r := bufio.NewReader(bytes.NewBufferString("garbage\r\nmore\r\n+OK\r\n"))
+	n, err := Resync(r, 1024)
+	if err != nil || n != 15 {
+		t.Fatal(n, err)
+	}
+	resp, err := ReadProtocol(r)
+	if err != nil || resp.String() != "OK" {
+		t.Fatal(resp, err)
+	}
+
+	r = bufio.NewReader(bytes.NewBufferString("0123456789\r\n:1\r\n"))
+	if _, err := Resync(r, 5); err != ResyncLimitError {
+		t.Fatal(err)
+	}
+
+	r = bufio.NewReader(bytes.NewBufferString("no boundary"))
+	if _, err := Resync(r, 1024); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestValidateStream(t *testing.T) {
+	stream := "+OK\r\n-ERR wrong\r\n:42\r\n$5\r\nhello\r\n$-1\r\n*-1\r\n" +
+		"*3\r\n$3\r\nset\r\n*2\r\n:1\r\n$-1\r\n$0\r\n\r\n" +
+		"%1\r\n+a\r\n*1\r\n$4\r\na\r\nb\r\n" +
+		"~2\r\n:1\r\n_\r\n"
+	r := bufio.NewReader(bytes.NewBufferString(stream))
+	if err := ValidateStream(r, 9); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatal("stream not consumed exactly")
+	}
+
+	for _, bad := range []string{"$3\r\nfoobar\r\n", "?x\r\n", "*2\r\n:1\r\n"} {
+		r := bufio.NewReader(bytes.NewBufferString(bad))
+		if err := ValidateStream(r, 1); err == nil {
+			t.Fatalf("%q should fail", bad)
+		}
+	}
+}
+
+func Benchmark_ReadProtocolFlat50(b *testing.B) {
+	var buf bytes.Buffer
+	buf.WriteString("*50\r\n")
+	for i := 0; i < 50; i++ {
+		s := "key:" + strconv.Itoa(i)
+		buf.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+	}
+	data := buf.Bytes()
+
+	rd := bytes.NewReader(data)
+	r := bufio.NewReader(rd)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rd.Reset(data)
+		r.Reset(rd)
+		if _, err := ReadProtocol(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMaxReplyBytes(t *testing.T) {
+	limits := (&ProxyConfig{maxReplyBytes: 64}).parserLimits()
+	if limits.MaxReplyBytes != 64 || limits.MaxBulkLen != DefaultParserLimits.MaxBulkLen || DefaultParserLimits.MaxReplyBytes != 0 {
+		t.Fatalf("%+v", limits)
+	}
+
+	r, err := ReadProtocolWithLimits(bufio.NewReader(bytes.NewBufferString("*2\r\n$3\r\nfoo\r\n$3\r\nbar\r\n")), limits)
+	if err != nil || r.String() != "foo bar" {
+		t.Fatal(r, err)
+	}
+
+	// 4 small elements are fine one by one, the whole array is over the limit
+	var big bytes.Buffer
+	big.WriteString("*4\r\n")
+	for i := 0; i < 4; i++ {
+		big.WriteString("$10\r\n0123456789\r\n")
+	}
+	for _, data := range []string{big.String(), "$100\r\n", "*1\r\n*1\r\n$1000000000\r\n"} {
+		_, err := ReadProtocolWithLimits(bufio.NewReader(bytes.NewBufferString(data)), limits)
+		if err != ReplyTooLargeError {
+			t.Fatalf("%q: expect ReplyTooLargeError, got %v", data, err)
+		}
+	}
+}
+
+func TestReadProtocolWithLimits(t *testing.T) {
+	limits := ParserLimits{MaxBulkLen: 8, MaxArrayLen: 4, MaxDepth: 2, MaxLineLen: 16}
+	read := func(data string) (Resp, error) {
+		return ReadProtocolWithLimits(bufio.NewReader(bytes.NewBufferString(data)), limits)
+	}
+
+	if _, err := read("*2\r\n*1\r\n$8\r\n01234567\r\n:1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		data string
+		err  error
+	}{
+		// the header is enough, the payload never arrives
+		{"$1000000000000\r\n", BulkTooLargeError},
+		{"$9\r\n", BulkTooLargeError},
+		{"*2000000000\r\n", ArrayTooLongError},
+		{"%5\r\n", ArrayTooLongError},
+		{"~5\r\n", ArrayTooLongError},
+		{"*1\r\n*1\r\n*1\r\n", NestingTooDeepError},
+		{"*1\r\n%1\r\n~1\r\n", NestingTooDeepError},
+		{"SET key 0123456789\r\n", LineTooLongError},
+		{"+01234567890123456789", LineTooLongError},
+		{"*1\r\n$0000000000000000001\r\n", LineTooLongError},
+	}
+	for _, tt := range tests {
+		if _, err := read(tt.data); err != tt.err {
+			t.Fatalf("%q: got %v want %v", tt.data, err, tt.err)
+		}
+	}
+
+	for _, data := range []string{"$-2\r\n", "*-5\r\n", "$99999999999999999999999\r\n"} {
+		if _, err := read(data); err == nil {
+			t.Fatalf("%q should be rejected", data)
+		}
+	}
+
+	// default limits
+	if _, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString("$1000000000000\r\n"))); err != BulkTooLargeError {
+		t.Fatal(err)
+	}
+}
+
+func TestErrorRespRedirect(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *Redirect
+	}{
+		{"MOVED 3999 127.0.0.1:6381", &Redirect{"MOVED", 3999, "127.0.0.1:6381"}},
+		{"ASK 3999 127.0.0.1:6381", &Redirect{"ASK", 3999, "127.0.0.1:6381"}},
+		{"  MOVED   0  [::1]:6381 ", &Redirect{"MOVED", 0, "[::1]:6381"}},
+		{"ERR unknown command", nil},
+		{"MOVED abc 127.0.0.1:6381", nil},
+		{"MOVED 16384 127.0.0.1:6381", nil},
+		{"MOVED -1 127.0.0.1:6381", nil},
+		{"MOVED 3999", nil},
+		{"MOVED 3999 127.0.0.1", nil},
+		{"ASK 3999 :6381", nil},
+		{"WRONGTYPE Operation against a key", nil},
+	}
+	for _, tt := range tests {
+		rd, ok := NewErrorResp([]byte(tt.in)).Redirect()
+		if ok != (tt.want != nil) {
+			t.Fatalf("%q: ok %v", tt.in, ok)
+		}
+		if ok && *rd != *tt.want {
+			t.Fatalf("%q: %+v", tt.in, rd)
+		}
+	}
+}
+
+func TestReadPipeline(t *testing.T) {
+	data := "+OK\r\n$3\r\nfoo\r\n:1\r\n*1\r\n$1\r\na\r\n-ERR x\r\n"
+	r := bufio.NewReader(bytes.NewBufferString(data))
+	replies, err := ReadPipeline(r, 5)
+	if err != nil || len(replies) != 5 {
+		t.Fatal(len(replies), err)
+	}
+	var got string
+	for _, rsp := range replies {
+		got += encodeResp(t, rsp)
+	}
+	if got != data {
+		t.Fatalf("%q", got)
+	}
+
+	// the third reply is truncated, the first two are still returned
+	r = bufio.NewReader(bytes.NewBufferString("+OK\r\n:2\r\n$10\r\nabc"))
+	replies, err = ReadPipeline(r, 3)
+	if err != io.ErrUnexpectedEOF || len(replies) != 2 || replies[1].String() != "2" {
+		t.Fatal(len(replies), err)
+	}
+
+	// reuse one slice between batches
+	r = bufio.NewReader(bytes.NewBufferString(strings.Repeat("+OK\r\n", 6)))
+	buf := make([]Resp, 0, 3)
+	for i := 0; i < 2; i++ {
+		buf, err = AppendPipeline(buf[:0], r, 3)
+		if err != nil || len(buf) != 3 || cap(buf) != 3 {
+			t.Fatal(len(buf), cap(buf), err)
+		}
+	}
+}
+
+func Benchmark_ReadPipeline(b *testing.B) {
+	data := []byte(strings.Repeat("$5\r\nvalue\r\n", 50))
+	rd := bytes.NewReader(data)
+	r := bufio.NewReader(rd)
+	buf := make([]Resp, 0, 50)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rd.Reset(data)
+		r.Reset(rd)
+		var err error
+		if buf, err = AppendPipeline(buf[:0], r, 50); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTypedAccessors(t *testing.T) {
+	if v, err := readResp(t, ":-42\r\n").(*IntResp).Int(); err != nil || v != -42 {
+		t.Fatal(v, err)
+	}
+	if _, err := (&IntResp{}).Int(); err != ReplyFormError {
+		t.Fatal(err)
+	}
+
+	if b, ok := readResp(t, "$3\r\nfoo\r\n").(*BulkResp).Bytes(); !ok || string(b) != "foo" {
+		t.Fatal(string(b), ok)
+	}
+	if b, ok := readResp(t, "$0\r\n\r\n").(*BulkResp).Bytes(); !ok || len(b) != 0 {
+		t.Fatal(b, ok)
+	}
+	for _, br := range []*BulkResp{NewNullBulkResp(), {}} {
+		if b, ok := br.Bytes(); ok || b != nil {
+			t.Fatal(b, ok)
+		}
+	}
+	if f := NewBulkResp([]byte("foo")).Frame(); string(f) != "$3\r\nfoo\r\n" {
+		t.Fatalf("%q", f)
+	}
+
+	if s := readResp(t, "+OK\r\n").(*SimpleResp).Status(); s != "OK" {
+		t.Fatal(s)
+	}
+	if s := (&SimpleResp{}).Status(); s != "" {
+		t.Fatal(s)
+	}
+
+	var err error = readResp(t, "-ERR unknown command\r\n").(*ErrorResp)
+	if err.Error() != "ERR unknown command" {
+		t.Fatal(err)
+	}
+	if s := (&ErrorResp{}).Error(); s != "" {
+		t.Fatal(s)
+	}
+}
+
+func TestReadProtocolContext(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	r := bufio.NewReader(client)
+
+	// whole frame, the deadline is cleared afterwards
+	go server.Write([]byte("*2\r\n$3\r\nfoo\r\n:1\r\n"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	rsp, err := ReadProtocolContext(ctx, r, client)
+	cancel()
+	if err != nil || rsp.String() != "foo 1" {
+		t.Fatal(rsp, err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		server.Write([]byte("+OK\r\n"))
+	}()
+	if rsp, err := ReadProtocolContext(context.Background(), r, client); err != nil || rsp.String() != "OK" {
+		t.Fatal(rsp, err)
+	}
+
+	// deadline in the middle of a bulk body
+	go server.Write([]byte("*2\r\n$3\r\nfoo\r\n$10\r\nabc"))
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	_, err = ReadProtocolContext(ctx, r, client)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+}
+
+func TestReadProtocolContextCancel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// cancelled in the middle of an array, no deadline at all
+	go server.Write([]byte("*3\r\n:1\r\n"))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := ReadProtocolContext(ctx, bufio.NewReader(client), client); err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	if _, err := ReadProtocolContext(ctx, bufio.NewReader(client), client); err != context.Canceled {
+		t.Fatal("cancelled context must not read", err)
+	}
+}
+
+func TestReadProtocolNegativeLength(t *testing.T) {
+	for _, data := range []string{"$-5\r\n", "*-3\r\n", "$-01\r\n", "*2\r\n$-2\r\n$1\r\na\r\n"} {
+		r, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString(data)))
+		if err != util.NegativeLengthError || r != nil {
+			t.Fatalf("%q: %v %v", data, r, err)
+		}
+		if _, _, err := Decode([]byte(data)); err != util.NegativeLengthError {
+			t.Fatalf("Decode %q: %v", data, err)
+		}
+	}
+
+	// -1 is still null
+	if !IsNull(readResp(t, "$-1\r\n")) || !IsNull(readResp(t, "*-1\r\n")) {
+		t.Fatal("-1 must be null")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	equal := [][2]Resp{
+		{readResp(t, "$3\r\nfoo\r\n"), NewBulkResp([]byte("foo"))},
+		{readResp(t, "$-1\r\n"), &BulkResp{BaseResp: BaseResp{Rtype: BulkType, Args: [][]byte{[]byte("stale")}}, Empty: true}},
+		{readResp(t, "*2\r\n$1\r\na\r\n:1\r\n"), readResp(t, "*2\r\n$1\r\na\r\n:1\r\n")},
+		{readResp(t, "%1\r\n+k\r\n~1\r\n#t\r\n"), readResp(t, "%1\r\n+k\r\n~1\r\n#t\r\n")},
+		{readResp(t, "=7\r\ntxt:abc\r\n"), NewVerbatimResp("txt", []byte("abc"))},
+		{nil, nil},
+		{(*BulkResp)(nil), nil},
+	}
+	for _, p := range equal {
+		if !Equal(p[0], p[1]) || !Equal(p[1], p[0]) {
+			t.Fatalf("%v should equal %v", p[0], p[1])
+		}
+	}
+
+	// an all bulk array keeps its elements in ArrayResp.Args, which shadows
+	// BaseResp.Args, the same array in Elems form must still be equal
+	args := newCommand("GET", "a")
+	elems := &ArrayResp{}
+	elems.Rtype = ArrayType
+	elems.Elems = []Resp{NewBulkResp([]byte("GET")), NewBulkResp([]byte("a"))}
+	elems.BaseResp.Args = [][]byte{[]byte("junk")}
+	if !Equal(args, elems) || !Equal(elems, args) {
+		t.Fatal("Args and Elems forms should be equal")
+	}
+
+	differ := [][2]Resp{
+		{readResp(t, "$-1\r\n"), readResp(t, "$0\r\n\r\n")},
+		{readResp(t, "$-1\r\n"), readResp(t, "_\r\n")},
+		{readResp(t, "*-1\r\n"), readResp(t, "*0\r\n")},
+		{readResp(t, "*1\r\n$1\r\na\r\n"), readResp(t, "*1\r\n*1\r\n$1\r\na\r\n")},
+		{readResp(t, "+OK\r\n"), readResp(t, "$2\r\nOK\r\n")},
+		{readResp(t, ":1\r\n"), readResp(t, ":2\r\n")},
+		{readResp(t, "=7\r\ntxt:abc\r\n"), readResp(t, "=7\r\nmkd:abc\r\n")},
+		{readResp(t, "#t\r\n"), nil},
+		{(*ArrayResp)(nil), newCommand("GET")},
+	}
+	for _, p := range differ {
+		if Equal(p[0], p[1]) || Equal(p[1], p[0]) {
+			t.Fatalf("%v should differ from %v", p[0], p[1])
+		}
+	}
+}
+
+func TestArrayRespCommand(t *testing.T) {
+	ar := readResp(t, "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$-1\r\n").(*ArrayResp)
+	if name, ok := ar.Command(); !ok || name != "SET" {
+		t.Fatal(name, ok)
+	}
+	if string(ar.Args[0].Args[0]) != "set" {
+		t.Fatal("Command must not modify ar")
+	}
+	if arg, ok := ar.Arg(1); !ok || string(arg) != "k" {
+		t.Fatal(arg, ok)
+	}
+	for _, i := range []int{-1, 2, 3} {
+		if arg, ok := ar.Arg(i); ok {
+			t.Fatalf("Arg(%d) got %q", i, arg)
+		}
+	}
+
+	mixed := &ArrayResp{}
+	mixed.Rtype = ArrayType
+	mixed.Elems = []Resp{NewBulkResp([]byte("ping")), NewIntResp(1), nil}
+	if name, ok := mixed.Command(); !ok || name != "PING" {
+		t.Fatal(name, ok)
+	}
+	if _, ok := mixed.Arg(1); ok {
+		t.Fatal("an integer is not an argument")
+	}
+	if _, ok := mixed.Arg(2); ok {
+		t.Fatal("nil is not an argument")
+	}
+
+	// none of these may panic
+	noName := &ArrayResp{}
+	noName.Rtype = ArrayType
+	noName.Args = []*BulkResp{nil}
+	for _, bad := range []*ArrayResp{nil, {}, noName, readResp(t, "*0\r\n").(*ArrayResp), readResp(t, "*1\r\n$0\r\n\r\n").(*ArrayResp)} {
+		if name, ok := bad.Command(); ok {
+			t.Fatalf("%v got %q", bad, name)
+		}
+	}
+}
+
+func TestReadProtocolNested(t *testing.T) {
+	// CLUSTER SLOTS, XRANGE, GEORADIUS WITHCOORD and a script returning mixed types
+	replies := []string{
+		"*1\r\n*3\r\n:0\r\n:5460\r\n*2\r\n$9\r\n127.0.0.1\r\n:6379\r\n",
+		"*1\r\n*2\r\n$15\r\n1526919030474-0\r\n*2\r\n$1\r\nf\r\n$1\r\nv\r\n",
+		"*1\r\n*2\r\n$7\r\nPalermo\r\n*2\r\n$4\r\n13.3\r\n$4\r\n38.1\r\n",
+		"*5\r\n$1\r\na\r\n:1\r\n+OK\r\n$-1\r\n*-1\r\n",
+	}
+	for _, data := range replies {
+		ar, ok := readResp(t, data).(*ArrayResp)
+		if !ok || ar.Elems == nil || ar.Args != nil {
+			t.Fatalf("%q: %#v", data, ar)
+		}
+		if ar.Length() != len(ar.Elems)-1 {
+			t.Fatalf("%q: Length %d", data, ar.Length())
+		}
+		if got := encodeResp(t, ar); got != data {
+			t.Fatalf("got %q want %q", got, data)
+		}
+	}
+
+	// 全是 BulkResp 的数组仍然放在 Args 里, Length 还是参数个数
+	ar := readResp(t, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$1\r\nv\r\n").(*ArrayResp)
+	if ar.Elems != nil || len(ar.Args) != 3 || ar.Length() != 2 {
+		t.Fatalf("%#v", ar)
+	}
+
+	// 嵌套数组不是合法的命令
+	cmd := readResp(t, "*2\r\n$3\r\nGET\r\n*1\r\n$1\r\nk\r\n")
+	if _, err := (&StrFilter{}).Inspect(cmd); err != BadCommandError {
+		t.Fatal(err)
+	}
+}
+
+func TestReadProtocolStrictCRLF(t *testing.T) {
+	bad := map[string]string{
+		"+OK\n":                          "+OK\n",
+		":1\n":                           ":1\n",
+		"$3\nfoo\r\n":                    "$3\n",
+		"$3\r\nfoo\n\n":                  "\n\n",
+		"$3\r\nfooXY":                    "XY",
+		"*1\r\n$3\r\nfoo\rX":             "\rX",
+		"*2\r\n$3\r\nfoo\r\n$3\nbar\r\n": "$3\n",
+		"*1\n$3\r\nfoo\r\n":              "*1\n",
+		",1.5\n":                         ",1.5\n",
+		"=7\r\ntxt:abcXX":                "XX",
+	}
+	check := func(who, in, want string, err error) {
+		pe, ok := err.(*ProtocolError)
+		if !ok {
+			t.Fatalf("%s %q got %v", who, in, err)
+		}
+		if string(pe.Bytes) != want {
+			t.Fatalf("%s %q got bytes %q", who, in, pe.Bytes)
+		}
+	}
+	for in, want := range bad {
+		_, err := ReadProtocol(bufio.NewReader(strings.NewReader(in)))
+		check("ReadProtocol", in, want, err)
+
+		if in[0] == ArrSep {
+			_, err = NewDecoder(bufio.NewReader(strings.NewReader(in))).Decode()
+			check("Decoder", in, want, err)
+		}
+
+		p := NewStreamParser()
+		p.Feed([]byte(in))
+		if r, ok := p.Next(); ok {
+			t.Fatalf("StreamParser %q got %v", in, r)
+		}
+		check("StreamParser", in, want, p.Err())
+	}
+
+	// telnet sends a bare \n
+	if r := readResp(t, "get a\n"); cmdName(r.(*ArrayResp)) != "GET" {
+		t.Fatal(r)
+	}
+	p := NewStreamParser()
+	p.Feed([]byte("get a\n"))
+	if r, ok := p.Next(); !ok || r.Length() != 1 {
+		t.Fatal(r, p.Err())
+	}
+
+	// proxy::strictinline of one proxy doesn't change the others
+	strict := (&ProxyConfig{strictInline: true}).parserLimits()
+	_, err := ReadProtocolWithLimits(bufio.NewReader(strings.NewReader("get a\n")), strict)
+	check("ReadProtocol", "get a\n", "get a\n", err)
+	if r, err := ReadProtocolWithLimits(bufio.NewReader(strings.NewReader("get a\r\n")), strict); err != nil || r.Length() != 1 {
+		t.Fatal(r, err)
+	}
+	sp := NewStreamParserWithLimits(strict)
+	sp.Feed([]byte("get a\n"))
+	if r, ok := sp.Next(); ok {
+		t.Fatal(r)
+	}
+	check("StreamParser", "get a\n", "get a\n", sp.Err())
+	if r := readResp(t, "get a\n"); r.Length() != 1 {
+		t.Fatal(r)
+	}
+}
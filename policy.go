@@ -0,0 +1,60 @@
+package archer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommandPolicy blocks and renames commands like rename-command of redis.
+// Clients see a blocked command, and the old name of a renamed one, as an
+// unknown command. The new name is rewritten to the command before the
+// filter, so a rename can't enable what the proxy doesn't support
+type CommandPolicy struct {
+	renamed map[string]string // new name => command, upper case
+	hidden  map[string]bool   // blocked and renamed commands, upper case
+}
+
+// NewCommandPolicy blocks the commands in block and renames the ones in
+// rename, command => new name. An empty new name blocks the command
+func NewCommandPolicy(block []string, rename map[string]string) (*CommandPolicy, error) {
+	cp := &CommandPolicy{
+		renamed: make(map[string]string),
+		hidden:  make(map[string]bool),
+	}
+	for _, name := range block {
+		cp.hidden[strings.ToUpper(name)] = true
+	}
+	for name, to := range rename {
+		name, to = strings.ToUpper(name), strings.ToUpper(to)
+		cp.hidden[name] = true
+		if to == "" {
+			continue
+		}
+		if _, ok := reqrules[to]; ok {
+			return nil, fmt.Errorf("rename %s to %s, a command of the same name exists", name, to)
+		}
+		if old, ok := cp.renamed[to]; ok {
+			return nil, fmt.Errorf("rename %s and %s both to %s", old, name, to)
+		}
+		cp.renamed[to] = name
+	}
+	return cp, nil
+}
+
+// Apply rewrites a renamed command in ar to its real name, the error is
+// the reply for a blocked or hidden command
+func (cp *CommandPolicy) Apply(ar *ArrayResp) error {
+	if cp == nil {
+		return nil
+	}
+	name := cmdName(ar)
+	if to, ok := cp.renamed[name]; ok && ar.Elems == nil {
+		ar.Args[0].Args[0] = []byte(to)
+		return nil
+	}
+	if cp.hidden[name] {
+		first, _ := ar.Arg(0)
+		return fmt.Errorf("ERR unknown command '%s'", first)
+	}
+	return nil
+}
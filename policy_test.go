@@ -0,0 +1,50 @@
+package archer
+
+import (
+	"testing"
+)
+
+func TestCommandPolicy(t *testing.T) {
+	if _, err := NewCommandPolicy(nil, map[string]string{"eval": "get"}); err == nil {
+		t.Fatal("rename to an existing command must fail")
+	}
+	if _, err := NewCommandPolicy(nil, map[string]string{"eval": "x", "evalsha": "X"}); err == nil {
+		t.Fatal("two renames to one name must fail")
+	}
+
+	cp, err := NewCommandPolicy([]string{"keys"}, map[string]string{"eval": "archer-eval", "shutdown": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd  *ArrayResp
+		err  string
+		name string
+	}{
+		{newCommand("GET", "k"), "", "GET"},
+		{newCommand("keys", "*"), "ERR unknown command 'keys'", ""},
+		{newCommand("SHUTDOWN"), "ERR unknown command 'SHUTDOWN'", ""},
+		{newCommand("EVAL", "return 1", "0"), "ERR unknown command 'EVAL'", ""},
+		{newCommand("Archer-Eval", "return 1", "0"), "", "EVAL"},
+	}
+	for _, tt := range tests {
+		err := cp.Apply(tt.cmd)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Fatalf("%s got %v, want %s", tt.cmd, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s got %v", tt.cmd, err)
+		}
+		if name := cmdName(tt.cmd); name != tt.name {
+			t.Fatalf("%s forwarded as %s, want %s", tt.cmd, name, tt.name)
+		}
+	}
+
+	var none *CommandPolicy
+	if err := none.Apply(newCommand("KEYS", "*")); err != nil {
+		t.Fatal("nil policy must allow everything")
+	}
+}
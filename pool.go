@@ -18,6 +18,8 @@ var (
 type Conn interface {
 	LastUsed() time.Time
 	SetLastUsed(time.Time)
+	CreatedAt() time.Time
+	Alive() bool // health check, e.g. PING
 	Close() error
 	ID() string
 	Discard() error
@@ -75,6 +77,15 @@ type Options struct {
 	// connections. Should be less than server's timeout.
 	// Default is to not close idle connections.
 	IdleTimeout time.Duration
+	// Minimum number of idle connections, dialed ahead of need by the
+	// health checker. Default is 0.
+	MinIdleConns int
+	// Connection age at which the pool closes a connection instead of
+	// reusing it. Default is to not close aged connections.
+	MaxConnAge time.Duration
+	// Frequency of the health check of idle connections, broken ones are
+	// closed. Default is 1 minute.
+	HealthCheckInterval time.Duration
 }
 
 func (opt *Options) getNetwork() string {
@@ -116,6 +127,13 @@ func (opt *Options) getIdleTimeout() time.Duration {
 	return opt.IdleTimeout
 }
 
+func (opt *Options) getHealthCheckInterval() time.Duration {
+	if opt.HealthCheckInterval == 0 {
+		return time.Minute
+	}
+	return opt.HealthCheckInterval
+}
+
 type connList struct {
 	cns  []Conn
 	mx   sync.Mutex
@@ -218,7 +236,8 @@ type ConnPool struct {
 	conns     *connList
 	freeConns chan Conn
 
-	_closed int32
+	_closed  int32
+	_retired int32 // closed by Retire, conns put back are closed
 
 	lastDialErr error
 }
@@ -231,27 +250,29 @@ func NewConnPool(opt *Options) *ConnPool {
 		conns:     newconnList(opt.getPoolSize()),
 		freeConns: make(chan Conn, opt.getPoolSize()),
 	}
-	if p.opt.getIdleTimeout() > 0 {
-		go p.reaper()
-	}
+	go p.reaper()
 	return p
 }
 
-func (p ConnPool) closed() bool {
+func (p *ConnPool) closed() bool {
 	return atomic.LoadInt32(&p._closed) == 1
 }
 
-func (p ConnPool) isIdle(cn Conn) bool {
-	return p.opt.getIdleTimeout() > 0 && time.Since(cn.LastUsed()) > p.opt.getIdleTimeout()
+// isStale reports whether cn has been idle or open for too long
+func (p *ConnPool) isStale(cn Conn) bool {
+	if p.opt.getIdleTimeout() > 0 && time.Since(cn.LastUsed()) > p.opt.getIdleTimeout() {
+		return true
+	}
+	return p.opt.MaxConnAge > 0 && time.Since(cn.CreatedAt()) > p.opt.MaxConnAge
 }
 
-// First returns first non-idle connection from the pool or nil if
+// First returns first non-stale connection from the pool or nil if
 // there are no connections.
-func (p ConnPool) First() Conn {
+func (p *ConnPool) First() Conn {
 	for {
 		select {
 		case cn := <-p.freeConns:
-			if p.isIdle(cn) {
+			if p.isStale(cn) {
 				p.conns.Remove(cn)
 				continue
 			}
@@ -263,13 +284,13 @@ func (p ConnPool) First() Conn {
 	panic("not reached")
 }
 
-// wait waits for free non-idle connection. It returns nil on timeout.
-func (p ConnPool) wait() Conn {
+// wait waits for free non-stale connection. It returns nil on timeout.
+func (p *ConnPool) wait() Conn {
 	deadline := time.After(p.opt.getPoolTimeout())
 	for {
 		select {
 		case cn := <-p.freeConns:
-			if p.isIdle(cn) {
+			if p.isStale(cn) {
 				p.Remove(cn)
 				continue
 			}
@@ -282,7 +303,7 @@ func (p ConnPool) wait() Conn {
 }
 
 // Establish a new connection
-func (p ConnPool) new() (Conn, error) {
+func (p *ConnPool) new() (Conn, error) {
 	if p.rl.Limit() {
 		err := fmt.Errorf(
 			"redis: you open connections too fast (last error: %v)",
@@ -300,12 +321,12 @@ func (p ConnPool) new() (Conn, error) {
 }
 
 // Get returns existed connection from the pool or creates a new one.
-func (p ConnPool) Get() (Conn, error) {
+func (p *ConnPool) Get() (Conn, error) {
 	if p.closed() {
 		return nil, errClosed
 	}
 
-	// Fetch first non-idle connection, if available.
+	// Fetch first non-stale connection, if available.
 	if cn := p.First(); cn != nil {
 		return cn, nil
 	}
@@ -329,8 +350,8 @@ func (p ConnPool) Get() (Conn, error) {
 	return nil, errPoolTimeout
 }
 
-func (p ConnPool) Put(cn Conn) error {
-	if cn.Discard() != nil {
+func (p *ConnPool) Put(cn Conn) error {
+	if cn.Discard() != nil || atomic.LoadInt32(&p._retired) == 1 {
 		return p.Remove(cn)
 	}
 	if p.opt.getIdleTimeout() > 0 {
@@ -340,7 +361,10 @@ func (p ConnPool) Put(cn Conn) error {
 	return nil
 }
 
-func (p ConnPool) Remove(cn Conn) error {
+func (p *ConnPool) Remove(cn Conn) error {
+	if p.closed() {
+		return p.conns.Remove(cn)
+	}
 	// Replace existing connection with new one and unblock waiter.
 	newcn, err := p.new()
 	if err != nil {
@@ -352,16 +376,16 @@ func (p ConnPool) Remove(cn Conn) error {
 }
 
 // Len returns total number of connections.
-func (p ConnPool) Len() int {
+func (p *ConnPool) Len() int {
 	return p.conns.Len()
 }
 
 // FreeLen returns number of free connections.
-func (p ConnPool) FreeLen() int {
+func (p *ConnPool) FreeLen() int {
 	return len(p.freeConns)
 }
 
-func (p ConnPool) Close() (retErr error) {
+func (p *ConnPool) Close() (retErr error) {
 	if !atomic.CompareAndSwapInt32(&p._closed, 0, 1) {
 		return errClosed
 	}
@@ -378,20 +402,69 @@ func (p ConnPool) Close() (retErr error) {
 	return retErr
 }
 
-func (p ConnPool) reaper() {
-	ticker := time.NewTicker(time.Minute)
+// Retire closes the pool without cutting off the conns in use: Get fails
+// from now on, idle conns are closed now and the others when put back
+func (p *ConnPool) Retire() {
+	atomic.StoreInt32(&p._retired, 1)
+	atomic.StoreInt32(&p._closed, 1)
+	for cn := p.First(); cn != nil; cn = p.First() {
+		p.conns.Remove(cn)
+	}
+}
+
+// Owns reports whether cn was dialed by p
+func (p *ConnPool) Owns(cn Conn) bool {
+	p.conns.mx.Lock()
+	defer p.conns.mx.Unlock()
+	for _, c := range p.conns.cns {
+		if c == cn {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ConnPool) reaper() {
+	ticker := time.NewTicker(p.opt.getHealthCheckInterval())
 	defer ticker.Stop()
 
+	p.fill()
 	for _ = range ticker.C {
 		if p.closed() {
 			break
 		}
+		p.healthCheck()
+	}
+}
+
+// healthCheck checks every idle connection: stale ones are closed by
+// First, broken ones are closed after a failed Alive. Then the idle
+// connections are filled up to MinIdleConns
+func (p *ConnPool) healthCheck() {
+	for n := p.FreeLen(); n > 0; n-- {
+		cn := p.First()
+		if cn == nil {
+			break
+		}
+		if !cn.Alive() {
+			p.conns.Remove(cn)
+			continue
+		}
+		// not Put, a health check doesn't count as use
+		p.freeConns <- cn
+	}
+	p.fill()
+}
 
-		// pool.First removes idle connections from the pool and
-		// returns first non-idle connection. So just put returned
-		// connection back.
-		if cn := p.First(); cn != nil {
-			p.Put(cn)
+// fill dials idle connections up to MinIdleConns, within PoolSize
+func (p *ConnPool) fill() {
+	for p.FreeLen() < p.opt.MinIdleConns && p.conns.Reserve() {
+		cn, err := p.new()
+		if err != nil {
+			p.conns.Remove(nil)
+			return
 		}
+		p.conns.Add(cn)
+		p.freeConns <- cn
 	}
 }
@@ -0,0 +1,91 @@
+package archer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeConn struct {
+	alive    int32
+	closed   int32
+	created  time.Time
+	lastUsed time.Time
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{alive: 1, created: time.Now(), lastUsed: time.Now()}
+}
+
+func (c *fakeConn) LastUsed() time.Time     { return c.lastUsed }
+func (c *fakeConn) SetLastUsed(t time.Time) { c.lastUsed = t }
+func (c *fakeConn) CreatedAt() time.Time    { return c.created }
+func (c *fakeConn) Alive() bool             { return atomic.LoadInt32(&c.alive) == 1 }
+func (c *fakeConn) Close() error            { atomic.StoreInt32(&c.closed, 1); return nil }
+func (c *fakeConn) ID() string              { return "fake" }
+func (c *fakeConn) Discard() error          { return nil }
+
+func newTestPool(opt *Options) *ConnPool {
+	opt.Dialer = func() (Conn, error) { return newFakeConn(), nil }
+	opt.PoolSize = 4
+	opt.HealthCheckInterval = time.Hour
+	return NewConnPool(opt)
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	p := newTestPool(&Options{MinIdleConns: 2})
+	defer p.Close()
+
+	p.healthCheck()
+	if p.FreeLen() < 2 {
+		t.Fatalf("%d idle conns, want 2", p.FreeLen())
+	}
+
+	cn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := cn.(*fakeConn)
+	atomic.StoreInt32(&bad.alive, 0)
+	p.Put(bad)
+
+	p.healthCheck()
+	if atomic.LoadInt32(&bad.closed) != 1 {
+		t.Fatal("broken conn must be closed")
+	}
+	for i := p.FreeLen(); i > 0; i-- {
+		cn := p.First()
+		if cn == bad {
+			t.Fatal("broken conn still in the pool")
+		}
+		defer p.Put(cn)
+	}
+	if p.Len() > 4 {
+		t.Fatalf("%d conns over pool size", p.Len())
+	}
+}
+
+func TestPoolMaxConnAge(t *testing.T) {
+	p := newTestPool(&Options{MaxConnAge: time.Minute})
+	defer p.Close()
+
+	cn, err := p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := cn.(*fakeConn)
+	old.created = time.Now().Add(-2 * time.Minute)
+	p.Put(old)
+
+	cn, err = p.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cn == old {
+		t.Fatal("conn older than MaxConnAge reused")
+	}
+	if atomic.LoadInt32(&old.closed) != 1 {
+		t.Fatal("old conn must be closed")
+	}
+	p.Put(cn)
+}
@@ -1,16 +1,28 @@
 package archer
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/pprof"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	log "github.com/ngaut/logging"
+	log "github.com/dongzerun/archer/logging"
 )
 
 type Proxy struct {
-	l net.Listener // 监听 Listener
+	l  net.Listener // 监听 Listener, port 为 0 时为 nil
+	ul net.Listener // unix socket Listener, nil 表示不监听
+	ml net.Listener // memcached 文本协议 Listener, nil 表示不监听
+	hl net.Listener // 管理 http Listener, nil 表示不监听
+
+	mux *http.ServeMux // 管理 http 的路由, 每个 Proxy 一个
 
 	filter Filter // Redis 有效协议检测过滤器
 
@@ -19,28 +31,150 @@ type Proxy struct {
 	sm *SessMana // Session 管理
 
 	cluster *Cluster // 集群实现
+
+	acl *ACL // 用户权限, nil 表示不检查
+
+	slowlog *SlowLog // 慢查询日志, nil 表示关闭
+	hotkeys *HotKeys // 热点 key 统计, nil 表示关闭
+
+	tracer  *Tracer      // OTLP 导出, nil 表示关闭
+	limiter *RateLimiter // 全局和客户端限速, nil 表示不限
+	cache   *ReplyCache  // 热点读命令的回复缓存, nil 表示关闭
+
+	pause trafficPause // 管理接口暂停的流量
+	audit *AuditLog    // 审计日志, 哪些客户端审计见 Session.audit
+
+	scripts ScriptCache // EVAL 和 SCRIPT LOAD 见过的脚本, EVALSHA 遇到 NOSCRIPT 时重试
+
+	shuttingDown int32         // Shutdown 开始后为 1
+	done         chan struct{} // Shutdown 完成后关闭
+
+	// Reload 替换 pc, filter 和 acl, 通过 conf, currentFilter 和 currentACL 读取
+	rw sync.RWMutex
 }
 
 func NewProxy(pc *ProxyConfig) *Proxy {
 	p := &Proxy{
-		sm:      newSessMana(pc.idleTimeout),
+		sm:      newSessMana(pc.clientTimeout),
 		cluster: NewCluster(pc),
-		filter:  &StrFilter{},
+		filter:  newFilter(pc),
 		pc:      pc,
+		done:    make(chan struct{}),
 	}
 
-	// listen 放到最后
-	l, err := net.Listen("tcp4", fmt.Sprintf(":%d", pc.port))
+	Stats.pools = p.cluster.PoolStats
+
+	if pc.slowlogMaxLen > 0 {
+		p.slowlog = NewSlowLog(pc.slowlogSlowerThan, pc.slowlogMaxLen)
+	}
+	p.limiter = NewRateLimiter(pc)
+	audit, err := NewAuditLog(pc)
+	if err != nil {
+		log.Fatalf("Proxy open audit log failed %s", err)
+	}
+	p.audit = audit
+	p.cache = NewReplyCache(pc.cacheSize, pc.cacheTTL, pc.cacheMaxBytes, pc.cacheCommands)
+	if pc.traceEndpoint != "" {
+		p.tracer = NewTracer(pc.traceEndpoint, pc.traceService, pc.traceRatio)
+	}
+	if pc.hotKeys > 0 {
+		p.hotkeys = NewHotKeys(pc.hotKeys, pc.hotKeyInterval, pc.hotKeySample)
+	}
+
+	acl, err := newACL(pc.aclRules)
 	if err != nil {
-		log.Fatalf("Proxy Listen  %d failed %s", pc.port, err.Error())
+		log.Fatal(err)
+	}
+	p.acl = acl
+	p.mux = p.newMux()
+
+	// listen 放到最后
+	if pc.port > 0 {
+		l, err := listenTCP(pc.port, pc.tcpKeepAlive)
+		if err != nil {
+			log.Fatalf("Proxy Listen  %d failed %s", pc.port, err.Error())
+		}
+		if pc.tls != nil {
+			l = tls.NewListener(l, pc.tls)
+		}
+		p.l = l
+	}
+	// unix socket 只给本机客户端用, 不走 TLS
+	if pc.unixSocket != "" {
+		ul, err := ListenUnix(pc.unixSocket, pc.unixPerm)
+		if err != nil {
+			log.Fatalf("Proxy Listen unix socket %s failed %s", pc.unixSocket, err)
+		}
+		p.ul = ul
+	}
+	if pc.memcachePort > 0 {
+		ml, err := listenTCP(pc.memcachePort, pc.tcpKeepAlive)
+		if err != nil {
+			log.Fatalf("Proxy Listen memcache port %d failed %s", pc.memcachePort, err)
+		}
+		p.ml = ml
+	}
+	if pc.adminAddr != "" {
+		hl, err := net.Listen("tcp", pc.adminAddr)
+		if err != nil {
+			log.Fatalf("Proxy Listen admin %s failed %s", pc.adminAddr, err)
+		}
+		p.hl = hl
 	}
-	p.l = l
 	return p
 }
 
+// newMux routes the admin http server of p: metrics, pprof, the slowlog
+// and hotkeys if they are on, reload and the admin API
+func (p *Proxy) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Stats)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if p.slowlog != nil {
+		mux.Handle("/slowlog", p.slowlog)
+	}
+	if p.hotkeys != nil {
+		mux.HandleFunc("/hotkeys", p.hotKeysHandler)
+	}
+	mux.HandleFunc("/reload", p.adminAuth(p.reloadHandler))
+	p.registerAdmin(mux)
+	return mux
+}
+
+// Start accepts clients on the tcp port, the unix socket and the memcache
+// port, it returns once they are all closed. The admin http server runs
+// beside them until Close
 func (p *Proxy) Start() {
+	if p.hl != nil {
+		go func() {
+			log.Warning("Proxy admin http server ", http.Serve(p.hl, p.mux))
+		}()
+	}
+	var wg sync.WaitGroup
+	for _, l := range []net.Listener{p.l, p.ul, p.ml} {
+		if l == nil {
+			continue
+		}
+		handle := HandleConn
+		if l == p.ml {
+			handle = HandleMemcacheConn
+		}
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			p.serve(l, handle)
+		}(l)
+	}
+	wg.Wait()
+}
+
+func (p *Proxy) serve(l net.Listener, handle func(*Proxy, net.Conn)) {
 	for {
-		c, err := p.l.Accept()
+		c, err := l.Accept()
 		if err != nil {
 			log.Warning("got error when Accept network connect ", err)
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
@@ -55,14 +189,114 @@ func (p *Proxy) Start() {
 			break
 		}
 
-		go HandleConn(p, c)
+		go handle(p, c)
+	}
+}
+
+// listenTCP listens on port, the clients accepted send TCP keepalives
+// every keepAlive, none if it's 0
+func listenTCP(port int, keepAlive time.Duration) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	if keepAlive == 0 {
+		lc.KeepAlive = -1
+	}
+	return lc.Listen(context.Background(), "tcp4", fmt.Sprintf(":%d", port))
+}
+
+func (p *Proxy) conf() *ProxyConfig {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.pc
+}
+
+func (p *Proxy) currentFilter() Filter {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.filter
+}
+
+func (p *Proxy) currentACL() *ACL {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.acl
+}
+
+// Close stops accepting new client connections and admin requests, Start
+// returns after that
+func (p *Proxy) Close() {
+	for _, l := range []net.Listener{p.l, p.ul, p.ml, p.hl} {
+		if l == nil {
+			continue
+		}
+		// the unix socket file is removed with it
+		if err := l.Close(); err != nil {
+			log.Warning("Proxy Close listener failed ", err)
+		}
+	}
+}
+
+// Shutdown stops the proxy gracefully for rolling deploys: no more client
+// connections are accepted, every session is drained within
+// shutdowntimeout, new commands are replied ShuttingDownError (or dropped
+// if shutdownreply is off), then the backend pools are closed. It returns
+// DrainTimeoutError if some sessions were cut off, Done is closed after it
+func (p *Proxy) Shutdown() error {
+	if !atomic.CompareAndSwapInt32(&p.shuttingDown, 0, 1) {
+		<-p.done
+		return nil
 	}
+	defer close(p.done)
+
+	pc := p.conf()
+	log.Warningf("Proxy shutting down, draining clients within %s", pc.shutdownTimeout)
+	p.Close()
+
+	var reject error
+	if pc.shutdownReply {
+		reject = ShuttingDownError
+	}
+	deadline := time.Now().Add(pc.shutdownTimeout)
+	var wg sync.WaitGroup
+	var cutOff int32
+	for _, s := range p.sm.Sessions() {
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			if err := s.drain(deadline, reject); err != nil {
+				log.Warningf("client %s %s", s.remote, err)
+				atomic.AddInt32(&cutOff, 1)
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	p.cluster.Close()
+	p.tracer.Close()
+	if cutOff > 0 {
+		log.Warningf("Proxy shutdown, %d clients cut off", cutOff)
+		return DrainTimeoutError
+	}
+	log.Warning("Proxy shutdown")
+	return nil
+}
+
+// Done is closed once Shutdown completes
+func (p *Proxy) Done() <-chan struct{} {
+	return p.done
 }
 
 func HandleConn(p *Proxy, c net.Conn) {
+	Stats.Clients.Add(1)
+	defer Stats.Clients.Add(-1)
 	s := NewSession(p, c)
-	p.sm.Put(c.RemoteAddr().String(), s)
+	p.sm.Put(s.remote, s)
+	// accepted while Shutdown was listing the sessions
+	if atomic.LoadInt32(&p.shuttingDown) == 1 {
+		p.sm.Del(s.remote, s)
+		c.Close()
+		return
+	}
 	s.Serve()
-	log.Warning("Close client ", c.RemoteAddr().String())
+	log.Warning("Close client ", s.remote)
 	c.Close()
 }
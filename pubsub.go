@@ -0,0 +1,246 @@
+package archer
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/dongzerun/archer/logging"
+)
+
+// 订阅相关命令, 走会话独占的后端连接
+var subscribeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+}
+
+// subscriber is the backend connection a session subscribes on. Redis
+// cluster broadcasts PUBLISH to every node, so one connection to any node
+// sees all channels. Dispatch writes the subscribe commands, relay reads
+// their confirmations and the messages and queues them for WriteLoop:
+// the last confirmation of a command is its reply, the others and the
+// messages are pushes written after the replies before them
+type subscriber struct {
+	s    *Session
+	conn *RedisConn
+
+	l        sync.Mutex
+	pending  []*subExpect // commands waiting for confirmations, in write order
+	channels map[string]bool
+	patterns map[string]bool
+	last     int64 // seq of the last command confirmed
+
+	count  int32 // channels and patterns subscribed
+	proto  int32 // protocol of the client, pushes are converted for RESP3
+	closed int32
+}
+
+// subExpect is a subscribe command waiting for its confirmations, one per
+// channel or pattern. n is -1 for UNSUBSCRIBE and PUNSUBSCRIBE without
+// arguments until relay knows how many are subscribed
+type subExpect struct {
+	seq  int64
+	kind string // lower case command, the kind of its confirmations
+	n    int
+}
+
+func newSubscriber(s *Session, conn *RedisConn) *subscriber {
+	return &subscriber{
+		s:        s,
+		conn:     conn,
+		channels: make(map[string]bool),
+		patterns: make(map[string]bool),
+		last:     -1,
+		proto:    RESP2,
+	}
+}
+
+// Subscribe sends SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE or PUNSUBSCRIBE on
+// the subscriber connection of the session, dialed at the first subscribe
+func (s *Session) Subscribe(ar *ArrayResp, command string, seq int64) {
+	if s.sub == nil {
+		if command == "UNSUBSCRIBE" || command == "PUNSUBSCRIBE" {
+			s.replyFrames(unsubscribeResps(ar, s.state.Proto), seq)
+			return
+		}
+		key, _ := ar.Arg(1)
+		rc, err := s.p.cluster.DialConn(key)
+		if err != nil {
+			s.reply(WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq))
+			return
+		}
+		s.sub = newSubscriber(s, rc)
+		atomic.StoreInt32(&s.pubsub, 1)
+		go s.sub.relay()
+	}
+
+	atomic.StoreInt32(&s.sub.proto, int32(s.state.Proto))
+	if err := s.sub.send(ar, command, seq); err != nil {
+		log.Warning("Session Subscribe write error ", err)
+		s.reply(WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq))
+	}
+}
+
+// replyFrames replies the last of frames to seq, the others go before it
+func (s *Session) replyFrames(frames []Resp, seq int64) {
+	for _, f := range frames[:len(frames)-1] {
+		s.reply(&wrappedResp{resp: f, seq: seq, push: true})
+	}
+	s.reply(WrappedResp(frames[len(frames)-1], seq))
+}
+
+// unsubscribeResps are the confirmations redis replies to an unsubscribe
+// command of a client subscribed to nothing
+func unsubscribeResps(ar *ArrayResp, proto int) []Resp {
+	kind := NewBulkResp([]byte(strings.ToLower(cmdName(ar))))
+	if ar.Length() == 0 {
+		return []Resp{pubsubResp(proto, kind, NewNullBulkResp(), NewIntResp(0))}
+	}
+	frames := make([]Resp, 0, ar.Length())
+	for _, ch := range ar.Args[1:] {
+		frames = append(frames, pubsubResp(proto, kind, ch, NewIntResp(0)))
+	}
+	return frames
+}
+
+// pubsubResp builds a confirmation or a message, a push for RESP3 clients
+func pubsubResp(proto int, elems ...Resp) Resp {
+	if proto == RESP3 {
+		return NewPushResp(elems...)
+	}
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Elems = elems
+	return ar
+}
+
+// subscribed returns the channels and patterns subscribed, counting the
+// subscribe commands not confirmed yet, they are in effect for the
+// commands read after them
+func (sub *subscriber) subscribed() int {
+	sub.l.Lock()
+	defer sub.l.Unlock()
+	n := int(atomic.LoadInt32(&sub.count))
+	for _, e := range sub.pending {
+		if e.kind == "subscribe" || e.kind == "psubscribe" {
+			n++
+		}
+	}
+	return n
+}
+
+// send writes ar under the lock, so pending stays in write order
+func (sub *subscriber) send(ar *ArrayResp, command string, seq int64) error {
+	e := &subExpect{seq: seq, kind: strings.ToLower(command), n: ar.Length()}
+	if e.n == 0 {
+		e.n = -1
+	}
+
+	sub.l.Lock()
+	defer sub.l.Unlock()
+	sub.pending = append(sub.pending, e)
+	if err := WriteProtocol(sub.conn.w, ar); err != nil {
+		sub.pending = sub.pending[:len(sub.pending)-1]
+		return err
+	}
+	return nil
+}
+
+// relay reads the backend until the connection is closed, a backend
+// failure closes the client since its subscriptions are gone
+func (sub *subscriber) relay() {
+	for {
+		r, err := ReadProtocolWithLimits(sub.conn.r, sub.s.limits)
+		if err != nil {
+			if atomic.LoadInt32(&sub.closed) == 0 {
+				log.Warning("subscriber relay read error ", err)
+				sub.s.Close()
+			}
+			return
+		}
+		sub.s.reply(sub.forward(r))
+	}
+}
+
+// forward tracks the subscriptions and turns r into the reply of the
+// command it confirms or a push
+func (sub *subscriber) forward(r Resp) *wrappedResp {
+	sub.l.Lock()
+	defer sub.l.Unlock()
+
+	kind, name := pubsubKind(r)
+	var e *subExpect
+	if len(sub.pending) > 0 {
+		e = sub.pending[0]
+	}
+	confirms := e != nil && kind == e.kind
+	if confirms && e.n == -1 {
+		e.n = len(sub.channels)
+		if kind == "punsubscribe" {
+			e.n = len(sub.patterns)
+		}
+		if e.n == 0 {
+			e.n = 1
+		}
+	}
+
+	switch kind {
+	case "subscribe":
+		sub.channels[name] = true
+	case "unsubscribe":
+		delete(sub.channels, name)
+	case "psubscribe":
+		sub.patterns[name] = true
+	case "punsubscribe":
+		delete(sub.patterns, name)
+	}
+	atomic.StoreInt32(&sub.count, int32(len(sub.channels)+len(sub.patterns)))
+
+	if atomic.LoadInt32(&sub.proto) == RESP3 {
+		if ar, ok := r.(*ArrayResp); ok {
+			r = NewPushResp(ar.Items()...)
+		}
+	}
+
+	if _, isErr := r.(*ErrorResp); isErr && e != nil {
+		confirms, e.n = true, 1
+	}
+	if !confirms {
+		// a message, after the reply of the last command confirmed
+		return &wrappedResp{resp: r, seq: sub.last + 1, push: true}
+	}
+	e.n--
+	if e.n > 0 {
+		return &wrappedResp{resp: r, seq: e.seq, push: true}
+	}
+	sub.pending = sub.pending[1:]
+	sub.last = e.seq
+	return WrappedResp(r, e.seq)
+}
+
+// pubsubKind returns the lower case kind of a backend pub/sub frame like
+// subscribe or message, and the channel or pattern it's about
+func pubsubKind(r Resp) (string, string) {
+	ar, ok := r.(*ArrayResp)
+	if !ok || ar.Length() < 1 {
+		return "", ""
+	}
+	items := ar.Items()
+	kind, ok := items[0].(*BulkResp)
+	if !ok || len(kind.Args) == 0 {
+		return "", ""
+	}
+	var name string
+	if br, ok := items[1].(*BulkResp); ok && len(br.Args) > 0 {
+		name = string(br.Args[0])
+	}
+	return strings.ToLower(string(kind.Args[0])), name
+}
+
+// close closes the backend connection, relay quits on the read error
+func (sub *subscriber) close() {
+	atomic.StoreInt32(&sub.closed, 1)
+	sub.conn.Close()
+}
@@ -0,0 +1,88 @@
+package archer
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/dongzerun/archer/util"
+)
+
+func TestSessionSubscribe(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	backend, proxySide := net.Pipe()
+	defer backend.Close()
+
+	s := newTestSession(&ProxyConfig{conCurrency: 5})
+	s.p.filter = &StrFilter{}
+	s.c = &util.Conn{Conn: server}
+	s.w = bufio.NewWriter(s.c)
+	s.cmds = make(chan *wrappedResp, 16)
+	s.quitChan = make(chan int, 1)
+	s.ooo = make(map[int64]*wrappedResp)
+	s.budget = newReplyBudget(0)
+	s.state = NewClientState()
+	go s.WriteLoop()
+	go s.Dispatch()
+	defer close(s.quitChan)
+
+	r := bufio.NewReader(client)
+	expect := func(want ...string) {
+		t.Helper()
+		for _, w := range want {
+			resp, err := ReadProtocol(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.String() != w {
+				t.Fatalf("got %q, want %q", resp.String(), w)
+			}
+		}
+	}
+
+	// nothing subscribed, no backend needed
+	s.cmds <- WrappedResp(newCommand("UNSUBSCRIBE", "a"), 0)
+	expect("unsubscribe a 0")
+
+	rc := &RedisConn{c: proxySide, w: bufio.NewWriter(proxySide), r: bufio.NewReader(proxySide)}
+	s.sub = newSubscriber(s, rc)
+	go s.sub.relay()
+	br := bufio.NewReader(backend)
+	recv := func(want string) {
+		t.Helper()
+		cmd, err := ReadProtocol(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd.String() != want {
+			t.Fatalf("backend got %q, want %q", cmd.String(), want)
+		}
+	}
+
+	s.cmds <- WrappedResp(newCommand("SUBSCRIBE", "a", "b"), 1)
+	recv("SUBSCRIBE a b")
+	go backend.Write([]byte("*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n" +
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nhello\r\n"))
+	expect("subscribe a 1", "subscribe b 2", "message a hello")
+
+	// RESP2 subscribe mode
+	s.cmds <- WrappedResp(newCommand("GET", "foo"), 2)
+	expect("ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context")
+	s.cmds <- WrappedResp(newCommand("PING"), 3)
+	expect("pong ")
+
+	// without arguments every channel is confirmed
+	s.cmds <- WrappedResp(newCommand("UNSUBSCRIBE"), 4)
+	recv("UNSUBSCRIBE")
+	go backend.Write([]byte("*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:1\r\n" +
+		"*3\r\n$11\r\nunsubscribe\r\n$1\r\nb\r\n:0\r\n"))
+	expect("unsubscribe a 1", "unsubscribe b 0")
+
+	s.cmds <- WrappedResp(newCommand("PING"), 5)
+	expect("PONG")
+
+	// before the backend pipe is closed, or relay closes the session
+	s.sub.close()
+}
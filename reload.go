@@ -0,0 +1,67 @@
+package archer
+
+import (
+	"net/http"
+
+	log "github.com/dongzerun/archer/logging"
+)
+
+// Reload reads the config file again and applies it without dropping the
+// clients: backend nodes, timeouts, pool settings, denied commands,
+// passwords and ACL users. Sessions opened before keep their client
+// read and write timeouts and stay authenticated. The port, unix socket,
+// memcache port, admin address, TCP keepalive, TLS, cpu, log and audit log, parser limits, slowlog,
+// hotkeys, rate limits, the cache and tracing only change with a restart
+func (p *Proxy) Reload() error {
+	old := p.conf()
+	pc, err := LoadProxyConfig(old.file)
+	if err != nil {
+		return err
+	}
+	acl, err := newACL(pc.aclRules)
+	if err != nil {
+		return err
+	}
+
+	if pc.port != old.port {
+		log.Warningf("Proxy Reload port %d ignored, restart to listen on it", pc.port)
+	}
+	if pc.unixSocket != old.unixSocket || pc.unixPerm != old.unixPerm {
+		log.Warningf("Proxy Reload unixsocket %s ignored, restart to listen on it", pc.unixSocket)
+	}
+	pc.port, pc.cpu, pc.tls = old.port, old.cpu, old.tls
+	pc.unixSocket, pc.unixPerm = old.unixSocket, old.unixPerm
+	if pc.memcachePort != old.memcachePort {
+		log.Warningf("Proxy Reload memcacheport %d ignored, restart to listen on it", pc.memcachePort)
+	}
+	pc.memcachePort = old.memcachePort
+	if pc.adminAddr != old.adminAddr {
+		log.Warningf("Proxy Reload adminaddr %s ignored, restart to listen on it", pc.adminAddr)
+	}
+	pc.adminAddr = old.adminAddr
+	pc.auditAll = old.auditAll
+
+	p.rw.Lock()
+	p.pc, p.filter, p.acl = pc, newFilter(pc), acl
+	p.rw.Unlock()
+
+	p.sm.SetIdle(pc.clientTimeout)
+	p.cluster.Reload(pc)
+	log.Warning("Proxy Reload ", pc.file)
+	return nil
+}
+
+// reloadHandler reloads the config on POST /reload of the admin http server,
+// with the admintoken like the admin API
+func (p *Proxy) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := p.Reload(); err != nil {
+		log.Warning("Proxy Reload failed ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK\n"))
+}
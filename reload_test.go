@@ -0,0 +1,95 @@
+package archer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeTestConfig(t *testing.T, file string, extra string) {
+	conf := "[proxy]\nname=test\nport=6000\n" + extra + "\n[redis]\npoolsize=10\n"
+	if err := ioutil.WriteFile(file, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProxyReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archer-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "archer.conf")
+
+	writeTestConfig(t, file, "deny=APPEND\npassword=foo")
+	pc, err := LoadProxyConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := newTestPool(&Options{})
+	p := &Proxy{
+		pc:     pc,
+		filter: newFilter(pc),
+		sm:     &SessMana{pool: make(map[string]*Session)},
+		cluster: &Cluster{
+			pc:      pc,
+			pools:   map[string]*ConnPool{"fake": pool},
+			opts:    make(map[string]*Options),
+			retired: make(map[string][]*ConnPool),
+			topo:    &Topology{conf: pc, slots: &SlotMap{}, reloadChan: make(chan int, 1)},
+		},
+	}
+	inUse, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.currentFilter().Inspect(newCommand("APPEND", "k", "v")); err != CommandForbidden {
+		t.Fatalf("APPEND got %v before reload", err)
+	}
+
+	writeTestConfig(t, file, "deny=STRLEN\npassword=bar\nport=7000\n[common]\nreadtimeout=9")
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.currentFilter().Inspect(newCommand("APPEND", "k", "v")); err != nil {
+		t.Fatalf("APPEND got %v after reload", err)
+	}
+	if _, err := p.currentFilter().Inspect(newCommand("STRLEN", "k")); err != CommandForbidden {
+		t.Fatalf("STRLEN got %v after reload", err)
+	}
+	if err := p.authenticate("default", "bar"); err != nil {
+		t.Fatal("new password must be accepted: ", err)
+	}
+	if err := p.authenticate("default", "foo"); err != WrongPassError {
+		t.Fatal("old password must be refused: ", err)
+	}
+	if p.conf().port != 6000 {
+		t.Fatalf("port %d must need a restart", p.conf().port)
+	}
+	if p.conf().readTimeout != 9*time.Second {
+		t.Fatalf("readtimeout %s not reloaded", p.conf().readTimeout)
+	}
+	if p.cluster.topo.config() != p.conf() {
+		t.Fatal("topology must ask the reloaded nodes")
+	}
+
+	// the timeouts changed, the pool is retired without cutting off inUse
+	if _, ok := p.cluster.pools["fake"]; ok {
+		t.Fatal("pool must be retired")
+	}
+	if atomic.LoadInt32(&inUse.(*fakeConn).closed) == 1 {
+		t.Fatal("conn in use must not be closed")
+	}
+	p.cluster.PutConn(inUse)
+	if atomic.LoadInt32(&inUse.(*fakeConn).closed) != 1 {
+		t.Fatal("conn of a retired pool must be closed when put back")
+	}
+	if len(p.cluster.retired) != 0 {
+		t.Fatal("empty retired pool must be forgotten")
+	}
+}
@@ -0,0 +1,536 @@
+package archer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/dongzerun/archer/hack"
+)
+
+// 解析 redis 回复的辅助函数, 代理需要检查或者合并回复时使用
+
+var (
+	ReplyTypeError = errors.New("unexpected reply type")
+	ReplyFormError = errors.New("malformed reply")
+)
+
+// ParseAclWhoami returns the user name replied by ACL WHOAMI
+func ParseAclWhoami(r *BulkResp) string {
+	if r == nil {
+		return ""
+	}
+	user, _ := r.Bytes()
+	return string(user)
+}
+
+// ParseAclGetUser converts the ACL GETUSER reply, a flat array of
+// alternating field names and values, to a map. The values are kept as Resp
+// since they are either bulk strings or nested arrays depending on the field.
+// A null reply (no such user) returns a nil map and no error.
+func ParseAclGetUser(r Resp) (map[string]Resp, error) {
+	if IsNull(r) {
+		return nil, nil
+	}
+
+	items, err := replyPairs(r)
+	if err != nil {
+		return nil, err
+	}
+	return pairsToMap(items)
+}
+
+// ParseConfigGet converts the CONFIG GET reply to a map, the reply is a flat
+// array of alternating names and values in RESP2 and a map in RESP3
+func ParseConfigGet(r Resp) (map[string]string, error) {
+	items, err := replyPairs(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(items)%2 != 0 {
+		return nil, ReplyFormError
+	}
+
+	m := make(map[string]string, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		k, ok := replyString(items[i])
+		if !ok {
+			return nil, ReplyFormError
+		}
+		v, ok := replyString(items[i+1])
+		if !ok {
+			return nil, ReplyFormError
+		}
+		m[k] = v
+	}
+	return m, nil
+}
+
+// replyPairs returns the flat k1 v1 k2 v2 ... elements of a RESP2 array or a RESP3 map
+func replyPairs(r Resp) ([]Resp, error) {
+	switch v := r.(type) {
+	case *ArrayResp:
+		return v.Items(), nil
+	case *MapResp:
+		return v.Elems, nil
+	}
+	return nil, ReplyTypeError
+}
+
+// pairsToMap converts [k1 v1 k2 v2 ...] to map, keys must be bulk or simple strings
+func pairsToMap(items []Resp) (map[string]Resp, error) {
+	if len(items)%2 != 0 {
+		return nil, ReplyFormError
+	}
+
+	m := make(map[string]Resp, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		k, ok := replyString(items[i])
+		if !ok {
+			return nil, ReplyFormError
+		}
+		m[k] = items[i+1]
+	}
+	return m, nil
+}
+
+// replyString returns the content of a bulk or simple string
+func replyString(r Resp) (string, bool) {
+	switch v := r.(type) {
+	case *BulkResp:
+		b, ok := v.Bytes()
+		return string(b), ok
+	case *SimpleResp:
+		return v.Status(), len(v.Args) > 0
+	}
+	return "", false
+}
+
+// ParseType returns the type name replied by TYPE, "none" for missing key
+func ParseType(r Resp) (string, error) {
+	sr, ok := r.(*SimpleResp)
+	if !ok {
+		return "", ReplyTypeError
+	}
+	if len(sr.Args) == 0 {
+		return "", ReplyFormError
+	}
+	return string(sr.Args[0]), nil
+}
+
+// ParseBitfield returns the integers replied by BITFIELD, one per subcommand.
+// INCRBY with OVERFLOW FAIL replies null when overflowed, which is returned as 0
+func ParseBitfield(ar *ArrayResp) ([]int64, error) {
+	if ar == nil || ar.Empty {
+		return nil, ReplyTypeError
+	}
+
+	items := ar.Items()
+	vals := make([]int64, len(items))
+	for i, item := range items {
+		if IsNull(item) {
+			continue
+		}
+		v, err := replyInt(item)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// replyInt returns the value of an IntResp
+func replyInt(r Resp) (int64, error) {
+	ir, ok := r.(*IntResp)
+	if !ok {
+		return 0, ReplyTypeError
+	}
+	return ir.Int()
+}
+
+type LCSMatch struct {
+	A   [2]int64 // start and end position in the first string
+	B   [2]int64 // start and end position in the second string
+	Len int64    // only with WITHMATCHLEN
+}
+
+type LCSResult struct {
+	Str     string     // plain LCS
+	Len     int64      // length of the longest common subsequence
+	Matches []LCSMatch // LCS IDX
+}
+
+// ParseLCS decodes every LCS reply form: the plain string, the LEN integer,
+// and the IDX reply which is a flat array in RESP2 and a map in RESP3:
+// matches => [[[a_start a_end] [b_start b_end] (match_len)] ...], len => n
+func ParseLCS(r Resp) (LCSResult, error) {
+	var res LCSResult
+	switch v := r.(type) {
+	case *BulkResp:
+		s, _ := replyString(v)
+		res.Str = s
+		res.Len = int64(len(s))
+		return res, nil
+	case *IntResp:
+		n, err := replyInt(v)
+		res.Len = n
+		return res, err
+	}
+
+	items, err := replyPairs(r)
+	if err != nil {
+		return res, err
+	}
+	m, err := pairsToMap(items)
+	if err != nil {
+		return res, err
+	}
+
+	if res.Len, err = replyInt(m["len"]); err != nil {
+		return res, err
+	}
+
+	matches, ok := m["matches"].(*ArrayResp)
+	if !ok {
+		return res, ReplyFormError
+	}
+	for _, item := range matches.Items() {
+		ar, ok := item.(*ArrayResp)
+		if !ok || ar.Length() < 1 {
+			return res, ReplyFormError
+		}
+		fields := ar.Items()
+
+		var match LCSMatch
+		if match.A, err = parseRange(fields[0]); err != nil {
+			return res, err
+		}
+		if match.B, err = parseRange(fields[1]); err != nil {
+			return res, err
+		}
+		if len(fields) > 2 {
+			if match.Len, err = replyInt(fields[2]); err != nil {
+				return res, err
+			}
+		}
+		res.Matches = append(res.Matches, match)
+	}
+	return res, nil
+}
+
+// parseRange decodes a two integers array [start end]
+func parseRange(r Resp) ([2]int64, error) {
+	var rg [2]int64
+	ar, ok := r.(*ArrayResp)
+	if !ok || ar.Length() != 1 {
+		return rg, ReplyFormError
+	}
+
+	var err error
+	for i, item := range ar.Items() {
+		if rg[i], err = replyInt(item); err != nil {
+			return rg, err
+		}
+	}
+	return rg, nil
+}
+
+// ParseMaybeArray normalizes the replies of commands like SPOP and SRANDMEMBER,
+// which reply a bulk without count and an array with count. null gives nil
+func ParseMaybeArray(r Resp) ([][]byte, error) {
+	if IsNull(r) {
+		return nil, nil
+	}
+
+	switch v := r.(type) {
+	case *BulkResp:
+		if len(v.Args) == 0 {
+			return nil, ReplyFormError
+		}
+		return [][]byte{v.Args[0]}, nil
+	case *ArrayResp:
+		items := v.Items()
+		vals := make([][]byte, 0, len(items))
+		for _, item := range items {
+			br, ok := item.(*BulkResp)
+			if !ok {
+				return nil, ReplyTypeError
+			}
+			if br.Empty || len(br.Args) == 0 {
+				vals = append(vals, nil)
+				continue
+			}
+			vals = append(vals, br.Args[0])
+		}
+		return vals, nil
+	}
+	return nil, ReplyTypeError
+}
+
+// ParseZAddReply parses the reply of ZADD. Without INCR the reply is the
+// number of added (or changed, with CH) members. With INCR it's the new
+// score, or null when the update was aborted by NX/XX/GT/LT
+func ParseZAddReply(r Resp, incr bool) (changed int64, score float64, isNull bool, err error) {
+	if !incr {
+		changed, err = replyInt(r)
+		return
+	}
+
+	if IsNull(r) {
+		isNull = true
+		return
+	}
+	score, err = replyFloat(r)
+	return
+}
+
+// ParseScore parses a sorted set score, such as the reply of ZSCORE,
+// ZINCRBY or ZADD INCR: a double in RESP3, a bulk string in RESP2
+func ParseScore(r Resp) (float64, error) {
+	return replyFloat(r)
+}
+
+// replyFloat returns the value of a double replied as double or bulk string, inf and -inf included
+func replyFloat(r Resp) (float64, error) {
+	if dr, ok := r.(*DoubleResp); ok {
+		return dr.Float()
+	}
+	br, ok := r.(*BulkResp)
+	if !ok {
+		return 0, ReplyTypeError
+	}
+	if br.Empty || len(br.Args) == 0 {
+		return 0, ReplyFormError
+	}
+	return strconv.ParseFloat(hack.String(br.Args[0]), 64)
+}
+
+// ParseHRandFieldWithValues parses HRANDFIELD key count WITHVALUES, which
+// replies a flat array f1 v1 f2 v2 in RESP2 and an array of pairs in RESP3
+func ParseHRandFieldWithValues(r Resp) ([][2][]byte, error) {
+	ar, ok := r.(*ArrayResp)
+	if !ok {
+		return nil, ReplyTypeError
+	}
+	if ar.Empty {
+		return nil, nil
+	}
+
+	items := ar.Items()
+	flat := make([]Resp, 0, len(items))
+	for _, item := range items {
+		if pair, ok := item.(*ArrayResp); ok {
+			if pair.Length() != 1 {
+				return nil, ReplyFormError
+			}
+			flat = append(flat, pair.Items()...)
+			continue
+		}
+		flat = append(flat, item)
+	}
+	if len(flat)%2 != 0 {
+		return nil, ReplyFormError
+	}
+
+	pairs := make([][2][]byte, 0, len(flat)/2)
+	for i := 0; i < len(flat); i += 2 {
+		f, ok1 := flat[i].(*BulkResp)
+		v, ok2 := flat[i+1].(*BulkResp)
+		if !ok1 || !ok2 || len(f.Args) == 0 || len(v.Args) == 0 {
+			return nil, ReplyFormError
+		}
+		pairs = append(pairs, [2][]byte{f.Args[0], v.Args[0]})
+	}
+	return pairs, nil
+}
+
+type ClusterNode struct {
+	ID       string
+	Addr     string   // host:port, the cluster bus port is dropped
+	Flags    []string // myself, master, slave, fail? ...
+	MasterID string   // empty for masters
+	Slots    [][2]int // served slot ranges, start and stop included
+}
+
+// ParseClusterNodes parses the text reply of CLUSTER NODES, one node per line:
+// <id> <ip:port@cport> <flags> <master> <ping-sent> <pong-recv> <epoch> <link-state> <slot> ...
+// slots being migrated or imported, like [93->-id], are skipped
+func ParseClusterNodes(r *BulkResp) ([]ClusterNode, error) {
+	if r == nil || r.Empty || len(r.Args) == 0 {
+		return nil, ReplyTypeError
+	}
+
+	var nodes []ClusterNode
+	for _, line := range strings.Split(string(r.Args[0]), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 8 {
+			return nil, ReplyFormError
+		}
+
+		n := ClusterNode{
+			ID:    fields[0],
+			Addr:  fields[1],
+			Flags: strings.Split(fields[2], ","),
+		}
+		if i := strings.IndexByte(n.Addr, '@'); i >= 0 {
+			n.Addr = n.Addr[:i]
+		}
+		if fields[3] != "-" {
+			n.MasterID = fields[3]
+		}
+
+		for _, s := range fields[8:] {
+			if strings.HasPrefix(s, "[") {
+				continue
+			}
+			var rg [2]int
+			bounds := strings.SplitN(s, "-", 2)
+			var err error
+			if rg[0], err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, ReplyFormError
+			}
+			rg[1] = rg[0]
+			if len(bounds) == 2 {
+				if rg[1], err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, ReplyFormError
+				}
+			}
+			n.Slots = append(n.Slots, rg)
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+type XPendingConsumer struct {
+	Name    string
+	Pending int64
+}
+
+type XPendingEntry struct {
+	ID         string
+	Consumer   string
+	Idle       int64 // milliseconds since last delivered
+	Deliveries int64
+}
+
+type XPendingResult struct {
+	Extended bool
+
+	// summary form: XPENDING key group
+	Count     int64
+	Lower     string // smallest pending id, empty if none
+	Higher    string
+	Consumers []XPendingConsumer
+
+	// extended form: XPENDING key group [IDLE ms] start end count [consumer]
+	Entries []XPendingEntry
+}
+
+// ParseXPending decodes both XPENDING replies, the summary starts with the
+// pending count while the extended form is an array of entries
+func ParseXPending(r Resp) (XPendingResult, error) {
+	var res XPendingResult
+	ar, ok := r.(*ArrayResp)
+	if !ok || ar.Empty {
+		return res, ReplyTypeError
+	}
+
+	items := ar.Items()
+	if len(items) == 4 {
+		if _, ok := items[0].(*IntResp); ok {
+			return parseXPendingSummary(items)
+		}
+	}
+
+	res.Extended = true
+	for _, item := range items {
+		er, ok := item.(*ArrayResp)
+		if !ok {
+			return res, ReplyFormError
+		}
+		fields := er.Items()
+		if len(fields) != 4 {
+			return res, ReplyFormError
+		}
+		var e XPendingEntry
+		if e.ID, ok = replyString(fields[0]); !ok {
+			return res, ReplyFormError
+		}
+		if e.Consumer, ok = replyString(fields[1]); !ok {
+			return res, ReplyFormError
+		}
+		var err error
+		if e.Idle, err = replyInt(fields[2]); err != nil {
+			return res, err
+		}
+		if e.Deliveries, err = replyInt(fields[3]); err != nil {
+			return res, err
+		}
+		res.Entries = append(res.Entries, e)
+	}
+	return res, nil
+}
+
+// parseXPendingSummary decodes count, min id, max id, [[consumer count] ...],
+// ids and consumers are null when nothing is pending
+func parseXPendingSummary(items []Resp) (XPendingResult, error) {
+	var res XPendingResult
+	var err error
+	if res.Count, err = replyInt(items[0]); err != nil {
+		return res, err
+	}
+	res.Lower, _ = replyString(items[1])
+	res.Higher, _ = replyString(items[2])
+	if IsNull(items[3]) {
+		return res, nil
+	}
+
+	consumers, ok := items[3].(*ArrayResp)
+	if !ok {
+		return res, ReplyFormError
+	}
+	for _, item := range consumers.Items() {
+		pair, ok := item.(*ArrayResp)
+		if !ok || pair.Length() != 1 {
+			return res, ReplyFormError
+		}
+		fields := pair.Items()
+		var c XPendingConsumer
+		if c.Name, ok = replyString(fields[0]); !ok {
+			return res, ReplyFormError
+		}
+		// the count is a bulk string
+		n, ok := replyString(fields[1])
+		if !ok {
+			return res, ReplyFormError
+		}
+		if c.Pending, err = strconv.ParseInt(n, 10, 64); err != nil {
+			return res, ReplyFormError
+		}
+		res.Consumers = append(res.Consumers, c)
+	}
+	return res, nil
+}
+
+// ParseClientInfo parses the CLIENT INFO reply, one line of space
+// separated key=value fields, values may be empty like name=
+func ParseClientInfo(r *BulkResp) (map[string]string, error) {
+	if r == nil || r.Empty || len(r.Args) == 0 {
+		return nil, ReplyTypeError
+	}
+
+	info := make(map[string]string)
+	for _, field := range strings.Fields(string(r.Args[0])) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, ReplyFormError
+		}
+		info[kv[0]] = kv[1]
+	}
+	return info, nil
+}
@@ -0,0 +1,360 @@
+package archer
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseAclWhoami(t *testing.T) {
+	r := readResp(t, "$7\r\ndefault\r\n")
+	if user := ParseAclWhoami(r.(*BulkResp)); user != "default" {
+		t.Fatal(user)
+	}
+	if user := ParseAclWhoami(NewNullBulkResp()); user != "" {
+		t.Fatal(user)
+	}
+	if !IsAdminCommand("ACL") {
+		t.Fatal("ACL must be admin")
+	}
+}
+
+func TestParseAclGetUser(t *testing.T) {
+	data := "*6\r\n" +
+		"$5\r\nflags\r\n*2\r\n$2\r\non\r\n$6\r\nnopass\r\n" +
+		"$9\r\npasswords\r\n*0\r\n" +
+		"$8\r\ncommands\r\n$5\r\n+@all\r\n"
+	m, err := ParseAclGetUser(readResp(t, data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 3 {
+		t.Fatal(len(m))
+	}
+	if m["flags"].String() != "on nopass" || m["commands"].String() != "+@all" {
+		t.Fatal(m["flags"].String(), m["commands"].String())
+	}
+}
+
+func TestParseType(t *testing.T) {
+	typ, err := ParseType(readResp(t, "+zset\r\n"))
+	if err != nil || typ != "zset" {
+		t.Fatal(typ, err)
+	}
+	if _, err := ParseType(readResp(t, ":1\r\n")); err != ReplyTypeError {
+		t.Fatal(err)
+	}
+}
+
+func TestParseConfigGet(t *testing.T) {
+	for _, data := range []string{
+		"*4\r\n$10\r\nmaxclients\r\n$5\r\n10000\r\n$7\r\ntimeout\r\n$1\r\n0\r\n",
+		"%2\r\n$10\r\nmaxclients\r\n$5\r\n10000\r\n$7\r\ntimeout\r\n$1\r\n0\r\n",
+	} {
+		r := readResp(t, data)
+		m, err := ParseConfigGet(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(m) != 2 || m["maxclients"] != "10000" || m["timeout"] != "0" {
+			t.Fatal(m)
+		}
+		if got := encodeResp(t, r); got != data {
+			t.Fatalf("round trip %q", got)
+		}
+	}
+
+	if _, err := ParseConfigGet(readResp(t, "*1\r\n$7\r\ntimeout\r\n")); err != ReplyFormError {
+		t.Fatal(err)
+	}
+}
+
+func TestParseBitfield(t *testing.T) {
+	r := readResp(t, "*3\r\n:1\r\n:-5\r\n$-1\r\n")
+	vals, err := ParseBitfield(r.(*ArrayResp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 3 || vals[0] != 1 || vals[1] != -5 || vals[2] != 0 {
+		t.Fatal(vals)
+	}
+
+	if !IsWriteCommand("BITFIELD") || IsWriteCommand("BITFIELD_RO") || !IsReadCommand("BITFIELD_RO") {
+		t.Fatal("BITFIELD must be write, BITFIELD_RO read")
+	}
+}
+
+func TestParseLCS(t *testing.T) {
+	// LCS key1 key2 IDX MINMATCHLEN 0 WITHMATCHLEN
+	resp2 := "*4\r\n" +
+		"$7\r\nmatches\r\n" +
+		"*2\r\n" +
+		"*3\r\n*2\r\n:4\r\n:7\r\n*2\r\n:5\r\n:8\r\n:4\r\n" +
+		"*3\r\n*2\r\n:2\r\n:3\r\n*2\r\n:0\r\n:1\r\n:2\r\n" +
+		"$3\r\nlen\r\n:6\r\n"
+	resp3 := "%2\r\n" + resp2[len("*4\r\n"):]
+
+	for _, data := range []string{resp2, resp3} {
+		res, err := ParseLCS(readResp(t, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Len != 6 || len(res.Matches) != 2 {
+			t.Fatal(res)
+		}
+		m := res.Matches[0]
+		if m.A != [2]int64{4, 7} || m.B != [2]int64{5, 8} || m.Len != 4 {
+			t.Fatal(m)
+		}
+		m = res.Matches[1]
+		if m.A != [2]int64{2, 3} || m.B != [2]int64{0, 1} || m.Len != 2 {
+			t.Fatal(m)
+		}
+	}
+
+	res, err := ParseLCS(readResp(t, "$6\r\nmytext\r\n"))
+	if err != nil || res.Str != "mytext" || res.Len != 6 {
+		t.Fatal(res, err)
+	}
+	res, err = ParseLCS(readResp(t, ":6\r\n"))
+	if err != nil || res.Len != 6 {
+		t.Fatal(res, err)
+	}
+}
+
+func TestParseMaybeArray(t *testing.T) {
+	tests := []struct {
+		reply string
+		vals  string
+	}{
+		{"$1\r\na\r\n", "a"},
+		{"*2\r\n$1\r\na\r\n$1\r\nb\r\n", "a b"},
+		{"*0\r\n", ""},
+		{"$-1\r\n", ""},
+	}
+
+	for _, tt := range tests {
+		vals, err := ParseMaybeArray(readResp(t, tt.reply))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(bytes.Join(vals, []byte(" "))); got != tt.vals {
+			t.Fatalf("ParseMaybeArray(%q) = %q, want %q", tt.reply, got, tt.vals)
+		}
+	}
+
+	if !IsWriteCommand("SPOP") || !IsReadCommand("SRANDMEMBER") || IsWriteCommand("SRANDMEMBER") {
+		t.Fatal("SPOP must be write, SRANDMEMBER read")
+	}
+}
+
+func TestParseZAddReply(t *testing.T) {
+	// ZADD key CH ...
+	changed, _, _, err := ParseZAddReply(readResp(t, ":2\r\n"), false)
+	if err != nil || changed != 2 {
+		t.Fatal(changed, err)
+	}
+
+	// ZADD key INCR ...
+	tests := []struct {
+		reply  string
+		score  float64
+		isNull bool
+	}{
+		{"$3\r\n1.5\r\n", 1.5, false},
+		{"$2\r\n-3\r\n", -3, false},
+		{"$3\r\ninf\r\n", math.Inf(1), false},
+		{"$-1\r\n", 0, true},
+		{"_\r\n", 0, true},
+	}
+	for _, tt := range tests {
+		_, score, isNull, err := ParseZAddReply(readResp(t, tt.reply), true)
+		if err != nil || score != tt.score || isNull != tt.isNull {
+			t.Fatalf("ParseZAddReply(%q) = %v %v %v", tt.reply, score, isNull, err)
+		}
+	}
+
+	if _, _, _, err := ParseZAddReply(readResp(t, ":1\r\n"), true); err != ReplyTypeError {
+		t.Fatal(err)
+	}
+	if !IsWriteCommand("ZADD") {
+		t.Fatal("ZADD must be a write command")
+	}
+}
+
+func TestParseHRandFieldWithValues(t *testing.T) {
+	for _, reply := range []string{
+		// RESP2
+		"*4\r\n$1\r\na\r\n$1\r\n1\r\n$1\r\nb\r\n$1\r\n2\r\n",
+		// RESP3
+		"*2\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n",
+	} {
+		pairs, err := ParseHRandFieldWithValues(readResp(t, reply))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != 2 || string(pairs[0][0]) != "a" || string(pairs[0][1]) != "1" ||
+			string(pairs[1][0]) != "b" || string(pairs[1][1]) != "2" {
+			t.Fatalf("ParseHRandFieldWithValues(%q) = %q", reply, pairs)
+		}
+	}
+
+	if pairs, err := ParseHRandFieldWithValues(readResp(t, "*0\r\n")); err != nil || len(pairs) != 0 {
+		t.Fatal(pairs, err)
+	}
+	if _, err := ParseHRandFieldWithValues(readResp(t, "*1\r\n$1\r\na\r\n")); err != ReplyFormError {
+		t.Fatal(err)
+	}
+	if !IsReadCommand("HRANDFIELD") || IsWriteCommand("HRANDFIELD") {
+		t.Fatal("HRANDFIELD must be a read command")
+	}
+}
+
+func TestParseClusterNodes(t *testing.T) {
+	text := "07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected\n" +
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460 5462 [5461-<-292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f]\n"
+	nodes, err := ParseClusterNodes(NewBulkResp([]byte(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatal(nodes)
+	}
+
+	slave, master := nodes[0], nodes[1]
+	if slave.ID != "07c37dfeb235213a872192d90877d0cd55635b91" || slave.Addr != "127.0.0.1:30004" ||
+		slave.MasterID != master.ID || len(slave.Slots) != 0 || strings.Join(slave.Flags, ",") != "slave" {
+		t.Fatalf("slave: %+v", slave)
+	}
+	if master.Addr != "127.0.0.1:30001" || master.MasterID != "" ||
+		strings.Join(master.Flags, ",") != "myself,master" {
+		t.Fatalf("master: %+v", master)
+	}
+	if len(master.Slots) != 2 || master.Slots[0] != [2]int{0, 5460} || master.Slots[1] != [2]int{5462, 5462} {
+		t.Fatalf("slots: %v", master.Slots)
+	}
+
+	if _, err := ParseClusterNodes(NewBulkResp([]byte("abc 127.0.0.1:1 master\n"))); err != ReplyFormError {
+		t.Fatal(err)
+	}
+}
+
+func TestParseXPending(t *testing.T) {
+	summary := "*4\r\n:3\r\n$15\r\n1526569495631-0\r\n$15\r\n1526569498055-0\r\n" +
+		"*2\r\n*2\r\n$5\r\nBob-1\r\n$1\r\n2\r\n*2\r\n$5\r\nJoe-2\r\n$1\r\n1\r\n"
+	res, err := ParseXPending(readResp(t, summary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Extended || res.Count != 3 || res.Lower != "1526569495631-0" || res.Higher != "1526569498055-0" {
+		t.Fatalf("%+v", res)
+	}
+	if len(res.Consumers) != 2 || res.Consumers[0] != (XPendingConsumer{"Bob-1", 2}) || res.Consumers[1] != (XPendingConsumer{"Joe-2", 1}) {
+		t.Fatalf("%+v", res.Consumers)
+	}
+
+	// nothing pending
+	res, err = ParseXPending(readResp(t, "*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n"))
+	if err != nil || res.Count != 0 || res.Lower != "" || res.Consumers != nil {
+		t.Fatal(res, err)
+	}
+
+	extended := "*2\r\n*4\r\n$15\r\n1526569498055-0\r\n$3\r\nBob\r\n:74170458\r\n:1\r\n" +
+		"*4\r\n$15\r\n1526569506935-0\r\n$3\r\nBob\r\n:74170458\r\n:3\r\n"
+	res, err = ParseXPending(readResp(t, extended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Extended || len(res.Entries) != 2 {
+		t.Fatalf("%+v", res)
+	}
+	if res.Entries[1] != (XPendingEntry{"1526569506935-0", "Bob", 74170458, 3}) {
+		t.Fatalf("%+v", res.Entries[1])
+	}
+
+	res, err = ParseXPending(readResp(t, "*0\r\n"))
+	if err != nil || !res.Extended || len(res.Entries) != 0 {
+		t.Fatal(res, err)
+	}
+	if _, err := ParseXPending(readResp(t, ":1\r\n")); err != ReplyTypeError {
+		t.Fatal(err)
+	}
+}
+
+func TestGetDel(t *testing.T) {
+	if !IsWriteCommand("GETDEL") || IsReadCommand("GETDEL") {
+		t.Fatal("GETDEL must be a write command")
+	}
+	cmd := newCommand("GETDEL", "foo")
+	if _, err := (&StrFilter{}).Inspect(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if keys := CommandKeys(cmd); len(keys) != 1 || string(keys[0]) != "foo" {
+		t.Fatalf("%q", keys)
+	}
+
+	// the old value, or null when the key doesn't exist
+	br, ok := readResp(t, "$3\r\nbar\r\n").(*BulkResp)
+	if !ok || br.Empty || br.String() != "bar" {
+		t.Fatal(br)
+	}
+	br, ok = readResp(t, "$-1\r\n").(*BulkResp)
+	if !ok || !br.Empty || !IsNull(br) {
+		t.Fatal(br)
+	}
+}
+
+func TestParseClientInfo(t *testing.T) {
+	line := "id=3 addr=127.0.0.1:50188 laddr=127.0.0.1:6379 fd=8 name= age=2 idle=0 flags=N db=0 sub=0 psub=0 ssub=0 multi=-1 qbuf=26 qbuf-free=20448 argv-mem=10 multi-mem=0 obl=0 oll=0 omem=0 tot-mem=22298 events=r cmd=client|info user=default redir=-1 resp=2\n"
+	info, err := ParseClientInfo(NewBulkResp([]byte(line)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["id"] != "3" || info["addr"] != "127.0.0.1:50188" || info["cmd"] != "client|info" || info["resp"] != "2" {
+		t.Fatalf("%v", info)
+	}
+	if v, ok := info["name"]; !ok || v != "" {
+		t.Fatalf("name %q %v", v, ok)
+	}
+
+	if _, err := ParseClientInfo(NewBulkResp([]byte("id=3 broken"))); err != ReplyFormError {
+		t.Fatal(err)
+	}
+	if _, err := ParseClientInfo(NewNullBulkResp()); err != ReplyTypeError {
+		t.Fatal(err)
+	}
+}
+
+func TestParseScore(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+	}{
+		{"$3\r\n1.5\r\n", 1.5},
+		{",1.5\r\n", 1.5},
+		{"$4\r\n-inf\r\n", math.Inf(-1)},
+		{",inf\r\n", math.Inf(1)},
+		{",-inf\r\n", math.Inf(-1)},
+		{",3e2\r\n", 300},
+	}
+	for _, tt := range tests {
+		f, err := ParseScore(readResp(t, tt.in))
+		if err != nil || f != tt.want {
+			t.Fatalf("%q: %v %v", tt.in, f, err)
+		}
+	}
+
+	// ZADD INCR under RESP3
+	_, score, isNull, err := ParseZAddReply(readResp(t, ",2\r\n"), true)
+	if err != nil || isNull || score != 2 {
+		t.Fatal(score, isNull, err)
+	}
+
+	if _, err := ParseScore(readResp(t, ":1\r\n")); err != ReplyTypeError {
+		t.Fatal(err)
+	}
+	if _, err := ParseScore(readResp(t, ",abc\r\n")); err == nil {
+		t.Fatal("bad double should fail")
+	}
+}
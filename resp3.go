@@ -0,0 +1,551 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/dongzerun/archer/util"
+)
+
+// RESP3 types based on:
+// https://github.com/antirez/RESP3/blob/master/spec.md
+// redis 6+ 在客户端发送 HELLO 3 之后使用
+
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+var (
+	_ Resp = (*NullResp)(nil)
+	_ Resp = (*MapResp)(nil)
+	_ Resp = (*SetResp)(nil)
+	_ Resp = (*BooleanResp)(nil)
+	_ Resp = (*DoubleResp)(nil)
+	_ Resp = (*BigNumberResp)(nil)
+	_ Resp = (*VerbatimResp)(nil)
+	_ Resp = (*PushResp)(nil)
+
+	NullType     = "null"
+	MapType      = "map"
+	SetType      = "set"
+	BoolType     = "boolean"
+	DoubleType   = "double"
+	BigNumType   = "bignumber"
+	VerbatimType = "verbatim"
+	PushType     = "push"
+
+	NullSep     = byte('_')
+	MapSep      = byte('%')
+	SetSep      = byte('~')
+	BoolSep     = byte('#')
+	DoubleSep   = byte(',')
+	BigNumSep   = byte('(')
+	VerbatimSep = byte('=')
+	PushSep     = byte('>')
+
+	EmptyNull = []byte("_\r\n")
+	BoolTrue  = []byte("#t\r\n")
+	BoolFalse = []byte("#f\r\n")
+
+	BoolFormError      = errors.New("boolean must be #t or #f")
+	VerbatimFormError  = errors.New("verbatim string must start with a 3 bytes format and ':'")
+	NullAggregateError = errors.New("map, set and push have no null length, null is _")
+)
+
+// RESP3 里统一的 null, 对应 RESP2 的 $-1 和 *-1
+type NullResp struct {
+	BaseResp
+}
+
+func NewNullResp() *NullResp {
+	nr := &NullResp{}
+	nr.Rtype = NullType
+	return nr
+}
+
+func (nr *NullResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, nr)
+}
+
+func (nr *NullResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, nr)
+}
+
+// WriteTo implements io.WriterTo
+func (nr *NullResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, nr)
+}
+
+func (nr *NullResp) writeFrame(fw frameWriter) (int64, error) {
+	if nr == nil || nr.Rtype != NullType {
+		return 0, RespTypeError
+	}
+	return fw.write(EmptyNull)
+}
+
+func NewNullBulkResp() *BulkResp {
+	br := &BulkResp{}
+	br.Rtype = BulkType
+	br.Empty = true
+	return br
+}
+
+// IsNull reports whether r is one of the null forms: $-1, *-1 or _
+func IsNull(r Resp) bool {
+	switch v := r.(type) {
+	case *NullResp:
+		return true
+	case *BulkResp:
+		return v.Empty
+	case *ArrayResp:
+		return v.Empty
+	}
+	return false
+}
+
+// NormalizeNull converts a null reply to the form expected by proto.
+// RESP3 always gets _, RESP2 keeps *-1 for arrays and gets $-1 otherwise.
+// Non-null replies are returned unchanged.
+func NormalizeNull(r Resp, proto int) Resp {
+	if !IsNull(r) {
+		return r
+	}
+
+	if proto == RESP3 {
+		if _, ok := r.(*NullResp); ok {
+			return r
+		}
+		return NewNullResp()
+	}
+
+	switch r.(type) {
+	case *ArrayResp, *BulkResp:
+		return r
+	}
+	return NewNullBulkResp()
+}
+
+// MapResp keeps key value pairs flat and in received order,
+// so Encode is deterministic
+type MapResp struct {
+	BaseResp
+	Elems []Resp // k1 v1 k2 v2 ...
+}
+
+func (mr *MapResp) String() string {
+	var str []string
+	for _, i := range mr.Elems {
+		str = append(str, i.String())
+	}
+	return strings.Join(str, " ")
+}
+
+func (mr *MapResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, mr)
+}
+
+func (mr *MapResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, mr)
+}
+
+// WriteTo implements io.WriterTo
+func (mr *MapResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, mr)
+}
+
+func (mr *MapResp) writeFrame(fw frameWriter) (int64, error) {
+	if mr == nil || mr.Rtype != MapType {
+		return 0, RespTypeError
+	}
+
+	n, err := fw.header(MapSep, len(mr.Elems)/2)
+	if err != nil {
+		return n, err
+	}
+	for _, e := range mr.Elems {
+		m, err := fw.elem(e)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// SetResp keeps members in insertion order, so Encode is deterministic
+// even though sets are unordered
+type SetResp struct {
+	BaseResp
+	Elems []Resp
+}
+
+func NewSetResp(members ...Resp) *SetResp {
+	sr := &SetResp{}
+	sr.Rtype = SetType
+	sr.Elems = append(sr.Elems, members...)
+	return sr
+}
+
+// Add appends a member, duplicates are not checked
+func (sr *SetResp) Add(member Resp) {
+	sr.Elems = append(sr.Elems, member)
+}
+
+func (sr *SetResp) String() string {
+	var str []string
+	for _, i := range sr.Elems {
+		str = append(str, i.String())
+	}
+	return strings.Join(str, " ")
+}
+
+func (sr *SetResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, sr)
+}
+
+func (sr *SetResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, sr)
+}
+
+// WriteTo implements io.WriterTo
+func (sr *SetResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, sr)
+}
+
+func (sr *SetResp) writeFrame(fw frameWriter) (int64, error) {
+	if sr == nil || sr.Rtype != SetType {
+		return 0, RespTypeError
+	}
+
+	n, err := fw.header(SetSep, len(sr.Elems))
+	if err != nil {
+		return n, err
+	}
+	for _, e := range sr.Elems {
+		m, err := fw.elem(e)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// PushResp is out of band data like pub/sub messages and client side
+// caching invalidations, the first element is the kind such as message
+type PushResp struct {
+	BaseResp
+	Elems []Resp
+}
+
+func NewPushResp(elems ...Resp) *PushResp {
+	pr := &PushResp{}
+	pr.Rtype = PushType
+	pr.Elems = append(pr.Elems, elems...)
+	return pr
+}
+
+// Kind returns the first element of a push like message or invalidate,
+// "" if it's not a string
+func (pr *PushResp) Kind() string {
+	if len(pr.Elems) == 0 {
+		return ""
+	}
+	switch v := pr.Elems[0].(type) {
+	case *BulkResp:
+		if b, ok := v.Bytes(); ok {
+			return string(b)
+		}
+	case *SimpleResp:
+		return v.Status()
+	}
+	return ""
+}
+
+func (pr *PushResp) String() string {
+	var str []string
+	for _, i := range pr.Elems {
+		str = append(str, i.String())
+	}
+	return strings.Join(str, " ")
+}
+
+func (pr *PushResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, pr)
+}
+
+func (pr *PushResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, pr)
+}
+
+// WriteTo implements io.WriterTo
+func (pr *PushResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, pr)
+}
+
+func (pr *PushResp) writeFrame(fw frameWriter) (int64, error) {
+	if pr == nil || pr.Rtype != PushType {
+		return 0, RespTypeError
+	}
+
+	n, err := fw.header(PushSep, len(pr.Elems))
+	if err != nil {
+		return n, err
+	}
+	for _, e := range pr.Elems {
+		m, err := fw.elem(e)
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// BooleanResp is #t or #f
+type BooleanResp struct {
+	BaseResp
+	Value bool
+}
+
+func NewBooleanResp(b bool) *BooleanResp {
+	br := &BooleanResp{Value: b}
+	br.Rtype = BoolType
+	return br
+}
+
+func (br *BooleanResp) String() string {
+	if br.Value {
+		return "true"
+	}
+	return "false"
+}
+
+func (br *BooleanResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, br)
+}
+
+func (br *BooleanResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, br)
+}
+
+// WriteTo implements io.WriterTo
+func (br *BooleanResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, br)
+}
+
+func (br *BooleanResp) writeFrame(fw frameWriter) (int64, error) {
+	if br == nil || br.Rtype != BoolType {
+		return 0, RespTypeError
+	}
+	if br.Value {
+		return fw.write(BoolTrue)
+	}
+	return fw.write(BoolFalse)
+}
+
+// DoubleResp keeps the double as received, so inf, -inf, nan and the
+// exponent form are passed through untouched
+type DoubleResp struct {
+	BaseResp
+}
+
+func NewDoubleResp(f float64) *DoubleResp {
+	dr := &DoubleResp{}
+	dr.Rtype = DoubleType
+	switch {
+	case math.IsInf(f, 1):
+		dr.Args = append(dr.Args, []byte("inf"))
+	case math.IsInf(f, -1):
+		dr.Args = append(dr.Args, []byte("-inf"))
+	case math.IsNaN(f):
+		dr.Args = append(dr.Args, []byte("nan"))
+	default:
+		dr.Args = append(dr.Args, strconv.AppendFloat(nil, f, 'g', -1, 64))
+	}
+	return dr
+}
+
+// Float parses the value, inf/-inf/nan included
+func (dr *DoubleResp) Float() (float64, error) {
+	return strconv.ParseFloat(string(dr.Args[0]), 64)
+}
+
+func (dr *DoubleResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, dr)
+}
+
+func (dr *DoubleResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, dr)
+}
+
+// WriteTo implements io.WriterTo
+func (dr *DoubleResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, dr)
+}
+
+func (dr *DoubleResp) writeFrame(fw frameWriter) (int64, error) {
+	if dr == nil || dr.Rtype != DoubleType {
+		return 0, RespTypeError
+	}
+	if len(dr.Args) == 0 {
+		return 0, RespArgsError
+	}
+	return fw.line(DoubleSep, dr.Args[0])
+}
+
+// BigNumberResp is an integer out of the int64 range, kept as decimal text
+type BigNumberResp struct {
+	BaseResp
+}
+
+func NewBigNumberResp(n []byte) *BigNumberResp {
+	br := &BigNumberResp{}
+	br.Rtype = BigNumType
+	br.Args = append(br.Args, n)
+	return br
+}
+
+func (br *BigNumberResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, br)
+}
+
+func (br *BigNumberResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, br)
+}
+
+// WriteTo implements io.WriterTo
+func (br *BigNumberResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, br)
+}
+
+func (br *BigNumberResp) writeFrame(fw frameWriter) (int64, error) {
+	if br == nil || br.Rtype != BigNumType {
+		return 0, RespTypeError
+	}
+	if len(br.Args) == 0 {
+		return 0, RespArgsError
+	}
+	return fw.line(BigNumSep, br.Args[0])
+}
+
+// VerbatimResp is a bulk string with a 3 bytes format such as txt or mkd,
+// Args[0] is the text without the format prefix
+type VerbatimResp struct {
+	BaseResp
+	Format string
+}
+
+func NewVerbatimResp(format string, text []byte) *VerbatimResp {
+	vr := &VerbatimResp{Format: format}
+	vr.Rtype = VerbatimType
+	vr.Args = append(vr.Args, text)
+	return vr
+}
+
+// parseAggregateLen parses the length of a map, set or push, unlike * they
+// have no -1
+func parseAggregateLen(p []byte) (int, error) {
+	n, err := util.ParseLen(p)
+	if err == nil && n < 0 {
+		return 0, NullAggregateError
+	}
+	return n, err
+}
+
+// parseVerbatim splits the payload fmt:text of a verbatim string
+func parseVerbatim(payload []byte) (*VerbatimResp, error) {
+	if len(payload) < 4 || payload[3] != ':' {
+		return nil, VerbatimFormError
+	}
+	return NewVerbatimResp(string(payload[:3]), payload[4:]), nil
+}
+
+func (vr *VerbatimResp) Encode(w *bufio.Writer) error {
+	return encodeFrame(w, vr)
+}
+
+func (vr *VerbatimResp) EncodeTo(b *bytes.Buffer) error {
+	return encodeTo(b, vr)
+}
+
+// WriteTo implements io.WriterTo
+func (vr *VerbatimResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, vr)
+}
+
+func (vr *VerbatimResp) writeFrame(fw frameWriter) (int64, error) {
+	if vr == nil || vr.Rtype != VerbatimType {
+		return 0, RespTypeError
+	}
+	if len(vr.Args) == 0 {
+		return 0, RespArgsError
+	}
+
+	n, err := fw.header(VerbatimSep, len(vr.Format)+1+len(vr.Args[0]))
+	if err != nil {
+		return n, err
+	}
+	m, err := fw.writeString(vr.Format)
+	n += m
+	if err != nil {
+		return n, err
+	}
+	m, err = fw.line(':', vr.Args[0])
+	return n + m, err
+}
+
+// BoolToIntResp converts a boolean to the :1/:0 RESP2 clients expect
+func BoolToIntResp(b bool) *IntResp {
+	if b {
+		return NewIntResp(1)
+	}
+	return NewIntResp(0)
+}
+
+// Downgrade converts a RESP3 reply for a RESP2 client, recursively:
+// booleans become :1/:0, null becomes $-1, maps become flat arrays
+// k1 v1 k2 v2, sets become arrays and doubles, big numbers and verbatim
+// strings become bulk strings, pushes become arrays as the pub/sub
+// messages of RESP2. RESP2 replies are returned unchanged
+func Downgrade(r Resp) Resp {
+	switch v := r.(type) {
+	case *BooleanResp:
+		return BoolToIntResp(v.Value)
+	case *DoubleResp:
+		return NewBulkResp(v.Args[0])
+	case *BigNumberResp:
+		return NewBulkResp(v.Args[0])
+	case *VerbatimResp:
+		return NewBulkResp(v.Args[0])
+	case *NullResp:
+		return NormalizeNull(v, RESP2)
+	case *MapResp:
+		return downgradeElems(v.Elems)
+	case *SetResp:
+		return downgradeElems(v.Elems)
+	case *PushResp:
+		return downgradeElems(v.Elems)
+	case *ArrayResp:
+		if v.Elems == nil {
+			return v
+		}
+		return downgradeElems(v.Elems)
+	}
+	return r
+}
+
+func downgradeElems(elems []Resp) *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	for _, e := range elems {
+		ar.append(Downgrade(e))
+	}
+	return ar
+}
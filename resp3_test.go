@@ -0,0 +1,225 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestNormalizeNull(t *testing.T) {
+	tests := []struct {
+		in    string
+		proto int
+		out   string
+	}{
+		{"$-1\r\n", RESP2, "$-1\r\n"},
+		{"*-1\r\n", RESP2, "*-1\r\n"},
+		{"_\r\n", RESP2, "$-1\r\n"},
+		{"$-1\r\n", RESP3, "_\r\n"},
+		{"*-1\r\n", RESP3, "_\r\n"},
+		{"_\r\n", RESP3, "_\r\n"},
+	}
+
+	for _, tt := range tests {
+		r := readResp(t, tt.in)
+		if !IsNull(r) {
+			t.Fatalf("%q should be null", tt.in)
+		}
+		if got := encodeResp(t, NormalizeNull(r, tt.proto)); got != tt.out {
+			t.Fatalf("NormalizeNull(%q, %d) = %q, want %q", tt.in, tt.proto, got, tt.out)
+		}
+	}
+}
+
+func TestNormalizeNullNotNull(t *testing.T) {
+	for _, in := range []string{"$0\r\n\r\n", "*0\r\n", "+OK\r\n", ":0\r\n"} {
+		r := readResp(t, in)
+		if IsNull(r) {
+			t.Fatalf("%q should not be null", in)
+		}
+		if NormalizeNull(r, RESP3) != r {
+			t.Fatalf("NormalizeNull should keep %q", in)
+		}
+	}
+}
+
+func TestArrayWithNullBulk(t *testing.T) {
+	if got := encodeResp(t, NewNullBulkResp()); got != "$-1\r\n" {
+		t.Fatalf("null bulk: %q", got)
+	}
+
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	for _, v := range []string{"a", "", "c"} {
+		br := NewNullBulkResp()
+		if v != "" {
+			br.Empty = false
+			br.Args = [][]byte{[]byte(v)}
+		}
+		ar.Args = append(ar.Args, br)
+	}
+
+	want := "*3\r\n$1\r\na\r\n$-1\r\n$1\r\nc\r\n"
+	got := encodeResp(t, ar)
+	if got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+
+	back, ok := readResp(t, got).(*ArrayResp)
+	if !ok || len(back.Args) != 3 {
+		t.Fatalf("round trip: %v", back)
+	}
+	if !back.Args[1].Empty || back.Args[0].Empty || back.Args[2].Empty {
+		t.Fatal("round trip lost null element")
+	}
+	if encodeResp(t, back) != want {
+		t.Fatal("round trip mismatch")
+	}
+}
+
+func TestSetRespDeterministic(t *testing.T) {
+	build := func() *SetResp {
+		sr := NewSetResp()
+		for _, m := range []string{"c", "a", "b"} {
+			sr.Add(NewBulkResp([]byte(m)))
+		}
+		return sr
+	}
+
+	want := "~3\r\n$1\r\nc\r\n$1\r\na\r\n$1\r\nb\r\n"
+	first, second := encodeResp(t, build()), encodeResp(t, build())
+	if first != want || second != want {
+		t.Fatalf("got %q and %q, want %q", first, second, want)
+	}
+
+	r := readResp(t, want)
+	if r.Type() != SetType || r.String() != "c a b" || encodeResp(t, r) != want {
+		t.Fatalf("round trip: %s %q", r.Type(), r.String())
+	}
+}
+
+func TestBoolToIntResp(t *testing.T) {
+	if got := encodeResp(t, BoolToIntResp(true)); got != ":1\r\n" {
+		t.Fatalf("%q", got)
+	}
+	if got := encodeResp(t, BoolToIntResp(false)); got != ":0\r\n" {
+		t.Fatalf("%q", got)
+	}
+
+	r := readResp(t, "*3\r\n#t\r\n_\r\n%1\r\n+a\r\n#f\r\n")
+	if got := encodeResp(t, Downgrade(r)); got != "*3\r\n:1\r\n$-1\r\n*2\r\n+a\r\n:0\r\n" {
+		t.Fatalf("Downgrade: %q", got)
+	}
+	if got := encodeResp(t, r); got != "*3\r\n#t\r\n_\r\n%1\r\n+a\r\n#f\r\n" {
+		t.Fatalf("Downgrade must not modify the reply: %q", got)
+	}
+}
+
+func TestRESP3RoundTrip(t *testing.T) {
+	frames := []struct {
+		in    string
+		rtype string
+	}{
+		{"_\r\n", NullType},
+		{"#t\r\n", BoolType},
+		{",3.14\r\n", DoubleType},
+		{",-inf\r\n", DoubleType},
+		{",1.5e+300\r\n", DoubleType},
+		{"(3492890328409238509324850943850943825024385\r\n", BigNumType},
+		{"=15\r\ntxt:Some string\r\n", VerbatimType},
+		{"%2\r\n+a\r\n:1\r\n$1\r\nb\r\n,2.5\r\n", MapType},
+		{"~3\r\n+a\r\n#f\r\n_\r\n", SetType},
+		{"*3\r\n,1\r\n(1\r\n=5\r\nmkd:x\r\n", ArrayType},
+		{">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n", PushType},
+		{">0\r\n", PushType},
+	}
+	for _, f := range frames {
+		r := readResp(t, f.in)
+		if r.Type() != f.rtype {
+			t.Fatalf("%q: type %s want %s", f.in, r.Type(), f.rtype)
+		}
+		if got := encodeResp(t, r); got != f.in {
+			t.Fatalf("ReadProtocol round trip %q: %q", f.in, got)
+		}
+
+		sr, n, err := Parse([]byte(f.in))
+		if err != nil || n != len(f.in) {
+			t.Fatalf("Parse %q: %d %v", f.in, n, err)
+		}
+		if got := encodeResp(t, sr); got != f.in {
+			t.Fatalf("Parse round trip %q: %q", f.in, got)
+		}
+	}
+
+	// _ stays distinct from the RESP2 null bulk
+	if r := readResp(t, "_\r\n"); r.Type() == BulkType {
+		t.Fatal("_ read as a bulk")
+	}
+	if r := readResp(t, "$-1\r\n"); r.Type() != BulkType {
+		t.Fatal("$-1 read as", r.Type())
+	}
+}
+
+func TestRESP3Scalars(t *testing.T) {
+	if got := encodeResp(t, NewDoubleResp(math.Inf(1))); got != ",inf\r\n" {
+		t.Fatalf("%q", got)
+	}
+	if got := encodeResp(t, NewDoubleResp(0.1)); got != ",0.1\r\n" {
+		t.Fatalf("%q", got)
+	}
+	f, err := readResp(t, ",-inf\r\n").(*DoubleResp).Float()
+	if err != nil || !math.IsInf(f, -1) {
+		t.Fatal(f, err)
+	}
+
+	vr := readResp(t, "=15\r\ntxt:Some string\r\n").(*VerbatimResp)
+	if vr.Format != "txt" || vr.String() != "Some string" {
+		t.Fatalf("%q %q", vr.Format, vr.String())
+	}
+	if _, err := ReadProtocol(bufio.NewReader(bytes.NewBufferString("=3\r\ntxt\r\n"))); err != VerbatimFormError {
+		t.Fatal(err)
+	}
+
+	down := map[string]string{
+		",3.14\r\n":                  "$4\r\n3.14\r\n",
+		"(12345678901234567890\r\n":  "$20\r\n12345678901234567890\r\n",
+		"=15\r\ntxt:Some string\r\n": "$11\r\nSome string\r\n",
+	}
+	for in, want := range down {
+		if got := encodeResp(t, Downgrade(readResp(t, in))); got != want {
+			t.Fatalf("Downgrade %q: %q", in, got)
+		}
+	}
+}
+
+func TestPushResp(t *testing.T) {
+	in := ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n"
+	pr, ok := readResp(t, in).(*PushResp)
+	if !ok || pr.Kind() != "message" || len(pr.Elems) != 3 {
+		t.Fatal(pr)
+	}
+
+	// RESP2 clients get pub/sub messages as arrays
+	if got := encodeResp(t, Downgrade(pr)); got != "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$2\r\nhi\r\n" {
+		t.Fatalf("%q", got)
+	}
+	if !Equal(pr, NewPushResp(NewBulkResp([]byte("message")), NewBulkResp([]byte("ch")), NewBulkResp([]byte("hi")))) {
+		t.Fatal("push must equal the same elements")
+	}
+
+	// pushes may arrive in the middle of a stream
+	p := NewStreamParser()
+	p.Feed([]byte(in[:10]))
+	if _, ok := p.Next(); ok {
+		t.Fatal("incomplete push")
+	}
+	p.Feed([]byte(in[10:] + "+OK\r\n"))
+	r, ok := p.Next()
+	if !ok || !Equal(r, pr) {
+		t.Fatal(r, p.Err())
+	}
+	if r, ok := p.Next(); !ok || r.Type() != SimpleType {
+		t.Fatal(r, p.Err())
+	}
+}
@@ -0,0 +1,98 @@
+package archer
+
+import (
+	"bufio"
+	"sync"
+)
+
+// BulkResp and ArrayResp pools for the hot path, every command and most
+// replies are made of them.
+//
+// A Resp from AcquireBulkResp, AcquireArrayResp or ReadProtocolPooled owns
+// its payload byte slices, they don't alias the bufio.Reader buffer. After
+// ReleaseResp the Resp and its payloads are reused by later calls, so copy
+// whatever outlives the release, and never release a Resp still queued
+// for writing or referenced by another Resp.
+var (
+	bulkPool = sync.Pool{
+		New: func() interface{} { return new(BulkResp) },
+	}
+	arrayPool = sync.Pool{
+		New: func() interface{} { return new(ArrayResp) },
+	}
+)
+
+func AcquireBulkResp() *BulkResp {
+	br := bulkPool.Get().(*BulkResp)
+	br.Rtype = BulkType
+	return br
+}
+
+func AcquireArrayResp() *ArrayResp {
+	ar := arrayPool.Get().(*ArrayResp)
+	ar.Rtype = ArrayType
+	return ar
+}
+
+// ReleaseResp puts r back to the pools, elements of an array included.
+// Args, Empty and Rtype are reset so nothing stale leaks into the next user,
+// a released payload buffer is kept only to be overwritten by the next read.
+// Types other than BulkResp and ArrayResp are ignored
+func ReleaseResp(r Resp) {
+	switch v := r.(type) {
+	case *BulkResp:
+		v.Rtype = ""
+		v.Empty = false
+		v.Args = v.Args[:0]
+		bulkPool.Put(v)
+	case *ArrayResp:
+		for _, br := range v.Args {
+			ReleaseResp(br)
+		}
+		for _, e := range v.Elems {
+			ReleaseResp(e)
+		}
+		for i := range v.Args {
+			v.Args[i] = nil
+		}
+		v.Rtype = ""
+		v.Empty = false
+		v.Args = v.Args[:0]
+		v.Elems = nil
+		arrayPool.Put(v)
+	}
+}
+
+// ReadProtocolPooled is ReadProtocol taking the bulks and arrays from the
+// pools, release the result with ReleaseResp once done
+func ReadProtocolPooled(r *bufio.Reader) (Resp, error) {
+	lim := &readLimits{ParserLimits: DefaultParserLimits, pooled: true}
+	return readProtocol(r, lim)
+}
+
+func (l *readLimits) newBulk() *BulkResp {
+	if l.pooled {
+		return AcquireBulkResp()
+	}
+	br := &BulkResp{}
+	br.Rtype = BulkType
+	return br
+}
+
+func (l *readLimits) newArray() *ArrayResp {
+	if l.pooled {
+		return AcquireArrayResp()
+	}
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	return ar
+}
+
+// payload returns the released payload of br to read the next one into,
+// nil if there is none
+func (l *readLimits) payload(br *BulkResp) []byte {
+	if l.pooled && cap(br.Args) > 0 {
+		return br.Args[:1][0]
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReleaseRespResets(t *testing.T) {
+	br := AcquireBulkResp()
+	br.Empty = true
+	br.Args = append(br.Args, []byte("secret"))
+	ReleaseResp(br)
+	if br.Rtype != "" || br.Empty || len(br.Args) != 0 {
+		t.Fatalf("%+v", br)
+	}
+
+	ar := AcquireArrayResp()
+	ar.Args = append(ar.Args, NewBulkResp([]byte("a")))
+	ar.Empty = true
+	ReleaseResp(ar)
+	if ar.Rtype != "" || ar.Empty || len(ar.Args) != 0 || ar.Elems != nil {
+		t.Fatalf("%+v", ar)
+	}
+
+	if br := AcquireBulkResp(); br.Rtype != BulkType || len(br.Args) != 0 {
+		t.Fatalf("%+v", br)
+	}
+}
+
+func TestReadProtocolPooled(t *testing.T) {
+	frames := []string{
+		"*2\r\n$3\r\nGET\r\n$6\r\nfoobar\r\n",
+		"*3\r\n$3\r\nSET\r\n$1\r\na\r\n$-1\r\n",
+		"*2\r\n*1\r\n:1\r\n$2\r\nxy\r\n",
+		"$-1\r\n",
+		"+OK\r\n",
+	}
+	r := bufio.NewReader(strings.NewReader(strings.Repeat(strings.Join(frames, ""), 3)))
+	for i := 0; i < 3; i++ {
+		for _, f := range frames {
+			rsp, err := ReadProtocolPooled(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := encodeResp(t, rsp); got != f {
+				t.Fatalf("got %q want %q", got, f)
+			}
+			ReleaseResp(rsp)
+		}
+	}
+}
+
+func Benchmark_ReadProtocolPooled(b *testing.B) {
+	cmd := "*3\r\n$3\r\nSET\r\n$8\r\nkey:1234\r\n$16\r\nvalue:0123456789\r\n"
+	data := []byte(strings.Repeat(cmd, 1000))
+	rd := bytes.NewReader(data)
+	r := bufio.NewReader(rd)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			rd.Reset(data)
+			r.Reset(rd)
+		}
+		rsp, err := ReadProtocolPooled(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ReleaseResp(rsp)
+	}
+}
@@ -11,33 +11,64 @@ var reqrules = map[string][]interface{}{
 	"SELECT": []interface{}{2, 2},
 	"PING":   []interface{}{1, 1},
 	"QUIT":   []interface{}{1, 1},
+	"HELLO":  []interface{}{1, 7},
+	"AUTH":   []interface{}{2, 3},
+	"CLIENT": []interface{}{2, -1},
+	// transaction
+	"MULTI":   []interface{}{1, 1},
+	"EXEC":    []interface{}{1, 1},
+	"DISCARD": []interface{}{1, 1},
+	"WATCH":   []interface{}{2, -1},
+	"UNWATCH": []interface{}{1, 1},
+	// pubsub
+	"SUBSCRIBE":    []interface{}{2, -1},
+	"UNSUBSCRIBE":  []interface{}{1, -1},
+	"PSUBSCRIBE":   []interface{}{2, -1},
+	"PUNSUBSCRIBE": []interface{}{1, -1},
 	// key
 	"DEL":       []interface{}{2, 2001},
 	"TYPE":      []interface{}{2, 2},
-	"EXISTS":    []interface{}{2, 2},
-	"EXPIRE":    []interface{}{3, 3},
-	"EXPIREAT":  []interface{}{3, 3},
+	"EXISTS":    []interface{}{2, -1},
+	"EXPIRE":    []interface{}{3, 4},
+	"EXPIREAT":  []interface{}{3, 4},
 	"TTL":       []interface{}{2, 2},
 	"PTTL":      []interface{}{2, 2},
 	"PERSIST":   []interface{}{2, 2},
-	"PEXPIRE":   []interface{}{3, 3},
-	"PEXPIREAT": []interface{}{3, 3},
+	"PEXPIRE":   []interface{}{3, 4},
+	"PEXPIREAT": []interface{}{3, 4},
 	"RENAME":    []interface{}{3, 3},
 	"RENAMENX":  []interface{}{3, 3},
 	"DUMP":      []interface{}{2, 2},
-	"RESTORE":   []interface{}{4, 4},
+	// blocking, on a connection of their own
+	"BLPOP":      []interface{}{3, -1},
+	"BRPOP":      []interface{}{3, -1},
+	"BRPOPLPUSH": []interface{}{4, 4},
+	"BLMOVE":     []interface{}{6, 6},
+	"WAIT":       []interface{}{3, 3},
+	"SCAN":       []interface{}{2, 8},
+	"DBSIZE":     []interface{}{1, 1},
+	"RANDOMKEY":  []interface{}{1, 1},
+	"RESTORE":    []interface{}{4, 4},
+	// scripting
+	"EVAL":    []interface{}{3, -1},
+	"EVALSHA": []interface{}{3, -1},
+	"SCRIPT":  []interface{}{2, -1},
 	// bit
 
-	"SETBIT":   []interface{}{4, 4},
-	"BITCOUNT": []interface{}{2, 2},
-	"GETBIT":   []interface{}{3, 3},
+	"SETBIT":      []interface{}{4, 4},
+	"BITCOUNT":    []interface{}{2, 2},
+	"GETBIT":      []interface{}{3, 3},
+	"BITFIELD":    []interface{}{2, -1},
+	"BITFIELD_RO": []interface{}{2, -1},
 
 	// string
 	"GET":         []interface{}{2, 2},
 	"MGET":        []interface{}{2, 2001},
 	"GETRANGE":    []interface{}{4, 4},
 	"GETSET":      []interface{}{3, 3},
-	"SET":         []interface{}{3, 6},
+	"GETDEL":      []interface{}{2, 2},
+	"GETEX":       []interface{}{2, 4},
+	"SET":         []interface{}{3, 7},
 	"MSET":        []interface{}{3, 4001},
 	"SETEX":       []interface{}{4, 4},
 	"SETNX":       []interface{}{3, 3},
@@ -64,13 +95,24 @@ var reqrules = map[string][]interface{}{
 	"HKEYS":        []interface{}{2, 2},
 	"HSETNX":       []interface{}{4, 4},
 	"HVALS":        []interface{}{2, 2},
+	"HRANDFIELD":   []interface{}{2, 4},
+	// redis 7.4 hash field ttl: key ... FIELDS numfields field ...
+	"HEXPIRE":      []interface{}{6, -1},
+	"HPEXPIRE":     []interface{}{6, -1},
+	"HEXPIREAT":    []interface{}{6, -1},
+	"HPEXPIREAT":   []interface{}{6, -1},
+	"HTTL":         []interface{}{5, -1},
+	"HPTTL":        []interface{}{5, -1},
+	"HEXPIRETIME":  []interface{}{5, -1},
+	"HPEXPIRETIME": []interface{}{5, -1},
+	"HPERSIST":     []interface{}{5, -1},
 	// set
 	"SADD":        []interface{}{3, -1},
 	"SCARD":       []interface{}{2, 2},
 	"SISMEMBER":   []interface{}{3, 3},
 	"SMEMBERS":    []interface{}{2, 2},
 	"SREM":        []interface{}{3, -1},
-	"SPOP":        []interface{}{2, 2},
+	"SPOP":        []interface{}{2, 3},
 	"SRANDMEMBER": []interface{}{2, 3},
 	// "SMOVE":       []interface{}{4, 4},
 	// list
@@ -105,6 +147,19 @@ var reqrules = map[string][]interface{}{
 	"ZRANGEBYLEX":      []interface{}{4, 7},
 	"ZLEXCOUNT":        []interface{}{4, 4},
 	"ZREMRANGEBYLEX":   []interface{}{4, 4},
+
+	// geo, GEORADIUS 的 STORE key 见 keywordKeySpecs
+	"GEOADD":               []interface{}{5, -1},
+	"GEODIST":              []interface{}{4, 5},
+	"GEOHASH":              []interface{}{2, -1},
+	"GEOPOS":               []interface{}{2, -1},
+	"GEORADIUS":            []interface{}{6, -1},
+	"GEORADIUS_RO":         []interface{}{6, -1},
+	"GEORADIUSBYMEMBER":    []interface{}{5, -1},
+	"GEORADIUSBYMEMBER_RO": []interface{}{5, -1},
+	"GEOSEARCH":            []interface{}{7, -1},
+	"GEOSEARCHSTORE":       []interface{}{8, -1},
+
 	//finite zset
 	"XADD":        []interface{}{4, -1},
 	"XINCRBY":     []interface{}{4, 9},
@@ -122,9 +177,18 @@ var specList = map[string]bool{
 	"INFO": true,
 	// "RENAME":   true,
 	// "RENAMENX": true,
-	"MGET": true,
-	"MSET": true,
-	"DEL":  true,
+	"MGET":   true,
+	"MSET":   true,
+	"DEL":    true,
+	"EXISTS": true,
+	// 在所有 master 上迭代或汇总
+	"SCAN":      true,
+	"DBSIZE":    true,
+	"RANDOMKEY": true,
+	// 按 numkeys 声明的 key 路由, SCRIPT 由代理处理
+	"EVAL":    true,
+	"EVALSHA": true,
+	"SCRIPT":  true,
 	// "MSETNX":      true,
 	// "RPOPLPUSH":   true,
 	// "SDIFF":       true,
@@ -140,15 +204,8 @@ var blackList = map[string]bool{
 	"BGREWRITEAOF": true,
 	"BGSAVE":       true,
 	"BITOP":        true,
-	"BLPOP":        true,
-	"BRPOP":        true,
-	"BRPOPLPUSH":   true,
-	"CLIENT":       true,
 	"CONFIG":       true,
-	"DBSIZE":       true,
 	"DEBUG":        true,
-	"DISCARD":      true,
-	"EXEC":         true,
 	"FLUSHALL":     true,
 	"FLUSHDB":      true,
 	"KEYS":         true,
@@ -156,26 +213,21 @@ var blackList = map[string]bool{
 	"MONITOR":      true,
 	"MOVE":         true,
 	"MSETNX":       true,
-	"MULTI":        true,
 	"OBJECT":       true,
-	"PSUBSCRIBE":   true,
 	"PUBLISH":      true,
-	"PUNSUBSCRIBE": true,
-	"RANDOMKEY":    true,
 	"RENAME":       true,
 	"RENAMENX":     true,
 	"SAVE":         true,
-	"SCAN":         true,
 	"SSCAN":        true,
 	"HSCAN":        true,
 	"ZSCAN":        true,
-	"SCRIPT":       true,
 	"SHUTDOWN":     true,
 	"SLAVEOF":      true,
 	"SLOWLOG":      true,
 	"SORT":         true,
-	"SUBSCRIBE":    true,
 	"SYNC":         true,
+	"PSYNC":        true,
+	"REPLCONF":     true,
 	"SDIFF":        true,
 	"SDIFFSTORE":   true,
 	"SINTER":       true,
@@ -184,9 +236,528 @@ var blackList = map[string]bool{
 	"SUNION":       true,
 	"SUNIONSTORE":  true,
 	"TIME":         true,
-	"UNSUBSCRIBE":  true,
-	"UNWATCH":      true,
-	"WATCH":        true,
 	"ZUNIONSTORE":  true,
 	"ZINTERSTORE":  true,
 }
+
+// 发出之后连接就变成了复制流, 不能再当普通命令连接用
+var replicationCommands = map[string]bool{
+	"SYNC":     true,
+	"PSYNC":    true,
+	"REPLCONF": true,
+}
+
+// 不按 key 路由的命令
+var routePolicies = map[string]RoutePolicy{
+	"RANDOMKEY": RouteAnyNode,
+	"PUBLISH":   RouteAnyNode,
+	"PUBSUB":    RouteAnyNode,
+	"CLUSTER":   RouteAnyNode,
+	"SCRIPT":    RouteAllMasters,
+	"DBSIZE":    RouteAllMasters,
+	"KEYS":      RouteAllMasters,
+	"FLUSHALL":  RouteAllMasters,
+	"FLUSHDB":   RouteAllMasters,
+}
+
+const (
+	CF_Read = 1 << iota
+	CF_Write
+	CF_Admin
+)
+
+// 命令读写分类, 用于选择 master/slave 以及权限控制
+var cmdFlags = map[string]int{
+	// connection
+	"PING":   0,
+	"QUIT":   0,
+	"SELECT": 0,
+	"HELLO":  0,
+	"AUTH":   0,
+	"WAIT":   0,
+	"PROXY":  CF_Admin,
+	// transaction
+	"MULTI":   0,
+	"EXEC":    0,
+	"DISCARD": 0,
+	"WATCH":   CF_Read,
+	"UNWATCH": 0,
+	// pubsub
+	"SUBSCRIBE":    0,
+	"UNSUBSCRIBE":  0,
+	"PSUBSCRIBE":   0,
+	"PUNSUBSCRIBE": 0,
+	// key
+	"DEL":       CF_Write,
+	"TYPE":      CF_Read,
+	"EXISTS":    CF_Read,
+	"EXPIRE":    CF_Write,
+	"EXPIREAT":  CF_Write,
+	"TTL":       CF_Read,
+	"PTTL":      CF_Read,
+	"PERSIST":   CF_Write,
+	"PEXPIRE":   CF_Write,
+	"PEXPIREAT": CF_Write,
+	"RENAME":    CF_Write,
+	"RENAMENX":  CF_Write,
+	"DUMP":      CF_Read,
+	"RESTORE":   CF_Write,
+	"MOVE":      CF_Write,
+	"SORT":      CF_Write,
+	"KEYS":      CF_Read,
+	"SCAN":      CF_Read,
+	"RANDOMKEY": CF_Read,
+	// bit
+	"SETBIT":      CF_Write,
+	"BITCOUNT":    CF_Read,
+	"GETBIT":      CF_Read,
+	"BITOP":       CF_Write,
+	"BITFIELD":    CF_Write,
+	"BITFIELD_RO": CF_Read,
+	// string
+	"GET":         CF_Read,
+	"MGET":        CF_Read,
+	"GETRANGE":    CF_Read,
+	"GETSET":      CF_Write,
+	"GETDEL":      CF_Write,
+	"GETEX":       CF_Write, // read only without options, see IsWriteRequest
+	"SET":         CF_Write,
+	"MSET":        CF_Write,
+	"MSETNX":      CF_Write,
+	"SETEX":       CF_Write,
+	"SETNX":       CF_Write,
+	"PSETEX":      CF_Write,
+	"SETRANGE":    CF_Write,
+	"STRLEN":      CF_Read,
+	"INCR":        CF_Write,
+	"DECR":        CF_Write,
+	"INCRBY":      CF_Write,
+	"DECRBY":      CF_Write,
+	"INCRBYFLOAT": CF_Write,
+	"APPEND":      CF_Write,
+	// hash
+	"HGET":         CF_Read,
+	"HSET":         CF_Write,
+	"HMGET":        CF_Read,
+	"HMSET":        CF_Write,
+	"HGETALL":      CF_Read,
+	"HLEN":         CF_Read,
+	"HDEL":         CF_Write,
+	"HEXISTS":      CF_Read,
+	"HINCRBY":      CF_Write,
+	"HINCRBYFLOAT": CF_Write,
+	"HKEYS":        CF_Read,
+	"HSETNX":       CF_Write,
+	"HVALS":        CF_Read,
+	"HRANDFIELD":   CF_Read,
+	"HEXPIRE":      CF_Write,
+	"HPEXPIRE":     CF_Write,
+	"HEXPIREAT":    CF_Write,
+	"HPEXPIREAT":   CF_Write,
+	"HTTL":         CF_Read,
+	"HPTTL":        CF_Read,
+	"HEXPIRETIME":  CF_Read,
+	"HPEXPIRETIME": CF_Read,
+	"HPERSIST":     CF_Write,
+	"HSCAN":        CF_Read,
+	// set
+	"SADD":        CF_Write,
+	"SCARD":       CF_Read,
+	"SISMEMBER":   CF_Read,
+	"SMEMBERS":    CF_Read,
+	"SREM":        CF_Write,
+	"SPOP":        CF_Write,
+	"SRANDMEMBER": CF_Read,
+	"SMOVE":       CF_Write,
+	"SDIFF":       CF_Read,
+	"SDIFFSTORE":  CF_Write,
+	"SINTER":      CF_Read,
+	"SINTERSTORE": CF_Write,
+	"SUNION":      CF_Read,
+	"SUNIONSTORE": CF_Write,
+	"SSCAN":       CF_Read,
+	// list
+	"LPUSH":      CF_Write,
+	"RPUSH":      CF_Write,
+	"LPOP":       CF_Write,
+	"RPOP":       CF_Write,
+	"LINDEX":     CF_Read,
+	"LINSERT":    CF_Write,
+	"LTRIM":      CF_Write,
+	"LRANGE":     CF_Read,
+	"LLEN":       CF_Read,
+	"LPUSHX":     CF_Write,
+	"RPUSHX":     CF_Write,
+	"LSET":       CF_Write,
+	"LREM":       CF_Write,
+	"BLPOP":      CF_Write,
+	"BRPOP":      CF_Write,
+	"BRPOPLPUSH": CF_Write,
+	"BLMOVE":     CF_Write,
+	"EVAL":       CF_Write,
+	"EVALSHA":    CF_Write,
+	// zset
+	"ZADD":             CF_Write,
+	"ZCARD":            CF_Read,
+	"ZCOUNT":           CF_Read,
+	"ZRANK":            CF_Read,
+	"ZREVRANK":         CF_Read,
+	"ZRANGE":           CF_Read,
+	"ZREVRANGE":        CF_Read,
+	"ZRANGEBYSCORE":    CF_Read,
+	"ZREVRANGEBYSCORE": CF_Read,
+	"ZREM":             CF_Write,
+	"ZREMRANGEBYRANK":  CF_Write,
+	"ZREMRANGEBYSCORE": CF_Write,
+	"ZINCRBY":          CF_Write,
+	"ZSCORE":           CF_Read,
+	"ZRANGEBYLEX":      CF_Read,
+	"ZLEXCOUNT":        CF_Read,
+	"ZREMRANGEBYLEX":   CF_Write,
+	"ZUNIONSTORE":      CF_Write,
+	"ZINTERSTORE":      CF_Write,
+	"ZSCAN":            CF_Read,
+
+	// geo, GEORADIUS 只有带 STORE 时才是写, 见 IsWriteRequest
+	"GEOADD":               CF_Write,
+	"GEODIST":              CF_Read,
+	"GEOHASH":              CF_Read,
+	"GEOPOS":               CF_Read,
+	"GEORADIUS":            CF_Write,
+	"GEORADIUS_RO":         CF_Read,
+	"GEORADIUSBYMEMBER":    CF_Write,
+	"GEORADIUSBYMEMBER_RO": CF_Read,
+	"GEOSEARCH":            CF_Read,
+	"GEOSEARCHSTORE":       CF_Write,
+
+	//finite zset
+	"XADD":        CF_Write,
+	"XINCRBY":     CF_Write,
+	"XRANGE":      CF_Read,
+	"XREVRANGE":   CF_Read,
+	"XSCORE":      CF_Read,
+	"XREM":        CF_Write,
+	"XCARD":       CF_Read,
+	"XSETOPTIONS": CF_Write,
+	"XGETFINITY":  CF_Read,
+	"XGETPRUNING": CF_Read,
+	// server
+	"ACL":          CF_Admin,
+	"BGREWRITEAOF": CF_Admin,
+	"BGSAVE":       CF_Admin,
+	"CLIENT":       CF_Admin,
+	"CLUSTER":      CF_Admin,
+	"CONFIG":       CF_Admin,
+	"DBSIZE":       CF_Read,
+	"DEBUG":        CF_Admin,
+	"FLUSHALL":     CF_Write | CF_Admin,
+	"FLUSHDB":      CF_Write | CF_Admin,
+	"INFO":         CF_Admin,
+	"LASTSAVE":     CF_Admin,
+	"MONITOR":      CF_Admin,
+	"SAVE":         CF_Admin,
+	"SCRIPT":       CF_Admin,
+	"SHUTDOWN":     CF_Admin,
+	"SLAVEOF":      CF_Admin,
+	"SLOWLOG":      CF_Admin,
+	"SYNC":         CF_Admin,
+	"PSYNC":        CF_Admin,
+	"REPLCONF":     CF_Admin,
+	"TIME":         0,
+}
+
+const (
+	KI_First = iota
+	KI_Last
+	KI_Step
+)
+
+// key 在命令参数中的位置: 第一个 key, 最后一个 key, 步长
+// 最后一个 key 为负数时从末尾倒数, -1 表示最后一个参数
+var keySpecs = map[string][]int{
+	// transaction
+	"WATCH": []int{1, -1, 1},
+	// key
+	"DEL":       []int{1, -1, 1},
+	"TYPE":      []int{1, 1, 1},
+	"EXISTS":    []int{1, -1, 1},
+	"EXPIRE":    []int{1, 1, 1},
+	"EXPIREAT":  []int{1, 1, 1},
+	"TTL":       []int{1, 1, 1},
+	"PTTL":      []int{1, 1, 1},
+	"PERSIST":   []int{1, 1, 1},
+	"PEXPIRE":   []int{1, 1, 1},
+	"PEXPIREAT": []int{1, 1, 1},
+	"RENAME":    []int{1, 2, 1},
+	"RENAMENX":  []int{1, 2, 1},
+	"DUMP":      []int{1, 1, 1},
+	"RESTORE":   []int{1, 1, 1},
+	"MOVE":      []int{1, 1, 1},
+	"SORT":      []int{1, 1, 1},
+	"UNLINK":    []int{1, -1, 1},
+	"TOUCH":     []int{1, -1, 1},
+	"COPY":      []int{1, 2, 1},
+	// OBJECT ENCODING key
+	"OBJECT":      []int{2, 2, 1},
+	"EXPIRETIME":  []int{1, 1, 1},
+	"PEXPIRETIME": []int{1, 1, 1},
+	// bit
+	"SETBIT":      []int{1, 1, 1},
+	"BITCOUNT":    []int{1, 1, 1},
+	"GETBIT":      []int{1, 1, 1},
+	"BITOP":       []int{2, -1, 1},
+	"BITFIELD":    []int{1, 1, 1},
+	"BITFIELD_RO": []int{1, 1, 1},
+	// string
+	"GET":         []int{1, 1, 1},
+	"MGET":        []int{1, -1, 1},
+	"GETRANGE":    []int{1, 1, 1},
+	"GETSET":      []int{1, 1, 1},
+	"GETDEL":      []int{1, 1, 1},
+	"GETEX":       []int{1, 1, 1},
+	"SET":         []int{1, 1, 1},
+	"MSET":        []int{1, -1, 2},
+	"MSETNX":      []int{1, -1, 2},
+	"SETEX":       []int{1, 1, 1},
+	"SETNX":       []int{1, 1, 1},
+	"PSETEX":      []int{1, 1, 1},
+	"SETRANGE":    []int{1, 1, 1},
+	"STRLEN":      []int{1, 1, 1},
+	"INCR":        []int{1, 1, 1},
+	"DECR":        []int{1, 1, 1},
+	"INCRBY":      []int{1, 1, 1},
+	"DECRBY":      []int{1, 1, 1},
+	"INCRBYFLOAT": []int{1, 1, 1},
+	"APPEND":      []int{1, 1, 1},
+	"SUBSTR":      []int{1, 1, 1},
+	"LCS":         []int{1, 2, 1},
+	// hyperloglog
+	"PFADD":   []int{1, 1, 1},
+	"PFCOUNT": []int{1, -1, 1},
+	"PFMERGE": []int{1, -1, 1},
+	// hash
+	"HGET":         []int{1, 1, 1},
+	"HSET":         []int{1, 1, 1},
+	"HMGET":        []int{1, 1, 1},
+	"HMSET":        []int{1, 1, 1},
+	"HGETALL":      []int{1, 1, 1},
+	"HLEN":         []int{1, 1, 1},
+	"HDEL":         []int{1, 1, 1},
+	"HEXISTS":      []int{1, 1, 1},
+	"HINCRBY":      []int{1, 1, 1},
+	"HINCRBYFLOAT": []int{1, 1, 1},
+	"HKEYS":        []int{1, 1, 1},
+	"HSETNX":       []int{1, 1, 1},
+	"HVALS":        []int{1, 1, 1},
+	"HRANDFIELD":   []int{1, 1, 1},
+	// FIELDS 后面是 field, 不是 key
+	"HEXPIRE":      []int{1, 1, 1},
+	"HPEXPIRE":     []int{1, 1, 1},
+	"HEXPIREAT":    []int{1, 1, 1},
+	"HPEXPIREAT":   []int{1, 1, 1},
+	"HTTL":         []int{1, 1, 1},
+	"HPTTL":        []int{1, 1, 1},
+	"HEXPIRETIME":  []int{1, 1, 1},
+	"HPEXPIRETIME": []int{1, 1, 1},
+	"HPERSIST":     []int{1, 1, 1},
+	"HSCAN":        []int{1, 1, 1},
+	"HSTRLEN":      []int{1, 1, 1},
+	// set
+	"SADD":        []int{1, 1, 1},
+	"SCARD":       []int{1, 1, 1},
+	"SISMEMBER":   []int{1, 1, 1},
+	"SMEMBERS":    []int{1, 1, 1},
+	"SREM":        []int{1, 1, 1},
+	"SPOP":        []int{1, 1, 1},
+	"SRANDMEMBER": []int{1, 1, 1},
+	"SMOVE":       []int{1, 2, 1},
+	"SDIFF":       []int{1, -1, 1},
+	"SDIFFSTORE":  []int{1, -1, 1},
+	"SINTER":      []int{1, -1, 1},
+	"SINTERSTORE": []int{1, -1, 1},
+	"SUNION":      []int{1, -1, 1},
+	"SUNIONSTORE": []int{1, -1, 1},
+	"SSCAN":       []int{1, 1, 1},
+	"SMISMEMBER":  []int{1, 1, 1},
+	// list
+	"LPUSH":      []int{1, 1, 1},
+	"RPUSH":      []int{1, 1, 1},
+	"LPOP":       []int{1, 1, 1},
+	"RPOP":       []int{1, 1, 1},
+	"LINDEX":     []int{1, 1, 1},
+	"LINSERT":    []int{1, 1, 1},
+	"LTRIM":      []int{1, 1, 1},
+	"LRANGE":     []int{1, 1, 1},
+	"LLEN":       []int{1, 1, 1},
+	"LPUSHX":     []int{1, 1, 1},
+	"RPUSHX":     []int{1, 1, 1},
+	"LSET":       []int{1, 1, 1},
+	"LREM":       []int{1, 1, 1},
+	"BLPOP":      []int{1, -2, 1},
+	"BRPOP":      []int{1, -2, 1},
+	"BRPOPLPUSH": []int{1, 2, 1},
+	"BLMOVE":     []int{1, 2, 1},
+	"LMOVE":      []int{1, 2, 1},
+	"RPOPLPUSH":  []int{1, 2, 1},
+	"LPOS":       []int{1, 1, 1},
+	// zset
+	"ZADD":             []int{1, 1, 1},
+	"ZCARD":            []int{1, 1, 1},
+	"ZCOUNT":           []int{1, 1, 1},
+	"ZRANK":            []int{1, 1, 1},
+	"ZREVRANK":         []int{1, 1, 1},
+	"ZRANGE":           []int{1, 1, 1},
+	"ZREVRANGE":        []int{1, 1, 1},
+	"ZRANGEBYSCORE":    []int{1, 1, 1},
+	"ZREVRANGEBYSCORE": []int{1, 1, 1},
+	"ZREM":             []int{1, 1, 1},
+	"ZREMRANGEBYRANK":  []int{1, 1, 1},
+	"ZREMRANGEBYSCORE": []int{1, 1, 1},
+	"ZINCRBY":          []int{1, 1, 1},
+	"ZSCORE":           []int{1, 1, 1},
+	"ZRANGEBYLEX":      []int{1, 1, 1},
+	"ZLEXCOUNT":        []int{1, 1, 1},
+	"ZREMRANGEBYLEX":   []int{1, 1, 1},
+	"ZSCAN":            []int{1, 1, 1},
+	"ZREVRANGEBYLEX":   []int{1, 1, 1},
+	"ZPOPMIN":          []int{1, 1, 1},
+	"ZPOPMAX":          []int{1, 1, 1},
+	"BZPOPMIN":         []int{1, -2, 1},
+	"BZPOPMAX":         []int{1, -2, 1},
+	"ZRANDMEMBER":      []int{1, 1, 1},
+	"ZMSCORE":          []int{1, 1, 1},
+	"ZRANGESTORE":      []int{1, 2, 1},
+	// 目标 key, 源 key 见 numKeysSpecs
+	"ZUNIONSTORE": []int{1, 1, 1},
+	"ZINTERSTORE": []int{1, 1, 1},
+	"ZDIFFSTORE":  []int{1, 1, 1},
+	// geo, GEORADIUS 的 STORE key 见 keywordKeySpecs
+	"GEOADD":               []int{1, 1, 1},
+	"GEODIST":              []int{1, 1, 1},
+	"GEOHASH":              []int{1, 1, 1},
+	"GEOPOS":               []int{1, 1, 1},
+	"GEORADIUS":            []int{1, 1, 1},
+	"GEORADIUS_RO":         []int{1, 1, 1},
+	"GEORADIUSBYMEMBER":    []int{1, 1, 1},
+	"GEORADIUSBYMEMBER_RO": []int{1, 1, 1},
+	"GEOSEARCH":            []int{1, 1, 1},
+	"GEOSEARCHSTORE":       []int{1, 2, 1},
+	// stream, XREAD 的 key 见 streamsKeySpecs
+	"XLEN":       []int{1, 1, 1},
+	"XDEL":       []int{1, 1, 1},
+	"XTRIM":      []int{1, 1, 1},
+	"XACK":       []int{1, 1, 1},
+	"XCLAIM":     []int{1, 1, 1},
+	"XAUTOCLAIM": []int{1, 1, 1},
+	"XPENDING":   []int{1, 1, 1},
+	// XGROUP CREATE key, XINFO STREAM key
+	"XGROUP": []int{2, 2, 1},
+	"XINFO":  []int{2, 2, 1},
+	//finite zset
+	"XADD":        []int{1, 1, 1},
+	"XINCRBY":     []int{1, 1, 1},
+	"XRANGE":      []int{1, 1, 1},
+	"XREVRANGE":   []int{1, 1, 1},
+	"XSCORE":      []int{1, 1, 1},
+	"XREM":        []int{1, 1, 1},
+	"XCARD":       []int{1, 1, 1},
+	"XSETOPTIONS": []int{1, 1, 1},
+	"XGETFINITY":  []int{1, 1, 1},
+	"XGETPRUNING": []int{1, 1, 1},
+}
+
+// numkeys 参数的位置, key 紧跟在 numkeys 之后
+// 比如 EVAL script numkeys key [key ...] arg [arg ...]
+var numKeysSpecs = map[string]int{
+	"EVAL":        2,
+	"EVALSHA":     2,
+	"EVAL_RO":     2,
+	"EVALSHA_RO":  2,
+	"FCALL":       2,
+	"FCALL_RO":    2,
+	"ZUNIONSTORE": 2,
+	"ZINTERSTORE": 2,
+	"ZDIFFSTORE":  2,
+	"ZUNION":      1,
+	"ZINTER":      1,
+	"ZDIFF":       1,
+	"ZINTERCARD":  1,
+	"SINTERCARD":  1,
+	"LMPOP":       1,
+	"ZMPOP":       1,
+	"BLMPOP":      2,
+	"BZMPOP":      2,
+}
+
+// XREAD [COUNT count] [BLOCK ms] STREAMS key [key ...] id [id ...]
+// 从这个位置开始找 STREAMS, 之后的参数前一半是 key
+var streamsKeySpecs = map[string]int{
+	"XREAD":      1,
+	"XREADGROUP": 4,
+}
+
+// 选项关键字后面的一个参数是 key, 从 From 开始找关键字
+// 比如 GEORADIUS key longitude latitude radius unit [STORE key] [STOREDIST key]
+type keywordKeySpec struct {
+	From     int
+	Keywords []string // upper case
+}
+
+var keywordKeySpecs = map[string]keywordKeySpec{
+	"GEORADIUS":         {6, []string{"STORE", "STOREDIST"}},
+	"GEORADIUSBYMEMBER": {5, []string{"STORE", "STOREDIST"}},
+}
+
+const (
+	BT_Pos  = iota // timeout 参数的位置, 负数时从末尾倒数
+	BT_Unit        // 1 秒, 1000 毫秒
+)
+
+// 阻塞命令的 timeout 参数, 0 表示永远阻塞
+var blockTimeouts = map[string][]int{
+	"BLPOP":      []int{-1, 1},
+	"BRPOP":      []int{-1, 1},
+	"BRPOPLPUSH": []int{-1, 1},
+	"BLMOVE":     []int{-1, 1},
+	"BZPOPMIN":   []int{-1, 1},
+	"BZPOPMAX":   []int{-1, 1},
+	"BLMPOP":     []int{1, 1},
+	"BZMPOP":     []int{1, 1},
+	"WAIT":       []int{-1, 1000},
+}
+
+// pub/sub 命令中 channel/pattern 的位置, 格式同 keySpecs
+// PUBSUB 的位置跟子命令有关, 用 "PUBSUB 子命令" 做 key
+var channelSpecs = map[string][]int{
+	"PUBLISH":              []int{1, 1, 1},
+	"SUBSCRIBE":            []int{1, -1, 1},
+	"UNSUBSCRIBE":          []int{1, -1, 1},
+	"PSUBSCRIBE":           []int{1, -1, 1},
+	"PUNSUBSCRIBE":         []int{1, -1, 1},
+	"SPUBLISH":             []int{1, 1, 1},
+	"SSUBSCRIBE":           []int{1, -1, 1},
+	"SUNSUBSCRIBE":         []int{1, -1, 1},
+	"PUBSUB CHANNELS":      []int{2, 2, 1},
+	"PUBSUB NUMSUB":        []int{2, -1, 1},
+	"PUBSUB SHARDCHANNELS": []int{2, 2, 1},
+	"PUBSUB SHARDNUMSUB":   []int{2, -1, 1},
+}
+
+// COMMAND GETKEYSANDFLAGS 返回的 key 访问标记, 不在表里的命令
+// 读命令是 RO access, 写命令是 RW access update
+var keyFlags = map[string][]string{
+	"DEL":    []string{"RM", "delete"},
+	"UNLINK": []string{"RM", "delete"},
+	"GETDEL": []string{"RW", "access", "delete"},
+	"GETEX":  []string{"RW", "access", "update"},
+	"MSET":   []string{"OW", "update"},
+	"SETEX":  []string{"OW", "update"},
+	"PSETEX": []string{"OW", "update"},
+	"APPEND": []string{"RW", "insert"},
+	"LPUSH":  []string{"RW", "insert"},
+	"RPUSH":  []string{"RW", "insert"},
+	"SADD":   []string{"RW", "insert"},
+	"ZADD":   []string{"RW", "update"},
+	"HSET":   []string{"RW", "update"},
+	"EXPIRE": []string{"RW", "update"},
+}
@@ -0,0 +1,156 @@
+package archer
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// ScriptCache keeps the bodies of the scripts seen by EVAL and SCRIPT LOAD
+// by their SHA1, so EVALSHA still works on a master which never loaded the
+// script or lost it in a restart or failover. The zero value is ready to use
+type ScriptCache struct {
+	mu      sync.RWMutex
+	scripts map[string][]byte
+}
+
+// ScriptSHA returns the SHA1 of body in lower case hex, like redis does
+func ScriptSHA(body []byte) string {
+	sum := sha1.Sum(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Add caches body and returns its SHA1
+func (sc *ScriptCache) Add(body []byte) string {
+	sha := ScriptSHA(body)
+	sc.mu.Lock()
+	if sc.scripts == nil {
+		sc.scripts = make(map[string][]byte)
+	}
+	if _, ok := sc.scripts[sha]; !ok {
+		// body may be a slice of a pooled request
+		sc.scripts[sha] = append([]byte(nil), body...)
+	}
+	sc.mu.Unlock()
+	return sha
+}
+
+// Get returns the body of the script sha, case insensitive like EVALSHA
+func (sc *ScriptCache) Get(sha string) ([]byte, bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	body, ok := sc.scripts[strings.ToLower(sha)]
+	return body, ok
+}
+
+// Flush forgets every script
+func (sc *ScriptCache) Flush() {
+	sc.mu.Lock()
+	sc.scripts = nil
+	sc.mu.Unlock()
+}
+
+// IsNoScript reports whether r is the NOSCRIPT error of EVALSHA
+func IsNoScript(r Resp) bool {
+	er, ok := r.(*ErrorResp)
+	return ok && strings.HasPrefix(er.Error(), "NOSCRIPT")
+}
+
+// evalOf turns EVALSHA sha numkeys ... into EVAL body numkeys ...,
+// req is left untouched
+func evalOf(req *ArrayResp, body []byte) *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Args = make([]*BulkResp, 0, len(req.Args))
+	ar.Args = append(ar.Args, NewBulkResp([]byte("EVAL")), NewBulkResp(body))
+	ar.Args = append(ar.Args, req.Args[2:]...)
+	return ar
+}
+
+// EVAL handles EVAL and EVALSHA. The keys declared by numkeys must hash
+// to one slot, the script runs on the node of that slot. EVAL bodies are
+// cached by the proxy, an EVALSHA answered NOSCRIPT is retried as EVAL
+// when the proxy knows the script, so the client never sees the miss
+func (s *Session) EVAL(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	if keys := CommandKeys(req); len(keys) > 0 {
+		if _, err := keysSlot(s.p.conf(), keys); err != nil {
+			s.reply(WrappedErrorResp([]byte(err.Error()), seq))
+			return
+		}
+	}
+
+	name := cmdName(req)
+	arg, _ := req.Arg(1)
+	if name == "EVAL" {
+		s.p.scripts.Add(arg)
+	}
+
+	sp := s.span(seq)
+	resp, err := s.ExecWithRedirect(req, true, sp)
+	if err == nil && name == "EVALSHA" && IsNoScript(resp) {
+		if body, ok := s.p.scripts.Get(string(arg)); ok {
+			resp, err = s.ExecWithRedirect(evalOf(req, body), true, sp)
+		}
+	}
+	if err != nil {
+		s.reply(WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq))
+		return
+	}
+	s.reply(WrappedResp(resp, seq))
+}
+
+// SCRIPT handles the subcommands which make sense for a cluster:
+// LOAD loads the script on every master and caches it, EXISTS answers
+// from the cache since the proxy can run a cached script anywhere, FLUSH
+// empties the cache and every master. KILL and DEBUG target one node and
+// are rejected
+func (s *Session) SCRIPT(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	sub, _ := req.Arg(1)
+	switch strings.ToUpper(string(sub)) {
+	case "LOAD":
+		if len(req.Args) != 3 {
+			s.reply(WrappedErrorResp([]byte("ERR wrong number of arguments for 'script|load' command"), seq))
+			return
+		}
+		if er := firstError(s.execOnMasters(req)); er != nil {
+			s.reply(WrappedResp(er, seq))
+			return
+		}
+		body, _ := req.Arg(2)
+		s.reply(WrappedResp(NewBulkResp([]byte(s.p.scripts.Add(body))), seq))
+	case "EXISTS":
+		if len(req.Args) < 3 {
+			s.reply(WrappedErrorResp([]byte("ERR wrong number of arguments for 'script|exists' command"), seq))
+			return
+		}
+		ar := &ArrayResp{}
+		ar.Rtype = ArrayType
+		for i := 2; i < len(req.Args); i++ {
+			sha, _ := req.Arg(i)
+			exists := int64(0)
+			if _, ok := s.p.scripts.Get(string(sha)); ok {
+				exists = 1
+			}
+			ar.append(NewIntResp(exists))
+		}
+		s.reply(WrappedResp(ar, seq))
+	case "FLUSH":
+		s.p.scripts.Flush()
+		if er := firstError(s.execOnMasters(req)); er != nil {
+			s.reply(WrappedResp(er, seq))
+			return
+		}
+		s.reply(WrappedOKResp(seq))
+	default:
+		s.reply(WrappedResp(NewErrorRespf("ERR SCRIPT %s is not supported by proxy", sub), seq))
+	}
+}
@@ -0,0 +1,87 @@
+package archer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScriptKeys(t *testing.T) {
+	cases := []struct {
+		args []string
+		keys []string
+	}{
+		{[]string{"EVAL", "return 1", "0"}, nil},
+		{[]string{"EVAL", "return 1", "2", "{a}1", "{a}2", "arg"}, []string{"{a}1", "{a}2"}},
+		{[]string{"EVALSHA", "abc", "1", "k"}, []string{"k"}},
+		{[]string{"EVAL", "return 1", "3", "k"}, nil},
+		{[]string{"EVAL", "return 1", "x", "k"}, nil},
+	}
+	for _, c := range cases {
+		keys := CommandKeys(newCommand(c.args...))
+		if len(keys) != len(c.keys) {
+			t.Fatalf("%v keys %q, want %q", c.args, keys, c.keys)
+		}
+		for i := range keys {
+			if string(keys[i]) != c.keys[i] {
+				t.Fatalf("%v keys %q, want %q", c.args, keys, c.keys)
+			}
+		}
+	}
+
+	ar := newCommand("EVAL", "return 1", "1", "k", "v")
+	if !RewriteKeys(ar, []byte("t:")) || ar.String() != "EVAL return 1 1 t:k v" {
+		t.Fatalf("RewriteKeys got %s", ar.String())
+	}
+}
+
+func TestSessionScripts(t *testing.T) {
+	body := "return redis.call('get', KEYS[1])"
+	sha := ScriptSHA([]byte(body))
+	replies := map[string]string{
+		"SCRIPT LOAD " + body:        "$40\r\n" + sha + "\r\n",
+		"SCRIPT FLUSH":               "+OK\r\n",
+		"EVALSHA " + sha + " 1 {a}k": "-NOSCRIPT No matching script. Please use EVAL.\r\n",
+		"EVAL " + body + " 1 {a}k":   "$1\r\nv\r\n",
+	}
+	a, la := fakeMaster(t, replies)
+	defer la.Close()
+	b, lb := fakeMaster(t, replies)
+	defer lb.Close()
+
+	pc := &ProxyConfig{conCurrency: 5, dialTimeout: time.Second, readTimeout: time.Second, poolSize: 2}
+	s := newTestSession(pc)
+	s.p.cluster = testCluster(pc, a, b)
+	s.conCurrency = make(chan int, 5)
+	exec := func(f func(*ArrayResp, int64), args ...string) string {
+		f(newCommand(args...), 0)
+		<-s.conCurrency
+		return encodeResp(t, (<-s.resps).resp)
+	}
+
+	// the proxy doesn't know the script yet, NOSCRIPT goes to the client
+	if got := exec(s.EVAL, "EVALSHA", sha, "1", "{a}k"); got[0] != '-' {
+		t.Fatalf("EVALSHA unknown script got %q", got)
+	}
+	if got := exec(s.SCRIPT, "SCRIPT", "LOAD", body); got != "$40\r\n"+sha+"\r\n" {
+		t.Fatalf("SCRIPT LOAD got %q", got)
+	}
+	if got := exec(s.SCRIPT, "SCRIPT", "EXISTS", sha, "ffff"); got != "*2\r\n:1\r\n:0\r\n" {
+		t.Fatalf("SCRIPT EXISTS got %q", got)
+	}
+	// the master replies NOSCRIPT, the proxy retries with EVAL
+	if got := exec(s.EVAL, "EVALSHA", sha, "1", "{a}k"); got != "$1\r\nv\r\n" {
+		t.Fatalf("EVALSHA fallback got %q", got)
+	}
+	if got := exec(s.EVAL, "EVAL", body, "2", "{a}k", "{b}k"); got != "-"+CrossSlotError.Error()+"\r\n" {
+		t.Fatalf("EVAL cross slot got %q", got)
+	}
+	if got := exec(s.SCRIPT, "SCRIPT", "FLUSH"); got != "+OK\r\n" {
+		t.Fatalf("SCRIPT FLUSH got %q", got)
+	}
+	if _, ok := s.p.scripts.Get(sha); ok {
+		t.Fatal("script cached after SCRIPT FLUSH")
+	}
+	if got := exec(s.SCRIPT, "SCRIPT", "KILL"); got[0] != '-' {
+		t.Fatalf("SCRIPT KILL got %q", got)
+	}
+}
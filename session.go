@@ -2,6 +2,7 @@ package archer
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -10,9 +11,8 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/dongzerun/archer/hack"
+	log "github.com/dongzerun/archer/logging"
 	"github.com/dongzerun/archer/util"
-	log "github.com/ngaut/logging"
 )
 
 type SessMana struct {
@@ -20,13 +20,13 @@ type SessMana struct {
 
 	pool map[string]*Session // Session Map
 
-	idle time.Duration // 超时时长
+	idle int64 // 超时时长 time.Duration, 原子读写, Reload 会修改
 }
 
 func newSessMana(t time.Duration) *SessMana {
 	sm := &SessMana{
 		pool: make(map[string]*Session, 4096),
-		idle: t,
+		idle: int64(t),
 	}
 	go sm.CheckIdleLoop()
 	return sm
@@ -44,29 +44,59 @@ func (sm *SessMana) Del(remote string, s *Session) {
 	delete(sm.pool, remote)
 }
 
+// Sessions returns the sessions open now
+func (sm *SessMana) Sessions() []*Session {
+	sm.l.Lock()
+	defer sm.l.Unlock()
+	ss := make([]*Session, 0, len(sm.pool))
+	for _, s := range sm.pool {
+		ss = append(ss, s)
+	}
+	return ss
+}
+
+// SetIdle changes the idle timeout of clients
+func (sm *SessMana) SetIdle(t time.Duration) {
+	atomic.StoreInt64(&sm.idle, int64(t))
+}
+
+// CheckIdleLoop 检查空闲客户端的间隔
+const idleCheckInterval = time.Second
+
 func (sm *SessMana) CheckIdleLoop() {
-	ticker := time.NewTicker(time.Minute)
+	ticker := time.NewTicker(idleCheckInterval)
 	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			for id, s := range sm.pool {
-				if sm.idle > 0 && time.Since(s.lastUsed) > sm.idle {
-					sm.l.Lock()
-					delete(sm.pool, id)
-					sm.l.Unlock()
-					log.Infof("client %s idle timeout quit", id)
-					s.Close()
-				}
+	for range ticker.C {
+		idle := time.Duration(atomic.LoadInt64(&sm.idle))
+		if idle <= 0 {
+			continue
+		}
+		now := time.Now()
+		for _, s := range sm.Sessions() {
+			if s.idle(now) > idle {
+				sm.Del(s.remote, s)
+				log.Infof("client %s idle timeout quit", s.remote)
+				s.Close()
 			}
 		}
 	}
 }
 
+// idle returns how long s has been silent at now, 0 for a client that
+// subscribed or waits for replies, e.g. to a BLPOP, like redis
+func (s *Session) idle(now time.Time) time.Duration {
+	if atomic.LoadInt32(&s.pubsub) == 1 || atomic.LoadInt64(&s.reqSequence) > atomic.LoadInt64(&s.flushedSequence) {
+		return 0
+	}
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastUsed)))
+}
+
 // for pipeline wrap Req and Resp with Sequence
 type wrappedResp struct {
 	seq  int64 // Session 级别的自增64位ID
 	resp Resp  // Redis 协议结果
+	size int64 // 计入 replyBudget 的字节数
+	push bool  // 带外的 pub/sub 消息, 前 seq 个回复写出之后再写
 }
 
 type Session struct {
@@ -78,75 +108,175 @@ type Session struct {
 	resps chan *wrappedResp
 	cmds  chan *wrappedResp
 	//out-of-order store temporary
-	ooo map[int64]Resp
+	ooo map[int64]*wrappedResp
+	// pub/sub pushes waiting for the replies before them
+	pushes []*wrappedResp
+	// bytes of replies waiting to be written
+	budget *replyBudget
+	// parser limits of the commands and of the backend replies
+	limits ParserLimits
 
 	conCurrency chan int
 
 	quitChan chan int
-	closed   bool
+	closed   int32 // Close 之后为 1, 原子读写, 管理接口和 Shutdown 也会 Close
 	wg       util.WaitGroupWrapper
 
 	// pipeline used seq
-	reqSequence  int64
-	respSequence int64
+	reqSequence     int64
+	respSequence    int64 // replies written to w
+	flushedSequence int64 // replies flushed to the client
 
-	lastUsed time.Time
+	lastUsed int64 // 最后读到命令的时间 UnixNano, 原子读写, 空闲检查用
 	remote   string
+	id       int64 // CLIENT ID, 进程内递增
+	pubsub   int32 // 订阅过之后为 1, 不算空闲
+
+	state *ClientState
+	tx    transaction // MULTI/EXEC, only Dispatch touches it
+	sub   *subscriber // pub/sub backend connection, only Dispatch touches it
+
+	lastWrite []byte // key of the last write, WAIT goes to its master. only Dispatch touches it
+
+	limit *ClientLimit // 客户端的限速额度, nil 表示不限
+	audit int32        // 为 1 时每个命令写一条审计日志, 管理接口可以单独打开
+
+	// 正在处理的命令, 回复写出时记录耗时
+	tl     sync.Mutex
+	traces map[int64]*cmdTrace
+	// 给管理接口看的, 同样由 tl 保护
+	created   time.Time
+	lastCmd   string
+	lastCmdAt time.Time
+	cmdCount  int64
+	// CLIENT SETNAME 和 CLIENT SETINFO, 同样由 tl 保护
+	name    string
+	libName string
+	libVer  string
+
+	// Drain 之后 seq >= drainSeq 的命令直接拒绝, drainReject 为 nil 时不回复
+	drainOnce   sync.Once
+	draining    int32
+	drainSeq    int64
+	drainReject error
 }
 
 func NewSession(p *Proxy, c net.Conn) *Session {
+	pc := p.conf()
 	s := &Session{
 		p: p,
 		c: &util.Conn{Conn: c},
 		//pipeline length 4096
-		cmds:  make(chan *wrappedResp, p.pc.pipeLength),
-		resps: make(chan *wrappedResp, p.pc.pipeLength),
-		//store temporary Resp for Max p.pc.conCurrency
+		cmds:  make(chan *wrappedResp, pc.pipeLength),
+		resps: make(chan *wrappedResp, pc.pipeLength),
+		//store temporary Resp for Max pc.conCurrency
 		//out-of-order store temporary
-		ooo: make(map[int64]Resp, p.pc.conCurrency),
+		ooo:    make(map[int64]*wrappedResp, pc.conCurrency),
+		budget: newReplyBudget(pc.maxPendingBytes),
+		limits: pc.parserLimits(),
 		//max dispatch concurrency goroutine per session
-		conCurrency: make(chan int, p.pc.conCurrency),
+		conCurrency: make(chan int, pc.conCurrency),
 		quitChan:    make(chan int, 1),
-		lastUsed:    time.Now(),
-		remote:      c.RemoteAddr().String(),
+		lastUsed:    time.Now().UnixNano(),
+		created:     time.Now(),
+		id:          atomic.AddInt64(&clientIDs, 1),
+		remote:      clientAddr(c),
+		state:       NewClientState(),
 	}
+	s.state.Authed = !p.requirePass()
+	s.limit = p.limiter.Client(s.remote)
+	s.SetAudit(pc.auditAll)
 
-	if p.pc.readTimeout > 0 {
-		s.c.ReadTimeout = p.pc.readTimeout
+	if pc.readTimeout > 0 {
+		s.c.ReadTimeout = pc.readTimeout
 	}
 
-	if p.pc.writeTimeout > 0 {
-		s.c.WriteTimeout = p.pc.writeTimeout
+	if pc.writeTimeout > 0 {
+		s.c.WriteTimeout = pc.writeTimeout
 	}
 
-	s.w = bufio.NewWriter(s.c)
-	s.r = bufio.NewReader(s.c)
+	s.w = bufio.NewWriter(countingWriter{s.c, &Stats.BytesOut})
+	s.r = bufio.NewReader(countingReader{s.c, &Stats.BytesIn})
 
-	for i := 0; i < p.pc.conCurrency; i++ {
+	for i := 0; i < pc.conCurrency; i++ {
 		s.conCurrency <- 1
 	}
 
 	return s
 }
 
+// 协议错误回复之后最多等这么久再关闭连接
+const protocolErrorLinger = time.Second
+
+// ProtocolErrorResp is the reply to a command failed to parse, redis
+// closes the connection after it
+func ProtocolErrorResp(err error) *ErrorResp {
+	msg := err.Error()
+	switch err {
+	case BulkTooLargeError:
+		msg = "invalid bulk length"
+	case ArrayTooLongError:
+		msg = "invalid multibulk length"
+	case ReplyTooLargeError:
+		msg = "command too large"
+	}
+	if strings.HasPrefix(msg, "ERR Protocol error") {
+		return NewErrorResp([]byte(msg))
+	}
+	return NewErrorRespf("ERR Protocol error: %s", msg)
+}
+
 func (s *Session) ReadLoop() {
-	for !s.closed {
+	for atomic.LoadInt32(&s.closed) == 0 {
 
-		cmd, err := ReadProtocol(s.r)
+		// 采样时从第一个字节到达开始计时, 不算客户端空闲的时间
+		var readStart time.Time
+		if s.p.tracer != nil {
+			s.r.Peek(1)
+			readStart = time.Now()
+		}
+		cmd, err := ReadProtocolWithLimits(s.r, s.limits)
+		if err == RawCmdError {
+			// redis ignores empty inline lines, telnet users hit enter
+			continue
+		}
+		if _, isNet := err.(net.Error); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF && !isNet {
+			// the stream is out of sync, reply the error and close like redis
+			Stats.ParseErrors.Add(1)
+			log.Warningf("%s ReadLoop %s, close the client", s.remote, err)
+			s.reply(WrappedResp(ProtocolErrorResp(err), s.reqSequence))
+			atomic.AddInt64(&s.reqSequence, 1)
+			s.Drain(time.Now().Add(protocolErrorLinger))
+			goto quit
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
 		if err != nil && err != io.EOF {
-			log.Warningf("%s ReadLoop read err: %s", s.c.RemoteAddr().String(), err)
+			log.Warningf("%s ReadLoop read err: %s", s.remote, err)
 			continue
 		}
 		if err == io.EOF {
-			log.Infof("%s ReadLoop read EOF just quit ", s.c.RemoteAddr().String())
+			log.Infof("%s ReadLoop read EOF just quit ", s.remote)
 			s.Close()
 			goto quit
 		}
 
+		atomic.StoreInt64(&s.lastUsed, time.Now().UnixNano())
+		s.traceStart(s.reqSequence, cmd, readStart)
 		s.cmds <- WrappedResp(cmd, s.reqSequence)
-
-		s.lastUsed = time.Now()
 		atomic.AddInt64(&s.reqSequence, 1)
+
+		// delay 模式下超过限速就推迟读取下一条命令
+		if s.p.limiter != nil {
+			if d := s.p.limiter.Delay(s.limit, respSize(cmd)); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-s.quitChan:
+					goto quit
+				}
+			}
+		}
 	}
 quit:
 	log.Warning("quit ReadLoop")
@@ -156,33 +286,181 @@ func (s *Session) Dispatch() {
 	for {
 		select {
 		case c := <-s.cmds:
-			command, err := s.p.filter.Inspect(c.resp)
+			if atomic.LoadInt32(&s.draining) == 1 && c.seq >= atomic.LoadInt64(&s.drainSeq) {
+				if s.drainReject != nil {
+					s.reply(WrappedErrorResp([]byte(s.drainReject.Error()), c.seq))
+				}
+				continue
+			}
+
+			// 管理接口暂停流量时命令在这里等待
+			if ar, ok := c.resp.(*ArrayResp); ok && !s.p.pause.Wait(ar, s.quitChan) {
+				goto quit
+			}
+
+			// reject 模式下超过限速的命令直接回复错误
+			if s.p.limiter != nil {
+				if err := s.p.limiter.Reject(s.limit, respSize(c.resp)); err != nil {
+					s.replyError(err, c.seq)
+					continue
+				}
+			}
+
+			// 屏蔽和改名的命令, 和 redis 一样先于 NOAUTH 检查
+			if ar, ok := c.resp.(*ArrayResp); ok {
+				if err := s.p.conf().policy.Apply(ar); err != nil {
+					s.replyError(err, c.seq)
+					continue
+				}
+			}
+
+			// 密码由代理检查, AUTH/HELLO 不会转发给后端
+			if ar, ok := c.resp.(*ArrayResp); ok && !s.state.Authed && !authFreeCommands[cmdName(ar)] {
+				s.replyError(NoAuthError, c.seq)
+				continue
+			}
+
+			// SHUTDOWN 永远不能转发给后端 redis
+			if ar, ok := c.resp.(*ArrayResp); ok && IsShutdown(ar) {
+				s.Shutdown(c.seq)
+				continue
+			}
+
+			// 复制流命令会把连接变成复制流, 直接拒绝
+			if ar, ok := c.resp.(*ArrayResp); ok && IsReplicationStreamCommand(cmdName(ar)) {
+				s.reply(WrappedErrorResp([]byte(ReplicationForbidden.Error()), c.seq))
+				continue
+			}
+
+			command, err := s.p.currentFilter().Inspect(c.resp)
 			if err != nil {
-				s.resps <- WrappedErrorResp([]byte(err.Error()), c.seq)
+				s.replyError(err, c.seq)
 				continue
 			}
 
 			ar := c.resp.(*ArrayResp)
+			if s.sub != nil {
+				s.state.Subscribed = s.sub.subscribed()
+			}
+			if !s.state.AllowedInSubscribeMode(ar) {
+				s.reply(WrappedResp(SubscribeModeErrorResp(ar), c.seq))
+				continue
+			}
+
+			if acl := s.p.currentACL(); acl != nil && !authFreeCommands[command] {
+				if err := acl.Check(s.state.User, ar); err != nil {
+					s.replyError(err, c.seq)
+					continue
+				}
+			}
+
+			if s.p.hotkeys != nil {
+				for _, key := range CommandKeys(ar) {
+					s.p.hotkeys.Record(key)
+				}
+			}
+
+			if IsWriteRequest(ar) {
+				s.lastWrite = routeKey(ar)
+				s.p.cache.Invalidate(ar)
+			}
+
+			// MULTI 之后的命令在代理排队, EXEC 时一起发给同一个后端连接
+			if command != "QUIT" && (s.state.Tx != TxNone || txCommands[command]) {
+				s.Transaction(ar, command, c.seq)
+				continue
+			}
+
+			// 阻塞命令用单独的后端连接, 不占连接池和会话并发
+			if IsBlockingCommand(command) {
+				s.Block(ar, c.seq)
+				continue
+			}
+
+			// 订阅之后后端连接只推消息, 用会话独占的连接
+			if subscribeCommands[command] {
+				s.Subscribe(ar, command, c.seq)
+				continue
+			}
+
 			switch command {
 			case "PING":
-				s.resps <- WrappedPONGResp(c.seq)
+				if s.state.Subscribed > 0 && s.state.Proto == RESP2 {
+					// RESP2 订阅模式下 PING 回复 pong 消息
+					s.reply(WrappedResp(pubsubResp(RESP2, NewBulkResp([]byte("pong")), NewBulkResp([]byte(""))), c.seq))
+					continue
+				}
+				s.reply(WrappedPONGResp(c.seq))
+				continue
+			case "AUTH":
+				s.Auth(ar, c.seq)
+				continue
+			case "PROXY":
+				s.ProxyCommand(ar, c.seq)
+				continue
+			case "CLIENT":
+				// 后端连接是共享的, CLIENT 由代理回答
+				s.ClientCommand(ar, c.seq)
 				continue
 			case "QUIT":
-				s.resps <- WrappedOKResp(c.seq)
+				s.reply(WrappedOKResp(c.seq))
 				s.Close()
 				goto quit
 			case "SELECT":
-				s.resps <- WrappedOKResp(c.seq)
+				db, ok := ParseSelect(ar)
+				if !ok {
+					s.reply(WrappedErrorResp([]byte("ERR DB index is out of range"), c.seq))
+					continue
+				}
+				if err := s.Select(db); err != nil {
+					s.replyError(err, c.seq)
+					continue
+				}
+				s.reply(WrappedOKResp(c.seq))
+				continue
+			case "HELLO":
+				// 后端连接仍然是 RESP2, RESP2 的回复对 RESP3 客户端同样合法
+				h, err := ParseHello(ar)
+				if err != nil {
+					s.reply(WrappedErrorResp([]byte(err.Error()), c.seq))
+					continue
+				}
+				if h.Auth {
+					if err := s.p.authenticate(h.User, h.Password); err != nil {
+						s.reply(WrappedErrorResp([]byte(err.Error()), c.seq))
+						continue
+					}
+					s.state.User, s.state.Authed = h.User, true
+				} else if !s.state.Authed {
+					s.reply(WrappedErrorResp([]byte(HelloNoAuthError.Error()), c.seq))
+					continue
+				}
+				if h.Proto != 0 {
+					s.state.Proto = h.Proto
+				}
+				s.reply(WrappedResp(HelloResp(s.state.Proto), c.seq))
 				continue
 			case "INFO":
 				//TODO: implement INFO command
-				s.resps <- WrappedOKResp(c.seq)
+				s.reply(WrappedOKResp(c.seq))
 			case "MSET":
 				s.Route(ar, c.seq, "MSET")
 			case "MGET":
 				s.Route(ar, c.seq, "MGET")
 			case "DEL":
 				s.Route(ar, c.seq, "DEL")
+			case "EXISTS":
+				s.Route(ar, c.seq, "EXISTS")
+			case "SCAN":
+				s.Route(ar, c.seq, "SCAN")
+			case "DBSIZE":
+				s.Route(ar, c.seq, "DBSIZE")
+			case "RANDOMKEY":
+				s.Route(ar, c.seq, "RANDOMKEY")
+			case "EVAL", "EVALSHA":
+				s.Route(ar, c.seq, "EVAL")
+			case "SCRIPT":
+				s.Route(ar, c.seq, "SCRIPT")
 			default:
 				s.Route(ar, c.seq, "")
 			}
@@ -192,9 +470,28 @@ func (s *Session) Dispatch() {
 		}
 	}
 quit:
+	s.abortTx()
+	if s.sub != nil {
+		s.sub.close()
+	}
 	log.Warning("quit Dispatch")
 }
 
+// Shutdown handles SHUTDOWN according to the configured policy:
+// reject(default) replies an error, proxy shuts down the proxy itself
+// and never reaches the backend redis
+func (s *Session) Shutdown(seq int64) {
+	if s.p.conf().shutdownPolicy != ShutdownProxy {
+		s.reply(WrappedErrorResp([]byte(ShutdownForbidden.Error()), seq))
+		return
+	}
+
+	// the session is drained with the others, it must not wait for itself
+	log.Warningf("client %s send SHUTDOWN, proxy is shutting down", s.remote)
+	s.reply(WrappedOKResp(seq))
+	go s.p.Shutdown()
+}
+
 func (s *Session) Route(req *ArrayResp, seq int64, multop string) {
 	//channel timeout ???
 	<-s.conCurrency
@@ -206,6 +503,18 @@ func (s *Session) Route(req *ArrayResp, seq int64, multop string) {
 		go s.MGET(req, seq)
 	case "DEL":
 		go s.DEL(req, seq)
+	case "EXISTS":
+		go s.EXISTS(req, seq)
+	case "SCAN":
+		go s.SCAN(req, seq)
+	case "DBSIZE":
+		go s.DBSIZE(req, seq)
+	case "RANDOMKEY":
+		go s.RANDOMKEY(req, seq)
+	case "EVAL":
+		go s.EVAL(req, seq)
+	case "SCRIPT":
+		go s.SCRIPT(req, seq)
 	default:
 		go s.DefaultOP(req, seq)
 	}
@@ -215,13 +524,34 @@ func (s *Session) DefaultOP(req *ArrayResp, seq int64) {
 	defer func() {
 		s.conCurrency <- 1
 	}()
-	resp, err := s.ExecWithRedirect(req, true)
+	cached, gen, hit := s.p.cache.Get(req)
+	if hit {
+		s.reply(WrappedResp(cached, seq))
+		return
+	}
+	resp, err := s.ExecWithRedirect(req, true, s.span(seq))
 	if err != nil {
 		errinfo := fmt.Errorf("proxy internal error %s", err.Error())
-		s.resps <- WrappedErrorResp([]byte(errinfo.Error()), seq)
+		s.reply(WrappedErrorResp([]byte(errinfo.Error()), seq))
 		return
 	}
-	s.resps <- WrappedResp(resp, seq)
+	s.p.cache.Put(req, resp, gen)
+	s.reply(WrappedResp(resp, seq))
+}
+
+// reply queues w for WriteLoop, it blocks when too many reply bytes are
+// waiting for a slow client, which in turn stops reading new commands
+func (s *Session) reply(w *wrappedResp) {
+	w.size = respSize(w.resp)
+	// the reply WriteLoop is waiting for must never block, or out-of-order
+	// replies holding the budget would wait for it forever
+	head := func() bool {
+		return atomic.LoadInt64(&s.respSequence) == w.seq
+	}
+	if !s.budget.acquire(w.size, head) {
+		return
+	}
+	s.resps <- w
 }
 
 func (s *Session) WriteLoop() {
@@ -229,40 +559,49 @@ func (s *Session) WriteLoop() {
 		select {
 		case r := <-s.resps:
 			// log.Info("WriteLoop Read Response ", r.resp.String(), r.seq)
-			// req and resp sequence must equal, thus we can ensure pipeline seq
-			resp := r.resp
-			if r.seq > s.respSequence {
-				// log.Warningf("WriteLoop receive resp unorder %d expected %d", r.seq, s.respSequence)
-				s.ooo[r.seq] = r.resp
-				// we will find r.respSequence in s.ooo
-				var ok bool
-				resp, ok = s.ooo[s.respSequence]
+			if r.push {
+				s.pushes = append(s.pushes, r)
+			} else if r.seq < s.respSequence {
+				// we already discard r.seq response
+				log.Warningf("WriteLoop receive %d < %d just discard resp:%s", r.seq, s.respSequence, r.resp.String())
+				s.budget.release(r.size)
+				continue
+			} else {
+				// req and resp sequence must equal, thus we can ensure pipeline seq
+				// out-of-order resp waits in s.ooo until all the previous are written,
+				// every command gets exactly one reply so nothing waits forever
+				s.ooo[r.seq] = r
+			}
+
+			for {
+				for len(s.pushes) > 0 && s.pushes[0].seq <= s.respSequence {
+					s.writeResp(s.pushes[0])
+					s.pushes = s.pushes[1:]
+				}
+				w, ok := s.ooo[s.respSequence]
 				if !ok {
-					// can't find, and wait again
-					// TODO:: we can't wait forever, may timeout after 1 second or p.pc.conCurrency-1 ???
-					// currently just p.pc.conCurrency-1 seq
-					if r.seq-s.respSequence < int64(s.p.pc.conCurrency-1) {
-						continue
-					}
-					// log.Warningf("WriteLoop receive resp unorder for %d, we send ERROR instead", s.p.pc.conCurrency-1)
-					er := &ErrorResp{}
-					er.Rtype = ErrorType
-					er.Args = append(er.Args, []byte("proxy internal error pipeline unorder"))
-					resp = er
+					break
 				}
+				delete(s.ooo, s.respSequence)
+				written := time.Now()
+				s.writeResp(w)
+				s.p.limiter.Written(s.limit, w.size)
+				s.traceEnd(w.seq, w.resp, written)
+				atomic.AddInt64(&s.respSequence, 1)
+				// writeResp released the budget before the head moved, the
+				// reply of the new head may have checked in between
+				s.budget.wake()
 			}
 
-			// we already discard r.seq response
-			if r.seq < s.respSequence {
-				log.Warningf("WriteLoop receive %d < %d just discard resp:%s", r.seq, s.respSequence, r.resp.String())
+			// 还有回复在排队就先不 Flush, 一个 pipeline 的回复合并成一次写
+			if len(s.resps) > 0 {
 				continue
 			}
-			atomic.AddInt64(&s.respSequence, 1)
-
-			err := WriteProtocol(s.w, resp)
-			if err != nil {
-				log.Warning("WriteLoop WriteProtocol err ", err.Error())
+			if err := s.w.Flush(); err != nil {
+				log.Warning("WriteLoop Flush err ", err.Error())
 			}
+			// only count them once they're flushed, Drain relies on this
+			atomic.StoreInt64(&s.flushedSequence, atomic.LoadInt64(&s.respSequence))
 		case <-s.quitChan:
 			goto quit
 		}
@@ -271,12 +610,23 @@ quit:
 	log.Warning("quit WriteLoop")
 }
 
+// writeResp writes w to the client without flushing
+func (s *Session) writeResp(w *wrappedResp) {
+	err := bufferProtocol(s.w, w.resp)
+	if err == RespTypeError || err == RespArgsError {
+		// a malformed Resp writes nothing, answer with an error so the pipeline stays in order
+		log.Warning("WriteLoop malformed resp ", err.Error())
+		err = bufferProtocol(s.w, NewErrorRespf("ERR proxy internal error %s", err))
+	}
+	s.budget.release(w.size)
+	if err != nil {
+		log.Warning("WriteLoop WriteProtocol err ", err.Error())
+	}
+}
+
 func WrappedErrorResp(reason []byte, seq int64) *wrappedResp {
-	er := &ErrorResp{}
-	er.Rtype = ErrorType
-	er.Args = append(er.Args, reason)
 	return &wrappedResp{
-		resp: er,
+		resp: NewErrorResp(reason),
 		seq:  seq,
 	}
 }
@@ -321,12 +671,15 @@ func (s *Session) GetRedisConnByKey(key []byte, slave bool) (*RedisConn, error)
 	if !ok {
 		return nil, fmt.Errorf("proxy error: GetRedisConnByKey failed")
 	}
-
+	if err := s.selectDB(rc); err != nil {
+		s.p.cluster.PutConn(rc)
+		return nil, err
+	}
 	return rc, nil
 }
 
 func (s *Session) GetRedisConnByID(id string) (*RedisConn, error) {
-	conn, err := s.p.cluster.pools[id].Get()
+	conn, err := s.p.cluster.GetConnByID(id)
 	if err != nil {
 		return nil, err
 	}
@@ -335,107 +688,285 @@ func (s *Session) GetRedisConnByID(id string) (*RedisConn, error) {
 	if !ok {
 		return nil, fmt.Errorf("proxy error: GetRedisConnByID failed")
 	}
-
+	if err := s.selectDB(rc); err != nil {
+		s.p.cluster.PutConn(rc)
+		return nil, err
+	}
 	return rc, nil
 }
 
-//tp type: moved ask normal
-func (s *Session) Redirect(tp string, req *ArrayResp, target string) Resp {
-	//reclaim RedisConn
-	rc, err := s.GetRedisConnByID(target)
+// Select switches the client to db. A cluster only has DB 0, like redis
+// cluster any other is refused. With ketama the commands in flight finish
+// on the DB they were sent for first, then every backend conn borrowed is
+// sent SELECT if it's on another DB, see selectDB
+func (s *Session) Select(db int) error {
+	if db == s.state.DB {
+		return nil
+	}
+	if s.p.conf().distribution != DistKetama {
+		return SelectClusterError
+	}
+	s.waitInflight()
+	s.state.DB = db
+	// WATCH pinned a conn before, EXEC goes to it
+	if s.tx.conn != nil {
+		if err := s.selectDB(s.tx.conn); err != nil {
+			s.endTx(false)
+			return err
+		}
+	}
+	return nil
+}
+
+// selectDB sends SELECT on rc if it's not on the DB of the client
+func (s *Session) selectDB(rc *RedisConn) error {
+	db := 0
+	if s.state != nil {
+		db = s.state.DB
+	}
+	if rc.db == db {
+		return nil
+	}
+	resp, err := s.ExecOnce(rc, newSelect(db))
 	if err != nil {
-		// log.Warning("Session forward get conn not RedisConn")
-		er := &ErrorResp{}
-		er.Rtype = ErrorType
-		er.Args = append(er.Args, []byte("proxy internal error pool conn not RedisConn"))
-		return er
+		return err
 	}
-	defer s.p.cluster.PutConn(rc)
+	if er, ok := resp.(*ErrorResp); ok {
+		return errors.New(er.Error())
+	}
+	rc.db = db
+	return nil
+}
 
-	switch tp {
-	case "ASK":
-		//ask first sending a ASKING command
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{[]byte("ASKING")}
-		ar.Args = append(ar.Args, br)
-		err = WriteProtocol(rc.w, ar)
+// waitInflight waits for the commands running in the background, the ones
+// routed after it see the state changed in between
+func (s *Session) waitInflight() {
+	n := cap(s.conCurrency)
+	for i := 0; i < n; i++ {
+		<-s.conCurrency
+	}
+	for i := 0; i < n; i++ {
+		s.conCurrency <- 1
 	}
+}
 
-	var resp Resp
-	resp, err = s.ExecOnce(rc, req)
-	if err == nil {
-		return resp
+// Redirect sends req to the node named by rd, after ASKING for an ASK.
+// The connection is taken from the pool of the target node
+func (s *Session) Redirect(rd *Redirect, req *ArrayResp) (Resp, error) {
+	rc, err := s.GetRedisConnByID(rd.Addr)
+	if err != nil {
+		return nil, err
 	}
+	defer s.p.cluster.PutConn(rc)
 
-	er := &ErrorResp{}
-	er.Rtype = ErrorType
-	er.Args = append(er.Args, []byte(err.Error()))
-	return er
+	if rd.Kind == "ASK" {
+		// ASKING only lets the next command on this connection in
+		resp, err := s.ExecOnce(rc, newASKING())
+		if err != nil {
+			return nil, err
+		}
+		if er, ok := resp.(*ErrorResp); ok {
+			return er, nil
+		}
+	}
+	return s.ExecOnce(rc, req)
 }
 
-func (s *Session) ExecWithRedirect(req *ArrayResp, redirect bool) (Resp, error) {
-	//ensure req.Args[1].Args[0] is key
-	rc, err := s.GetRedisConnByKey(req.Args[1].Args[0], false)
+// readFromSlave reports whether req may be served by a slave, a read
+// request with a read policy other than primary-only. A bare GETEX is
+// a write command but a read request
+func (s *Session) readFromSlave(req *ArrayResp) bool {
+	if policy := s.p.conf().readPolicy; policy == "" || policy == ReadPrimaryOnly {
+		return false
+	}
+	name := cmdName(req)
+	return (IsReadCommand(name) || IsWriteCommand(name)) && !IsWriteRequest(req)
+}
+
+// ExecWithRedirect sends req to the node of its key and, if redirect,
+// follows MOVED and ASK up to maxredirects times, then replies
+// TooManyRedirectsError. A MOVED routes the slot to the new node at once
+// and reloads the slot map in the background, an ASK only sends this
+// command, after ASKING, to the importing node. sp is the span of the
+// command, nil if it's not sampled
+func (s *Session) ExecWithRedirect(req *ArrayResp, redirect bool, sp *Span) (Resp, error) {
+	rs := sp.Child("route", SpanInternal)
+	key, slot := routeSlot(req)
+	slave := s.readFromSlave(req)
+	rc, err := s.GetRedisConnByKey(key, slave)
+	if err != nil && slave {
+		log.Warning("ExecWithRedirect slave conn failed, read from master ", err)
+		rc, err = s.GetRedisConnByKey(key, false)
+	}
+	rs.SetAttr("archer.slot", slot)
+	rs.SetAttr("archer.replica", slave)
+	rs.SetError(err)
+	rs.End()
 	if err != nil {
 		log.Warning("ExecWithRedirect GetRedisConnByKey get conn failed ", err)
 		return nil, err
 	}
-	//reclaim RedisConn
-	defer s.p.cluster.PutConn(rc)
 
 	var resp Resp
+	bs := sp.Child("backend", SpanClient)
+	bs.SetAttr("server.address", rc.id)
 	resp, err = s.ExecOnce(rc, req)
+	bs.SetError(err)
+	bs.End()
+	//reclaim RedisConn before following a redirect
+	s.p.cluster.PutConn(rc)
 	if err != nil {
 		log.Warning("Session forward ReadProtocol error ", err)
 		return nil, err
 	}
 
-	er, ok := resp.(*ErrorResp)
-	if ok {
+	if redirect {
+		resp, err = s.followRedirects(req, resp, sp)
+	}
+	if IsWriteRequest(req) {
+		// again once done, a read racing with the write may have fetched the old value
+		s.p.cache.Invalidate(req)
+	}
+	return resp, err
+}
+
+// followRedirects follows the MOVED and ASK replied to req, resp is the
+// first reply
+func (s *Session) followRedirects(req *ArrayResp, resp Resp, sp *Span) (Resp, error) {
+	max := s.p.conf().maxRedirects
+	for i := 0; ; i++ {
 		//-MOVED 15495 10.10.200.11:6481 redirect to target
 		//-ASK 15495 10.10.200.11:6481 redirect to target,send ASKING command and then real ArrayResp
-		//handle error response
-		e := strings.Fields(hack.String(er.Args[0]))
-		if len(e) == 3 && redirect {
-			switch e[0] {
-			case "MOVED":
-				//we need reload Slots Info
-				s.p.cluster.topo.reloadChan <- 1
-				resp = s.Redirect("MOVED", req, e[2])
-			case "ASK":
-				//need not reload Slots Info, wait Migrate Done
-				resp = s.Redirect("ASK", req, e[2])
-			}
+		er, ok := resp.(*ErrorResp)
+		if !ok {
+			return resp, nil
+		}
+		rd, ok := er.Redirect()
+		if !ok {
+			return resp, nil
+		}
+		if i == max {
+			log.Warningf("Session %s %s redirected %d times, last %s", s.remote, cmdName(req), i, er.Error())
+			return NewErrorRespf("%s, last %s", TooManyRedirectsError, er.Error()), nil
+		}
+
+		Stats.Redirects.With(strings.ToLower(rd.Kind)).Add(1)
+		if rd.Kind == "MOVED" {
+			//route the slot to its new node now, reload Slots Info in the background
+			s.p.cluster.topo.Moved(rd.Slot, rd.Addr)
+		}
+		ds := sp.Child("redirect", SpanClient)
+		ds.SetAttr("archer.redirect", rd.Kind)
+		ds.SetAttr("server.address", rd.Addr)
+		var err error
+		resp, err = s.Redirect(rd, req)
+		ds.SetError(err)
+		ds.End()
+		if err != nil {
+			log.Warning("Session redirect error ", err)
+			return nil, err
 		}
 	}
-	return resp, nil
 }
 
 func (s *Session) ExecOnce(c *RedisConn, req *ArrayResp) (Resp, error) {
 	err := WriteProtocol(c.w, req)
 	if err != nil {
+		// part of req may be written
+		c.broken = true
 		return nil, err
 	}
 
 	var resp Resp
-	resp, err = ReadProtocol(c.r)
+	resp, err = ReadProtocolWithLimits(c.r, s.limits)
 	if err != nil {
+		// the rest of the reply is still in the socket, never reuse c
+		c.broken = true
 		return nil, err
 	}
 	return resp, nil
 }
 
+// Drain closes the session gracefully: commands read from now on are
+// rejected, the ones already accepted complete and their replies are
+// flushed, then the session is closed. If deadline comes first the session
+// is closed anyway and DrainTimeoutError is returned
+func (s *Session) Drain(deadline time.Time) error {
+	return s.drain(deadline, DrainingError)
+}
+
+// drain is Drain replying reject to the commands read from now on, a nil
+// reject drops them without a reply
+func (s *Session) drain(deadline time.Time, reject error) error {
+	s.drainOnce.Do(func() {
+		s.drainReject = reject
+		atomic.StoreInt64(&s.drainSeq, atomic.LoadInt64(&s.reqSequence))
+		atomic.StoreInt32(&s.draining, 1)
+	})
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		// rejected commands are replied too, wait for every reply
+		last := atomic.LoadInt64(&s.reqSequence)
+		if s.drainReject == nil {
+			last = atomic.LoadInt64(&s.drainSeq)
+		}
+		if atomic.LoadInt64(&s.flushedSequence) >= last {
+			s.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			s.Close()
+			return DrainTimeoutError
+		}
+		<-ticker.C
+	}
+}
+
+// ReadCommandWithIdleTimeout reads the next command of session, closing
+// idle clients: the deadline d only applies while waiting for the first byte
+// of the command, once a frame has started it's read with the normal
+// read timeout, so a slow but progressing large command is not killed
+func ReadCommandWithIdleTimeout(session *Session, d time.Duration) (*ArrayResp, error) {
+	s := session
+	if d > 0 && s.r.Buffered() == 0 {
+		readTimeout := s.c.ReadTimeout
+		s.c.ReadTimeout = d
+		_, err := s.r.Peek(1)
+		s.c.ReadTimeout = readTimeout
+		if readTimeout == 0 {
+			s.c.Conn.SetReadDeadline(time.Time{})
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return nil, IdleTimeoutError
+			}
+			return nil, err
+		}
+	}
+
+	r, err := ReadProtocolWithLimits(s.r, s.limits)
+	if err != nil {
+		return nil, err
+	}
+	ar, ok := r.(*ArrayResp)
+	if !ok {
+		return nil, BadCommandError
+	}
+	return ar, nil
+}
+
+// Close may be called from several goroutines, only the first one closes
 func (s *Session) Close() {
-	if s.closed {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
 		return
 	}
 
-	s.closed = true
 	close(s.quitChan)
+	s.budget.close()
 	s.p.sm.Del(s.remote, s)
+	s.p.limiter.Release(s.limit)
 
 	if s.c != nil {
 		s.c.Close()
@@ -450,3 +981,134 @@ func (s *Session) Serve() {
 
 	s.wg.Wait()
 }
+
+// replyBudget limits the bytes of pending replies per session, max <= 0 means no limit
+type replyBudget struct {
+	l    sync.Mutex
+	cond *sync.Cond
+
+	max     int64
+	used    int64
+	waiting int // replies blocked in acquire
+	closed  bool
+}
+
+func newReplyBudget(max int64) *replyBudget {
+	b := &replyBudget{max: max}
+	b.cond = sync.NewCond(&b.l)
+	return b
+}
+
+// acquire waits until n bytes are available or pass returns true, a single
+// reply larger than max is still allowed when nothing else is pending.
+// false means budget closed
+func (b *replyBudget) acquire(n int64, pass func() bool) bool {
+	if b == nil || b.max <= 0 {
+		return true
+	}
+
+	b.l.Lock()
+	defer b.l.Unlock()
+	for !b.closed && b.used > 0 && b.used+n > b.max && !pass() {
+		b.waiting++
+		b.cond.Wait()
+		b.waiting--
+	}
+	if b.closed {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *replyBudget) release(n int64) {
+	if b == nil || b.max <= 0 {
+		return
+	}
+
+	b.l.Lock()
+	b.used -= n
+	b.l.Unlock()
+	b.cond.Broadcast()
+}
+
+// wake makes the waiting replies check pass again, it takes the lock so a
+// reply between its check and Wait doesn't miss it
+func (b *replyBudget) wake() {
+	if b == nil || b.max <= 0 {
+		return
+	}
+
+	b.l.Lock()
+	b.l.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *replyBudget) close() {
+	if b == nil {
+		return
+	}
+
+	b.l.Lock()
+	b.closed = true
+	b.l.Unlock()
+	b.cond.Broadcast()
+}
+
+// respSize roughly estimates the encoded size of r
+func respSize(r Resp) int64 {
+	var n int64
+	switch v := r.(type) {
+	case *ArrayResp:
+		n = 16
+		if v.Elems != nil {
+			for _, e := range v.Elems {
+				n += respSize(e)
+			}
+			break
+		}
+		for _, br := range v.Args {
+			n += respSize(br)
+		}
+	case *MapResp:
+		n = 16
+		for _, e := range v.Elems {
+			n += respSize(e)
+		}
+	case *SetResp:
+		n = 16
+		for _, e := range v.Elems {
+			n += respSize(e)
+		}
+	case *PushResp:
+		n = 16
+		for _, e := range v.Elems {
+			n += respSize(e)
+		}
+	case *BulkResp:
+		n = 16 + argsSize(v.Args)
+	case *SimpleResp:
+		n = 16 + argsSize(v.Args)
+	case *ErrorResp:
+		n = 16 + argsSize(v.Args)
+	case *IntResp:
+		n = 16 + argsSize(v.Args)
+	case *DoubleResp:
+		n = 16 + argsSize(v.Args)
+	case *BigNumberResp:
+		n = 16 + argsSize(v.Args)
+	case *VerbatimResp:
+		n = 16 + argsSize(v.Args)
+	default:
+		n = 16
+	}
+	return n
+}
+
+func argsSize(args [][]byte) int64 {
+	var n int64
+	for _, a := range args {
+		n += int64(len(a))
+	}
+	return n
+}
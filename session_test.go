@@ -0,0 +1,677 @@
+package archer
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dongzerun/archer/util"
+)
+
+func newTestSession(pc *ProxyConfig) *Session {
+	p := &Proxy{pc: pc}
+	return &Session{
+		p:     p,
+		resps: make(chan *wrappedResp, 16),
+	}
+}
+
+func TestSessionShutdownReject(t *testing.T) {
+	if !IsShutdown(newCommand("shutdown", "nosave")) || IsShutdown(newCommand("GET", "shutdown")) {
+		t.Fatal("IsShutdown wrong")
+	}
+
+	s := newTestSession(&ProxyConfig{shutdownPolicy: ShutdownReject})
+	s.Shutdown(7)
+	r := <-s.resps
+	if r.seq != 7 {
+		t.Fatal(r.seq)
+	}
+	if got := encodeResp(t, r.resp); got != "-ERR shutdown forbidden by proxy\r\n" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestSessionReplyBudget(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	pc := &ProxyConfig{conCurrency: 5, maxPendingBytes: 1024}
+	s := newTestSession(pc)
+	s.c = &util.Conn{Conn: server}
+	s.w = bufio.NewWriter(s.c)
+	s.quitChan = make(chan int, 1)
+	s.ooo = make(map[int64]*wrappedResp)
+	s.budget = newReplyBudget(pc.maxPendingBytes)
+	go s.WriteLoop()
+
+	// client never reads, WriteLoop blocks on the first reply
+	value := make([]byte, 100)
+	var queued int64
+	go func() {
+		for i := 0; i < 100; i++ {
+			br := NewNullBulkResp()
+			br.Empty = false
+			br.Args = [][]byte{value}
+			s.reply(WrappedResp(br, int64(i)))
+			atomic.AddInt64(&queued, 1)
+		}
+	}()
+
+	// wait for a reply blocked on the budget, the next one can't fit
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.budget.l.Lock()
+		used, waiting := s.budget.used, s.budget.waiting
+		s.budget.l.Unlock()
+		if used > pc.maxPendingBytes {
+			t.Fatalf("pending %d bytes exceed %d", used, pc.maxPendingBytes)
+		}
+		if waiting == 1 {
+			size := respSize(NewBulkResp(value))
+			if used+size <= pc.maxPendingBytes {
+				t.Fatalf("reply blocked with %d bytes pending", used)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no reply blocked, bound not enforced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt64(&queued); n == 0 || n >= 100 {
+		t.Fatalf("queued %d replies, bound not enforced", n)
+	}
+
+	// reading unblocks everything
+	go io.Copy(ioutil.Discard, client)
+	deadline = time.Now().Add(time.Second)
+	for atomic.LoadInt64(&queued) != 100 {
+		if time.Now().After(deadline) {
+			t.Fatal("replies not drained")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(s.quitChan)
+	s.budget.close()
+}
+
+// TestSessionReplyBudgetOutOfOrder replies out of order with room for a few
+// replies only, the head must never miss the wakeup of the reply before it
+func TestSessionReplyBudgetOutOfOrder(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+
+	pc := &ProxyConfig{maxPendingBytes: 64}
+	s := newTestSession(pc)
+	s.c = &util.Conn{Conn: server}
+	s.w = bufio.NewWriter(s.c)
+	s.quitChan = make(chan int, 1)
+	s.ooo = make(map[int64]*wrappedResp)
+	s.budget = newReplyBudget(pc.maxPendingBytes)
+	go s.WriteLoop()
+	defer s.budget.close()
+	defer close(s.quitChan)
+
+	const n, workers = 2000, 8
+	done := make(chan bool)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			// worker w replies the seqs w, w+workers, ... so they interleave
+			for seq := w; seq < n; seq += workers {
+				s.reply(WrappedResp(NewBulkResp(make([]byte, 20)), int64(seq)))
+			}
+			done <- true
+		}(w)
+	}
+	for w := 0; w < workers; w++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("replies stuck at seq %d", atomic.LoadInt64(&s.respSequence))
+		}
+	}
+}
+
+// servingSession serves a session of p on a pipe, the client end is returned
+// with a channel closed once Serve returns
+func servingSession(t *testing.T, p *Proxy) (*Session, net.Conn, chan struct{}) {
+	server, client := net.Pipe()
+	s := NewSession(p, server)
+	p.sm.Put(s.remote, s)
+	done := make(chan struct{})
+	go func() {
+		s.Serve()
+		close(done)
+	}()
+	return s, client, done
+}
+
+// TestSessionCloseConcurrent closes a session from Shutdown, the admin API
+// and the client at once, it's closed once without a race
+func TestSessionCloseConcurrent(t *testing.T) {
+	pc := &ProxyConfig{conCurrency: 5, pipeLength: 16}
+	p := &Proxy{pc: pc, sm: &SessMana{pool: make(map[string]*Session)}, filter: &StrFilter{}}
+	for i := 0; i < 20; i++ {
+		s, client, done := servingSession(t, p)
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Close()
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.drain(time.Now(), nil)
+		}()
+		client.Close()
+		wg.Wait()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("session not closed")
+		}
+	}
+}
+
+func TestReadCommandWithIdleTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	s := newTestSession(&ProxyConfig{})
+	s.c = &util.Conn{Conn: server}
+	s.r = bufio.NewReader(s.c)
+
+	// idle: nothing sent
+	start := time.Now()
+	if _, err := ReadCommandWithIdleTimeout(s, 50*time.Millisecond); err != IdleTimeoutError {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("idle timeout fired too late")
+	}
+
+	// mid-frame: the client stalls longer than d after the frame started
+	go func() {
+		client.Write([]byte("*2\r\n$3\r\nGET\r\n"))
+		time.Sleep(150 * time.Millisecond)
+		client.Write([]byte("$3\r\nfoo\r\n"))
+	}()
+	ar, err := ReadCommandWithIdleTimeout(s, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ar.String() != "GET foo" {
+		t.Fatal(ar.String())
+	}
+}
+
+func TestSessionDrain(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	pc := &ProxyConfig{conCurrency: 5}
+	s := newTestSession(pc)
+	s.p.filter = &StrFilter{}
+	s.p.sm = &SessMana{pool: make(map[string]*Session)}
+	s.c = &util.Conn{Conn: server}
+	s.w = bufio.NewWriter(s.c)
+	s.cmds = make(chan *wrappedResp, 16)
+	s.quitChan = make(chan int, 1)
+	s.ooo = make(map[int64]*wrappedResp)
+	s.state = NewClientState()
+	go s.WriteLoop()
+	go s.Dispatch()
+
+	replies := make(chan string, 4)
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			resp, err := ReadProtocol(r)
+			if err != nil {
+				close(replies)
+				return
+			}
+			replies <- resp.String()
+		}
+	}()
+
+	// command 0 is in progress at the backend
+	atomic.StoreInt64(&s.reqSequence, 1)
+	done := make(chan error, 1)
+	go func() { done <- s.Drain(time.Now().Add(2 * time.Second)) }()
+	for atomic.LoadInt32(&s.draining) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// command 1 arrives after Drain
+	s.cmds <- WrappedResp(newCommand("GET", "foo"), 1)
+	atomic.StoreInt64(&s.reqSequence, 2)
+
+	select {
+	case err := <-done:
+		t.Fatalf("Drain returned %v before command 0 completed", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.reply(WrappedOKResp(0))
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if r := <-replies; r != "OK" {
+		t.Fatalf("in progress command got %q", r)
+	}
+	if r := <-replies; r != DrainingError.Error() {
+		t.Fatalf("new command got %q", r)
+	}
+	if _, ok := <-replies; ok {
+		t.Fatal("session must be closed")
+	}
+}
+
+func TestProxyShutdown(t *testing.T) {
+	for _, reply := range []bool{true, false} {
+		server, client := net.Pipe()
+
+		pc := &ProxyConfig{conCurrency: 5, shutdownTimeout: 2 * time.Second, shutdownReply: reply}
+		s := newTestSession(pc)
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.p.l = l
+		s.p.done = make(chan struct{})
+		s.p.cluster = &Cluster{pools: make(map[string]*ConnPool)}
+		s.p.filter = &StrFilter{}
+		s.p.sm = &SessMana{pool: make(map[string]*Session)}
+		s.p.sm.Put("client", s)
+		s.remote = "client"
+		s.c = &util.Conn{Conn: server}
+		s.w = bufio.NewWriter(s.c)
+		s.cmds = make(chan *wrappedResp, 16)
+		s.quitChan = make(chan int, 1)
+		s.ooo = make(map[int64]*wrappedResp)
+		s.state = NewClientState()
+		go s.WriteLoop()
+		go s.Dispatch()
+
+		replies := make(chan string, 4)
+		go func() {
+			r := bufio.NewReader(client)
+			for {
+				resp, err := ReadProtocol(r)
+				if err != nil {
+					close(replies)
+					return
+				}
+				replies <- resp.String()
+			}
+		}()
+
+		// command 0 is in progress at the backend
+		atomic.StoreInt64(&s.reqSequence, 1)
+		done := make(chan error, 1)
+		go func() { done <- s.p.Shutdown() }()
+		for atomic.LoadInt32(&s.draining) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		if _, err := l.Accept(); err == nil {
+			t.Fatal("listener must be closed")
+		}
+
+		// command 1 arrives during the shutdown
+		s.cmds <- WrappedResp(newCommand("GET", "foo"), 1)
+		atomic.StoreInt64(&s.reqSequence, 2)
+		time.Sleep(50 * time.Millisecond)
+
+		s.reply(WrappedOKResp(0))
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-s.p.Done():
+		default:
+			t.Fatal("Done must be closed after Shutdown")
+		}
+		if r := <-replies; r != "OK" {
+			t.Fatalf("in progress command got %q", r)
+		}
+		if reply {
+			if r := <-replies; r != ShuttingDownError.Error() {
+				t.Fatalf("new command got %q", r)
+			}
+		}
+		if r, ok := <-replies; ok {
+			t.Fatalf("session must be closed, got %q", r)
+		}
+		client.Close()
+	}
+}
+
+func TestSessionPipelineOutOfOrder(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	pc := &ProxyConfig{conCurrency: 2}
+	s := newTestSession(pc)
+	s.c = &util.Conn{Conn: server}
+	s.w = bufio.NewWriter(s.c)
+	s.quitChan = make(chan int, 1)
+	s.ooo = make(map[int64]*wrappedResp)
+	go s.WriteLoop()
+
+	// the slow command 0 replies after everything behind it, far more
+	// replies than conCurrency are waiting for it
+	const n = 10
+	for i := n - 1; i > 0; i-- {
+		s.reply(WrappedResp(NewIntResp(int64(i)), int64(i)))
+	}
+	time.Sleep(20 * time.Millisecond)
+	if seq := atomic.LoadInt64(&s.respSequence); seq != 0 {
+		t.Fatalf("%d replies written before command 0", seq)
+	}
+	s.reply(WrappedResp(NewIntResp(0), 0))
+
+	r := bufio.NewReader(client)
+	for i := 0; i < n; i++ {
+		resp, err := ReadProtocol(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.String() != strconv.Itoa(i) {
+			t.Fatalf("reply %d is %q", i, resp.String())
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&s.flushedSequence) != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("flushed %d replies, want %d", atomic.LoadInt64(&s.flushedSequence), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(s.quitChan)
+}
+
+func TestReadFromSlave(t *testing.T) {
+	s := newTestSession(&ProxyConfig{readPolicy: ReadPrimaryOnly})
+	if s.readFromSlave(newCommand("GET", "k")) {
+		t.Fatal("primary-only")
+	}
+	s.p.pc.readPolicy = ReadRoundRobin
+	for _, c := range []struct {
+		cmd   []string
+		slave bool
+	}{
+		{[]string{"GET", "k"}, true},
+		{[]string{"HGETALL", "k"}, true},
+		{[]string{"GETEX", "k"}, true},
+		{[]string{"GETEX", "k", "EX", "10"}, false},
+		{[]string{"SET", "k", "v"}, false},
+		{[]string{"INCR", "k"}, false},
+	} {
+		if got := s.readFromSlave(newCommand(c.cmd...)); got != c.slave {
+			t.Fatalf("%v: %v", c.cmd, got)
+		}
+	}
+}
+
+func TestSessionProtocolError(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	s := newTestSession(&ProxyConfig{conCurrency: 5})
+	s.p.filter = &StrFilter{}
+	s.p.sm = newSessMana(0)
+	s.c = &util.Conn{Conn: server}
+	s.w = bufio.NewWriter(s.c)
+	s.r = bufio.NewReader(s.c)
+	s.cmds = make(chan *wrappedResp, 16)
+	s.quitChan = make(chan int, 1)
+	s.ooo = make(map[int64]*wrappedResp)
+	s.budget = newReplyBudget(0)
+	s.state = NewClientState()
+	go s.WriteLoop()
+	go s.Dispatch()
+	done := make(chan struct{})
+	go func() {
+		s.ReadLoop()
+		close(done)
+	}()
+
+	go client.Write([]byte("PING\r\n*1\r\n$x\r\n"))
+	r := bufio.NewReader(client)
+	for _, want := range []string{"PONG", "ERR Protocol error: illegal bytes in length"} {
+		resp, err := ReadProtocol(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.String() != want {
+			t.Fatalf("got %q, want %q", resp.String(), want)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadLoop must quit")
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Fatal("client must be closed")
+	}
+}
+
+func TestProtocolErrorResp(t *testing.T) {
+	for err, want := range map[error]string{
+		BulkTooLargeError: "ERR Protocol error: invalid bulk length",
+		LineTooLongError:  "ERR Protocol error: too big inline request",
+		InlineQuotesError: "ERR Protocol error: unbalanced quotes in request",
+	} {
+		if got := ProtocolErrorResp(err).String(); got != want {
+			t.Fatalf("%q, want %q", got, want)
+		}
+	}
+}
+
+func TestExecWithRedirect(t *testing.T) {
+	ra, rb := make(map[string]string), make(map[string]string)
+	a, la := fakeMaster(t, ra)
+	defer la.Close()
+	b, lb := fakeMaster(t, rb)
+	defer lb.Close()
+
+	// k1 moved to b
+	ra["GET k1"] = "-MOVED 12706 " + b.id + "\r\n"
+	rb["GET k1"] = "$2\r\nv1\r\n"
+	// k2 is migrating to b, the reply of ASKING is not the reply of GET
+	ra["GET k2"] = "-ASK 449 " + b.id + "\r\n"
+	rb["ASKING"] = "+OK\r\n"
+	rb["GET k2"] = "$2\r\nv2\r\n"
+	// k3 bounces between a and b
+	ra["GET k3"] = "-MOVED 4576 " + b.id + "\r\n"
+	rb["GET k3"] = "-MOVED 4576 " + a.id + "\r\n"
+
+	pc := &ProxyConfig{dialTimeout: time.Second, readTimeout: time.Second, poolSize: 2, maxRedirects: 3}
+	s := newTestSession(pc)
+	s.p.cluster = testCluster(pc, a, a)
+	exec := func(args ...string) string {
+		resp, err := s.ExecWithRedirect(newCommand(args...), true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encodeResp(t, resp)
+	}
+
+	if got := exec("GET", "k1"); got != "$2\r\nv1\r\n" {
+		t.Fatalf("MOVED got %q", got)
+	}
+	if id := s.p.cluster.topo.GetNodeID([]byte("k1"), false); id != b.id {
+		t.Fatalf("slot of k1 still routed to %s", id)
+	}
+	if got := exec("GET", "k2"); got != "$2\r\nv2\r\n" {
+		t.Fatalf("ASK got %q", got)
+	}
+	if id := s.p.cluster.topo.GetNodeID([]byte("k2"), false); id != a.id {
+		t.Fatalf("ASK changed the route of k2 to %s", id)
+	}
+	if got := exec("GET", "k3"); got[:len(TooManyRedirectsError.Error())+1] != "-"+TooManyRedirectsError.Error() {
+		t.Fatalf("redirect loop got %q", got)
+	}
+	// without redirect the MOVED goes to the caller
+	resp, err := s.ExecWithRedirect(newCommand("GET", "k3"), false, nil)
+	if er, ok := resp.(*ErrorResp); err != nil || !ok || !strings.HasPrefix(er.Error(), "MOVED") {
+		t.Fatalf("redirect off got %v %v", resp, err)
+	}
+}
+
+// fakeDBServer is a redis with 16 DBs, each conn starts on DB 0 and
+// understands SELECT, SET, GET, MULTI and EXEC
+func fakeDBServer(t *testing.T) (net.Listener, func(db int, key string) (string, bool)) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	store := make(map[int]map[string]string)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				db := 0
+				run := func(args []*BulkResp) string {
+					mu.Lock()
+					defer mu.Unlock()
+					switch strings.ToUpper(string(args[0].Args[0])) {
+					case "SELECT":
+						db, _ = strconv.Atoi(string(args[1].Args[0]))
+						return "+OK\r\n"
+					case "SET":
+						if store[db] == nil {
+							store[db] = make(map[string]string)
+						}
+						store[db][string(args[1].Args[0])] = string(args[2].Args[0])
+						return "+OK\r\n"
+					case "GET":
+						if v, ok := store[db][string(args[1].Args[0])]; ok {
+							return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+						}
+						return "$-1\r\n"
+					}
+					return "-ERR unknown command\r\n"
+				}
+				var queue [][]*BulkResp
+				multi := false
+				for {
+					req, err := ReadProtocol(r)
+					if err != nil {
+						return
+					}
+					args := req.(*ArrayResp).Args
+					reply := ""
+					switch name := strings.ToUpper(string(args[0].Args[0])); {
+					case name == "MULTI":
+						multi, reply = true, "+OK\r\n"
+					case name == "EXEC":
+						reply = "*" + strconv.Itoa(len(queue)) + "\r\n"
+						for _, q := range queue {
+							reply += run(q)
+						}
+						multi, queue = false, nil
+					case multi:
+						queue, reply = append(queue, args), "+QUEUED\r\n"
+					default:
+						reply = run(args)
+					}
+					c.Write([]byte(reply))
+				}
+			}(c)
+		}
+	}()
+	return l, func(db int, key string) (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		v, ok := store[db][key]
+		return v, ok
+	}
+}
+
+func TestSessionSelect(t *testing.T) {
+	l, get := fakeDBServer(t)
+	defer l.Close()
+	servers, err := ParseKetamaServers(l.Addr().String() + ":1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring, err := NewKetama(servers, HashFnv1a64, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc := &ProxyConfig{distribution: DistKetama, ring: ring, dialTimeout: time.Second, readTimeout: time.Second, poolSize: 1}
+	s := newTestSession(pc)
+	s.p.cluster = testCluster(pc, nil, nil)
+	s.state = NewClientState()
+	s.conCurrency = make(chan int, 2)
+	s.conCurrency <- 1
+	s.conCurrency <- 1
+
+	exec := func(args ...string) string {
+		t.Helper()
+		rc, err := s.GetRedisConnByKey([]byte(args[1]), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.p.cluster.PutConn(rc)
+		resp, err := s.ExecOnce(rc, newCommand(args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.String()
+	}
+
+	exec("SET", "k", "zero")
+	if err := s.Select(3); err != nil {
+		t.Fatal(err)
+	}
+	// the pooled conn is on DB 0, it's switched before the SET
+	exec("SET", "k", "three")
+	if v, _ := get(0, "k"); v != "zero" {
+		t.Fatalf("DB 0: %q", v)
+	}
+	if v, _ := get(3, "k"); v != "three" {
+		t.Fatalf("DB 3: %q", v)
+	}
+	if got := exec("GET", "k"); got != "three" {
+		t.Fatalf("GET on DB 3: %q", got)
+	}
+	if err := s.Select(0); err != nil {
+		t.Fatal(err)
+	}
+	if got := exec("GET", "k"); got != "zero" {
+		t.Fatalf("GET on DB 0: %q", got)
+	}
+	if len(s.conCurrency) != 2 {
+		t.Fatalf("%d tokens left", len(s.conCurrency))
+	}
+
+	pc.distribution = DistCluster
+	if err := s.Select(1); err != SelectClusterError {
+		t.Fatalf("cluster mode: %v", err)
+	}
+	if err := s.Select(0); err != nil || s.state.DB != 0 {
+		t.Fatalf("SELECT 0 in cluster mode: %v %d", err, s.state.DB)
+	}
+}
@@ -0,0 +1,150 @@
+package archer
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 每条慢日志最多记录的 key 个数
+const slowLogKeys = 3
+
+// SlowEntry is a command whose proxy latency, from read to reply written,
+// exceeded the slowlog threshold
+type SlowEntry struct {
+	ID       int64         `json:"id"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Command  string        `json:"command"`
+	Keys     []string      `json:"keys,omitempty"` // sampled, at most slowLogKeys
+	Node     string        `json:"node,omitempty"` // the node the first key routes to
+	Client   string        `json:"client"`
+}
+
+// SlowLog keeps the last entries in a ring buffer, like SLOWLOG of redis
+type SlowLog struct {
+	l       sync.Mutex
+	entries []SlowEntry
+	next    int   // where the next entry goes
+	full    bool  // entries wrapped around
+	id      int64 // id of the next entry, never reset
+
+	threshold time.Duration // negative disables, 0 logs every command
+}
+
+func NewSlowLog(threshold time.Duration, maxLen int) *SlowLog {
+	if maxLen <= 0 {
+		maxLen = 128
+	}
+	return &SlowLog{
+		entries:   make([]SlowEntry, maxLen),
+		threshold: threshold,
+	}
+}
+
+// Slow reports whether a command taking d must be logged
+func (sl *SlowLog) Slow(d time.Duration) bool {
+	return sl.threshold >= 0 && d >= sl.threshold
+}
+
+func (sl *SlowLog) Add(e SlowEntry) {
+	sl.l.Lock()
+	e.ID = sl.id
+	sl.id++
+	sl.entries[sl.next] = e
+	sl.next++
+	if sl.next == len(sl.entries) {
+		sl.next, sl.full = 0, true
+	}
+	sl.l.Unlock()
+}
+
+// Get returns the last n entries, newest first
+func (sl *SlowLog) Get(n int) []SlowEntry {
+	sl.l.Lock()
+	defer sl.l.Unlock()
+	if l := sl.len(); n < 0 || n > l {
+		n = l
+	}
+	es := make([]SlowEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		es = append(es, sl.entries[(sl.next-i+len(sl.entries))%len(sl.entries)])
+	}
+	return es
+}
+
+func (sl *SlowLog) Len() int {
+	sl.l.Lock()
+	defer sl.l.Unlock()
+	return sl.len()
+}
+
+func (sl *SlowLog) len() int {
+	if sl.full {
+		return len(sl.entries)
+	}
+	return sl.next
+}
+
+func (sl *SlowLog) Reset() {
+	sl.l.Lock()
+	sl.next, sl.full = 0, false
+	sl.l.Unlock()
+}
+
+// ServeHTTP serves the entries as json, ?n= limits them, 128 by default
+func (sl *SlowLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil {
+		n = 128
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sl.Get(n))
+}
+
+// Resp is the entry in the reply of PROXY SLOWLOG GET: id, unix time,
+// microseconds, the command and its sampled keys, client and node
+func (e SlowEntry) Resp() Resp {
+	args := &ArrayResp{}
+	args.Rtype = ArrayType
+	args.append(NewBulkResp([]byte(e.Command)))
+	for _, k := range e.Keys {
+		args.append(NewBulkResp([]byte(k)))
+	}
+
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.append(NewIntResp(e.ID))
+	ar.append(NewIntResp(e.Time.Unix()))
+	ar.append(NewIntResp(int64(e.Duration / time.Microsecond)))
+	ar.append(args)
+	ar.append(NewBulkResp([]byte(e.Client)))
+	ar.append(NewBulkResp([]byte(e.Node)))
+	return ar
+}
+
+// slowEntry builds the entry of a command traced by t
+func (s *Session) slowEntry(t *cmdTrace, d time.Duration) SlowEntry {
+	e := SlowEntry{
+		Time:     t.start,
+		Duration: d,
+		Command:  t.name,
+		Client:   s.remote,
+	}
+	if t.req == nil {
+		return e
+	}
+	keys := CommandKeys(t.req)
+	for i, k := range keys {
+		if i == slowLogKeys {
+			break
+		}
+		e.Keys = append(e.Keys, string(k))
+	}
+	if len(keys) > 0 && s.p.cluster != nil && s.p.cluster.topo != nil {
+		e.Node = s.p.cluster.topo.GetNodeID(keys[0], false)
+	}
+	return e
+}
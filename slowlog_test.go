@@ -0,0 +1,77 @@
+package archer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlowLogRing(t *testing.T) {
+	sl := NewSlowLog(time.Millisecond, 3)
+	if sl.Slow(time.Microsecond) || !sl.Slow(time.Millisecond) {
+		t.Fatal("threshold")
+	}
+	if NewSlowLog(-1, 3).Slow(time.Hour) {
+		t.Fatal("negative threshold logs nothing")
+	}
+
+	for _, cmd := range []string{"A", "B", "C", "D"} {
+		sl.Add(SlowEntry{Command: cmd})
+	}
+	if sl.Len() != 3 {
+		t.Fatal(sl.Len())
+	}
+	es := sl.Get(-1)
+	if len(es) != 3 || es[0].Command != "D" || es[0].ID != 3 || es[2].Command != "B" {
+		t.Fatalf("%+v", es)
+	}
+	if es := sl.Get(1); len(es) != 1 || es[0].Command != "D" {
+		t.Fatalf("%+v", es)
+	}
+
+	sl.Reset()
+	sl.Add(SlowEntry{Command: "E"})
+	if es := sl.Get(10); len(es) != 1 || es[0].ID != 4 {
+		t.Fatalf("%+v", es)
+	}
+}
+
+func TestProxySlowLogCommand(t *testing.T) {
+	s := newTestSession(&ProxyConfig{})
+	s.remote = "10.0.0.1:5000"
+	s.p.slowlog = NewSlowLog(0, 8)
+
+	s.traceStart(0, newCommand("MGET", "a", "b", "c", "d"), time.Time{})
+	s.traceEnd(0, nil, time.Now())
+
+	steps := []struct {
+		cmd   []string
+		reply string
+	}{
+		{[]string{"PROXY", "SLOWLOG", "LEN"}, "1"},
+		{[]string{"PROXY", "SLOWLOG", "GET", "x"}, "ERR count should be greater than or equal to -1"},
+		{[]string{"PROXY", "FOO"}, "ERR unknown PROXY subcommand 'FOO'"},
+		{[]string{"PROXY", "SLOWLOG", "RESET"}, "OK"},
+		{[]string{"PROXY", "SLOWLOG", "GET"}, ""},
+	}
+
+	r := s.p.slowlog.Get(1)
+	if len(r) != 1 || r[0].Command != "MGET" || len(r[0].Keys) != slowLogKeys || r[0].Client != s.remote {
+		t.Fatalf("%+v", r)
+	}
+	s.ProxyCommand(newCommand("PROXY", "SLOWLOG", "GET", "1"), 9)
+	got := (<-s.resps).resp.(*ArrayResp).Items()
+	if len(got) != 1 || got[0].(*ArrayResp).Items()[3].String() != "MGET a b c" {
+		t.Fatalf("%v", got)
+	}
+
+	for i, step := range steps {
+		s.ProxyCommand(newCommand(step.cmd...), int64(i))
+		if got := (<-s.resps).resp.String(); got != step.reply {
+			t.Fatalf("step %d %v: got %q, want %q", i, step.cmd, got, step.reply)
+		}
+	}
+	s.ProxyCommand(newCommand("PROXY", "SLOWLOG", "GET"), 10)
+	if got := encodeResp(t, (<-s.resps).resp); got != "*0\r\n" {
+		t.Fatalf("%q", got)
+	}
+}
@@ -1,142 +1,469 @@
 package archer
 
 import (
-	"bytes"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
 
-	"github.com/dongzerun/archer/util"
-	log "github.com/ngaut/logging"
+	log "github.com/dongzerun/archer/logging"
 )
 
-func (s *Session) MGET(req *ArrayResp, seq int64) {
-	defer func() {
-		s.conCurrency <- 1
-	}()
-	var failed bool
+var (
+	MGetMergeError     = errors.New("MGET sub reply does not match its keys")
+	IntMergeError      = errors.New("sub reply is not an integer")
+	ScanMergeError     = errors.New("SCAN sub reply is not a cursor and keys")
+	InvalidCursorError = errors.New("ERR invalid cursor")
+)
+
+// SCAN 的游标低 scanNodeBits 位是 master 的序号, 其余是该节点自己的游标
+const scanNodeBits = 10
+
+// slotPart is the part of a multi key command sent to one slot, indices
+// are the positions of its keys in the original command, starting from 0
+// for the first key
+type slotPart struct {
+	indices []int
+	cmd     *ArrayResp
+	resp    Resp       // reply of cmd
+	reply   *ArrayResp // resp of an MGET part
+}
+
+// splitKeys splits a multi key command by the slot of its keys, see
+// keySlot, keeping key order in each part. step is the number of arguments
+// per key, 2 for the key value pairs of MSET
+func splitKeys(pc *ProxyConfig, req *ArrayResp, step int) map[int]*slotPart {
+	parts := make(map[int]*slotPart)
+	for i := 0; (i+1)*step <= req.Length(); i++ {
+		args := req.Args[1+i*step : 1+(i+1)*step]
+		var k []byte
+		if len(args[0].Args) > 0 {
+			k = args[0].Args[0]
+		}
+		slot := keySlot(pc, k)
+		part, ok := parts[slot]
+		if !ok {
+			part = &slotPart{cmd: &ArrayResp{}}
+			part.cmd.Rtype = ArrayType
+			part.cmd.Args = append(part.cmd.Args, req.Args[0])
+			parts[slot] = part
+		}
+		part.indices = append(part.indices, i)
+		part.cmd.Args = append(part.cmd.Args, args...)
+	}
+	return parts
+}
+
+// splitMGet splits an MGET by the slot of its keys, keeping key order in each part
+func splitMGet(pc *ProxyConfig, req *ArrayResp) map[int]*slotPart {
+	return splitKeys(pc, req, 1)
+}
+
+// MergeMGet puts the values replied by every part back in the key order of
+// original, keys not covered by any part get null
+func MergeMGet(original *ArrayResp, parts map[int]*slotPart) (*ArrayResp, error) {
 	mget := &ArrayResp{}
 	mget.Rtype = ArrayType
-	mget.Args = make([]*BulkResp, req.Length())
-	for i := 0; i < req.Length(); i++ {
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{[]byte("GET")}
-		ar.Args = append(ar.Args, br)
-
-		br1 := &BulkResp{}
-		br1.Rtype = BulkType
-		br1.Args = [][]byte{req.Args[i+1].Args[0]}
-		ar.Args = append(ar.Args, br1)
-
-		resp, err := s.ExecWithRedirect(ar, true)
-		if err != nil {
-			log.Warning("Session MGET ExecWithRedirect wrong ", ar.String())
-			failed = true
-			break
+	mget.Args = make([]*BulkResp, original.Length())
+
+	for _, part := range parts {
+		if part.reply == nil || part.reply.Length()+1 != len(part.indices) {
+			return nil, MGetMergeError
+		}
+		for i, item := range part.reply.Items() {
+			idx := part.indices[i]
+			if idx < 0 || idx >= len(mget.Args) {
+				return nil, MGetMergeError
+			}
+			if IsNull(item) {
+				mget.Args[idx] = NewNullBulkResp()
+				continue
+			}
+			br, ok := item.(*BulkResp)
+			if !ok {
+				return nil, MGetMergeError
+			}
+			mget.Args[idx] = br
+		}
+	}
+
+	for i, br := range mget.Args {
+		if br == nil {
+			mget.Args[i] = NewNullBulkResp()
+		}
+	}
+	return mget, nil
+}
+
+// SplitScan builds the SCAN sent to every node, node i continues from
+// cursors[i]. The options after the cursor, MATCH, COUNT and TYPE, are
+// copied to every sub command, so each node filters the same way
+func SplitScan(req *ArrayResp, cursors []string) []*ArrayResp {
+	cmds := make([]*ArrayResp, len(cursors))
+	for i, cursor := range cursors {
+		cmd := &ArrayResp{}
+		cmd.Rtype = ArrayType
+		cmd.Args = make([]*BulkResp, 0, len(req.Args))
+		cmd.Args = append(cmd.Args, req.Args[0], NewBulkResp([]byte(cursor)))
+		if len(req.Args) > 2 {
+			cmd.Args = append(cmd.Args, req.Args[2:]...)
+		}
+		cmds[i] = cmd
+	}
+	return cmds
+}
+
+// MergeScan merges the SCAN replies of every node, replies[i] answers the
+// sub command of node i. It returns the next cursor of every node, "0" once
+// the node is done, and all keys in node order
+func MergeScan(replies []Resp) ([]string, *ArrayResp, error) {
+	keys := &ArrayResp{}
+	keys.Rtype = ArrayType
+	keys.Args = []*BulkResp{}
+
+	cursors := make([]string, len(replies))
+	for i, r := range replies {
+		ar, ok := r.(*ArrayResp)
+		if !ok || ar.Length() != 1 {
+			return nil, nil, ScanMergeError
+		}
+		items := ar.Items()
+		cursor, ok := items[0].(*BulkResp)
+		if !ok || cursor.Empty || len(cursor.Args) == 0 {
+			return nil, nil, ScanMergeError
 		}
-		br, ok := resp.(*BulkResp)
+		batch, ok := items[1].(*ArrayResp)
 		if !ok {
-			log.Warning("Session MGET ExecWithRedirect  wrong must get BulkResp")
-			failed = true
-			break
+			return nil, nil, ScanMergeError
+		}
+		cursors[i] = string(cursor.Args[0])
+		for _, item := range batch.Items() {
+			br, ok := item.(*BulkResp)
+			if !ok {
+				return nil, nil, ScanMergeError
+			}
+			keys.Args = append(keys.Args, br)
 		}
-		mget.Args[i] = br
 	}
+	return cursors, keys, nil
+}
+
+// MergeSetReplies unions the members replied by SUNION/SINTER parts sent to
+// different nodes, duplicates are removed and first seen order is kept
+func MergeSetReplies(parts []*ArrayResp) *ArrayResp {
+	merged := &ArrayResp{}
+	merged.Rtype = ArrayType
+	merged.Args = []*BulkResp{}
+
+	seen := make(map[string]bool)
+	for _, part := range parts {
+		if part == nil || part.Empty {
+			continue
+		}
+		for _, item := range part.Items() {
+			br, ok := item.(*BulkResp)
+			if !ok || br.Empty || len(br.Args) == 0 {
+				continue
+			}
+			member := string(br.Args[0])
+			if seen[member] {
+				continue
+			}
+			seen[member] = true
+			merged.Args = append(merged.Args, br)
+		}
+	}
+	return merged
+}
 
-	if failed {
-		s.resps <- WrappedErrorResp([]byte("proxy internal MGET failed"), seq)
+// SumIntReplies adds up the integer replies of the parts of DEL or
+// EXISTS, IntMergeError if one of them is not an integer
+func SumIntReplies(replies []Resp) (*IntResp, error) {
+	var sum int64
+	for _, r := range replies {
+		ir, ok := r.(*IntResp)
+		if !ok || len(ir.Args) == 0 {
+			return nil, IntMergeError
+		}
+		n, err := strconv.ParseInt(string(ir.Args[0]), 10, 64)
+		if err != nil {
+			return nil, IntMergeError
+		}
+		sum += n
+	}
+	return NewIntResp(sum), nil
+}
+
+// fanOut sends the parts to their slots in parallel and waits for all the
+// replies, a part failing in the proxy gets an error reply
+func (s *Session) fanOut(parts map[int]*slotPart, seq int64) {
+	sp := s.span(seq)
+	var wg sync.WaitGroup
+	for _, part := range parts {
+		wg.Add(1)
+		go func(part *slotPart) {
+			defer wg.Done()
+			resp, err := s.ExecWithRedirect(part.cmd, true, sp)
+			if err != nil {
+				log.Warning("Session fanOut ExecWithRedirect wrong ", part.cmd.String())
+				resp = NewErrorRespf("proxy internal error %s", err)
+			}
+			part.resp = resp
+		}(part)
+	}
+	wg.Wait()
+}
+
+// partsError returns the first error replied to the parts, nil if none
+func partsError(parts map[int]*slotPart) Resp {
+	for _, part := range parts {
+		if er, ok := part.resp.(*ErrorResp); ok {
+			return er
+		}
+	}
+	return nil
+}
+
+func (s *Session) MGET(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	parts := splitMGet(s.p.conf(), req)
+	s.fanOut(parts, seq)
+	if er := partsError(parts); er != nil {
+		s.reply(WrappedResp(er, seq))
+		return
+	}
+	for _, part := range parts {
+		part.reply, _ = part.resp.(*ArrayResp)
+	}
+
+	mget, err := MergeMGet(req, parts)
+	if err != nil {
+		s.reply(WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq))
 		return
 	}
-	s.resps <- WrappedResp(mget, seq)
+	s.reply(WrappedResp(mget, seq))
 }
 
+// MSET sets the keys of every slot with one MSET, the slots are set
+// independently so the whole MSET is not atomic across slots
 func (s *Session) MSET(req *ArrayResp, seq int64) {
 	defer func() {
 		s.conCurrency <- 1
 	}()
 
 	if req.Length()%2 != 0 {
-		s.resps <- WrappedErrorResp([]byte("MSET args count must Even"), seq)
+		s.reply(WrappedErrorResp([]byte("MSET args count must Even"), seq))
 		return
 	}
 
-	var failed bool
-	for i := 0; i < req.Length(); i += 2 {
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{[]byte("SET")}
-		ar.Args = append(ar.Args, br)
+	parts := splitKeys(s.p.conf(), req, 2)
+	s.fanOut(parts, seq)
+	if er := partsError(parts); er != nil {
+		s.reply(WrappedResp(er, seq))
+		return
+	}
+	for _, part := range parts {
+		if !isStatus(part.resp, OK) {
+			log.Warning("Session MSET wrong must get OK ", part.resp.String())
+			s.reply(WrappedErrorResp([]byte("proxy internal MSET partitial failed"), seq))
+			return
+		}
+	}
+	s.reply(WrappedOKResp(seq))
+}
 
-		br1 := &BulkResp{}
-		br1.Rtype = BulkType
-		br1.Args = [][]byte{req.Args[i+1].Args[0]}
-		ar.Args = append(ar.Args, br1)
+func (s *Session) DEL(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+	s.reply(WrappedResp(s.countKeys(req, seq), seq))
+}
 
-		br2 := &BulkResp{}
-		br2.Rtype = BulkType
-		br2.Args = [][]byte{req.Args[i+2].Args[0]}
-		ar.Args = append(ar.Args, br2)
+func (s *Session) EXISTS(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+	s.reply(WrappedResp(s.countKeys(req, seq), seq))
+}
 
-		resp, err := s.ExecWithRedirect(ar, true)
-		if err != nil {
-			log.Warning("Session MSET ExecWithRedirect wrong ", ar.String())
-			failed = true
-			break
+// countKeys runs DEL or EXISTS per slot and sums the counts
+func (s *Session) countKeys(req *ArrayResp, seq int64) Resp {
+	parts := splitKeys(s.p.conf(), req, 1)
+	s.fanOut(parts, seq)
+	if er := partsError(parts); er != nil {
+		return er
+	}
+
+	replies := make([]Resp, 0, len(parts))
+	for _, part := range parts {
+		replies = append(replies, part.resp)
+	}
+	sum, err := SumIntReplies(replies)
+	if err != nil {
+		return NewErrorResp([]byte("proxy internal error " + err.Error()))
+	}
+	return sum
+}
+
+// EncodeScanCursor builds the cursor returned to the client from the cursor
+// of the master at index node, redis cursors are far below 1<<54
+func EncodeScanCursor(node int, cursor uint64) string {
+	return strconv.FormatUint(cursor<<scanNodeBits|uint64(node), 10)
+}
+
+// DecodeScanCursor splits the cursor of the client into the master index
+// and the cursor of that master
+func DecodeScanCursor(c []byte) (int, uint64, error) {
+	cursor, err := strconv.ParseUint(string(c), 10, 64)
+	if err != nil {
+		return 0, 0, InvalidCursorError
+	}
+	return int(cursor & (1<<scanNodeBits - 1)), cursor >> scanNodeBits, nil
+}
+
+// execOnNode sends req to node id, without following redirects
+func (s *Session) execOnNode(id string, req *ArrayResp) (Resp, error) {
+	rc, err := s.GetRedisConnByID(id)
+	if err != nil {
+		return nil, err
+	}
+	defer s.p.cluster.PutConn(rc)
+	return s.ExecOnce(rc, req)
+}
+
+// execOnMasters sends req to every master concurrently, a failed node
+// replies an ErrorResp
+func (s *Session) execOnMasters(req *ArrayResp) []Resp {
+	masters := s.p.cluster.topo.Masters()
+	replies := make([]Resp, len(masters))
+	var wg sync.WaitGroup
+	for i, id := range masters {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			resp, err := s.execOnNode(id, req)
+			if err != nil {
+				resp = NewErrorRespf("proxy internal error %s", err)
+			}
+			replies[i] = resp
+		}(i, id)
+	}
+	wg.Wait()
+	return replies
+}
+
+// firstError returns the first ErrorResp of replies, nil if none
+func firstError(replies []Resp) *ErrorResp {
+	for _, r := range replies {
+		if er, ok := r.(*ErrorResp); ok {
+			return er
 		}
-		_, ok := resp.(*SimpleResp)
-		if !ok {
-			log.Warning("Session MSET ExecWithRedirect  wrong must get SimpleResp ")
-			failed = true
-			break
+	}
+	return nil
+}
+
+// SCAN iterates the masters one after another, the node index is encoded
+// in the cursor so the client sees a single keyspace. A master done moves
+// the cursor to the next one, the cursor is 0 after the last master. Keys
+// may be missed or repeated if the topology changes during the iteration
+func (s *Session) SCAN(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
+
+	arg, _ := req.Arg(1)
+	node, cursor, err := DecodeScanCursor(arg)
+	if err != nil {
+		s.reply(WrappedErrorResp([]byte(err.Error()), seq))
+		return
+	}
+	masters := s.p.cluster.topo.Masters()
+	if node >= len(masters) {
+		s.reply(WrappedResp(scanResp("0", nil), seq))
+		return
+	}
+
+	sub := SplitScan(req, []string{strconv.FormatUint(cursor, 10)})[0]
+	resp, err := s.execOnNode(masters[node], sub)
+	if err != nil {
+		s.reply(WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq))
+		return
+	}
+	if er, ok := resp.(*ErrorResp); ok {
+		s.reply(WrappedResp(er, seq))
+		return
+	}
+	cursors, keys, err := MergeScan([]Resp{resp})
+	if err != nil {
+		s.reply(WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq))
+		return
+	}
+
+	next, _ := strconv.ParseUint(cursors[0], 10, 64)
+	if next == 0 {
+		// this master is done, continue with the next one
+		if node++; node == len(masters) {
+			s.reply(WrappedResp(scanResp("0", keys), seq))
+			return
 		}
 	}
+	s.reply(WrappedResp(scanResp(EncodeScanCursor(node, next), keys), seq))
+}
+
+// scanResp is the reply of SCAN, a cursor and the keys
+func scanResp(cursor string, keys *ArrayResp) *ArrayResp {
+	if keys == nil {
+		keys = &ArrayResp{}
+		keys.Rtype = ArrayType
+		keys.Args = []*BulkResp{}
+	}
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.append(NewBulkResp([]byte(cursor)))
+	ar.append(keys)
+	return ar
+}
+
+// DBSIZE sums the keys of every master
+func (s *Session) DBSIZE(req *ArrayResp, seq int64) {
+	defer func() {
+		s.conCurrency <- 1
+	}()
 
-	if failed {
-		s.resps <- WrappedErrorResp([]byte("MGET partitial failed"), seq)
+	replies := s.execOnMasters(req)
+	if er := firstError(replies); er != nil {
+		s.reply(WrappedResp(er, seq))
+		return
+	}
+	sum, err := SumIntReplies(replies)
+	if err != nil {
+		s.reply(WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq))
 		return
 	}
-	s.resps <- WrappedOKResp(seq)
+	s.reply(WrappedResp(sum, seq))
 }
 
-func (s *Session) DEL(req *ArrayResp, seq int64) {
+// RANDOMKEY asks the masters in random order until one has a key, null if
+// the whole cluster is empty
+func (s *Session) RANDOMKEY(req *ArrayResp, seq int64) {
 	defer func() {
 		s.conCurrency <- 1
 	}()
 
-	var del int
-	for i := 0; i < req.Length(); i++ {
-		ar := &ArrayResp{}
-		ar.Rtype = ArrayType
-		br := &BulkResp{}
-		br.Rtype = BulkType
-		br.Args = [][]byte{[]byte("DEL")}
-		ar.Args = append(ar.Args, br)
-
-		br1 := &BulkResp{}
-		br1.Rtype = BulkType
-		br1.Args = [][]byte{req.Args[i+1].Args[0]}
-		ar.Args = append(ar.Args, br1)
-
-		resp, err := s.ExecWithRedirect(ar, true)
+	masters := s.p.cluster.topo.Masters()
+	for _, i := range rand.Perm(len(masters)) {
+		resp, err := s.execOnNode(masters[i], req)
 		if err != nil {
-			log.Warning("Session DEL ExecWithRedirect wrong ", ar.String())
-			continue
-		}
-		ir, ok := resp.(*IntResp)
-		if !ok {
-			log.Warning("Session DEL ExecWithRedirect  wrong must get IntResp")
-			continue
+			s.reply(WrappedErrorResp([]byte("proxy internal error "+err.Error()), seq))
+			return
 		}
-		log.Info("DEL resp ", ir.Rtype, string(ir.Args[0]))
-		if bytes.Equal(ir.Args[0], []byte("1")) {
-			del += 1
+		if !IsNull(resp) {
+			s.reply(WrappedResp(resp, seq))
+			return
 		}
 	}
-	r := &IntResp{}
-	r.Rtype = IntType
-	r.Args = append(r.Args, util.Iu32tob2(del))
-	s.resps <- WrappedResp(r, seq)
-	return
+	s.reply(WrappedResp(NewNullBulkResp(), seq))
 }
@@ -0,0 +1,301 @@
+package archer
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMergeMGet(t *testing.T) {
+	req := newCommand("MGET", "{a}1", "{b}1", "{a}2", "{b}2")
+	parts := splitMGet(nil, req)
+	if len(parts) != 2 {
+		t.Fatalf("%d parts, want 2", len(parts))
+	}
+
+	for _, part := range parts {
+		switch part.cmd.String() {
+		case "MGET {a}1 {a}2":
+			part.reply = readResp(t, "*2\r\n$2\r\na1\r\n$-1\r\n").(*ArrayResp)
+		case "MGET {b}1 {b}2":
+			part.reply = readResp(t, "*2\r\n$2\r\nb1\r\n$2\r\nb2\r\n").(*ArrayResp)
+		default:
+			t.Fatal(part.cmd.String())
+		}
+	}
+
+	mget, err := MergeMGet(req, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "*4\r\n$2\r\na1\r\n$2\r\nb1\r\n$-1\r\n$2\r\nb2\r\n"
+	if got := encodeResp(t, mget); got != want {
+		t.Fatalf("%q", got)
+	}
+
+	for _, part := range parts {
+		part.reply = readResp(t, "*1\r\n$1\r\nx\r\n").(*ArrayResp)
+	}
+	if _, err := MergeMGet(req, parts); err != MGetMergeError {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeSetReplies(t *testing.T) {
+	parts := []*ArrayResp{
+		readResp(t, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n").(*ArrayResp),
+		readResp(t, "*3\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\na\r\n").(*ArrayResp),
+		readResp(t, "*0\r\n").(*ArrayResp),
+		nil,
+	}
+	merged := MergeSetReplies(parts)
+	if got := encodeResp(t, merged); got != "*4\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n" {
+		t.Fatalf("%q", got)
+	}
+
+	if got := encodeResp(t, MergeSetReplies(nil)); got != "*0\r\n" {
+		t.Fatalf("%q", got)
+	}
+}
+
+func TestSplitScanKeepsOptions(t *testing.T) {
+	req := newCommand("SCAN", "0", "MATCH", "foo*", "COUNT", "100", "TYPE", "string")
+	cmds := SplitScan(req, []string{"0", "17", "0"})
+	if len(cmds) != 3 {
+		t.Fatal(len(cmds))
+	}
+	for i, want := range []string{
+		"SCAN 0 MATCH foo* COUNT 100 TYPE string",
+		"SCAN 17 MATCH foo* COUNT 100 TYPE string",
+		"SCAN 0 MATCH foo* COUNT 100 TYPE string",
+	} {
+		if got := cmds[i].String(); got != want {
+			t.Fatalf("node %d: %q", i, got)
+		}
+	}
+	if req.String() != "SCAN 0 MATCH foo* COUNT 100 TYPE string" {
+		t.Fatal("original modified", req.String())
+	}
+
+	if got := SplitScan(newCommand("SCAN", "5"), []string{"3"})[0].String(); got != "SCAN 3" {
+		t.Fatal(got)
+	}
+}
+
+func TestMergeScan(t *testing.T) {
+	replies := []Resp{
+		readResp(t, "*2\r\n$2\r\n42\r\n*2\r\n$4\r\nfoo1\r\n$4\r\nfoo2\r\n"),
+		readResp(t, "*2\r\n$1\r\n0\r\n*0\r\n"),
+		readResp(t, "*2\r\n$1\r\n0\r\n*1\r\n$4\r\nfoo3\r\n"),
+	}
+	cursors, keys, err := MergeScan(replies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cursors, ",") != "42,0,0" || keys.String() != "foo1 foo2 foo3" {
+		t.Fatal(cursors, keys.String())
+	}
+
+	if _, _, err := MergeScan([]Resp{readResp(t, "-ERR x\r\n")}); err != ScanMergeError {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitKeysPairs(t *testing.T) {
+	req := newCommand("MSET", "{a}1", "x", "{b}1", "y", "{a}2", "z")
+	parts := splitKeys(nil, req, 2)
+	if len(parts) != 2 {
+		t.Fatalf("%d parts, want 2", len(parts))
+	}
+	for _, part := range parts {
+		switch part.cmd.String() {
+		case "MSET {a}1 x {a}2 z":
+			if len(part.indices) != 2 || part.indices[0] != 0 || part.indices[1] != 2 {
+				t.Fatalf("indices %v", part.indices)
+			}
+		case "MSET {b}1 y":
+			if len(part.indices) != 1 || part.indices[0] != 1 {
+				t.Fatalf("indices %v", part.indices)
+			}
+		default:
+			t.Fatal(part.cmd.String())
+		}
+	}
+}
+
+func TestSumIntReplies(t *testing.T) {
+	sum, err := SumIntReplies([]Resp{NewIntResp(2), NewIntResp(0), NewIntResp(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.String() != "5" {
+		t.Fatalf("sum %s", sum)
+	}
+	if _, err := SumIntReplies([]Resp{NewIntResp(1), NewBulkResp([]byte("1"))}); err != IntMergeError {
+		t.Fatal(err)
+	}
+}
+
+func TestScanCursor(t *testing.T) {
+	for _, tt := range []struct {
+		node   int
+		cursor uint64
+	}{{0, 0}, {2, 0}, {1, 17}, {1023, 1 << 40}} {
+		c := EncodeScanCursor(tt.node, tt.cursor)
+		node, cursor, err := DecodeScanCursor([]byte(c))
+		if err != nil || node != tt.node || cursor != tt.cursor {
+			t.Fatalf("%d %d encoded as %s decoded as %d %d %v", tt.node, tt.cursor, c, node, cursor, err)
+		}
+	}
+	if c := EncodeScanCursor(0, 0); c != "0" {
+		t.Fatalf("start cursor %s, want 0", c)
+	}
+	for _, c := range []string{"", "-1", "abc", "18446744073709551616"} {
+		if _, _, err := DecodeScanCursor([]byte(c)); err != InvalidCursorError {
+			t.Fatalf("cursor %q got %v", c, err)
+		}
+	}
+}
+
+// fakeMaster answers the commands of a test with fixed replies, keyed by
+// the command as printed by String, an empty reply never comes. Close the
+// listener to stop it
+func fakeMaster(t *testing.T, replies map[string]string) (*Node, net.Listener) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the conns are closed and their goroutines gone when the test ends,
+	// they don't read into the next test
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+		done  bool
+		wg    sync.WaitGroup
+	)
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		done = true
+		for _, c := range conns {
+			c.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			if done {
+				mu.Unlock()
+				c.Close()
+				return
+			}
+			conns = append(conns, c)
+			mu.Unlock()
+			wg.Add(1)
+			go func(c net.Conn) {
+				defer wg.Done()
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					req, err := ReadProtocol(r)
+					if err != nil {
+						return
+					}
+					reply, ok := replies[req.String()]
+					if !ok {
+						reply = "-ERR unexpected " + req.String() + "\r\n"
+					}
+					if reply != "" {
+						c.Write([]byte(reply))
+					}
+				}
+			}(c)
+		}
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return &Node{id: addr.String(), host: "127.0.0.1", port: addr.Port, role: "master"}, l
+}
+
+// testCluster serves the slots below 8192 by a and the others by b
+func testCluster(pc *ProxyConfig, a, b *Node) *Cluster {
+	slots := &SlotMap{}
+	for i := range slots {
+		n := a
+		if i >= 8192 {
+			n = b
+		}
+		slots[i] = &Slot{id: i, master: n}
+	}
+	return &Cluster{
+		pc:      pc,
+		pools:   make(map[string]*ConnPool),
+		opts:    make(map[string]*Options),
+		retired: make(map[string][]*ConnPool),
+		topo:    &Topology{conf: pc, slots: slots, reloadChan: make(chan int, 1)},
+	}
+}
+
+func TestClusterKeyspace(t *testing.T) {
+	// a is the first master in id order
+	ra, rb := make(map[string]string), make(map[string]string)
+	a, la := fakeMaster(t, ra)
+	defer la.Close()
+	b, lb := fakeMaster(t, rb)
+	defer lb.Close()
+	if b.id < a.id {
+		a, b = b, a
+		ra, rb = rb, ra
+	}
+	ra["SCAN 0 COUNT 1"] = "*2\r\n$1\r\n5\r\n*1\r\n$2\r\na1\r\n"
+	ra["SCAN 5 COUNT 1"] = "*2\r\n$1\r\n0\r\n*1\r\n$2\r\na2\r\n"
+	ra["DBSIZE"] = ":2\r\n"
+	ra["RANDOMKEY"] = "$-1\r\n"
+	rb["SCAN 0 COUNT 1"] = "*2\r\n$1\r\n0\r\n*1\r\n$2\r\nb1\r\n"
+	rb["DBSIZE"] = ":1\r\n"
+	rb["RANDOMKEY"] = "$2\r\nb1\r\n"
+
+	pc := &ProxyConfig{conCurrency: 5, dialTimeout: time.Second, readTimeout: time.Second, poolSize: 2}
+	s := newTestSession(pc)
+	s.p.cluster = testCluster(pc, a, b)
+	s.conCurrency = make(chan int, 5)
+	exec := func(f func(*ArrayResp, int64), args ...string) string {
+		f(newCommand(args...), 0)
+		<-s.conCurrency
+		return encodeResp(t, (<-s.resps).resp)
+	}
+
+	// a has a1 and a2, b has b1, the cursor moves from a to b
+	steps := []struct {
+		cursor, want string
+	}{
+		{"0", "*2\r\n$4\r\n5120\r\n*1\r\n$2\r\na1\r\n"},
+		{"5120", "*2\r\n$1\r\n1\r\n*1\r\n$2\r\na2\r\n"},
+		{"1", "*2\r\n$1\r\n0\r\n*1\r\n$2\r\nb1\r\n"},
+		{"2", "*2\r\n$1\r\n0\r\n*0\r\n"},
+	}
+	for _, step := range steps {
+		if got := exec(s.SCAN, "SCAN", step.cursor, "COUNT", "1"); got != step.want {
+			t.Fatalf("SCAN %s got %q, want %q", step.cursor, got, step.want)
+		}
+	}
+	if got := exec(s.SCAN, "SCAN", "x"); got != "-"+InvalidCursorError.Error()+"\r\n" {
+		t.Fatalf("bad cursor got %q", got)
+	}
+	if got := exec(s.DBSIZE, "DBSIZE"); got != ":3\r\n" {
+		t.Fatalf("DBSIZE got %q", got)
+	}
+	if got := exec(s.RANDOMKEY, "RANDOMKEY"); got != "$2\r\nb1\r\n" {
+		t.Fatalf("RANDOMKEY got %q", got)
+	}
+}
@@ -0,0 +1,221 @@
+package archer
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	NoProtoError     = errors.New("NOPROTO unsupported protocol version")
+	HelloSyntaxError = errors.New("ERR Syntax error in HELLO option")
+	// 和 redis cluster 一样, 集群只有 DB 0
+	SelectClusterError = errors.New("ERR SELECT is not allowed in cluster mode")
+)
+
+// ClientState tracks the connection level state changed by client commands,
+// a backend connection must be in the same state before serving the client
+type ClientState struct {
+	User       string  // AUTH/HELLO, default user before authenticated
+	Authed     bool    // AUTH/HELLO, false while the client still must AUTH
+	DB         int     // SELECT
+	Proto      int     // HELLO, RESP2 or RESP3
+	Subscribed int     // channels and patterns subscribed
+	Tx         TxState // MULTI/EXEC
+}
+
+type TxState int
+
+const (
+	TxNone    TxState = iota // 不在事务中
+	TxMulti                  // MULTI 之后, 命令返回 +QUEUED 排队中
+	TxAborted                // 排队时有命令出错, EXEC 会返回 EXECABORT
+)
+
+func NewClientState() *ClientState {
+	return &ClientState{User: "default", Authed: true, Proto: RESP2}
+}
+
+// StateSnapshot is a comparable copy of ClientState
+type StateSnapshot struct {
+	DB         int
+	Proto      int
+	Subscribed int
+	Tx         TxState
+}
+
+func (s *ClientState) Snapshot() StateSnapshot {
+	return StateSnapshot{
+		DB:         s.DB,
+		Proto:      s.Proto,
+		Subscribed: s.Subscribed,
+		Tx:         s.Tx,
+	}
+}
+
+// Restore resets s to the state recorded by ss
+func (s *ClientState) Restore(ss StateSnapshot) {
+	s.DB = ss.DB
+	s.Proto = ss.Proto
+	s.Subscribed = ss.Subscribed
+	s.Tx = ss.Tx
+}
+
+// Matches reports whether a connection in state ss can serve a client in state other
+func (ss StateSnapshot) Matches(other StateSnapshot) bool {
+	return ss == other
+}
+
+// ParseSelect returns the DB index of a SELECT command, ok is false if r
+// isn't SELECT or the index is negative or not a number
+func ParseSelect(r Resp) (db int, ok bool) {
+	ar, isArr := r.(*ArrayResp)
+	if !isArr || ar.Length() != 1 {
+		return 0, false
+	}
+	if name, ok := ar.Arg(0); !ok || !bytes.EqualFold(name, SELECT) {
+		return 0, false
+	}
+	arg, ok := ar.Arg(1)
+	if !ok {
+		return 0, false
+	}
+
+	// ParseUint rejects signs, so -1 and +1 as well
+	n, err := strconv.ParseUint(string(arg), 10, 31)
+	if err != nil {
+		return 0, false
+	}
+	return int(n), true
+}
+
+func newSelect(db int) *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Args = []*BulkResp{NewBulkResp(SELECT), NewBulkResp([]byte(strconv.Itoa(db)))}
+	return ar
+}
+
+// Hello is a parsed HELLO command
+type Hello struct {
+	Proto    int // 0 if there's none and the current protocol is kept
+	Auth     bool
+	User     string
+	Password string
+}
+
+// ParseHello parses HELLO [protover [AUTH username password] [SETNAME name]],
+// SETNAME is accepted and ignored
+func ParseHello(ar *ArrayResp) (*Hello, error) {
+	h := &Hello{}
+	v, ok := ar.Arg(1)
+	if !ok {
+		return h, nil
+	}
+	proto, err := strconv.Atoi(string(v))
+	if err != nil || (proto != RESP2 && proto != RESP3) {
+		return nil, NoProtoError
+	}
+	h.Proto = proto
+
+	for i := 2; i <= ar.Length(); i++ {
+		opt, _ := ar.Arg(i)
+		switch {
+		case bytes.EqualFold(opt, []byte("AUTH")) && i+2 <= ar.Length():
+			user, _ := ar.Arg(i + 1)
+			password, _ := ar.Arg(i + 2)
+			h.Auth, h.User, h.Password = true, string(user), string(password)
+			i += 2
+		case bytes.EqualFold(opt, []byte("SETNAME")) && i+1 <= ar.Length():
+			i++
+		default:
+			return nil, HelloSyntaxError
+		}
+	}
+	return h, nil
+}
+
+// HelloResp is the reply of HELLO in protocol proto, a map in RESP3 and a
+// flat array in RESP2. version is the redis version whose protocol the
+// proxy speaks, clients check it before using newer features
+func HelloResp(proto int) Resp {
+	modules := &ArrayResp{}
+	modules.Rtype = ArrayType
+	elems := []Resp{
+		NewBulkResp([]byte("server")), NewBulkResp([]byte("archer")),
+		NewBulkResp([]byte("version")), NewBulkResp([]byte("6.0.0")),
+		NewBulkResp([]byte("proto")), NewIntResp(int64(proto)),
+		NewBulkResp([]byte("mode")), NewBulkResp([]byte("standalone")),
+		NewBulkResp([]byte("role")), NewBulkResp([]byte("master")),
+		NewBulkResp([]byte("modules")), modules,
+	}
+
+	if proto == RESP3 {
+		mr := &MapResp{Elems: elems}
+		mr.Rtype = MapType
+		return mr
+	}
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	for _, e := range elems {
+		ar.append(e)
+	}
+	return ar
+}
+
+// TrackTx updates the transaction state with the backend reply of command
+// cmd (upper case). Every command queued after MULTI must reply +QUEUED,
+// any other reply means redis refused to queue it and EXEC will abort.
+func (s *ClientState) TrackTx(cmd string, reply Resp) {
+	switch cmd {
+	case "MULTI":
+		if s.Tx == TxNone && isStatus(reply, OK) {
+			s.Tx = TxMulti
+		}
+		return
+	case "EXEC", "DISCARD":
+		s.Tx = TxNone
+		return
+	}
+
+	if s.Tx == TxMulti && !isStatus(reply, QUEUED) {
+		s.Tx = TxAborted
+	}
+}
+
+// isStatus reports whether r is the simple string status
+func isStatus(r Resp, status []byte) bool {
+	sr, ok := r.(*SimpleResp)
+	return ok && len(sr.Args) > 0 && bytes.Equal(sr.Args[0], status)
+}
+
+// commands a RESP2 client can send while subscribed
+var subscribeModeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+	"RESET":        true,
+}
+
+// AllowedInSubscribeMode reports whether ar can be sent in the current state,
+// a RESP2 connection with subscriptions only accepts the subscribe commands,
+// PING, QUIT and RESET. RESP3 connections accept any command
+func (s *ClientState) AllowedInSubscribeMode(ar *ArrayResp) bool {
+	if s.Subscribed == 0 || s.Proto == RESP3 {
+		return true
+	}
+	return subscribeModeCommands[cmdName(ar)]
+}
+
+// SubscribeModeErrorResp is the error redis replies to a command refused by
+// AllowedInSubscribeMode
+func SubscribeModeErrorResp(ar *ArrayResp) *ErrorResp {
+	return NewErrorRespf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context",
+		strings.ToLower(cmdName(ar)))
+}
@@ -0,0 +1,178 @@
+package archer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStateSnapshotMatches(t *testing.T) {
+	a := NewClientState()
+	b := NewClientState()
+	if !a.Snapshot().Matches(b.Snapshot()) {
+		t.Fatal("fresh states must match")
+	}
+
+	b.DB = 3
+	if a.Snapshot().Matches(b.Snapshot()) {
+		t.Fatal("different DB must not match")
+	}
+
+	b.DB = 0
+	b.Proto = RESP3
+	if a.Snapshot().Matches(b.Snapshot()) {
+		t.Fatal("different protocol must not match")
+	}
+
+	b.Proto = RESP2
+	b.Tx = TxMulti
+	b.Subscribed = 2
+	ss := b.Snapshot()
+	if a.Snapshot().Matches(ss) {
+		t.Fatal("tx/subscribe state must not match")
+	}
+
+	a.Restore(ss)
+	if !a.Snapshot().Matches(ss) {
+		t.Fatal("restored state must match")
+	}
+	b.Restore(NewClientState().Snapshot())
+	if !b.Snapshot().Matches(NewClientState().Snapshot()) {
+		t.Fatal("reset state must match a fresh one")
+	}
+}
+
+func TestTrackTx(t *testing.T) {
+	s := NewClientState()
+	steps := []struct {
+		cmd   string
+		reply string
+		tx    TxState
+	}{
+		{"MULTI", "+OK\r\n", TxMulti},
+		{"SET", "+QUEUED\r\n", TxMulti},
+		{"FOO", "-ERR unknown command 'FOO'\r\n", TxAborted},
+		{"GET", "+QUEUED\r\n", TxAborted},
+		{"EXEC", "-EXECABORT Transaction discarded because of previous errors.\r\n", TxNone},
+		{"MULTI", "+OK\r\n", TxMulti},
+		{"INCR", "+QUEUED\r\n", TxMulti},
+		{"EXEC", "*1\r\n:1\r\n", TxNone},
+	}
+
+	for i, step := range steps {
+		s.TrackTx(step.cmd, readResp(t, step.reply))
+		if s.Tx != step.tx {
+			t.Fatalf("step %d %s: tx state %d, want %d", i, step.cmd, s.Tx, step.tx)
+		}
+	}
+}
+
+func TestAllowedInSubscribeMode(t *testing.T) {
+	s := NewClientState()
+	get := newCommand("get", "foo")
+	if !s.AllowedInSubscribeMode(get) {
+		t.Fatal("GET must be allowed without subscriptions")
+	}
+
+	s.Subscribed = 1
+	if s.AllowedInSubscribeMode(get) {
+		t.Fatal("GET must be rejected in subscribe mode")
+	}
+	for _, cmd := range []*ArrayResp{newCommand("SUBSCRIBE", "ch"), newCommand("punsubscribe"), newCommand("PING"), newCommand("QUIT")} {
+		if !s.AllowedInSubscribeMode(cmd) {
+			t.Fatalf("%s must be allowed in subscribe mode", cmd.String())
+		}
+	}
+	want := "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n"
+	if got := encodeResp(t, SubscribeModeErrorResp(get)); got != want {
+		t.Fatalf("%q", got)
+	}
+
+	s.Proto = RESP3
+	if !s.AllowedInSubscribeMode(get) {
+		t.Fatal("RESP3 allows any command in subscribe mode")
+	}
+}
+
+func TestParseSelect(t *testing.T) {
+	for in, want := range map[string]int{
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n":  0,
+		"*2\r\n$6\r\nselect\r\n$2\r\n15\r\n": 15,
+		"select 3\r\n":                       3,
+	} {
+		db, ok := ParseSelect(readResp(t, in))
+		if !ok || db != want {
+			t.Fatalf("%q got %d %v", in, db, ok)
+		}
+	}
+
+	for _, in := range []string{
+		"*2\r\n$6\r\nSELECT\r\n$2\r\n-1\r\n",
+		"*2\r\n$6\r\nSELECT\r\n$2\r\n+1\r\n",
+		"*2\r\n$6\r\nSELECT\r\n$1\r\na\r\n",
+		"*2\r\n$6\r\nSELECT\r\n$0\r\n\r\n",
+		"*2\r\n$6\r\nSELECT\r\n$-1\r\n",
+		"*1\r\n$6\r\nSELECT\r\n",
+		"*3\r\n$6\r\nSELECT\r\n$1\r\n1\r\n$1\r\n2\r\n",
+		"*2\r\n$3\r\nGET\r\n$1\r\n1\r\n",
+		"+SELECT\r\n",
+	} {
+		if db, ok := ParseSelect(readResp(t, in)); ok {
+			t.Fatalf("%q must be rejected, got %d", in, db)
+		}
+	}
+}
+
+func TestParseHello(t *testing.T) {
+	for in, want := range map[string]int{
+		"HELLO\r\n":                 0,
+		"hello 3\r\n":               RESP3,
+		"HELLO 2\r\n":               RESP2,
+		"HELLO 3 SETNAME myapp\r\n": RESP3,
+		"HELLO 3 setname myapp\r\n": RESP3,
+	} {
+		h, err := ParseHello(readResp(t, in).(*ArrayResp))
+		if err != nil || h.Proto != want || h.Auth {
+			t.Fatalf("%q got %+v %v", in, h, err)
+		}
+	}
+
+	h, err := ParseHello(readResp(t, "HELLO 3 AUTH alice secret SETNAME myapp\r\n").(*ArrayResp))
+	if err != nil || h.Proto != RESP3 || !h.Auth || h.User != "alice" || h.Password != "secret" {
+		t.Fatalf("got %+v %v", h, err)
+	}
+
+	for in, want := range map[string]error{
+		"HELLO 4\r\n":              NoProtoError,
+		"HELLO x\r\n":              NoProtoError,
+		"HELLO 3 AUTH default\r\n": HelloSyntaxError,
+		"HELLO 3 SETNAME\r\n":      HelloSyntaxError,
+		"HELLO 3 FOO\r\n":          HelloSyntaxError,
+	} {
+		if _, err := ParseHello(readResp(t, in).(*ArrayResp)); err != want {
+			t.Fatalf("%q got %v", in, err)
+		}
+	}
+}
+
+func TestHelloResp(t *testing.T) {
+	r3, ok := HelloResp(RESP3).(*MapResp)
+	if !ok || len(r3.Elems) != 12 {
+		t.Fatal(r3)
+	}
+	r2, ok := HelloResp(RESP2).(*ArrayResp)
+	if !ok || r2.Length() != 11 {
+		t.Fatal(r2)
+	}
+	// the same pairs, a RESP2 client gets the map flattened
+	if d := Downgrade(r3); d.Type() != ArrayType || d.String() != strings.Replace(r2.String(), "proto 2", "proto 3", 1) {
+		t.Fatal(d, r2)
+	}
+
+	fields, err := replyPairs(r3)
+	if err != nil || len(fields) != 12 || string(fields[4].(*BulkResp).Args[0]) != "proto" {
+		t.Fatal(fields, err)
+	}
+	if n, err := fields[5].(*IntResp).Int(); err != nil || n != RESP3 {
+		t.Fatal(n, err)
+	}
+}
@@ -0,0 +1,331 @@
+package archer
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dongzerun/archer/util"
+)
+
+var IncompleteError = errors.New("incomplete resp frame")
+
+// StreamParser is a resumable parser for event loop style I/O: feed it
+// whatever bytes arrived, and take the completed frames with Next.
+// Partial frames are kept between calls, whatever the frame stopped in the
+// middle of a header line, a bulk body or an array.
+//
+//	p := NewStreamParser()
+//	p.Feed(data)
+//	for r, ok := p.Next(); ok; r, ok = p.Next() {
+//	    ...
+//	}
+//	if p.Err() != nil { close the connection }
+type StreamParser struct {
+	buf []byte // fed but not parsed yet
+
+	line []byte // header line without \n yet
+
+	bulk     *BulkResp // bulk waiting for its body
+	body     []byte
+	need     int  // bytes of body and \r\n still missing
+	verbatim bool // the body is a verbatim string fmt:text
+
+	stack []*pending // containers waiting for their elements
+
+	limits ParserLimits
+	err    error
+}
+
+// pending is an array or map waiting for remain more elements
+type pending struct {
+	resp   Resp
+	remain int
+}
+
+// NewStreamParser returns a parser with DefaultParserLimits
+func NewStreamParser() *StreamParser {
+	return &StreamParser{limits: DefaultParserLimits}
+}
+
+// NewStreamParserWithLimits returns a parser with the header lengths capped by limits
+func NewStreamParserWithLimits(limits ParserLimits) *StreamParser {
+	return &StreamParser{limits: limits}
+}
+
+// Feed appends data to the parser, data is copied and can be reused by the caller
+func (p *StreamParser) Feed(data []byte) {
+	p.buf = append(p.buf, data...)
+}
+
+// Next returns the next completed frame, false if more data is needed
+// or a protocol error happened, see Err
+func (p *StreamParser) Next() (Resp, bool) {
+	for len(p.buf) > 0 && p.err == nil {
+		// middle of bulk body
+		if p.bulk != nil {
+			n := p.need
+			if n > len(p.buf) {
+				n = len(p.buf)
+			}
+			p.body = append(p.body, p.buf[:n]...)
+			p.buf = p.buf[n:]
+			p.need -= n
+			if p.need > 0 {
+				break
+			}
+
+			if err := checkBulkEnd(p.body, len(p.body)-2); err != nil {
+				p.err = err
+				break
+			}
+			br := p.bulk
+			p.bulk = nil
+			var r Resp = br
+			if p.verbatim {
+				vr, err := parseVerbatim(p.body[:len(p.body)-2])
+				if err != nil {
+					p.err = err
+					break
+				}
+				r = vr
+			} else {
+				br.Args = append(br.Args, p.body[:len(p.body)-2])
+			}
+			p.body = nil
+			if r, ok := p.complete(r); ok {
+				return r, true
+			}
+			continue
+		}
+
+		// middle of header line
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			p.line = append(p.line, p.buf...)
+			p.buf = p.buf[:0]
+			break
+		}
+		line := append(p.line, p.buf[:i+1]...)
+		p.line = nil
+		p.buf = p.buf[i+1:]
+
+		r, err := p.header(line)
+		if err != nil {
+			p.err = err
+			break
+		}
+		if r == nil {
+			// bulk body or container elements follow
+			continue
+		}
+		if r, ok := p.complete(r); ok {
+			return r, true
+		}
+	}
+
+	// reclaim the consumed space
+	if len(p.buf) == 0 {
+		p.buf = p.buf[:0]
+	}
+	return nil, false
+}
+
+// Err returns the protocol error stopping the parser, the connection should be closed
+func (p *StreamParser) Err() error {
+	return p.err
+}
+
+// Buffered returns the bytes fed but not consumed yet
+func (p *StreamParser) Buffered() int {
+	return len(p.buf)
+}
+
+// header handles a complete header line, it returns the frame if the line is
+// the whole frame, or nil when waiting for a bulk body or container elements
+func (p *StreamParser) header(line []byte) (Resp, error) {
+	if err := p.limits.checkLine(line); err != nil {
+		return nil, err
+	}
+	if !isFrameByte(line[0]) {
+		return parseInline(line)
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case SimpSep:
+		sr := &SimpleResp{}
+		sr.Rtype = SimpleType
+		sr.Args = append(sr.Args, body)
+		return sr, nil
+	case ErrSep:
+		er := &ErrorResp{}
+		er.Rtype = ErrorType
+		er.Args = append(er.Args, body)
+		return er, nil
+	case IntSep:
+		ir := &IntResp{}
+		ir.Rtype = IntType
+		ir.Args = append(ir.Args, body)
+		return ir, nil
+	case NullSep:
+		return NewNullResp(), nil
+	case BoolSep:
+		return parseBool(line)
+	case DoubleSep:
+		dr := &DoubleResp{}
+		dr.Rtype = DoubleType
+		dr.Args = append(dr.Args, body)
+		return dr, nil
+	case BigNumSep:
+		return NewBigNumberResp(body), nil
+	case BulkSep, VerbatimSep:
+		l, err := util.ParseLen(body)
+		if err != nil {
+			return nil, err
+		}
+		p.verbatim = line[0] == VerbatimSep
+		if l == -1 {
+			if p.verbatim {
+				return nil, VerbatimFormError
+			}
+			return NewNullBulkResp(), nil
+		}
+		if p.limits.MaxBulkLen > 0 && l > p.limits.MaxBulkLen {
+			return nil, BulkTooLargeError
+		}
+		p.bulk = &BulkResp{}
+		p.bulk.Rtype = BulkType
+		p.need = l + 2
+		size := l + 2
+		if size > bulkPrealloc {
+			size = bulkPrealloc
+		}
+		p.body = make([]byte, 0, size)
+		return nil, nil
+	case ArrSep:
+		n, err := util.ParseLen(body)
+		if err != nil {
+			return nil, err
+		}
+		ar := &ArrayResp{}
+		ar.Rtype = ArrayType
+		if n == -1 {
+			ar.Empty = true
+			return ar, nil
+		}
+		if err := p.checkAggregate(n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return ar, nil
+		}
+		p.stack = append(p.stack, &pending{resp: ar, remain: n})
+		return nil, nil
+	case MapSep:
+		n, err := parseAggregateLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkAggregate(n); err != nil {
+			return nil, err
+		}
+		mr := &MapResp{}
+		mr.Rtype = MapType
+		if n == 0 {
+			return mr, nil
+		}
+		p.stack = append(p.stack, &pending{resp: mr, remain: 2 * n})
+		return nil, nil
+	case SetSep:
+		n, err := parseAggregateLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkAggregate(n); err != nil {
+			return nil, err
+		}
+		sr := NewSetResp()
+		if n == 0 {
+			return sr, nil
+		}
+		p.stack = append(p.stack, &pending{resp: sr, remain: n})
+		return nil, nil
+	case PushSep:
+		n, err := parseAggregateLen(body)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.checkAggregate(n); err != nil {
+			return nil, err
+		}
+		pr := NewPushResp()
+		if n == 0 {
+			return pr, nil
+		}
+		p.stack = append(p.stack, &pending{resp: pr, remain: n})
+		return nil, nil
+	}
+
+	return parseInline(line)
+}
+
+// checkAggregate checks an array, map or set of n elements opened
+// inside the pending containers against the limits
+func (p *StreamParser) checkAggregate(n int) error {
+	if p.limits.MaxArrayLen > 0 && n > p.limits.MaxArrayLen {
+		return ArrayTooLongError
+	}
+	if p.limits.MaxDepth > 0 && len(p.stack)+1 > p.limits.MaxDepth {
+		return NestingTooDeepError
+	}
+	return nil
+}
+
+// complete adds r to the innermost pending container, it returns the top
+// level frame when r completes it
+func (p *StreamParser) complete(r Resp) (Resp, bool) {
+	for len(p.stack) > 0 {
+		top := p.stack[len(p.stack)-1]
+		switch c := top.resp.(type) {
+		case *ArrayResp:
+			c.append(r)
+		case *MapResp:
+			c.Elems = append(c.Elems, r)
+		case *SetResp:
+			c.Add(r)
+		case *PushResp:
+			c.Elems = append(c.Elems, r)
+		}
+		top.remain--
+		if top.remain > 0 {
+			return nil, false
+		}
+		p.stack = p.stack[:len(p.stack)-1]
+		r = top.resp
+	}
+	return r, true
+}
+
+// Decode parses one frame from the front of data without a bufio.Reader,
+// it returns the frame and the number of bytes consumed, so a pipeline
+// buffer can be walked by slicing off n each time. IncompleteError means
+// data doesn't hold a whole frame yet, read more and call again.
+// The frame is copied out, data can be reused once Decode returns
+func Decode(data []byte) (Resp, int, error) {
+	return Parse(data)
+}
+
+// Parse parses one frame from the front of data, it returns the frame and
+// the number of bytes consumed, IncompleteError if data is not a whole frame.
+// DefaultParserLimits apply as in ReadProtocol
+func Parse(data []byte) (Resp, int, error) {
+	p := &StreamParser{buf: data, limits: DefaultParserLimits}
+	r, ok := p.Next()
+	if p.err != nil {
+		return nil, 0, p.err
+	}
+	if !ok {
+		return nil, 0, IncompleteError
+	}
+	return r, len(data) - len(p.buf), nil
+}
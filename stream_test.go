@@ -0,0 +1,202 @@
+package archer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStreamParserByteByByte(t *testing.T) {
+	frames := []string{
+		"$5\r\nhello\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		"_\r\n",
+		"+OK\r\n",
+		"-ERR wrong\r\n",
+		":42\r\n",
+		"*0\r\n",
+		"*3\r\n$3\r\nset\r\n*2\r\n:1\r\n$-1\r\n$0\r\n\r\n",
+		"%2\r\n+a\r\n:1\r\n+b\r\n*1\r\n$1\r\nx\r\n",
+		"~2\r\n:1\r\n$1\r\ny\r\n",
+		"#f\r\n",
+		"PING\r\n",
+	}
+
+	p := NewStreamParser()
+	var got []Resp
+	for _, f := range frames {
+		for i := 0; i < len(f); i++ {
+			p.Feed([]byte{f[i]})
+			for r, ok := p.Next(); ok; r, ok = p.Next() {
+				got = append(got, r)
+			}
+		}
+	}
+	if p.Err() != nil {
+		t.Fatal(p.Err())
+	}
+	if p.Buffered() != 0 {
+		t.Fatalf("%d bytes left", p.Buffered())
+	}
+	if len(got) != len(frames) {
+		t.Fatalf("got %d frames, want %d", len(got), len(frames))
+	}
+	for i, r := range got {
+		if i == len(frames)-1 {
+			// inline command comes back as a RESP array
+			if s := encodeResp(t, r); s != "*1\r\n$4\r\nPING\r\n" {
+				t.Fatalf("inline: %q", s)
+			}
+			continue
+		}
+		if s := encodeResp(t, r); s != frames[i] {
+			t.Fatalf("frame %d: got %q want %q", i, s, frames[i])
+		}
+	}
+}
+
+func TestStreamParserPipeline(t *testing.T) {
+	p := NewStreamParser()
+	p.Feed([]byte("+OK\r\n:1\r\n$3\r\nfo"))
+
+	n := 0
+	for _, ok := p.Next(); ok; _, ok = p.Next() {
+		n++
+	}
+	if n != 2 {
+		t.Fatalf("got %d frames, want 2", n)
+	}
+
+	p.Feed([]byte("o\r\n"))
+	r, ok := p.Next()
+	if !ok || r.String() != "foo" {
+		t.Fatalf("got %v %v", r, ok)
+	}
+}
+
+func TestStreamParserError(t *testing.T) {
+	p := NewStreamParser()
+	p.Feed([]byte("$3\r\nfoobar\r\n"))
+	if _, ok := p.Next(); ok {
+		t.Fatal("expect no frame")
+	}
+	if p.Err() == nil {
+		t.Fatal("expect error for bad bulk length")
+	}
+	// parser stays stopped
+	p.Feed([]byte("+OK\r\n"))
+	if _, ok := p.Next(); ok {
+		t.Fatal("expect no frame after error")
+	}
+}
+
+func TestParse(t *testing.T) {
+	data := []byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n+OK\r\n")
+	r, n, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Fatalf("consumed %d, want 20", n)
+	}
+	if r.String() != "get a" {
+		t.Fatalf("got %q", r.String())
+	}
+
+	r, n, err = Parse(data[n:])
+	if err != nil || n != 5 || r.String() != "OK" {
+		t.Fatalf("got %v %d %v", r, n, err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if _, _, err := Parse(data[:i]); err != IncompleteError {
+			t.Fatalf("prefix %d: got %v", i, err)
+		}
+	}
+}
+
+func TestStreamParserInline(t *testing.T) {
+	r, n, err := Parse([]byte("SET a b\r\n"))
+	if err != nil || n != 9 {
+		t.Fatal(n, err)
+	}
+	if s := encodeResp(t, r); s != "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\nb\r\n" {
+		t.Fatalf("%q", s)
+	}
+	if _, _, err := Parse([]byte(" \r\n")); err != RawCmdError {
+		t.Fatal(err)
+	}
+}
+
+func TestParseMaxDepth(t *testing.T) {
+	nested := func(depth int) []byte {
+		var b bytes.Buffer
+		for i := 0; i < depth; i++ {
+			b.WriteString("*1\r\n")
+		}
+		b.WriteString(":1\r\n")
+		return b.Bytes()
+	}
+
+	max := DefaultParserLimits.MaxDepth
+	if _, n, err := Parse(nested(max)); err != nil || n != len(nested(max)) {
+		t.Fatal(n, err)
+	}
+	if _, _, err := Parse(nested(max + 1)); err != NestingTooDeepError {
+		t.Fatal(err)
+	}
+	if _, _, err := Parse(nested(100000)); err != NestingTooDeepError {
+		t.Fatal(err)
+	}
+
+	limits := ParserLimits{MaxBulkLen: 3, MaxArrayLen: 2, MaxDepth: 2}
+	for _, tt := range []struct {
+		data string
+		err  error
+	}{
+		{"$4\r\n", BulkTooLargeError},
+		{"*3\r\n", ArrayTooLongError},
+		{"%1\r\n~1\r\n*0\r\n", NestingTooDeepError},
+	} {
+		p := NewStreamParserWithLimits(limits)
+		p.Feed([]byte(tt.data))
+		if _, ok := p.Next(); ok || p.Err() != tt.err {
+			t.Fatalf("%q: %v", tt.data, p.Err())
+		}
+	}
+}
+
+func TestDecodePipeline(t *testing.T) {
+	frames := []string{
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n",
+		"+OK\r\n",
+		"*2\r\n*1\r\n:1\r\n$-1\r\n",
+		"PING\r\n",
+	}
+	data := []byte(strings.Join(frames, ""))
+
+	var got []string
+	for len(data) > 0 {
+		r, n, err := Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, encodeResp(t, r))
+		data = data[n:]
+	}
+	if len(got) != len(frames) || got[0] != frames[0] || got[2] != frames[2] {
+		t.Fatalf("%q", got)
+	}
+
+	// every proper prefix is incomplete
+	whole := []byte(frames[0])
+	for i := 1; i < len(whole); i++ {
+		if _, n, err := Decode(whole[:i]); err != IncompleteError || n != 0 {
+			t.Fatalf("prefix %q: %d %v", whole[:i], n, err)
+		}
+	}
+	if _, _, err := Decode(nil); err != IncompleteError {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,365 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/dongzerun/archer/util"
+)
+
+var (
+	BodyNotDrainedError = errors.New("streaming bulk body not drained before the next read")
+	BodyConsumedError   = errors.New("streaming bulk body already read")
+)
+
+// StreamingDecoder reads Resp one by one like ReadProtocol, except a bulk
+// string longer than threshold bytes: it's returned as a StreamingBulkResp
+// whose payload is still in the bufio.Reader, so a huge value can be copied
+// to the client without ever being held in memory.
+//
+// The body shares the reader with the next frame, it must be read to the
+// end, by Body, Encode, WriteTo or Discard, before calling Decode again.
+// Decode returns BodyNotDrainedError while an earlier body is abandoned
+// partway. Only top level bulks are streamed, bulks inside arrays are read
+// as usual. MaxReplyBytes doesn't apply to streamed bodies, MaxBulkLen does
+type StreamingDecoder struct {
+	r         *bufio.Reader
+	threshold int
+
+	pending *StreamingBulkResp
+}
+
+func NewStreamingDecoder(r *bufio.Reader, threshold int) *StreamingDecoder {
+	return &StreamingDecoder{r: r, threshold: threshold}
+}
+
+func (d *StreamingDecoder) Decode() (Resp, error) {
+	if d.pending != nil && !d.pending.done {
+		return nil, BodyNotDrainedError
+	}
+	d.pending = nil
+
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != BulkSep {
+		return ReadProtocol(d.r)
+	}
+
+	res, err := d.r.ReadSlice(byte('\n'))
+	if err != nil {
+		return nil, err
+	}
+	if err := DefaultParserLimits.checkLine(res); err != nil {
+		return nil, err
+	}
+	l, err := util.ParseLen(res[1 : len(res)-2])
+	if err != nil {
+		return nil, err
+	}
+	lim := &readLimits{ParserLimits: DefaultParserLimits}
+	if l <= d.threshold || l <= 0 {
+		if err := lim.add(len(res)); err != nil {
+			return nil, err
+		}
+		return readBulkBody(d.r, res, lim)
+	}
+	if err := lim.bulk(l); err != nil {
+		return nil, err
+	}
+
+	sb := &StreamingBulkResp{r: d.r, n: l, remain: l}
+	sb.Rtype = BulkType
+	d.pending = sb
+	return sb, nil
+}
+
+// StreamingBulkResp is a bulk string whose payload is read from the
+// backend on demand, see StreamingDecoder. The body can be read only once:
+// by Body, or by Encode and WriteTo which copy it out as a bulk frame
+type StreamingBulkResp struct {
+	BaseResp
+
+	r      *bufio.Reader
+	n      int   // payload length
+	remain int   // payload bytes not read yet
+	done   bool  // payload and \r\n read
+	err    error // sticky read error
+}
+
+// Len returns the payload length
+func (sb *StreamingBulkResp) Len() int {
+	return sb.n
+}
+
+// Body returns the payload reader, it returns io.EOF once Len bytes are
+// read and the \r\n after them checked
+func (sb *StreamingBulkResp) Body() io.Reader {
+	return readerFunc(sb.read)
+}
+
+// Drained reports whether the body is read to the end
+func (sb *StreamingBulkResp) Drained() bool {
+	return sb.done
+}
+
+// Discard reads and drops the rest of the body, so the next frame can be read
+func (sb *StreamingBulkResp) Discard() error {
+	_, err := io.Copy(ioutil.Discard, sb.Body())
+	return err
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+func (sb *StreamingBulkResp) read(p []byte) (int, error) {
+	if sb.err != nil {
+		return 0, sb.err
+	}
+	if sb.done {
+		return 0, io.EOF
+	}
+	if sb.remain == 0 {
+		return 0, sb.finish()
+	}
+
+	if len(p) > sb.remain {
+		p = p[:sb.remain]
+	}
+	n, err := sb.r.Read(p)
+	sb.remain -= n
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		sb.err = err
+		return n, err
+	}
+	// io.CopyN stops after the payload, check the \r\n right away
+	if sb.remain == 0 {
+		if err := sb.finish(); err != io.EOF {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// finish reads the \r\n after the payload, io.EOF if it's there
+func (sb *StreamingBulkResp) finish() error {
+	var crlf [2]byte
+	if _, err := io.ReadFull(sb.r, crlf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		sb.err = err
+		return err
+	}
+	if err := checkBulkEnd(crlf[:], 0); err != nil {
+		sb.err = err
+		return err
+	}
+	sb.done = true
+	return io.EOF
+}
+
+func (sb *StreamingBulkResp) String() string {
+	return fmt.Sprintf("<streaming bulk of %d bytes>", sb.n)
+}
+
+func (sb *StreamingBulkResp) Encode(w *bufio.Writer) error {
+	_, err := sb.WriteTo(w)
+	return err
+}
+
+func (sb *StreamingBulkResp) EncodeTo(b *bytes.Buffer) error {
+	_, err := sb.WriteTo(b)
+	return err
+}
+
+// WriteTo copies the body to w as a bulk frame, BodyConsumedError if some
+// of the body was read already. A *bufio.Writer is flushed at the end
+func (sb *StreamingBulkResp) WriteTo(w io.Writer) (int64, error) {
+	if sb.remain != sb.n || sb.done || sb.err != nil {
+		return 0, BodyConsumedError
+	}
+
+	var scratch [24]byte
+	header := append(scratch[:0], BulkSep)
+	header = strconv.AppendInt(header, int64(sb.n), 10)
+	header = append(header, CRLF...)
+	m, err := w.Write(header)
+	n := int64(m)
+	if err != nil {
+		return n, err
+	}
+	c, err := io.CopyN(w, sb.Body(), int64(sb.n))
+	n += c
+	if err != nil {
+		return n, err
+	}
+	m, err = w.Write(CRLF)
+	n += int64(m)
+	if err != nil {
+		return n, err
+	}
+	if bw, ok := w.(*bufio.Writer); ok {
+		return n, bw.Flush()
+	}
+	return n, nil
+}
+
+// ReadProtocolStreaming reads one frame from r and writes it to w as it
+// goes, bulk strings longer than maxBuf are copied in chunks of maxBuf bytes
+// and never held in memory. The returned Resp has the small elements, so
+// the command can still be inspected, the large bulks in it are drained
+// StreamingBulkResp with only their Len.
+//
+// w is flushed at the end. On error a partial frame may have been written,
+// the connection behind w must be closed. MaxReplyBytes doesn't apply to
+// the copied bulks, the other limits do.
+//
+// The sessions don't use it: ReadLoop reads every command whole, up to
+// MaxBulkLen, since the filter, ACL, rate limits and routing look at the
+// whole command before a backend is chosen
+func ReadProtocolStreaming(r *bufio.Reader, w *bufio.Writer, maxBuf int) (Resp, error) {
+	f := &frameForwarder{r: r, w: w, maxBuf: maxBuf}
+	f.lim = &readLimits{ParserLimits: DefaultParserLimits}
+	rsp, err := f.forward()
+	if err != nil {
+		return nil, err
+	}
+	return rsp, w.Flush()
+}
+
+type frameForwarder struct {
+	r      *bufio.Reader
+	w      *bufio.Writer
+	lim    *readLimits
+	maxBuf int
+	chunk  []byte // allocated at the first large bulk
+}
+
+func (f *frameForwarder) forward() (Resp, error) {
+	b, err := f.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	// b is overwritten by the next reads
+	sep := b[0]
+	switch sep {
+	case BulkSep, ArrSep, MapSep, SetSep, PushSep:
+	default:
+		// one line frames, verbatim strings and inline commands
+		rsp, err := readProtocol(f.r, f.lim)
+		if err != nil {
+			return nil, err
+		}
+		return f.emit(rsp)
+	}
+
+	res, err := f.r.ReadSlice(byte('\n'))
+	if err != nil {
+		return nil, err
+	}
+	if err := f.lim.checkLine(res); err != nil {
+		return nil, err
+	}
+	n, err := util.ParseLen(res[1 : len(res)-2])
+	if err != nil {
+		return nil, err
+	}
+	if sep == BulkSep && n > f.maxBuf {
+		return f.copyBulk(res, n)
+	}
+	if err := f.lim.add(len(res)); err != nil {
+		return nil, err
+	}
+	if sep == BulkSep {
+		rsp, err := readBulkBody(f.r, res, f.lim)
+		if err != nil {
+			return nil, err
+		}
+		return f.emit(rsp)
+	}
+	if sep == ArrSep && n == -1 {
+		ar := f.lim.newArray()
+		ar.Empty = true
+		return f.emit(ar)
+	}
+
+	if err := f.lim.enter(n); err != nil {
+		return nil, err
+	}
+	defer f.lim.leave()
+	if _, err := f.w.Write(res); err != nil {
+		return nil, err
+	}
+
+	var agg Resp
+	var add func(Resp)
+	switch sep {
+	case ArrSep:
+		ar := f.lim.newArray()
+		agg, add = ar, ar.append
+	case MapSep:
+		mr := &MapResp{}
+		mr.Rtype = MapType
+		agg, add = mr, func(e Resp) { mr.Elems = append(mr.Elems, e) }
+		n *= 2
+	case SetSep:
+		sr := NewSetResp()
+		agg, add = sr, sr.Add
+	case PushSep:
+		pr := NewPushResp()
+		agg, add = pr, func(e Resp) { pr.Elems = append(pr.Elems, e) }
+	}
+	for i := 0; i < n; i++ {
+		e, err := f.forward()
+		if err != nil {
+			return nil, err
+		}
+		add(e)
+	}
+	return agg, nil
+}
+
+// emit writes rsp to w without flushing
+func (f *frameForwarder) emit(rsp Resp) (Resp, error) {
+	if _, err := (frameWriter{bw: f.w}).elem(rsp); err != nil {
+		return nil, err
+	}
+	return rsp, nil
+}
+
+// copyBulk copies the n bytes body of a large bulk from r to w in chunks
+func (f *frameForwarder) copyBulk(res []byte, n int) (Resp, error) {
+	if err := f.lim.bulk(n); err != nil {
+		return nil, err
+	}
+	if _, err := f.w.Write(res); err != nil {
+		return nil, err
+	}
+	if f.chunk == nil {
+		f.chunk = make([]byte, f.maxBuf)
+	}
+
+	sb := &StreamingBulkResp{r: f.r, n: n, remain: n}
+	sb.Rtype = BulkType
+	// hide bufio.Writer.ReadFrom, so the body goes through chunk
+	if _, err := io.CopyBuffer(struct{ io.Writer }{f.w}, sb.Body(), f.chunk); err != nil {
+		return nil, err
+	}
+	if _, err := f.w.Write(CRLF); err != nil {
+		return nil, err
+	}
+	return sb, nil
+}
@@ -0,0 +1,196 @@
+package archer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestStreamingDecoder(t *testing.T) {
+	big := strings.Repeat("x", 100000)
+	data := "$3\r\nfoo\r\n$" + "100000\r\n" + big + "\r\n+OK\r\n$-1\r\n"
+	d := NewStreamingDecoder(bufio.NewReaderSize(strings.NewReader(data), 16), 1024)
+
+	r, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br, ok := r.(*BulkResp); !ok || string(br.Args[0]) != "foo" {
+		t.Fatalf("a small bulk is read as usual, got %v", r)
+	}
+
+	r, err = d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, ok := r.(*StreamingBulkResp)
+	if !ok || sb.Len() != len(big) || sb.Type() != BulkType {
+		t.Fatalf("%T %v", r, r)
+	}
+	var out bytes.Buffer
+	if n, err := io.CopyN(&out, sb.Body(), int64(sb.Len())); err != nil || n != int64(len(big)) {
+		t.Fatal(n, err)
+	}
+	if out.String() != big || !sb.Drained() {
+		t.Fatal("body not copied")
+	}
+
+	for _, want := range []string{"+OK\r\n", "$-1\r\n"} {
+		r, err = d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encodeResp(t, r) != want {
+			t.Fatal(r)
+		}
+	}
+}
+
+func TestStreamingDecoderAbandoned(t *testing.T) {
+	data := "$10\r\n0123456789\r\n:1\r\n"
+	d := NewStreamingDecoder(bufio.NewReader(strings.NewReader(data)), 4)
+	r, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb := r.(*StreamingBulkResp)
+
+	var p [3]byte
+	if _, err := sb.Body().Read(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode(); err != BodyNotDrainedError {
+		t.Fatal(err)
+	}
+	// half read, can't be encoded as a whole frame any more
+	if err := sb.EncodeTo(&bytes.Buffer{}); err != BodyConsumedError {
+		t.Fatal(err)
+	}
+
+	if err := sb.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	r, err = d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ir, ok := r.(*IntResp); !ok || string(ir.Args[0]) != "1" {
+		t.Fatal(r)
+	}
+}
+
+func TestStreamingBulkRespEncode(t *testing.T) {
+	data := "$10\r\n0123456789\r\n"
+	d := NewStreamingDecoder(bufio.NewReader(strings.NewReader(data)), 4)
+	r, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := WriteProtocol(w, r); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != data {
+		t.Fatalf("%q", b.String())
+	}
+	// the body is read once
+	if err := r.Encode(bufio.NewWriter(ioutil.Discard)); err != BodyConsumedError {
+		t.Fatal(err)
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamingBulkRespBadFrame(t *testing.T) {
+	for in, want := range map[string]error{
+		"$10\r\n0123456789XX": &ProtocolError{},
+		"$10\r\n01234":        io.ErrUnexpectedEOF,
+		"$10\r\n0123456789":   io.ErrUnexpectedEOF,
+	} {
+		d := NewStreamingDecoder(bufio.NewReader(strings.NewReader(in)), 4)
+		r, err := d.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = r.(*StreamingBulkResp).Discard()
+		if _, ok := want.(*ProtocolError); ok {
+			if _, ok := err.(*ProtocolError); !ok {
+				t.Fatalf("%q got %v", in, err)
+			}
+		} else if err != want {
+			t.Fatalf("%q got %v", in, err)
+		}
+	}
+}
+
+func TestReadProtocolStreaming(t *testing.T) {
+	big := strings.Repeat("v", 100000)
+	in := "*5\r\n$3\r\nSET\r\n$3\r\nkey\r\n$100000\r\n" + big + "\r\n$2\r\nEX\r\n$2\r\n10\r\n"
+	var out bytes.Buffer
+	w := bufio.NewWriterSize(&out, 64)
+	r, err := ReadProtocolStreaming(bufio.NewReaderSize(strings.NewReader(in), 16), w, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != in {
+		t.Fatal("frame not copied as is")
+	}
+
+	ar := r.(*ArrayResp)
+	if name, _ := ar.Command(); name != "SET" || ar.Length() != 4 {
+		t.Fatal(ar)
+	}
+	if key, _ := ar.Arg(1); string(key) != "key" {
+		t.Fatal(ar)
+	}
+	if ex, _ := ar.Arg(3); string(ex) != "EX" {
+		t.Fatal(ar)
+	}
+	sb, ok := ar.Elems[2].(*StreamingBulkResp)
+	if !ok || sb.Len() != len(big) || !sb.Drained() {
+		t.Fatal(ar.Elems[2])
+	}
+
+	for in, want := range map[string]string{
+		"+OK\r\n":                                "+OK\r\n",
+		"*-1\r\n":                                "*-1\r\n",
+		"get a\n":                                "*2\r\n$3\r\nget\r\n$1\r\na\r\n",
+		"%1\r\n$1\r\nk\r\n*2\r\n:1\r\n$-1\r\n":   "%1\r\n$1\r\nk\r\n*2\r\n:1\r\n$-1\r\n",
+		">2\r\n$7\r\nmessage\r\n=5\r\ntxt:x\r\n": ">2\r\n$7\r\nmessage\r\n=5\r\ntxt:x\r\n",
+		"~1\r\n$20\r\n01234567890123456789\r\n":  "~1\r\n$20\r\n01234567890123456789\r\n",
+	} {
+		var out bytes.Buffer
+		w := bufio.NewWriter(&out)
+		r, err := ReadProtocolStreaming(bufio.NewReader(strings.NewReader(in)), w, 8)
+		if err != nil {
+			t.Fatalf("%q: %v", in, err)
+		}
+		if out.String() != want {
+			t.Fatalf("%q: wrote %q", in, out.String())
+		}
+		if r == nil {
+			t.Fatal(in)
+		}
+	}
+
+	for in, want := range map[string]error{
+		"*1\r\n$20\r\n0123456789":             io.ErrUnexpectedEOF,
+		"*1\r\n$20\r\n01234567890123456789XX": &ProtocolError{},
+		"*1\r\n$4\r\nab":                      io.ErrUnexpectedEOF,
+	} {
+		_, err := ReadProtocolStreaming(bufio.NewReader(strings.NewReader(in)), bufio.NewWriter(ioutil.Discard), 8)
+		if _, ok := want.(*ProtocolError); ok {
+			if _, ok := err.(*ProtocolError); !ok {
+				t.Fatalf("%q got %v", in, err)
+			}
+		} else if err != want {
+			t.Fatalf("%q got %v", in, err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Package testutil has helpers shared by the protocol tests
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+
+	"github.com/dongzerun/archer"
+)
+
+// AssertValidFrame fails t unless data is exactly one RESP frame: it must
+// decode without error and consume every byte, and encoding the frame again
+// must give data back. Inline commands are re-encoded as arrays, so only
+// framed data is compared byte by byte
+func AssertValidFrame(t testing.TB, data []byte) archer.Resp {
+	t.Helper()
+
+	r, n, err := archer.Decode(data)
+	if err != nil {
+		t.Fatalf("decode %q: %s", data, err)
+	}
+	if n != len(data) {
+		t.Fatalf("decode %q: consumed %d of %d bytes", data, n, len(data))
+	}
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := r.Encode(w); err != nil {
+		t.Fatalf("encode %q: %s", data, err)
+	}
+	if isFramed(data[0]) && !bytes.Equal(b.Bytes(), data) {
+		t.Fatalf("round trip %q: got %q", data, b.Bytes())
+	}
+	return r
+}
+
+func isFramed(c byte) bool {
+	switch c {
+	case archer.SimpSep, archer.ErrSep, archer.IntSep, archer.BulkSep, archer.ArrSep,
+		archer.NullSep, archer.BoolSep, archer.DoubleSep, archer.BigNumSep,
+		archer.VerbatimSep, archer.MapSep, archer.SetSep, archer.PushSep:
+		return true
+	}
+	return false
+}
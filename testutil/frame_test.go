@@ -0,0 +1,68 @@
+package testutil
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/dongzerun/archer"
+)
+
+func TestAssertValidFrame(t *testing.T) {
+	frames := map[string]string{
+		"+OK\r\n":                        archer.SimpleType,
+		"-ERR x\r\n":                     archer.ErrorType,
+		":-42\r\n":                       archer.IntType,
+		"$3\r\nfoo\r\n":                  archer.BulkType,
+		"$-1\r\n":                        archer.BulkType,
+		"*2\r\n$3\r\nGET\r\n$1\r\na\r\n": archer.ArrayType,
+		"*2\r\n*1\r\n:1\r\n+OK\r\n":      archer.ArrayType,
+		"*-1\r\n":                        archer.ArrayType,
+		"_\r\n":                          archer.NullType,
+		"#t\r\n":                         archer.BoolType,
+		",1.5\r\n":                       archer.DoubleType,
+		"(12345678901234567890\r\n":      archer.BigNumType,
+		"=7\r\ntxt:abc\r\n":              archer.VerbatimType,
+		"%1\r\n+a\r\n:1\r\n":             archer.MapType,
+		"~2\r\n+a\r\n+b\r\n":             archer.SetType,
+		">2\r\n+message\r\n:1\r\n":       archer.PushType,
+		"GET a\r\n":                      archer.ArrayType,
+	}
+	for data, typ := range frames {
+		if r := AssertValidFrame(t, []byte(data)); r.Type() != typ {
+			t.Fatalf("%q: type %s want %s", data, r.Type(), typ)
+		}
+	}
+}
+
+// fatalTB records the failure instead of stopping the test
+type fatalTB struct {
+	testing.TB
+	failed bool
+}
+
+func (f *fatalTB) Helper() {}
+
+func (f *fatalTB) Fatalf(format string, args ...interface{}) {
+	f.failed = true
+	runtime.Goexit()
+}
+
+func TestAssertValidFrameFails(t *testing.T) {
+	for _, data := range []string{
+		"+OK\r\n+OK\r\n", // two frames
+		"$3\r\nfo",       // incomplete
+		"$03\r\nfoo\r\n", // not the canonical encoding
+		"\r\n",           // empty inline command
+	} {
+		f := &fatalTB{TB: t}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			AssertValidFrame(f, []byte(data))
+		}()
+		<-done
+		if !f.failed {
+			t.Fatalf("%q should fail", data)
+		}
+	}
+}
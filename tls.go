@@ -0,0 +1,115 @@
+package archer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// ServerTLSConfig is the TLS config of the client listener. With caFile
+// clients are verified against it, clientAuth requires them to send a
+// certificate at all
+func ServerTLSConfig(certFile, keyFile, caFile string, clientAuth bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS cert %s failed %s", certFile, err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		if cfg.ClientCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if clientAuth {
+		if cfg.ClientCAs == nil {
+			return nil, errors.New("TLS client auth needs a CA file")
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// BackendTLSConfig is the TLS config archer dials backends with, caFile
+// empty verifies them against the system roots, certFile and keyFile are
+// the client certificate for backends verifying clients
+func BackendTLSConfig(caFile, certFile, keyFile, serverName string, skipVerify bool) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: skipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	var err error
+	if caFile != "" {
+		if cfg.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load backend TLS cert %s failed %s", certFile, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read TLS CA %s failed %s", file, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate in TLS CA %s", file)
+	}
+	return pool, nil
+}
+
+// dialBackend dials a backend node, over TLS if pc has a backend TLS
+// config. The handshake is done here within the dial timeout, so a slow
+// handshake never shows up as a read timeout of the first command
+func dialBackend(host string, port int, pc *ProxyConfig) (net.Conn, error) {
+	addr := fmt.Sprintf("%s:%d", host, port)
+	network, dialAddr := "tcp4", addr
+	if path, ok := pc.unixSockets[addr]; ok {
+		network, dialAddr = "unix", path
+	}
+	var c net.Conn
+	var err error
+
+	if pc.dialTimeout > 0 {
+		c, err = net.DialTimeout(network, dialAddr, pc.dialTimeout)
+	} else {
+		c, err = net.Dial(network, dialAddr)
+	}
+	if err != nil || pc.backendTLS == nil {
+		return c, err
+	}
+
+	cfg := pc.backendTLS
+	if cfg.ServerName == "" {
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	tc := tls.Client(c, cfg)
+	if pc.dialTimeout > 0 {
+		tc.SetDeadline(time.Now().Add(pc.dialTimeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed %s", addr, err)
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
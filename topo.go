@@ -4,13 +4,16 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	log "github.com/dongzerun/archer/logging"
 	"github.com/dongzerun/archer/util"
-	log "github.com/ngaut/logging"
 )
 
 func init() {
@@ -18,12 +21,13 @@ func init() {
 }
 
 type Node struct {
-	id        string // host:port
-	host      string
-	port      int
-	role      string
-	serveSlot *SlotRange // 0-16384
-	slaveOf   string
+	id         string // host:port
+	name       string // cluster node id, slaves refer to their master by it
+	host       string
+	port       int
+	role       string
+	serveSlots []SlotRange // 0-16383
+	slaveOf    string
 }
 
 type SlotRange struct {
@@ -37,21 +41,35 @@ type Slot struct {
 	slaves []*Node // slaves
 }
 
+// SlotMap is the node serving every slot, requests are routed from it
+// locally instead of chasing MOVED redirects. Unassigned slots are nil
+type SlotMap [16384]*Slot
+
 type Topology struct {
-	conf *ProxyConfig // 全局配置
+	conf *ProxyConfig // 全局配置, Reload 时由 SetConf 替换
 
-	rw sync.RWMutex // 读写锁
+	rw sync.RWMutex // 读写锁, 保护 slots 和 conf
 
-	slots []*Slot // Cluster Slot 逻辑拓扑结构
+	slots *SlotMap // Cluster Slot 逻辑拓扑结构
 
 	reloadChan chan int // Reload 消息 channel
+
+	rr uint32 // round-robin 读 slave 的计数
+
+	down func(id string) bool // 熔断摘除的节点, 读 slave 时跳过, nil 表示没有
+
+	// 拉取 slot 的种子节点, 来自 conf.nodes, 失败的移到 kickOff. 由 rw 保护,
+	// getSlots 在本地修改后整体替换, 共享的 conf 不变
+	seeds   []string
+	kickOff []string //TODO: handle kickOff nodes
 }
 
 func NewTopo(pc *ProxyConfig) *Topology {
 	t := &Topology{
 		conf:       pc,
 		reloadChan: make(chan int, 1),
-		slots:      make([]*Slot, 1),
+		slots:      &SlotMap{},
+		seeds:      pc.nodes,
 	}
 
 	t.reloadSlots()
@@ -72,10 +90,45 @@ func (t *Topology) ReloadLoop() {
 
 }
 
+// Reload asks ReloadLoop to reload the slot map, it never blocks: a reload
+// already asked for covers this one
+func (t *Topology) Reload() {
+	select {
+	case t.reloadChan <- 1:
+	default:
+	}
+}
+
+// SetConf switches to pc, the next reload asks the nodes of pc
+func (t *Topology) SetConf(pc *ProxyConfig) {
+	t.rw.Lock()
+	t.conf = pc
+	t.seeds, t.kickOff = pc.nodes, nil
+	t.rw.Unlock()
+}
+
+func (t *Topology) config() *ProxyConfig {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	return t.conf
+}
+
+// ring is the ketama ring, nil for a cluster
+func (t *Topology) ring() *Ketama {
+	if conf := t.config(); conf != nil {
+		return conf.ring
+	}
+	return nil
+}
+
 func (t *Topology) reloadSlots() {
+	// ketama 的 server 是配置的, 没有 slot
+	if t.ring() != nil {
+		return
+	}
 	ss, err := t.getSlots()
 	if err != nil {
-		log.Warningf("ReloadLoop failed ", err)
+		log.Warningf("ReloadLoop failed %s", err)
 		return
 	}
 
@@ -84,91 +137,171 @@ func (t *Topology) reloadSlots() {
 	t.rw.Unlock()
 }
 
-// 从配置中随机挑选一个节点，调用 cluster nodes 命令获取slot信息
-// 失败的话应该有重试，并且将失败的节点踢出掉
-func (t *Topology) getSlots() ([]*Slot, error) {
-	var nodes []*Node
+// 从种子节点中随机挑选一个节点，调用 cluster nodes 命令获取slot信息
+// 失败的节点踢出掉, 最多重试 3 次
+func (t *Topology) getSlots() (*SlotMap, error) {
+	var (
+		nodes []*Node
+		err   error
+	)
+	t.rw.RLock()
+	conf, seeds, kickOff := t.conf, t.seeds, t.kickOff
+	t.rw.RUnlock()
+	// 踢出在副本上做, 结束时在锁里发布, 期间 SetConf 换了配置就作废
+	seeds = append([]string(nil), seeds...)
+	defer func() {
+		t.rw.Lock()
+		if t.conf == conf {
+			t.seeds, t.kickOff = seeds, kickOff
+		}
+		t.rw.Unlock()
+	}()
 	for i := 0; i < 3; i++ {
-		idx := rand.Intn(len(t.conf.nodes))
+		if len(seeds) == 0 {
+			return nil, errors.New("loadSlots no nodes left")
+		}
+		idx := rand.Intn(len(seeds))
 
-		url := strings.Split(t.conf.nodes[idx], ":")
+		url := strings.Split(seeds[idx], ":")
 		if len(url) != 2 {
 			return nil, errors.New("loadSlots read nodes failed")
 		}
-		var (
-			err  error
-			port int
-		)
+		var port int
 		port, err = strconv.Atoi(url[1])
 		if err != nil {
 			return nil, fmt.Errorf("Topology getSlots port failed %s ", err.Error())
 		}
-		nodes, err = GetClusterNodes(url[0], port)
+		nodes, err = GetClusterNodes(url[0], port, conf)
 		if err == nil {
 			break
 		}
 
-		log.Warningf("getSlots failed, kick off url %s for reason %s", t.conf.nodes[idx], err.Error())
-		t.conf.kickOff = append(t.conf.kickOff, t.conf.nodes[idx])
-		if idx == 0 {
-			t.conf.nodes = t.conf.nodes[1:]
-		} else if idx == len(t.conf.nodes)-1 {
-			t.conf.nodes = t.conf.nodes[:len(t.conf.nodes)-2]
-		} else {
-			t.conf.nodes = append(t.conf.nodes[:idx-1], t.conf.nodes[idx+1:]...)
-		}
-
+		log.Warningf("getSlots failed, kick off url %s for reason %s", seeds[idx], err.Error())
+		kickOff = append(kickOff[:len(kickOff):len(kickOff)], seeds[idx])
+		seeds = append(seeds[:idx], seeds[idx+1:]...)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	slots := make([]*Slot, 16384)
-	slaves := make([]*Node, 0)
+	return buildSlots(nodes), nil
+}
+
+// buildSlots builds the slot map of the nodes replied by CLUSTER NODES
+func buildSlots(nodes []*Node) *SlotMap {
+	slots := &SlotMap{}
+	masters := make(map[string]*Node)
 
 	// range master node
 	for _, n := range nodes {
-		s := &Slot{}
-		for i := n.serveSlot.start; i <= n.serveSlot.stop; i++ {
-			s.id = i
-			if n.role == "master" {
-				s.master = n
-				slots[i] = s
-			} else {
-				slaves = append(slaves, n)
+		if n.role != "master" {
+			continue
+		}
+		masters[n.name] = n
+		for _, r := range n.serveSlots {
+			for i := r.start; i <= r.stop; i++ {
+				slots[i] = &Slot{id: i, master: n}
 			}
 		}
 	}
 
 	// range slave nodes
-	for _, n := range slaves {
-		for _, s := range slots {
-			if n.slaveOf == s.master.id {
-				s.slaves = append(s.slaves, n)
+	for _, n := range nodes {
+		m, ok := masters[n.slaveOf]
+		if n.role != "slave" || !ok {
+			continue
+		}
+		for _, r := range m.serveSlots {
+			for i := r.start; i <= r.stop; i++ {
+				slots[i].slaves = append(slots[i].slaves, n)
 			}
 		}
 	}
 
-	return slots, nil
+	return slots
 }
 
+// GetNodeID returns the node of key: the master of its slot, a slave of
+// it for a read with slave, or its ketama server
 func (t *Topology) GetNodeID(key []byte, slave bool) string {
+	if ring := t.ring(); ring != nil {
+		return ring.Get(key).id
+	}
 	id := util.Crc16sum(key) % 16384
 
+	t.rw.RLock()
 	s := t.slots[id]
+	t.rw.RUnlock()
+
+	if s == nil {
+		log.Warningf("Topology slot %d not served, Notify to Reload Topology", id)
+		t.Reload()
+		return ""
+	}
 
 	if !slave && s.master != nil {
 		return s.master.id
 	}
 
-	// default we have only 1 slave
-	// TODO:: add more slave RR read
 	if slave && len(s.slaves) >= 1 {
-		return s.slaves[0].id
+		start := uint32(0)
+		if conf := t.config(); conf != nil && conf.readPolicy == ReadRoundRobin {
+			start = atomic.AddUint32(&t.rr, 1)
+		}
+		for i := range s.slaves {
+			n := s.slaves[int((start+uint32(i))%uint32(len(s.slaves)))]
+			if t.down == nil || !t.down(n.id) {
+				return n.id
+			}
+		}
 	}
 
+	// no slave up, reads go to the master
+	if s.master != nil {
+		return s.master.id
+	}
 	return ""
 }
 
+// Masters returns the id of every master serving slots, or of every ketama
+// server, sorted so a node keeps its index as long as the topology doesn't
+// change
+func (t *Topology) Masters() []string {
+	if ring := t.ring(); ring != nil {
+		ids := make([]string, 0, len(ring.Servers()))
+		for _, n := range ring.Servers() {
+			ids = append(ids, n.id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	t.rw.RLock()
+	seen := make(map[string]bool)
+	for _, s := range t.slots {
+		if s != nil && s.master != nil {
+			seen[s.master.id] = true
+		}
+	}
+	t.rw.RUnlock()
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 func (t *Topology) GetNode(id string) *Node {
+	if ring := t.ring(); ring != nil {
+		return ring.Node(id)
+	}
+	t.rw.RLock()
+	defer t.rw.RUnlock()
 	for _, s := range t.slots {
+		if s == nil {
+			continue
+		}
 		if s.master != nil && s.master.id == id {
 			return s.master
 		}
@@ -181,6 +314,163 @@ func (t *Topology) GetNode(id string) *Node {
 	}
 
 	log.Warning("Topology GetNode Empty, Notify to Reload Topology ")
-	t.reloadChan <- 1
+	t.Reload()
 	return nil
 }
+
+// Moved points slot at the node addr right after a MOVED redirect, so
+// the next requests of the slot go there directly, and reloads the whole
+// map in the background since a MOVED usually comes with more changes
+func (t *Topology) Moved(slot int, addr string) {
+	n := t.GetNode(addr)
+	if n == nil {
+		n = nodeFromAddr(addr)
+	}
+	if n == nil || slot < 0 || slot >= len(t.slots) {
+		return
+	}
+
+	t.rw.Lock()
+	// the slaves belong to the old master
+	t.slots[slot] = &Slot{id: slot, master: n}
+	t.rw.Unlock()
+	t.Reload()
+}
+
+// NodeStatus is a node of the slot map, as listed by the admin API
+type NodeStatus struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Role    string `json:"role"`
+	SlaveOf string `json:"slave_of,omitempty"`
+	Slots   int    `json:"slots"` // served as the master
+}
+
+// SlotSpan is a run of consecutive slots served by the same nodes
+type SlotSpan struct {
+	Start  int      `json:"start"`
+	Stop   int      `json:"stop"`
+	Master string   `json:"master"`
+	Slaves []string `json:"slaves,omitempty"`
+}
+
+// Nodes returns the masters and slaves of the slot map, or the ketama
+// servers, sorted by id
+func (t *Topology) Nodes() []NodeStatus {
+	if ring := t.ring(); ring != nil {
+		list := make([]NodeStatus, 0, len(ring.Servers()))
+		for _, n := range ring.Servers() {
+			list = append(list, NodeStatus{ID: n.id, Name: n.name, Role: n.role})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		return list
+	}
+	t.rw.RLock()
+	nodes := make(map[string]*NodeStatus)
+	add := func(n *Node) *NodeStatus {
+		ns, ok := nodes[n.id]
+		if !ok {
+			ns = &NodeStatus{ID: n.id, Name: n.name, Role: n.role, SlaveOf: n.slaveOf}
+			nodes[n.id] = ns
+		}
+		return ns
+	}
+	for _, s := range t.slots {
+		if s == nil || s.master == nil {
+			continue
+		}
+		add(s.master).Slots++
+		for _, slave := range s.slaves {
+			add(slave)
+		}
+	}
+	t.rw.RUnlock()
+
+	list := make([]NodeStatus, 0, len(nodes))
+	for _, ns := range nodes {
+		list = append(list, *ns)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// SlotSpans returns the slot map as runs of slots, unassigned slots are
+// left out. It's empty with ketama
+func (t *Topology) SlotSpans() []SlotSpan {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	var spans []SlotSpan
+	var last *Slot
+	for i, s := range t.slots {
+		if s == nil || s.master == nil {
+			last = nil
+			continue
+		}
+		if last != nil && sameNodes(last, s) {
+			spans[len(spans)-1].Stop = i
+			continue
+		}
+		span := SlotSpan{Start: i, Stop: i, Master: s.master.id}
+		for _, slave := range s.slaves {
+			span.Slaves = append(span.Slaves, slave.id)
+		}
+		spans = append(spans, span)
+		last = s
+	}
+	return spans
+}
+
+// allNodes returns every node of the slot map, or every ketama server
+func (t *Topology) allNodes() []*Node {
+	if ring := t.ring(); ring != nil {
+		return ring.Servers()
+	}
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+	seen := make(map[string]bool)
+	var nodes []*Node
+	add := func(n *Node) {
+		if !seen[n.id] {
+			seen[n.id] = true
+			nodes = append(nodes, n)
+		}
+	}
+	for _, s := range t.slots {
+		if s == nil {
+			continue
+		}
+		if s.master != nil {
+			add(s.master)
+		}
+		for _, n := range s.slaves {
+			add(n)
+		}
+	}
+	return nodes
+}
+
+func sameNodes(a, b *Slot) bool {
+	if a.master.id != b.master.id || len(a.slaves) != len(b.slaves) {
+		return false
+	}
+	for i := range a.slaves {
+		if a.slaves[i].id != b.slaves[i].id {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeFromAddr makes a master node of host:port, for a node not in the
+// slot map yet
+func nodeFromAddr(addr string) *Node {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return nil
+	}
+	return &Node{id: addr, host: host, port: port, role: "master"}
+}
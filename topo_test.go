@@ -0,0 +1,162 @@
+package archer
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dongzerun/archer/util"
+)
+
+const clusterNodes = `07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 0 1426238317239 4 connected
+67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002 master - 0 1426238316232 2 connected 5461-10922
+292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003 master - 0 1426238318243 3 connected 10923-16383
+e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5459 5460 [5461-<-67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1]
+`
+
+func testNodes(t *testing.T, text string) []*Node {
+	cns, err := ParseClusterNodes(NewBulkResp([]byte(text)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := topoNodes(cns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nodes
+}
+
+func TestBuildSlots(t *testing.T) {
+	nodes := testNodes(t, clusterNodes)
+	if len(nodes) != 4 {
+		t.Fatalf("%d nodes, want 4", len(nodes))
+	}
+	n := nodes[3]
+	if n.id != "127.0.0.1:30001" || n.port != 30001 || n.role != "master" {
+		t.Fatalf("node %+v", n)
+	}
+	if nodes[0].role != "slave" || nodes[0].slaveOf != n.name {
+		t.Fatalf("slave %+v", nodes[0])
+	}
+
+	slots := buildSlots(nodes)
+	for _, i := range []int{0, 5459, 5460} {
+		if slots[i] == nil || slots[i].id != i || slots[i].master != n {
+			t.Fatalf("slot %d %+v", i, slots[i])
+		}
+		if len(slots[i].slaves) != 1 || slots[i].slaves[0] != nodes[0] {
+			t.Fatalf("slot %d slaves %v", i, slots[i].slaves)
+		}
+	}
+	if slots[16383] == nil || slots[16383].master.id != "127.0.0.1:30003" || len(slots[16383].slaves) != 0 {
+		t.Fatalf("slot 16383 %+v", slots[16383])
+	}
+}
+
+func TestTopologyMoved(t *testing.T) {
+	topo := &Topology{slots: buildSlots(testNodes(t, clusterNodes)), reloadChan: make(chan int, 1)}
+
+	key := []byte("foo")
+	slot := int(util.Crc16sum(key) % 16384)
+	if id := topo.GetNodeID(key, false); id != "127.0.0.1:30003" {
+		t.Fatalf("foo on %s", id)
+	}
+	if id := topo.GetNodeID([]byte("bar"), true); id != "127.0.0.1:30004" {
+		t.Fatalf("bar slave on %s", id)
+	}
+
+	topo.Moved(slot, "127.0.0.1:30002")
+	if id := topo.GetNodeID(key, false); id != "127.0.0.1:30002" {
+		t.Fatalf("foo on %s after MOVED", id)
+	}
+	topo.Moved(slot, "10.0.0.9:7000")
+	if id := topo.GetNodeID(key, false); id != "10.0.0.9:7000" {
+		t.Fatalf("foo on %s after MOVED to a new node", id)
+	}
+	select {
+	case <-topo.reloadChan:
+	default:
+		t.Fatal("MOVED must ask for a reload")
+	}
+}
+
+func TestGetNodeIDReadPolicy(t *testing.T) {
+	m, s1, s2 := &Node{id: "m:1"}, &Node{id: "s:1"}, &Node{id: "s:2"}
+	key := []byte("foo")
+	slot := util.Crc16sum(key) % 16384
+	topo := &Topology{slots: &SlotMap{}, conf: &ProxyConfig{readPolicy: ReadPreferReplica}}
+	topo.slots[slot] = &Slot{id: int(slot), master: m}
+
+	if id := topo.GetNodeID(key, true); id != "m:1" {
+		t.Fatalf("no slave, read from %s", id)
+	}
+
+	topo.slots[slot].slaves = []*Node{s1, s2}
+	for i := 0; i < 3; i++ {
+		if id := topo.GetNodeID(key, true); id != "s:1" {
+			t.Fatalf("prefer-replica read from %s", id)
+		}
+	}
+
+	topo.conf.readPolicy = ReadRoundRobin
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		seen[topo.GetNodeID(key, true)]++
+	}
+	if seen["s:1"] != 2 || seen["s:2"] != 2 {
+		t.Fatalf("round-robin %v", seen)
+	}
+	if id := topo.GetNodeID(key, false); id != "m:1" {
+		t.Fatalf("write to %s", id)
+	}
+}
+
+func TestTopologyMasters(t *testing.T) {
+	topo := &Topology{slots: buildSlots(testNodes(t, clusterNodes)), reloadChan: make(chan int, 1)}
+	got := topo.Masters()
+	want := []string{"127.0.0.1:30001", "127.0.0.1:30002", "127.0.0.1:30003"}
+	if len(got) != len(want) {
+		t.Fatalf("masters %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("masters %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGetSlotsKickOff(t *testing.T) {
+	good, lg := fakeMaster(t, map[string]string{
+		"CLUSTER NODES": fmt.Sprintf("$%d\r\n%s\r\n", len(clusterNodes), clusterNodes),
+	})
+	defer lg.Close()
+	ld, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := ld.Addr().String()
+	ld.Close()
+
+	pc := &ProxyConfig{nodes: []string{dead, good.id}, dialTimeout: time.Second, readTimeout: time.Second}
+	topo := &Topology{conf: pc, seeds: pc.nodes, reloadChan: make(chan int, 1)}
+	// the dead seed is tried first or not at all, the good one answers
+	for i := 0; i < 5; i++ {
+		ss, err := topo.getSlots()
+		if err != nil || ss[0].master.id != "127.0.0.1:30001" {
+			t.Fatal(err)
+		}
+	}
+	if len(pc.nodes) != 2 || pc.nodes[0] != dead || pc.nodes[1] != good.id {
+		t.Fatalf("config changed %v", pc.nodes)
+	}
+	if len(topo.seeds)+len(topo.kickOff) != 2 || topo.seeds[len(topo.seeds)-1] != good.id {
+		t.Fatalf("seeds %v kicked off %v", topo.seeds, topo.kickOff)
+	}
+
+	// a new config brings its seeds back
+	topo.SetConf(pc)
+	if len(topo.seeds) != 2 || topo.kickOff != nil {
+		t.Fatalf("seeds %v kicked off %v", topo.seeds, topo.kickOff)
+	}
+}
@@ -0,0 +1,272 @@
+package archer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/dongzerun/archer/logging"
+)
+
+const (
+	traceQueueLen  = 4096            // 等待导出的 span, 满了就丢弃
+	traceBatchSize = 512             // 一次导出的最多 span 个数
+	traceInterval  = 5 * time.Second // 不满一批时的导出间隔
+)
+
+// OTLP span kinds
+const (
+	SpanInternal = 1
+	SpanServer   = 2
+	SpanClient   = 3
+)
+
+// Tracer samples commands and exports their spans to an OpenTelemetry
+// collector with OTLP/HTTP in the JSON encoding, e.g. to
+// http://collector:4318/v1/traces. A command is sampled as a whole: its
+// root span covers the command from the first byte read to its reply
+// written, children are the client read, routing, backend round trips,
+// redirects and the reply write
+type Tracer struct {
+	endpoint string
+	service  string
+	ratio    float64 // sampled share of commands, 0 to 1
+
+	client *http.Client
+	spans  chan *Span
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// NewTracer starts exporting to endpoint, ratio is the share of commands
+// traced
+func NewTracer(endpoint, service string, ratio float64) *Tracer {
+	t := &Tracer{
+		endpoint: endpoint,
+		service:  service,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *Span, traceQueueLen),
+		done:     make(chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.exportLoop()
+	return t
+}
+
+// Start returns the root span of a command started at start, nil if the
+// command is not sampled. A nil Tracer samples nothing
+func (t *Tracer) Start(name string, start time.Time) *Span {
+	if t == nil || t.ratio <= 0 || (t.ratio < 1 && rand.Float64() >= t.ratio) {
+		return nil
+	}
+	sp := &Span{tracer: t, name: name, kind: SpanServer, start: start}
+	binary.BigEndian.PutUint64(sp.traceID[:8], rand.Uint64())
+	binary.BigEndian.PutUint64(sp.traceID[8:], rand.Uint64())
+	binary.BigEndian.PutUint64(sp.id[:], rand.Uint64())
+	return sp
+}
+
+// Close exports the spans queued and stops the Tracer
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() { close(t.done) })
+	t.wg.Wait()
+}
+
+func (t *Tracer) export(sp *Span) {
+	select {
+	case t.spans <- sp:
+	default:
+		Stats.SpansDropped.Add(1)
+	}
+}
+
+func (t *Tracer) exportLoop() {
+	defer t.wg.Done()
+	tick := time.NewTicker(traceInterval)
+	defer tick.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case sp := <-t.spans:
+			if batch = append(batch, sp); len(batch) >= traceBatchSize {
+				t.post(batch)
+				batch = nil
+			}
+		case <-tick.C:
+			if len(batch) > 0 {
+				t.post(batch)
+				batch = nil
+			}
+		case <-t.done:
+			for len(t.spans) > 0 {
+				batch = append(batch, <-t.spans)
+			}
+			if len(batch) > 0 {
+				t.post(batch)
+			}
+			return
+		}
+	}
+}
+
+// post sends a batch to the collector, a failed batch is dropped
+func (t *Tracer) post(batch []*Span) {
+	body, err := json.Marshal(t.otlp(batch))
+	if err != nil {
+		log.Warning("Tracer encode spans failed ", err)
+		return
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		Stats.SpansDropped.Add(int64(len(batch)))
+		log.Warning("Tracer export spans failed ", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		Stats.SpansDropped.Add(int64(len(batch)))
+		log.Warningf("Tracer export spans to %s: %s", t.endpoint, resp.Status)
+	}
+}
+
+// otlp is an ExportTraceServiceRequest in the OTLP JSON encoding
+func (t *Tracer) otlp(batch []*Span) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, sp := range batch {
+		spans = append(spans, sp.otlp())
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []interface{}{otlpAttr("service.name", t.service)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/dongzerun/archer"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+type spanAttr struct {
+	key   string
+	value interface{} // string, int, int64 or bool
+}
+
+func otlpAttr(key string, value interface{}) map[string]interface{} {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case int64:
+		v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return map[string]interface{}{"key": key, "value": v}
+}
+
+// Span is one timed step of a sampled command. The methods of a nil Span
+// do nothing, so code paths don't check whether the command is sampled.
+// A Span is used by one goroutine at a time, Child is safe for concurrent
+// use
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte // zero for the root span
+
+	name       string
+	kind       int
+	start, end time.Time
+	attrs      []spanAttr
+	err        string
+}
+
+// Child starts a span under sp now
+func (sp *Span) Child(name string, kind int) *Span {
+	return sp.ChildAt(name, kind, time.Now())
+}
+
+// ChildAt starts a span under sp at start
+func (sp *Span) ChildAt(name string, kind int, start time.Time) *Span {
+	if sp == nil {
+		return nil
+	}
+	c := &Span{tracer: sp.tracer, traceID: sp.traceID, parent: sp.id, name: name, kind: kind, start: start}
+	binary.BigEndian.PutUint64(c.id[:], rand.Uint64())
+	return c
+}
+
+func (sp *Span) SetAttr(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.attrs = append(sp.attrs, spanAttr{key, value})
+}
+
+// SetError marks sp failed with err, nil err is ignored
+func (sp *Span) SetError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.err = err.Error()
+}
+
+// End ends sp now and queues it for export
+func (sp *Span) End() {
+	sp.EndAt(time.Now())
+}
+
+func (sp *Span) EndAt(end time.Time) {
+	if sp == nil {
+		return
+	}
+	sp.end = end
+	sp.tracer.export(sp)
+}
+
+func (sp *Span) otlp() map[string]interface{} {
+	m := map[string]interface{}{
+		"traceId":           hex.EncodeToString(sp.traceID[:]),
+		"spanId":            hex.EncodeToString(sp.id[:]),
+		"name":              sp.name,
+		"kind":              sp.kind,
+		"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+	}
+	if sp.parent != [8]byte{} {
+		m["parentSpanId"] = hex.EncodeToString(sp.parent[:])
+	}
+	if len(sp.attrs) > 0 {
+		attrs := make([]interface{}, 0, len(sp.attrs))
+		for _, a := range sp.attrs {
+			attrs = append(attrs, otlpAttr(a.key, a.value))
+		}
+		m["attributes"] = attrs
+	}
+	if sp.err != "" {
+		// STATUS_CODE_ERROR
+		m["status"] = map[string]interface{}{"code": 2, "message": sp.err}
+	}
+	return m
+}
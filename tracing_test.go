@@ -0,0 +1,101 @@
+package archer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+}
+
+func TestTracerSession(t *testing.T) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	a, la := fakeMaster(t, map[string]string{"GET k": "$1\r\nv\r\n"})
+	defer la.Close()
+	pc := &ProxyConfig{conCurrency: 5, dialTimeout: time.Second, readTimeout: time.Second, poolSize: 2}
+	s := newTestSession(pc)
+	s.p.cluster = testCluster(pc, a, a)
+	s.p.tracer = NewTracer(srv.URL, "archer", 1)
+
+	req := newCommand("GET", "k")
+	s.traceStart(0, req, time.Now())
+	if _, err := s.ExecWithRedirect(req, true, s.span(0)); err != nil {
+		t.Fatal(err)
+	}
+	s.traceEnd(0, nil, time.Now())
+	s.p.tracer.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := make(map[string]otlpSpan)
+	for _, sp := range spans {
+		byName[sp.Name] = sp
+	}
+	root, ok := byName["GET"]
+	if !ok || root.ParentSpanID != "" || root.Kind != SpanServer {
+		t.Fatalf("root span %+v in %+v", root, spans)
+	}
+	for _, name := range []string{"read", "route", "backend", "write"} {
+		sp, ok := byName[name]
+		if !ok {
+			t.Fatalf("no %s span in %+v", name, spans)
+		}
+		if sp.TraceID != root.TraceID || sp.ParentSpanID != root.SpanID {
+			t.Fatalf("%s span %+v is not a child of %+v", name, sp, root)
+		}
+	}
+	if len(spans) != 5 {
+		t.Fatalf("%d spans, want 5", len(spans))
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	var tr *Tracer
+	if sp := tr.Start("GET", time.Now()); sp != nil {
+		t.Fatal("nil Tracer sampled a command")
+	}
+	// the methods of an unsampled span do nothing
+	var sp *Span
+	sp.Child("route", SpanInternal).SetAttr("archer.slot", 1)
+	sp.End()
+
+	tr = &Tracer{ratio: 0}
+	if tr.Start("GET", time.Now()) != nil {
+		t.Fatal("samplerate 0 sampled a command")
+	}
+	tr = &Tracer{ratio: 1}
+	if tr.Start("GET", time.Now()) == nil {
+		t.Fatal("samplerate 1 didn't sample a command")
+	}
+}
@@ -0,0 +1,261 @@
+package archer
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/dongzerun/archer/logging"
+)
+
+var (
+	NestedMultiError    = errors.New("ERR MULTI calls can not be nested")
+	ExecWithoutMulti    = errors.New("ERR EXEC without MULTI")
+	DiscardWithoutMulti = errors.New("ERR DISCARD without MULTI")
+	WatchInMultiError   = errors.New("ERR WATCH inside MULTI is not allowed")
+	ExecAbortError      = errors.New("EXECABORT Transaction discarded because of previous errors.")
+	CrossSlotError      = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+	TxForbiddenError    = errors.New("ERR Command not allowed inside a transaction")
+)
+
+// 事务相关命令, 不在事务中也由 Transaction 处理
+var txCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"UNWATCH": true,
+}
+
+// 代理自己处理的命令, 不能放进事务转发给后端
+var txForbidden = map[string]bool{
+	"SELECT":       true,
+	"HELLO":        true,
+	"AUTH":         true,
+	"PROXY":        true,
+	"SUBSCRIBE":    true,
+	"UNSUBSCRIBE":  true,
+	"PSUBSCRIBE":   true,
+	"PUNSUBSCRIBE": true,
+}
+
+// transaction is the MULTI/EXEC of a session. Commands are queued by the
+// proxy and sent to one backend connection at EXEC, all their keys must be
+// in the same slot. Only Dispatch touches it
+type transaction struct {
+	key     []byte // first key queued or watched, chooses the backend
+	slot    int
+	hasSlot bool
+
+	queue []*ArrayResp
+	conn  *RedisConn // pinned by WATCH until EXEC, DISCARD or UNWATCH
+}
+
+// pin checks that keys hash to the slot of the transaction, the first
+// keys seen choose the slot
+func (tx *transaction) pin(pc *ProxyConfig, keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	slot, err := keysSlot(pc, keys)
+	if err != nil {
+		return err
+	}
+	if tx.hasSlot && slot != tx.slot {
+		return CrossSlotError
+	}
+	if !tx.hasSlot {
+		tx.key, tx.slot, tx.hasSlot = keys[0], slot, true
+	}
+	return nil
+}
+
+// Transaction handles MULTI, EXEC, DISCARD, WATCH, UNWATCH and every
+// command read between MULTI and EXEC, with the replies redis would give
+func (s *Session) Transaction(ar *ArrayResp, command string, seq int64) {
+	switch {
+	case command == "MULTI":
+		if s.state.Tx != TxNone {
+			s.reply(WrappedErrorResp([]byte(NestedMultiError.Error()), seq))
+			return
+		}
+		s.state.Tx = TxMulti
+		s.reply(WrappedOKResp(seq))
+	case command == "EXEC":
+		if s.state.Tx == TxNone {
+			s.reply(WrappedErrorResp([]byte(ExecWithoutMulti.Error()), seq))
+			return
+		}
+		s.reply(WrappedResp(s.exec(), seq))
+	case command == "DISCARD":
+		if s.state.Tx == TxNone {
+			s.reply(WrappedErrorResp([]byte(DiscardWithoutMulti.Error()), seq))
+			return
+		}
+		s.endTx(true)
+		s.reply(WrappedOKResp(seq))
+	case command == "WATCH" && s.state.Tx != TxNone:
+		s.replyError(WatchInMultiError, seq)
+	case command == "WATCH":
+		s.reply(WrappedResp(s.watch(ar), seq))
+	case command == "UNWATCH" && s.state.Tx == TxNone:
+		s.endTx(true)
+		s.reply(WrappedOKResp(seq))
+	case txForbidden[command]:
+		s.replyError(TxForbiddenError, seq)
+	default:
+		if err := s.tx.pin(s.p.conf(), CommandKeys(ar)); err != nil {
+			s.replyError(err, seq)
+			return
+		}
+		s.tx.queue = append(s.tx.queue, ar)
+		s.reply(WrappedResp(NewSimpleResp(QUEUED), seq))
+	}
+}
+
+// replyError replies err, a command refused while queuing a transaction
+// makes EXEC abort like redis does
+func (s *Session) replyError(err error, seq int64) {
+	if s.state.Tx == TxMulti {
+		s.state.Tx = TxAborted
+	}
+	s.reply(WrappedErrorResp([]byte(err.Error()), seq))
+}
+
+// watch sends WATCH on the connection pinned for the transaction
+func (s *Session) watch(ar *ArrayResp) Resp {
+	pinned := s.tx.hasSlot
+	if err := s.tx.pin(s.p.conf(), CommandKeys(ar)); err != nil {
+		return NewErrorResp([]byte(err.Error()))
+	}
+	if s.tx.conn == nil {
+		rc, err := s.GetRedisConnByKey(s.tx.key, false)
+		if err != nil {
+			s.endTx(false)
+			return NewErrorRespf("proxy internal error %s", err)
+		}
+		s.tx.conn = rc
+	}
+
+	resp, err := s.ExecOnce(s.tx.conn, ar)
+	if err != nil {
+		s.endTx(false)
+		return NewErrorRespf("proxy internal error %s", err)
+	}
+	// e.g. MOVED, nothing is watched on this connection
+	if _, ok := resp.(*ErrorResp); ok && !pinned {
+		s.endTx(false)
+	}
+	return resp
+}
+
+// exec sends the queued commands between MULTI and EXEC in one write to
+// the pinned connection, or one chosen by the first key, and returns the
+// reply of EXEC
+func (s *Session) exec() Resp {
+	if s.state.Tx == TxAborted {
+		s.endTx(true)
+		return NewErrorResp([]byte(ExecAbortError.Error()))
+	}
+	if len(s.tx.queue) == 0 && s.tx.conn == nil {
+		s.endTx(false)
+		ar := &ArrayResp{}
+		ar.Rtype = ArrayType
+		ar.Elems = []Resp{}
+		return ar
+	}
+
+	rc := s.tx.conn
+	if rc == nil {
+		var err error
+		if rc, err = s.GetRedisConnByKey(s.tx.key, false); err != nil {
+			s.endTx(false)
+			return NewErrorRespf("proxy internal error %s", err)
+		}
+		s.tx.conn = rc
+	}
+
+	resp, err := execTx(rc, s.tx.queue, s.limits)
+	// the writes were invalidated when queued, a read since then may have
+	// cached the value they replace
+	for _, ar := range s.tx.queue {
+		if IsWriteRequest(ar) {
+			s.p.cache.Invalidate(ar)
+		}
+	}
+	if err != nil {
+		log.Warning("Session exec transaction error ", err)
+		s.endTx(false)
+		return NewErrorRespf("proxy internal error %s", err)
+	}
+	// EXEC unwatches everything, even when it aborts
+	s.endTx(false)
+	return resp
+}
+
+// endTx leaves the transaction and gives the pinned connection back,
+// unwatch sends UNWATCH first since the backend never saw EXEC
+func (s *Session) endTx(unwatch bool) {
+	if rc := s.tx.conn; rc != nil {
+		if unwatch {
+			if _, err := s.ExecOnce(rc, txCommand("UNWATCH")); err != nil {
+				log.Warning("Session UNWATCH error ", err)
+			}
+		}
+		s.p.cluster.PutConn(rc)
+	}
+	s.tx = transaction{}
+	s.state.Tx = TxNone
+}
+
+// abortTx drops the transaction of a closing session, the pinned
+// connection may still watch keys and is closed instead of reused
+func (s *Session) abortTx() {
+	if s.tx.conn != nil {
+		s.tx.conn.broken = true
+	}
+	s.endTx(false)
+}
+
+// execTx writes MULTI, queue and EXEC to c in one write and returns the
+// reply of EXEC read within limits. A command redis refuses to queue makes
+// EXEC reply EXECABORT, which is returned as is
+func execTx(c *RedisConn, queue []*ArrayResp, limits ParserLimits) (Resp, error) {
+	cmds := make([]*ArrayResp, 0, len(queue)+2)
+	cmds = append(cmds, txCommand("MULTI"))
+	cmds = append(cmds, queue...)
+	cmds = append(cmds, txCommand("EXEC"))
+	for _, cmd := range cmds {
+		if err := bufferProtocol(c.w, cmd); err != nil {
+			c.broken = true
+			return nil, err
+		}
+	}
+	if err := c.w.Flush(); err != nil {
+		c.broken = true
+		return nil, err
+	}
+
+	var resp Resp
+	for i := range cmds {
+		r, err := ReadProtocolWithLimits(c.r, limits)
+		if err != nil {
+			// the rest of the replies are still in the socket, never reuse c
+			c.broken = true
+			return nil, err
+		}
+		if i == 0 && !isStatus(r, OK) {
+			c.broken = true
+			return nil, fmt.Errorf("MULTI replied %s", r.String())
+		}
+		resp = r
+	}
+	return resp, nil
+}
+
+// txCommand builds a command without arguments
+func txCommand(name string) *ArrayResp {
+	ar := &ArrayResp{}
+	ar.Rtype = ArrayType
+	ar.Args = append(ar.Args, NewBulkResp([]byte(name)))
+	return ar
+}
@@ -0,0 +1,139 @@
+package archer
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dongzerun/archer/util"
+)
+
+func TestTransactionQueue(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	s := newTestSession(&ProxyConfig{conCurrency: 5})
+	s.p.filter = &StrFilter{}
+	s.c = &util.Conn{Conn: server}
+	s.w = bufio.NewWriter(s.c)
+	s.cmds = make(chan *wrappedResp, 16)
+	s.quitChan = make(chan int, 1)
+	s.ooo = make(map[int64]*wrappedResp)
+	s.budget = newReplyBudget(0)
+	s.state = NewClientState()
+	go s.WriteLoop()
+	go s.Dispatch()
+	defer close(s.quitChan)
+
+	// foo and bar are in different slots, nothing reaches a backend
+	steps := []struct {
+		cmd   []string
+		reply string
+	}{
+		{[]string{"EXEC"}, ExecWithoutMulti.Error()},
+		{[]string{"DISCARD"}, DiscardWithoutMulti.Error()},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"MULTI"}, NestedMultiError.Error()},
+		{[]string{"EXEC"}, ""},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "foo", "1"}, "QUEUED"},
+		{[]string{"DISCARD"}, "OK"},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"SET", "foo", "1"}, "QUEUED"},
+		{[]string{"INCR", "{foo}:n"}, "QUEUED"},
+		{[]string{"GET", "bar"}, CrossSlotError.Error()},
+		{[]string{"SELECT", "1"}, TxForbiddenError.Error()},
+		{[]string{"PING"}, "QUEUED"},
+		{[]string{"EXEC"}, ExecAbortError.Error()},
+		{[]string{"MULTI"}, "OK"},
+		{[]string{"WATCH", "foo"}, WatchInMultiError.Error()},
+		{[]string{"EXEC"}, ExecAbortError.Error()},
+		{[]string{"WATCH", "foo", "bar"}, CrossSlotError.Error()},
+		{[]string{"UNWATCH"}, "OK"},
+	}
+
+	r := bufio.NewReader(client)
+	for i, step := range steps {
+		s.cmds <- WrappedResp(newCommand(step.cmd...), int64(i))
+		resp, err := ReadProtocol(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.String(); got != step.reply {
+			t.Fatalf("step %d %v: got %q, want %q", i, step.cmd, got, step.reply)
+		}
+	}
+}
+
+func TestExecTx(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	rc := &RedisConn{c: client, w: bufio.NewWriter(client), r: bufio.NewReader(client)}
+
+	// the backend gets MULTI, the queue and EXEC in one go
+	go func() {
+		r := bufio.NewReader(server)
+		for i := 0; i < 4; i++ {
+			if _, err := ReadProtocol(r); err != nil {
+				return
+			}
+		}
+		server.Write([]byte("+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n+OK\r\n:2\r\n"))
+	}()
+
+	queue := []*ArrayResp{newCommand("SET", "foo", "1"), newCommand("INCR", "foo")}
+	resp, err := execTx(rc, queue, DefaultParserLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := readResp(t, "*2\r\n+OK\r\n:2\r\n")
+	if !Equal(resp, want) {
+		t.Fatalf("EXEC replied %s, want %s", resp, want)
+	}
+	if rc.broken {
+		t.Fatal("conn must stay usable")
+	}
+}
+
+// TestExecInvalidatesCache reads a key queued for a write in MULTI from
+// another client, EXEC must drop what that read cached
+func TestExecInvalidatesCache(t *testing.T) {
+	l, _ := fakeDBServer(t)
+	defer l.Close()
+	addr := l.Addr().(*net.TCPAddr)
+	n := &Node{id: addr.String(), host: "127.0.0.1", port: addr.Port, role: "master"}
+	pc := &ProxyConfig{dialTimeout: time.Second, readTimeout: time.Second, poolSize: 2}
+	p := &Proxy{pc: pc, cluster: testCluster(pc, n, n), cache: NewReplyCache(16, time.Hour, 0, []string{"GET"})}
+	session := func() *Session {
+		s := newTestSession(pc)
+		s.p = p
+		s.state = NewClientState()
+		s.conCurrency = make(chan int, 1)
+		return s
+	}
+	a, b := session(), session()
+	// DefaultOP gives back the token Route took
+	get := func(s *Session) string {
+		s.DefaultOP(newCommand("GET", "k"), 0)
+		<-s.conCurrency
+		return (<-s.resps).resp.String()
+	}
+
+	b.DefaultOP(newCommand("SET", "k", "old"), 0)
+	<-b.conCurrency
+	<-b.resps
+	a.Transaction(newCommand("MULTI"), "MULTI", 0)
+	a.Transaction(newCommand("SET", "k", "new"), "SET", 1)
+	p.cache.Invalidate(newCommand("SET", "k", "new"))
+	if got := get(b); got != "old" {
+		t.Fatalf("GET before EXEC %q", got)
+	}
+	a.Transaction(newCommand("EXEC"), "EXEC", 2)
+	for i := 0; i < 3; i++ {
+		<-a.resps
+	}
+	if got := get(b); got != "new" {
+		t.Fatalf("GET after EXEC %q", got)
+	}
+}
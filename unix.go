@@ -0,0 +1,72 @@
+package archer
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ListenUnix listens on the unix socket path, for clients on the same host
+// like sidecars. A socket left by a previous run is removed, any other
+// file at path is an error. The socket file gets the mode perm
+func ListenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("unix socket %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale unix socket %s failed %s", path, err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("chmod unix socket %s failed %s", path, err)
+	}
+	return l, nil
+}
+
+// ParseUnixSocketPerm parses an octal mode like 700 or 0770
+func ParseUnixSocketPerm(s string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("unix socket perm %s is not an octal mode", s)
+	}
+	return os.FileMode(perm), nil
+}
+
+// ParseUnixSockets parses the backends dialed over unix sockets, fields of
+// host:port=/path/to/redis.sock. Nodes keep their host:port id, the one of
+// CLUSTER NODES, only the dial goes to the socket
+func ParseUnixSockets(s string) (map[string]string, error) {
+	sockets := make(map[string]string)
+	for _, f := range strings.Fields(strings.Replace(s, ",", " ", -1)) {
+		i := strings.Index(f, "=")
+		if i <= 0 || i == len(f)-1 {
+			return nil, fmt.Errorf("unix socket %s is not host:port=path", f)
+		}
+		if _, _, err := net.SplitHostPort(f[:i]); err != nil {
+			return nil, fmt.Errorf("unix socket %s: %s", f, err)
+		}
+		sockets[f[:i]] = f[i+1:]
+	}
+	return sockets, nil
+}
+
+var unixClients int64
+
+// clientAddr is the name of client c in the sessions, the logs and the
+// admin API. Clients of a unix socket have no remote address, they are
+// named path:n after the socket instead
+func clientAddr(c net.Conn) string {
+	if _, ok := c.LocalAddr().(*net.UnixAddr); ok {
+		return fmt.Sprintf("%s:%d", c.LocalAddr().String(), atomic.AddInt64(&unixClients, 1))
+	}
+	return c.RemoteAddr().String()
+}
@@ -0,0 +1,117 @@
+package archer
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archer-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archer.sock")
+
+	l, err := ListenUnix(path, 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0770 {
+		t.Fatalf("socket mode %v %v", fi, err)
+	}
+
+	// clients are named after the socket, each one apart
+	go func() {
+		for i := 0; i < 2; i++ {
+			if c, err := net.Dial("unix", path); err == nil {
+				defer c.Close()
+			}
+		}
+	}()
+	a, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if ra, rb := clientAddr(a), clientAddr(b); ra == rb || filepath.Dir(ra) != dir {
+		t.Fatalf("unix clients named %s and %s", ra, rb)
+	}
+
+	// a stale socket is replaced, another file is not
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+	l.Close()
+	if l, err = ListenUnix(path, 0700); err != nil {
+		t.Fatalf("stale socket: %s", err)
+	}
+	l.Close()
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(path, 0700); err == nil {
+		t.Fatal("regular file replaced by the socket")
+	}
+}
+
+func TestParseUnixConfig(t *testing.T) {
+	if perm, err := ParseUnixSocketPerm("770"); err != nil || perm != 0770 {
+		t.Fatalf("perm 770 got %o %v", perm, err)
+	}
+	for _, s := range []string{"", "800", "7777"} {
+		if _, err := ParseUnixSocketPerm(s); err == nil {
+			t.Fatalf("perm %q accepted", s)
+		}
+	}
+
+	sockets, err := ParseUnixSockets("127.0.0.1:7000=/tmp/7000.sock, 127.0.0.1:7001=/tmp/7001.sock")
+	if err != nil || len(sockets) != 2 || sockets["127.0.0.1:7001"] != "/tmp/7001.sock" {
+		t.Fatalf("sockets %v %v", sockets, err)
+	}
+	for _, s := range []string{"127.0.0.1:7000", "127.0.0.1=/tmp/a.sock", "127.0.0.1:7000="} {
+		if _, err := ParseUnixSockets(s); err == nil {
+			t.Fatalf("sockets %q accepted", s)
+		}
+	}
+}
+
+func TestDialBackendUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archer-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redis.sock")
+	l, err := ListenUnix(path, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			c.Write([]byte("+PONG\r\n"))
+			c.Close()
+		}
+	}()
+
+	// the node keeps its tcp address, nothing listens on it
+	pc := &ProxyConfig{unixSockets: map[string]string{"127.0.0.1:1": path}}
+	c, err := dialBackend("127.0.0.1", 1, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf, err := ioutil.ReadAll(c)
+	if err != nil || string(buf) != "+PONG\r\n" {
+		t.Fatalf("read %q %v", buf, err)
+	}
+}
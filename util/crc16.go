@@ -39,8 +39,10 @@ var crc16tab = [256]uint16{
 	0x6e17, 0x7e36, 0x4e55, 0x5e74, 0x2e93, 0x3eb2, 0x0ed1, 0x1ef0,
 }
 
+// Crc16sum is the crc16 of key, of its hash tag if it has one, the cluster
+// slot of key is Crc16sum(key) % 16384
 func Crc16sum(key []byte) uint16 {
-	key = hashtag(key)
+	key = HashTag(key)
 	var crc uint16
 	for i := 0; i < len(key); i++ {
 		crc = (crc << 8) ^ crc16tab[(byte(crc>>8)^key[i])&0x00ff]
@@ -48,8 +50,9 @@ func Crc16sum(key []byte) uint16 {
 	return crc
 }
 
-func hashtag(key []byte) []byte {
-	// {}
+// HashTag returns the part of key between the first { and the first }
+// after it, or key itself if there is none or it's empty like redis cluster
+func HashTag(key []byte) []byte {
 	nl := -1
 	nr := -1
 	for i, b := range key {
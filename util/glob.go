@@ -0,0 +1,81 @@
+package util
+
+// GlobMatch reports whether str matches the redis style glob pattern,
+// supports * ? [abc] [^abc] [a-z] and \ escape, same as KEYS and ACL
+func GlobMatch(pattern, str []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if GlobMatch(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			str = str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) > 1 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					if str[0] >= start && str[0] <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				} else if pattern[0] == str[0] {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				// missing ], treat as end of pattern
+				return false
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			str = str[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(str) == 0
+}
@@ -27,7 +27,7 @@ func (c *Conn) Read(b []byte) (count int, e error) {
 
 // 重写 Write 方法
 func (c *Conn) Write(b []byte) (count int, e error) {
-	if c.ReadTimeout > 0 {
+	if c.WriteTimeout > 0 {
 		err := c.Conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout))
 		if err != nil {
 			return 0, err
@@ -3,13 +3,12 @@ package util
 import (
 	"bytes"
 	"errors"
+	"math"
 	"strconv"
-	"sync"
 )
 
-var scratchPool = sync.Pool{
-	New: func() interface{} { return make([]byte, 10) },
-}
+// NegativeLengthError is a $ or * length below -1, or -1 written another way
+var NegativeLengthError = errors.New("negative length other than -1")
 
 func Itob(i int) []byte {
 	return []byte(strconv.Itoa(i))
@@ -33,8 +32,8 @@ func Iu32tob2(i int) []byte {
 
 func WriteLength(w *bytes.Buffer, i int) (int, error) {
 	// buf := make([]byte, 10) // 大量小对象的创建是个问题
-	buf := scratchPool.Get().([]byte)
-	defer scratchPool.Put(buf)
+	// 栈上数组, sync.Pool Put []byte 本身也会分配
+	var buf [10]byte
 	idx := len(buf) - 1
 	for i >= 10 {
 		buf[idx] = byte('0' + i%10)
@@ -46,23 +45,38 @@ func WriteLength(w *bytes.Buffer, i int) (int, error) {
 	return n, err
 }
 
+// ParseLen parses the length of a $ or * header. Leading spaces and
+// zeros sent by some noncompliant servers are accepted, $ 7 and $007 are 7,
+// signs other than the null -1 are rejected
 func ParseLen(p []byte) (int, error) {
+	for len(p) > 0 && p[0] == ' ' {
+		p = p[1:]
+	}
 	if len(p) == 0 {
 		return -1, errors.New("malformed length")
 	}
+	if p[0] == '+' {
+		return -1, errors.New("length must not have a sign")
+	}
 
-	if p[0] == '-' && len(p) == 2 && p[1] == '1' {
+	if p[0] == '-' {
 		// handle $-1 and $-1 null replies.
-		return -1, nil
+		if len(p) == 2 && p[1] == '1' {
+			return -1, nil
+		}
+		return -1, NegativeLengthError
 	}
 
 	var n int
 	for _, b := range p {
-		n *= 10
 		if b < '0' || b > '9' {
 			return -1, errors.New("illegal bytes in length")
 		}
-		n += int(b - '0')
+		// a huge length must not wrap around to a small or negative one
+		if n > (math.MaxInt-int(b-'0'))/10 {
+			return -1, errors.New("length overflows")
+		}
+		n = n*10 + int(b-'0')
 	}
 
 	return n, nil
@@ -21,3 +21,71 @@ func Benchmark_Iu32tob2(b *testing.B) {
 		Iu32tob2(i)
 	}
 }
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		match        bool
+	}{
+		{"*", "", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"*:{tag}", "x:y:{tag}", true},
+	}
+
+	for _, tt := range tests {
+		if GlobMatch([]byte(tt.pattern), []byte(tt.str)) != tt.match {
+			t.Fatalf("GlobMatch(%q, %q) != %v", tt.pattern, tt.str, tt.match)
+		}
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	for key, tag := range map[string]string{
+		"{user}:1": "user",
+		"a{b}{c}":  "b",
+		"a{}b":     "a{}b",
+		"{}{b}":    "{}{b}",
+		"a{b":      "a{b",
+		"a}b{c}":   "c",
+		"plain":    "plain",
+	} {
+		if got := string(HashTag([]byte(key))); got != tag {
+			t.Fatalf("HashTag(%s) = %s, want %s", key, got, tag)
+		}
+	}
+	if Crc16sum([]byte("{user}:1"))%16384 != Crc16sum([]byte("user"))%16384 {
+		t.Fatal("slot of a key is not the slot of its hash tag")
+	}
+}
+
+func TestParseLen(t *testing.T) {
+	for in, want := range map[string]int{
+		"7":    7,
+		"007":  7,
+		"0":    0,
+		"000":  0,
+		" 7":   7,
+		"  07": 7,
+		"-1":   -1,
+		" -1":  -1,
+	} {
+		n, err := ParseLen([]byte(in))
+		if err != nil || n != want {
+			t.Fatalf("%q: %d %v", in, n, err)
+		}
+	}
+
+	for _, in := range []string{"", " ", "+7", "-7", "-01", "7 ", "0x7", "1e3", "99999999999999999999999"} {
+		if _, err := ParseLen([]byte(in)); err == nil {
+			t.Fatalf("%q should be rejected", in)
+		}
+	}
+}